@@ -0,0 +1,322 @@
+package capacity
+
+import (
+	"encoding/json"
+	"fmt"
+	"karst/config"
+	"karst/metrics"
+	"karst/store"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	dbutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const filePrefix = "usage_file_"
+
+// Bytes of incoming files being written, they are counted as used until written
+var lock sync.Mutex
+var incoming uint64
+
+// QuotaError rejects incoming file which doesn't fit in capacity
+type QuotaError struct {
+	Need      uint64
+	Available uint64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%d bytes are needed but only %d are available", e.Need, e.Available)
+}
+
+// FileUsage is the bytes of a file kept by this karst, parts shared with other files in part store are counted once in total
+type FileUsage struct {
+	Hash       string    `json:"hash"`
+	SealedHash string    `json:"sealed_hash,omitempty"`
+	Size       uint64    `json:"size"`
+	SealedSize uint64    `json:"sealed_size"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// OrderUsage is the bytes a storage order to this provider commits, files which aren't stored yet are committed
+type OrderUsage struct {
+	Id       string `json:"id"`
+	FileHash string `json:"file_hash"`
+	Status   string `json:"status"`
+	Size     uint64 `json:"size"`
+	Stored   bool   `json:"stored"`
+}
+
+type Report struct {
+	// Total 0 means capacity isn't limited
+	Total     uint64       `json:"total"`
+	Reserved  uint64       `json:"reserved"`
+	Used      uint64       `json:"used"`
+	Committed uint64       `json:"committed"`
+	Available uint64       `json:"available"`
+	Files     []FileUsage  `json:"files"`
+	Orders    []OrderUsage `json:"orders"`
+}
+
+// OrderLister lists usage of storage orders, it is given by order package which builds on this one
+type OrderLister func(db *leveldb.DB) ([]OrderUsage, error)
+
+// Accountant keeps usage of files in leveldb and checks incoming files against 'capacity.total' less 'capacity.reserved'
+// and bytes committed by storage orders
+type Accountant struct {
+	db       *leveldb.DB
+	store    *store.Store
+	orders   OrderLister
+	total    uint64
+	reserved uint64
+}
+
+func New(db *leveldb.DB, cfg *config.Configuration, orders OrderLister) *Accountant {
+	return &Accountant{
+		db:       db,
+		store:    store.New(db, cfg.KarstPaths),
+		orders:   orders,
+		total:    uint64(cfg.Capacity.Total),
+		reserved: uint64(cfg.Capacity.Reserved),
+	}
+}
+
+// Limited tells whether 'capacity.total' is set
+func (accountant *Accountant) Limited() bool {
+	return accountant.total != 0
+}
+
+// Offered is the bytes offered to clients, nothing is offered if reserved bytes take all
+func (accountant *Accountant) Offered() uint64 {
+	return sub(accountant.total, accountant.reserved)
+}
+
+// Reserve holds size bytes for an incoming file until release is called, QuotaError is returned if they don't fit
+// in offered bytes less used and incoming ones. Committed bytes aren't counted, the incoming file may be the one
+// they are committed for, they are checked when storage orders are accepted
+func (accountant *Accountant) Reserve(size uint64) (func(), error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if accountant.Limited() {
+		used, err := accountant.used()
+		if err != nil {
+			return nil, err
+		}
+		if taken := used + incoming; taken+size > accountant.Offered() {
+			metrics.CapacityRejected.Inc()
+			return nil, &QuotaError{Need: size, Available: sub(accountant.Offered(), taken)}
+		}
+	}
+
+	incoming += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lock.Lock()
+			incoming -= size
+			lock.Unlock()
+		})
+	}, nil
+}
+
+// Accept checks a new storage order against offered bytes less used, incoming and committed ones, orders whose
+// file is already stored take nothing more
+func (accountant *Accountant) Accept(order OrderUsage) error {
+	if !accountant.Limited() || order.Stored {
+		return nil
+	}
+	orders, err := accountant.orders(accountant.db)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	used, err := accountant.used()
+	if err != nil {
+		return err
+	}
+	if taken := used + incoming + committedOf(orders); taken+order.Size > accountant.Offered() {
+		metrics.CapacityRejected.Inc()
+		return &QuotaError{Need: order.Size, Available: sub(accountant.Offered(), taken)}
+	}
+	return nil
+}
+
+// SaveFile records usage of a file split into files directory
+func (accountant *Accountant) SaveFile(hash string, size uint64) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	usage, err := getFile(accountant.db, hash)
+	if err != nil {
+		return err
+	}
+	if usage == nil {
+		usage = &FileUsage{Hash: hash}
+	}
+	usage.Size = size
+	return saveFile(accountant.db, usage)
+}
+
+// SealFile records usage of sealed parts of a file in fs
+func (accountant *Accountant) SealFile(hash string, sealedHash string, sealedSize uint64) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	usage, err := getFile(accountant.db, hash)
+	if err != nil {
+		return err
+	}
+	if usage == nil {
+		usage = &FileUsage{Hash: hash}
+	}
+	usage.SealedHash = sealedHash
+	usage.SealedSize = sealedSize
+	return saveFile(accountant.db, usage)
+}
+
+// RemoveFile drops usage of a deleted file
+func RemoveFile(db *leveldb.DB, hash string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	return db.Delete([]byte(filePrefix+hash), nil)
+}
+
+// HasFile tells whether usage of file is recorded
+func HasFile(db *leveldb.DB, hash string) bool {
+	ok, _ := db.Has([]byte(filePrefix+hash), nil)
+	return ok
+}
+
+// Files lists usage of all files
+func Files(db *leveldb.DB) ([]FileUsage, error) {
+	files := make([]FileUsage, 0)
+	iter := db.NewIterator(dbutil.BytesPrefix([]byte(filePrefix)), nil)
+	for iter.Next() {
+		usage := FileUsage{}
+		if err := json.Unmarshal(iter.Value(), &usage); err != nil {
+			continue
+		}
+		files = append(files, usage)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].UpdatedAt.Before(files[j].UpdatedAt)
+	})
+	return files, nil
+}
+
+// Used is the bytes used on disk and in fs, including incoming files
+func (accountant *Accountant) Used() (uint64, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	used, err := accountant.used()
+	return used + incoming, err
+}
+
+// Report sums usage of files and storage orders
+func (accountant *Accountant) Report() (*Report, error) {
+	files, err := Files(accountant.db)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := accountant.orders(accountant.db)
+	if err != nil {
+		return nil, err
+	}
+	used, err := accountant.Used()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Total:     accountant.total,
+		Reserved:  accountant.reserved,
+		Used:      used,
+		Files:     files,
+		Orders:    orders,
+		Committed: committedOf(orders),
+	}
+	if accountant.Limited() {
+		report.Available = sub(accountant.Offered(), report.Used+report.Committed)
+	}
+
+	metrics.Capacity.WithLabelValues("total").Set(float64(report.Total))
+	metrics.Capacity.WithLabelValues("reserved").Set(float64(report.Reserved))
+	metrics.Capacity.WithLabelValues("used").Set(float64(report.Used))
+	metrics.Capacity.WithLabelValues("committed").Set(float64(report.Committed))
+	return report, nil
+}
+
+// used counts parts in store once, files outside store by their size, and sealed parts in fs
+func (accountant *Accountant) used() (uint64, error) {
+	used, err := accountant.store.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	iter := accountant.db.NewIterator(dbutil.BytesPrefix([]byte(filePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		usage := FileUsage{}
+		if err := json.Unmarshal(iter.Value(), &usage); err != nil {
+			continue
+		}
+		if !accountant.store.HasFile(usage.Hash) {
+			used += usage.Size
+		}
+		used += usage.SealedSize
+	}
+	return used, iter.Error()
+}
+
+// committedOf sums bytes of orders whose files aren't stored yet
+func committedOf(orders []OrderUsage) uint64 {
+	var committed uint64
+	for _, order := range orders {
+		if !order.Stored {
+			committed += order.Size
+		}
+	}
+	return committed
+}
+
+func getFile(db *leveldb.DB, hash string) (*FileUsage, error) {
+	usageBytes, err := db.Get([]byte(filePrefix+hash), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	usage := &FileUsage{}
+	if err = json.Unmarshal(usageBytes, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func saveFile(db *leveldb.DB, usage *FileUsage) error {
+	usage.UpdatedAt = time.Now()
+	usageBytes, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return db.Put([]byte(filePrefix+usage.Hash), usageBytes, nil)
+}
+
+func sub(a uint64, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
@@ -0,0 +1,126 @@
+package capacity
+
+import (
+	"karst/config"
+	"karst/util"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+const mb = 1024 * 1024
+
+// newTestAccountant offers 10MB, orders are listed from orders
+func newTestAccountant(t *testing.T, orders *[]OrderUsage) (*Accountant, *leveldb.DB) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Open db: %s", err)
+	}
+	cfg := &config.Configuration{
+		KarstPaths: &util.KarstPaths{},
+		Capacity:   config.CapacityConfiguration{Total: 12 * mb, Reserved: 2 * mb},
+	}
+	return New(db, cfg, func(db *leveldb.DB) ([]OrderUsage, error) {
+		return *orders, nil
+	}), db
+}
+
+func expectQuota(t *testing.T, step string, err error, available uint64) {
+	quotaErr, ok := err.(*QuotaError)
+	if !ok {
+		t.Fatalf("%s: got %v, want quota error", step, err)
+	}
+	if quotaErr.Available != available {
+		t.Errorf("%s: %d bytes are available, want %d", step, quotaErr.Available, available)
+	}
+}
+
+func TestReservePendingOrder(t *testing.T) {
+	orders := []OrderUsage{{Id: "0x01", FileHash: "aa", Status: "receiving", Size: 8 * mb}}
+	accountant, db := newTestAccountant(t, &orders)
+	defer db.Close()
+
+	report, err := accountant.Report()
+	if err != nil {
+		t.Fatalf("Report: %s", err)
+	}
+	if report.Committed != 8*mb || report.Available != 2*mb {
+		t.Errorf("Committed %d and available %d bytes, want 8MB and 2MB", report.Committed, report.Available)
+	}
+
+	// The file of the pending order fits though its bytes are committed
+	release, err := accountant.Reserve(8 * mb)
+	if err != nil {
+		t.Fatalf("Reserve file of pending order: %s", err)
+	}
+	_, err = accountant.Reserve(3 * mb)
+	expectQuota(t, "Reserve beyond incoming file", err, 2*mb)
+
+	if err := accountant.SaveFile("aa", 8*mb); err != nil {
+		t.Fatalf("Save file: %s", err)
+	}
+	release()
+	release()
+	orders[0].Stored = true
+	if report, err = accountant.Report(); err != nil {
+		t.Fatalf("Report: %s", err)
+	}
+	if report.Used != 8*mb || report.Committed != 0 || report.Available != 2*mb || len(report.Files) != 1 {
+		t.Errorf("Stored file is reported as used %d, committed %d and available %d bytes of %d files", report.Used, report.Committed, report.Available, len(report.Files))
+	}
+}
+
+func TestReserveOverQuota(t *testing.T) {
+	orders := []OrderUsage{}
+	accountant, db := newTestAccountant(t, &orders)
+	defer db.Close()
+
+	_, err := accountant.Reserve(11 * mb)
+	expectQuota(t, "Reserve beyond offered", err, 10*mb)
+
+	if err := accountant.SaveFile("aa", 6*mb); err != nil {
+		t.Fatalf("Save file: %s", err)
+	}
+	if err := accountant.SealFile("aa", "bb", 3*mb); err != nil {
+		t.Fatalf("Seal file: %s", err)
+	}
+	_, err = accountant.Reserve(2 * mb)
+	expectQuota(t, "Reserve beyond used", err, 1*mb)
+
+	if err := RemoveFile(db, "aa"); err != nil {
+		t.Fatalf("Remove file: %s", err)
+	}
+	if used, err := accountant.Used(); err != nil || used != 0 {
+		t.Errorf("Used %d bytes (%v) after removing file", used, err)
+	}
+	release, err := accountant.Reserve(10 * mb)
+	if err != nil {
+		t.Fatalf("Reserve all offered: %s", err)
+	}
+	release()
+}
+
+func TestAccept(t *testing.T) {
+	orders := []OrderUsage{{Id: "0x01", FileHash: "aa", Size: 8 * mb}}
+	accountant, db := newTestAccountant(t, &orders)
+	defer db.Close()
+
+	expectQuota(t, "Accept order beyond committed", accountant.Accept(OrderUsage{Id: "0x02", FileHash: "bb", Size: 3 * mb}), 2*mb)
+	if err := accountant.Accept(OrderUsage{Id: "0x02", FileHash: "bb", Size: 2 * mb}); err != nil {
+		t.Errorf("Accept order which fits: %s", err)
+	}
+	if err := accountant.Accept(OrderUsage{Id: "0x03", FileHash: "cc", Size: 20 * mb, Stored: true}); err != nil {
+		t.Errorf("Accept order of stored file: %s", err)
+	}
+
+	accountant.total = 0
+	if err := accountant.Accept(OrderUsage{Id: "0x02", FileHash: "bb", Size: 20 * mb}); err != nil {
+		t.Errorf("Accept order without limit: %s", err)
+	}
+	release, err := accountant.Reserve(20 * mb)
+	if err != nil {
+		t.Fatalf("Reserve without limit: %s", err)
+	}
+	release()
+}
@@ -0,0 +1,173 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	schnorrkel "github.com/ChainSafe/go-schnorrkel"
+	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Layout of pkcs8 secret in polkadot-js backup
+var (
+	pkcs8Header  = []byte{48, 83, 2, 1, 1, 48, 5, 6, 3, 43, 101, 112, 4, 34, 4, 32}
+	pkcs8Divider = []byte{161, 35, 3, 33, 0}
+)
+
+const signingContext = "substrate"
+
+// Keypair is a sr25519 account which signs extrinsics locally
+type Keypair struct {
+	Address   string
+	PublicKey [32]byte
+	secretKey *schnorrkel.SecretKey
+}
+
+type backupJson struct {
+	Address  string `json:"address"`
+	Encoded  string `json:"encoded"`
+	Encoding struct {
+		Content []string    `json:"content"`
+		Type    interface{} `json:"type"`
+		Version string      `json:"version"`
+	} `json:"encoding"`
+}
+
+// NewKeypair decrypts the polkadot-js account backup with its password, only sr25519 accounts are supported
+func NewKeypair(backup string, password string) (*Keypair, error) {
+	b := backupJson{}
+	if err := json.Unmarshal([]byte(backup), &b); err != nil {
+		return nil, fmt.Errorf("Wrong crust account backup: %s", err)
+	}
+	if len(b.Encoding.Content) < 2 || b.Encoding.Content[0] != "pkcs8" || b.Encoding.Content[1] != "sr25519" {
+		return nil, fmt.Errorf("Unsupported crust account backup content %v, it should be pkcs8 sr25519", b.Encoding.Content)
+	}
+
+	encoded, err := hex.DecodeString(strings.TrimPrefix(b.Encoded, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("Wrong crust account backup encoded: %s", err)
+	}
+
+	// Version 3 puts scrypt params before the secretbox, older versions use password as key directly
+	key := [32]byte{}
+	if strings.Contains(fmt.Sprint(b.Encoding.Type), "scrypt") {
+		if len(encoded) < 44 {
+			return nil, errors.New("Wrong crust account backup: scrypt params are too short")
+		}
+		n := binary.LittleEndian.Uint32(encoded[32:36])
+		p := binary.LittleEndian.Uint32(encoded[36:40])
+		r := binary.LittleEndian.Uint32(encoded[40:44])
+		derived, err := scrypt.Key([]byte(password), encoded[:32], int(n), int(r), int(p), 64)
+		if err != nil {
+			return nil, err
+		}
+		copy(key[:], derived)
+		encoded = encoded[44:]
+	} else {
+		copy(key[:], password)
+	}
+
+	if len(encoded) < 24 {
+		return nil, errors.New("Wrong crust account backup: encoded is too short")
+	}
+	nonce := [24]byte{}
+	copy(nonce[:], encoded[:24])
+	pkcs8, ok := secretbox.Open(nil, encoded[24:], &nonce, &key)
+	if !ok {
+		return nil, errors.New("Wrong crust account password")
+	}
+
+	return keypairFromPkcs8(pkcs8)
+}
+
+func keypairFromPkcs8(pkcs8 []byte) (*Keypair, error) {
+	if len(pkcs8) < len(pkcs8Header)+64+len(pkcs8Divider)+32 || !bytes.Equal(pkcs8[:len(pkcs8Header)], pkcs8Header) {
+		return nil, errors.New("Wrong pkcs8 secret in crust account backup")
+	}
+	secret := pkcs8[len(pkcs8Header) : len(pkcs8Header)+64]
+	divider := len(pkcs8Header) + 64
+	if !bytes.Equal(pkcs8[divider:divider+len(pkcs8Divider)], pkcs8Divider) {
+		return nil, errors.New("Wrong pkcs8 divider in crust account backup")
+	}
+
+	kp := &Keypair{}
+	copy(kp.PublicKey[:], pkcs8[divider+len(pkcs8Divider):])
+
+	// Secret is kept in ed25519 format by polkadot-js, which is multiplied by cofactor
+	key := [32]byte{}
+	nonce := [32]byte{}
+	copy(key[:], secret[:32])
+	copy(nonce[:], secret[32:])
+	divideScalarByCofactor(key[:])
+	kp.secretKey = schnorrkel.NewSecretKey(key, nonce)
+
+	pub, err := kp.secretKey.Public()
+	if err != nil {
+		return nil, err
+	}
+	if pub.Encode() != kp.PublicKey {
+		return nil, errors.New("Public key doesn't match secret in crust account backup")
+	}
+
+	kp.Address = EncodeAddress(kp.PublicKey, defaultSs58Prefix)
+	return kp, nil
+}
+
+// Sign signs message with substrate context
+func (kp *Keypair) Sign(message []byte) ([]byte, error) {
+	sig, err := kp.secretKey.Sign(schnorrkel.NewSigningContext([]byte(signingContext), message))
+	if err != nil {
+		return nil, err
+	}
+	encoded := sig.Encode()
+	return encoded[:], nil
+}
+
+func divideScalarByCofactor(s []byte) {
+	low := byte(0)
+	for i := len(s) - 1; i >= 0; i-- {
+		r := s[i] & 0x07
+		s[i] >>= 3
+		s[i] += low
+		low = r << 5
+	}
+}
+
+// Generic substrate prefix, crust accounts use it
+const defaultSs58Prefix = 42
+
+// EncodeAddress formats public key as ss58 address
+func EncodeAddress(publicKey [32]byte, prefix byte) string {
+	payload := append([]byte{prefix}, publicKey[:]...)
+	checksum := ss58Checksum(payload)
+	return base58.Encode(append(payload, checksum[:2]...))
+}
+
+// DecodeAddress gets public key from ss58 address
+func DecodeAddress(address string) ([32]byte, error) {
+	publicKey := [32]byte{}
+	decoded := base58.Decode(address)
+	if len(decoded) != 35 {
+		return publicKey, fmt.Errorf("Wrong address '%s'", address)
+	}
+
+	checksum := ss58Checksum(decoded[:33])
+	if !bytes.Equal(checksum[:2], decoded[33:]) {
+		return publicKey, fmt.Errorf("Wrong checksum of address '%s'", address)
+	}
+
+	copy(publicKey[:], decoded[1:33])
+	return publicKey, nil
+}
+
+func ss58Checksum(payload []byte) [64]byte {
+	return blake2b.Sum512(append([]byte("SS58PRE"), payload...))
+}
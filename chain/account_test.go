@@ -0,0 +1,151 @@
+package chain
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	schnorrkel "github.com/ChainSafe/go-schnorrkel"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Well-known development account Alice, its seed is derived from the substrate dev phrase with '//Alice'
+const (
+	aliceSeed      = "e5be9a5092b81bca64be81d212e7f2f9eba183bb7a90954f7b76361f6edb5c0a"
+	alicePublicKey = "d43593c715fdd31c61141abd04a99fd6822c8558854ccde39a5684e7a56da27d"
+	aliceAddress   = "5GrwvaEF5zXb26Fz9rcQpDWS57CtERHpNehXCPcNoHGKutQY"
+	bobPublicKey   = "8eaf04151687736326c9fea17e25fc5287613693c912909cb226aa4794f26a48"
+	bobAddress     = "5FHneW46xGXgs5mUiveU4sbTyGBzmstUspZC92UhjJM694ty"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Decode hex '%s': %s", s, err)
+	}
+	return b
+}
+
+// alicePkcs8 is Alice's secret in polkadot-js pkcs8 layout, the secret is ed25519 expansion of the seed
+func alicePkcs8(t *testing.T) []byte {
+	h := sha512.Sum512(mustHex(t, aliceSeed))
+	h[0] &= 248
+	h[31] &= 63
+	h[31] |= 64
+
+	pkcs8 := append([]byte{}, pkcs8Header...)
+	pkcs8 = append(pkcs8, h[:]...)
+	pkcs8 = append(pkcs8, pkcs8Divider...)
+	return append(pkcs8, mustHex(t, alicePublicKey)...)
+}
+
+// backupOf encrypts pkcs8 like polkadot-js does, version 3 derives key from password with scrypt
+func backupOf(t *testing.T, pkcs8 []byte, password string, version string) string {
+	var nonce [24]byte
+	copy(nonce[:], "karst test nonce for box")
+	var key [32]byte
+	encoded := []byte{}
+	encoding := []string{"xsalsa20-poly1305"}
+
+	if version == "3" {
+		salt := []byte("karst test salt for scrypt ahead")
+		derived, err := scrypt.Key([]byte(password), salt, 1<<10, 8, 1, 64)
+		if err != nil {
+			t.Fatalf("Derive key: %s", err)
+		}
+		copy(key[:], derived)
+		params := make([]byte, 12)
+		binary.LittleEndian.PutUint32(params[0:4], 1<<10)
+		binary.LittleEndian.PutUint32(params[4:8], 1)
+		binary.LittleEndian.PutUint32(params[8:12], 8)
+		encoded = append(append(encoded, salt...), params...)
+		encoding = []string{"scrypt", "xsalsa20-poly1305"}
+	} else {
+		copy(key[:], password)
+	}
+	encoded = append(encoded, nonce[:]...)
+	encoded = secretbox.Seal(encoded, pkcs8, &nonce, &key)
+
+	backup, _ := json.Marshal(map[string]interface{}{
+		"address": aliceAddress,
+		"encoded": "0x" + hex.EncodeToString(encoded),
+		"encoding": map[string]interface{}{
+			"content": []string{"pkcs8", "sr25519"},
+			"type":    encoding,
+			"version": version,
+		},
+	})
+	return string(backup)
+}
+
+func TestSs58Address(t *testing.T) {
+	vectors := map[string]string{
+		alicePublicKey: aliceAddress,
+		bobPublicKey:   bobAddress,
+	}
+	for publicKeyHex, address := range vectors {
+		var publicKey [32]byte
+		copy(publicKey[:], mustHex(t, publicKeyHex))
+		if encoded := EncodeAddress(publicKey, defaultSs58Prefix); encoded != address {
+			t.Errorf("Address of %s is %s, want %s", publicKeyHex, encoded, address)
+		}
+		decoded, err := DecodeAddress(address)
+		if err != nil || decoded != publicKey {
+			t.Errorf("Public key of %s is %x (%v), want %s", address, decoded, err, publicKeyHex)
+		}
+	}
+
+	// Last character changes the checksum
+	if _, err := DecodeAddress(aliceAddress[:len(aliceAddress)-1] + "Z"); err == nil {
+		t.Error("Address with wrong checksum is decoded")
+	}
+	if _, err := DecodeAddress("5Grwva"); err == nil {
+		t.Error("Short address is decoded")
+	}
+}
+
+func TestNewKeypair(t *testing.T) {
+	for _, version := range []string{"2", "3"} {
+		kp, err := NewKeypair(backupOf(t, alicePkcs8(t), "alice password", version), "alice password")
+		if err != nil {
+			t.Fatalf("Decrypt version %s backup: %s", version, err)
+		}
+		if kp.Address != aliceAddress || hex.EncodeToString(kp.PublicKey[:]) != alicePublicKey {
+			t.Errorf("Keypair of version %s backup is %s, want %s", version, kp.Address, aliceAddress)
+		}
+
+		// Signature is verified by the public key
+		message := []byte("karst")
+		sig, err := kp.Sign(message)
+		if err != nil {
+			t.Fatalf("Sign: %s", err)
+		}
+		var sigBytes [64]byte
+		copy(sigBytes[:], sig)
+		signature := &schnorrkel.Signature{}
+		if err := signature.Decode(sigBytes); err != nil {
+			t.Fatalf("Decode signature: %s", err)
+		}
+		if !schnorrkel.NewPublicKey(kp.PublicKey).Verify(signature, schnorrkel.NewSigningContext([]byte(signingContext), message)) {
+			t.Errorf("Signature of version %s keypair isn't verified", version)
+		}
+	}
+
+	if _, err := NewKeypair(backupOf(t, alicePkcs8(t), "alice password", "3"), "wrong password"); err == nil {
+		t.Error("Backup is decrypted with wrong password")
+	}
+
+	// Public key in backup which isn't of the secret
+	pkcs8 := alicePkcs8(t)
+	copy(pkcs8[len(pkcs8)-32:], mustHex(t, bobPublicKey))
+	if _, err := NewKeypair(backupOf(t, pkcs8, "alice password", "3"), "alice password"); err == nil {
+		t.Error("Backup whose public key doesn't match secret is accepted")
+	}
+
+	if _, err := NewKeypair(`{"encoded":"0x00","encoding":{"content":["pkcs8","ed25519"]}}`, ""); err == nil {
+		t.Error("Ed25519 backup is accepted")
+	}
+}
@@ -2,21 +2,35 @@ package chain
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"karst/logger"
+	"karst/metrics"
+	"time"
 
 	"github.com/imroc/req"
 )
 
 type RegisterRequest struct {
-	AddressInfo string `json:"addressInfo"`
-	Backup      string `json:"backup"`
+	AddressInfo  string `json:"addressInfo"`
+	StoragePrice uint64 `json:"storagePrice"`
+	Backup       string `json:"backup"`
 }
 
+// Provider is the provision of provider, every entry of file map is file identifier followed by its order ids
 type Provider struct {
-	Address string     `json:"address"`
-	FileMap [][]string `json:"file_map"`
+	Address      string     `json:"address"`
+	StoragePrice uint64     `json:"storage_price"`
+	FileMap      [][]string `json:"file_map"`
+}
+
+// RegisteredProvider is a provider account with its karst address and storage price
+type RegisteredProvider struct {
+	Account      string `json:"account"`
+	Address      string `json:"address"`
+	StoragePrice uint64 `json:"storage_price"`
+}
+
+type BlockHeader struct {
+	Number uint64 `json:"number"`
 }
 
 type SOrderRequest struct {
@@ -48,28 +62,70 @@ type SOrderResponse struct {
 	OrderId string `json:"orderId"`
 }
 
-// TODO: extract baseUrl, backup and pwd to common structure
-func Register(baseUrl string, backup string, pwd string, karstAddr string) error {
+type SOrderRenewRequest struct {
+	OrderId  string `json:"orderId"`
+	Amount   uint64 `json:"amount"`
+	Duration uint64 `json:"duration"`
+	Backup   string `json:"backup"`
+}
+
+type SOrderCancelRequest struct {
+	OrderId string `json:"orderId"`
+	Backup  string `json:"backup"`
+}
+
+// HttpClient uses crust api shim, which signs extrinsics with the backup and password sent to it
+type HttpClient struct {
+	baseUrl  string
+	backup   string
+	password string
+	client   *req.Req
+}
+
+// NewHttpClient creates client whose requests fail after timeout, including the ones waiting for chain to confirm
+func NewHttpClient(baseUrl string, backup string, password string, timeout time.Duration) *HttpClient {
+	client := req.New()
+	client.SetTimeout(timeout)
+	return &HttpClient{
+		baseUrl:  baseUrl,
+		backup:   backup,
+		password: password,
+		client:   client,
+	}
+}
+
+// Ping checks whether crust api responds, any http status is treated as reachable
+func (c *HttpClient) Ping(timeout time.Duration) error {
+	r := req.New()
+	r.SetTimeout(timeout)
+	_, err := r.Get(c.baseUrl)
+	return err
+}
+
+func (c *HttpClient) Register(karstAddr string, price uint64) (err error) {
+	defer func() { metrics.ObserveChain("register", err) }()
+
 	header := req.Header{
-		"password": pwd,
+		"password": c.password,
 	}
 
 	regReq := RegisterRequest{
-		AddressInfo: karstAddr,
-		Backup:      backup,
+		AddressInfo:  karstAddr,
+		StoragePrice: price,
+		Backup:       c.backup,
 	}
 
 	body := req.BodyJSON(&regReq)
-	logger.Debug("Register request body: %s", body)
+	logger.Debug("Register karst address: %s, storage price: %d", karstAddr, price)
 
-	r, err := req.Post(baseUrl+"/api/v1/market/register", header, body)
+	r, err := c.client.Post(c.baseUrl+"/api/v1/market/register", header, body)
 
 	if err != nil {
 		return err
 	}
 
 	if r.Response().StatusCode != 200 {
-		return fmt.Errorf("Register karst provider failed! Error code is: %d", r.Response().StatusCode)
+		return statusError(r.Response().StatusCode, "Register karst provider failed! Error code is: %d", r.Response().StatusCode)
 	}
 
 	logger.Debug("Register response: %s", r)
@@ -77,40 +133,94 @@ func Register(baseUrl string, backup string, pwd string, karstAddr string) error
 	return nil
 }
 
-func GetProviderAddr(baseUrl string, pChainAddr string) (string, error) {
-	param := req.Param{
-		"address": pChainAddr,
-	}
-	r, err := req.Get(baseUrl+"/api/v1/market/provider", param)
+func (c *HttpClient) GetProviderAddr(pChainAddr string) (addr string, err error) {
+	defer func() { metrics.ObserveChain("get_provider", err) }()
 
+	provider, err := c.getProvider(pChainAddr)
 	if err != nil {
 		return "", err
 	}
+	return provider.Address, nil
+}
+
+func (c *HttpClient) GetProviderPrice(pChainAddr string) (price uint64, err error) {
+	defer func() { metrics.ObserveChain("get_provider_price", err) }()
+
+	provider, err := c.getProvider(pChainAddr)
+	if err != nil {
+		return 0, err
+	}
+	return provider.StoragePrice, nil
+}
+
+func (c *HttpClient) GetProviders() (providers []RegisteredProvider, err error) {
+	defer func() { metrics.ObserveChain("get_providers", err) }()
+
+	r, err := c.client.Get(c.baseUrl + "/api/v1/market/providers")
+	if err != nil {
+		return nil, err
+	}
 
 	if r.Response().StatusCode != 200 {
-		return "", fmt.Errorf("Get provider failed! Error code is: %d", r.Response().StatusCode)
+		return nil, newerStatusError(r.Response().StatusCode, "/api/v1/market/providers", "Get providers failed! Error code is: %d", r.Response().StatusCode)
 	}
-	logger.Debug("Get provider address response: %s", r)
 
-	provider := Provider{}
-	if err = r.ToJSON(&provider); err != nil {
-		return "", err
+	providers = make([]RegisteredProvider, 0)
+	if err = r.ToJSON(&providers); err != nil {
+		return nil, err
 	}
+	return providers, nil
+}
 
-	return provider.Address, nil
+func (c *HttpClient) GetProviderOrders(provider string) (orderIds []string, err error) {
+	defer func() { metrics.ObserveChain("get_provider_orders", err) }()
+
+	p, err := c.getProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	orderIds = make([]string, 0)
+	for _, entry := range p.FileMap {
+		if len(entry) > 1 {
+			orderIds = append(orderIds, entry[1:]...)
+		}
+	}
+	return orderIds, nil
+}
+
+func (c *HttpClient) GetBlockNumber() (number uint64, err error) {
+	defer func() { metrics.ObserveChain("get_block_number", err) }()
+
+	r, err := c.client.Get(c.baseUrl + "/api/v1/block/header")
+	if err != nil {
+		return 0, err
+	}
+
+	if r.Response().StatusCode != 200 {
+		return 0, newerStatusError(r.Response().StatusCode, "/api/v1/block/header", "Get block header failed! Error code is: %d", r.Response().StatusCode)
+	}
+
+	header := BlockHeader{}
+	if err = r.ToJSON(&header); err != nil {
+		return 0, err
+	}
+	return header.Number, nil
 }
 
-func PlaceStorageOrder(baseUrl string, backup string, pwd string, provider string, fId string, fSize uint64) (string, error) {
+func (c *HttpClient) PlaceStorageOrder(provider string, fId string, fSize uint64, duration uint64, amount uint64) (orderId string, err error) {
+	defer func() { metrics.ObserveChain("place_storage_order", err) }()
+
 	header := req.Header{
-		"password": pwd,
+		"password": c.password,
 	}
 
 	sOrder := StorageOrder{
 		Provider:       provider,
-		Amount:         0,
+		Amount:         amount,
 		FileIdentifier: fId,
 		FileSize:       fSize,
-		Duration:       320,
+		Duration:       duration,
 	}
 
 	sOrderStr, err := json.Marshal(sOrder)
@@ -121,18 +231,18 @@ func PlaceStorageOrder(baseUrl string, backup string, pwd string, provider strin
 
 	sOrderReq := SOrderRequest{
 		SOrder: string(sOrderStr),
-		Backup: backup,
+		Backup: c.backup,
 	}
 
 	body := req.BodyJSON(&sOrderReq)
 
-	r, err := req.Post(baseUrl+"/api/v1/market/sorder", header, body)
+	r, err := c.client.Post(c.baseUrl+"/api/v1/market/sorder", header, body)
 	if err != nil {
 		return "", err
 	}
 
 	if r.Response().StatusCode != 200 {
-		return "", fmt.Errorf("Place storage order failed, error code: %d", r.Response().StatusCode)
+		return "", statusError(r.Response().StatusCode, "Place storage order failed, error code: %d", r.Response().StatusCode)
 	}
 	logger.Debug("Response from sorder: %s", r)
 
@@ -143,24 +253,84 @@ func PlaceStorageOrder(baseUrl string, backup string, pwd string, provider strin
 	return sOrderRes.OrderId, nil
 }
 
-func GetStorageOrder(baseUrl string, orderId string) (FullStorageOrder, error) {
+func (c *HttpClient) GetStorageOrder(orderId string) (sOrder FullStorageOrder, err error) {
+	defer func() { metrics.ObserveChain("get_storage_order", err) }()
+
 	param := req.Param{
 		"orderId": orderId,
 	}
-	r, err := req.Get(baseUrl+"/api/v1/market/sorder", param)
-	sOrder := FullStorageOrder{}
+	r, err := c.client.Get(c.baseUrl+"/api/v1/market/sorder", param)
 
 	if err != nil {
 		return sOrder, err
 	}
 
 	if r.Response().StatusCode == 200 {
-		err := r.ToJSON(&sOrder)
+		err = r.ToJSON(&sOrder)
 		if err != nil {
 			return sOrder, err
 		}
 		return sOrder, nil
 	}
 
-	return sOrder, errors.New("Error from crust api")
+	return sOrder, statusError(r.Response().StatusCode, "Get storage order failed, error code: %d", r.Response().StatusCode)
+}
+
+func (c *HttpClient) RenewStorageOrder(orderId string, duration uint64, amount uint64) (err error) {
+	defer func() { metrics.ObserveChain("renew_storage_order", err) }()
+
+	return c.post("/api/v1/market/sorder/renew", SOrderRenewRequest{
+		OrderId:  orderId,
+		Amount:   amount,
+		Duration: duration,
+		Backup:   c.backup,
+	})
+}
+
+func (c *HttpClient) CancelStorageOrder(orderId string) (err error) {
+	defer func() { metrics.ObserveChain("cancel_storage_order", err) }()
+
+	return c.post("/api/v1/market/sorder/cancel", SOrderCancelRequest{
+		OrderId: orderId,
+		Backup:  c.backup,
+	})
+}
+
+func (c *HttpClient) getProvider(pChainAddr string) (*Provider, error) {
+	param := req.Param{
+		"address": pChainAddr,
+	}
+	r, err := c.client.Get(c.baseUrl+"/api/v1/market/provider", param)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Response().StatusCode != 200 {
+		return nil, statusError(r.Response().StatusCode, "Get provider failed! Error code is: %d", r.Response().StatusCode)
+	}
+	logger.Debug("Get provider response: %s", r)
+
+	provider := &Provider{}
+	if err = r.ToJSON(provider); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// post sends signed request to endpoint of newer crust api shims, the body isn't logged for it contains backup
+func (c *HttpClient) post(path string, body interface{}) error {
+	header := req.Header{
+		"password": c.password,
+	}
+
+	r, err := c.client.Post(c.baseUrl+path, header, req.BodyJSON(body))
+	if err != nil {
+		return err
+	}
+
+	if r.Response().StatusCode != 200 {
+		return newerStatusError(r.Response().StatusCode, path, "Request '%s' failed, error code: %d", path, r.Response().StatusCode)
+	}
+	logger.Debug("Response from '%s': %s", path, r)
+	return nil
 }
@@ -0,0 +1,39 @@
+package chain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// oldShim serves only the endpoints of the first crust api shim
+func oldShim() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/market/provider", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"address":"ws://127.0.0.1:17000","storage_price":3,"file_map":[]}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestHttpClientUnsupportedEndpoints(t *testing.T) {
+	server := oldShim()
+	defer server.Close()
+	client := NewHttpClient(server.URL, "{}", "", 5*time.Second)
+
+	if _, err := client.GetProviderAddr("5FqazaU79hjpEMiWTWZx81VjsYFst15eBuSBKdQLgQibD7CX"); err != nil {
+		t.Fatalf("Get provider from old shim: %s", err)
+	}
+
+	calls := map[string]func() error{
+		"renew":    func() error { return client.RenewStorageOrder("0x01", 10, 0) },
+		"cancel":   func() error { return client.CancelStorageOrder("0x01") },
+		"block":    func() error { _, err := client.GetBlockNumber(); return err },
+		"provider": func() error { _, err := client.GetProviders(); return err },
+	}
+	for name, call := range calls {
+		if err := call(); KindOf(err) != KindUnsupported {
+			t.Errorf("%s on old shim: got %v (%s), want unsupported", name, err, KindOf(err))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package chain
+
+import (
+	"fmt"
+	"karst/config"
+	"time"
+)
+
+const (
+	BackendHttp      = "http"
+	BackendSubstrate = "substrate"
+	BackendMock      = "mock"
+)
+
+// Crust produces a block every 6 seconds
+const blockTime = 6 * time.Second
+
+// LocalMockChain is the chain used by 'mock' backend, it lives in daemon's memory
+var LocalMockChain = NewMockChain(blockTime)
+
+// DefaultDuration is the storage order duration in blocks if client doesn't choose one
+const DefaultDuration = 320
+
+// Storage price of provider is the amount for a MB per block
+const priceUnit = 1024 * 1024
+
+// Quote is the amount of storing fSize bytes for duration blocks at provider's price, size is rounded up to MB
+func Quote(price uint64, fSize uint64, duration uint64) uint64 {
+	return price * ((fSize + priceUnit - 1) / priceUnit) * duration
+}
+
+// Client talks to crust chain with the account of this karst
+type Client interface {
+	// Register registers karst address and storage price of this provider
+	Register(karstAddr string, price uint64) error
+	// GetProviderAddr gets the karst address registered by provider account
+	GetProviderAddr(pChainAddr string) (string, error)
+	// GetProviderPrice gets the storage price registered by provider account
+	GetProviderPrice(pChainAddr string) (uint64, error)
+	// GetProviders lists all registered providers
+	GetProviders() ([]RegisteredProvider, error)
+	// PlaceStorageOrder places a storage order of duration blocks to provider and returns the order id
+	PlaceStorageOrder(provider string, fId string, fSize uint64, duration uint64, amount uint64) (string, error)
+	GetStorageOrder(orderId string) (FullStorageOrder, error)
+	// RenewStorageOrder extends an unexpired order by duration blocks
+	RenewStorageOrder(orderId string, duration uint64, amount uint64) error
+	// CancelStorageOrder makes order expire at current block
+	CancelStorageOrder(orderId string) error
+	// GetProviderOrders gets ids of storage orders placed to provider
+	GetProviderOrders(provider string) ([]string, error)
+	// GetBlockNumber gets the height of the latest block
+	GetBlockNumber() (uint64, error)
+	// Ping checks whether chain is reachable
+	Ping(timeout time.Duration) error
+}
+
+// NewClient creates the client of 'crust.backend', credentials are read from unlocked configuration.
+// Calls time out after 'crust.timeout' and are retried 'crust.retries' times after network errors
+func NewClient(cfg *config.Configuration) (Client, error) {
+	var client Client
+	switch cfg.Crust.Backend {
+	case "", BackendHttp:
+		client = NewHttpClient(cfg.Crust.BaseUrl, cfg.Crust.Backup, cfg.Crust.Password, cfg.Crust.Timeout)
+	case BackendSubstrate:
+		substrateClient, err := NewSubstrateClient(cfg.Crust.BaseUrl, cfg.Crust.Backup, cfg.Crust.Password, cfg.Crust.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		client = substrateClient
+	case BackendMock:
+		client = LocalMockChain.Client(cfg.Crust.Address)
+	default:
+		return nil, fmt.Errorf("Unknown crust backend '%s'", cfg.Crust.Backend)
+	}
+	return newRetryClient(client, cfg.Crust.Address, cfg.Crust.Retries), nil
+}
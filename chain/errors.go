@@ -0,0 +1,105 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+type ErrorKind string
+
+const (
+	// KindCredentials is wrong or missing crust account backup and password
+	KindCredentials ErrorKind = "credentials"
+	// KindNetwork is unreachable or timed out chain, the call may be retried
+	KindNetwork ErrorKind = "network"
+	// KindNotFound is missing provider or storage order
+	KindNotFound ErrorKind = "not_found"
+	// KindRejected is a call refused by chain, like wrong arguments or insufficient balance
+	KindRejected ErrorKind = "rejected"
+	// KindUnsupported is a call the backend can't make, like an endpoint older crust api shims don't serve
+	KindUnsupported ErrorKind = "unsupported"
+	// KindOutcomeUnknown is a call whose response is lost and whose effect can't be looked up on chain, it may have
+	// landed, so chain should be checked before the call is made again
+	KindOutcomeUnknown ErrorKind = "outcome_unknown"
+)
+
+// Error is returned by chain clients, its kind tells whether to retry
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func NewError(kind ErrorKind, format string, v ...interface{}) *Error {
+	return &Error{
+		Kind: kind,
+		Err:  fmt.Errorf(format, v...),
+	}
+}
+
+func (err *Error) Error() string {
+	return err.Err.Error()
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// KindOf gets the kind of error, network errors from net and url packages are network kind,
+// other untyped errors are treated as rejected
+func KindOf(err error) ErrorKind {
+	var chainErr *Error
+	if errors.As(err, &chainErr) {
+		return chainErr.Kind
+	}
+
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) {
+		return KindNetwork
+	}
+	return KindRejected
+}
+
+// IsTransient tells whether call may succeed if it is retried
+func IsTransient(err error) bool {
+	return err != nil && KindOf(err) == KindNetwork
+}
+
+// typed keeps chain errors and classifies the others
+func typed(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{
+		Kind: KindOf(err),
+		Err:  err,
+	}
+}
+
+// statusError classifies http status returned by crust api shim
+func statusError(status int, format string, v ...interface{}) *Error {
+	kind := KindRejected
+	switch {
+	case status == 401 || status == 403:
+		kind = KindCredentials
+	case status == 404:
+		kind = KindNotFound
+	case status == 408 || status == 429 || status >= 500:
+		kind = KindNetwork
+	}
+	return NewError(kind, format, v...)
+}
+
+// newerStatusError classifies http status of endpoints which older crust api shims don't serve, 404 means the
+// shim doesn't have path
+func newerStatusError(status int, path string, format string, v ...interface{}) *Error {
+	if status == 404 {
+		return NewError(KindUnsupported, "Crust api shim doesn't serve '%s', renewing and cancelling orders, watching orders and discovering providers need a newer shim or 'substrate' backend", path)
+	}
+	return statusError(status, format, v...)
+}
@@ -0,0 +1,399 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default blocks for a pending order to succeed in mock chain
+const mockConfirmBlocks = 2
+
+// Accounts, provider and file of tests on mock chain
+const (
+	MockProviderAccount = "5FqazaU79hjpEMiWTWZx81VjsYFst15eBuSBKdQLgQibD7CX"
+	MockClientAccount   = "5HZFQohYpN4MVyHFYxKSVAZqd1gFfdQwcqw3aB1fUeDzVuxn"
+	MockProviderAddr    = "ws://127.0.0.1:17000"
+	MockProviderPrice   = 3
+	MockFileIdentifier  = "0x5e9b98f62cf8b6ba6b8a9b1ab55ab5ed4dbd1be9b9e8a0b7c5a1d4c2b3a49586"
+	MockFileSize        = 3 * 1024 * 1024
+)
+
+// MockChain is an in-memory crust chain for local runs and tests, clients of different accounts share it.
+// Block height grows with time if block time is set, and by Advance
+type MockChain struct {
+	lock      sync.Mutex
+	blockTime time.Duration
+	startAt   time.Time
+	advanced  uint64
+	nonce     uint64
+	providers map[string]string
+	prices    map[string]uint64
+	orders    map[string]*FullStorageOrder
+	clients   map[string][]string
+	failures  map[string]error
+	losses    map[string]error
+
+	// ConfirmBlocks is the number of blocks for a pending order to become success
+	ConfirmBlocks uint64
+}
+
+func NewMockChain(blockTime time.Duration) *MockChain {
+	return &MockChain{
+		blockTime:     blockTime,
+		startAt:       time.Now(),
+		providers:     make(map[string]string),
+		prices:        make(map[string]uint64),
+		orders:        make(map[string]*FullStorageOrder),
+		clients:       make(map[string][]string),
+		failures:      make(map[string]error),
+		losses:        make(map[string]error),
+		ConfirmBlocks: mockConfirmBlocks,
+	}
+}
+
+// NewTestMockChain creates a mock chain without block time where MockProviderAccount is registered
+func NewTestMockChain() *MockChain {
+	chain := NewMockChain(0)
+	chain.providers[MockProviderAccount] = MockProviderAddr
+	chain.prices[MockProviderAccount] = MockProviderPrice
+	return chain
+}
+
+// PlaceMockOrder places order of MockClientAccount to MockProviderAccount for file fId of MockFileSize at the quote of provider
+func (chain *MockChain) PlaceMockOrder(fId string, duration uint64) (string, error) {
+	amount := Quote(MockProviderPrice, MockFileSize, duration)
+	return chain.Client(MockClientAccount).PlaceStorageOrder(MockProviderAccount, fId, MockFileSize, duration, amount)
+}
+
+// Client returns a client which acts as account address
+func (chain *MockChain) Client(address string) *MockClient {
+	return &MockClient{
+		chain:   chain,
+		address: address,
+	}
+}
+
+// Block returns current block height
+func (chain *MockChain) Block() uint64 {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	return chain.block()
+}
+
+// Advance produces blocks, pending orders are confirmed on the way
+func (chain *MockChain) Advance(blocks uint64) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.advanced += blocks
+	chain.update()
+}
+
+// FailNext makes next call of client fail with err, call is 'register', 'get_provider', 'get_provider_price',
+// 'get_providers', 'place_storage_order', 'get_storage_order', 'renew_storage_order', 'cancel_storage_order', 'get_provider_orders',
+// 'get_block_number' or 'ping'
+func (chain *MockChain) FailNext(call string, err error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.failures[call] = err
+}
+
+// LoseNext makes next call of client take effect but fail with err, like its response is lost in network,
+// call is 'register', 'place_storage_order', 'renew_storage_order' or 'cancel_storage_order'
+func (chain *MockChain) LoseNext(call string, err error) {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.losses[call] = err
+}
+
+// SetOrderStatus changes order status directly, like 'Failed'
+func (chain *MockChain) SetOrderStatus(orderId string, status string) error {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	order, ok := chain.orders[orderId]
+	if !ok {
+		return NewError(KindNotFound, "Storage order '%s' not found", orderId)
+	}
+	order.OrderStatus = status
+	return nil
+}
+
+// Orders returns copies of all orders placed by or to account
+func (chain *MockChain) Orders(address string) []FullStorageOrder {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	chain.update()
+
+	orders := make([]FullStorageOrder, 0)
+	for _, order := range chain.orders {
+		if order.Client == address || order.Provider == address {
+			orders = append(orders, *order)
+		}
+	}
+	return orders
+}
+
+// block is called with lock held
+func (chain *MockChain) block() uint64 {
+	block := chain.advanced
+	if chain.blockTime > 0 {
+		block += uint64(time.Since(chain.startAt) / chain.blockTime)
+	}
+	return block
+}
+
+// update confirms pending orders, it is called with lock held
+func (chain *MockChain) update() {
+	block := chain.block()
+	for _, order := range chain.orders {
+		if order.OrderStatus == "Pending" && order.CreatedOn+chain.ConfirmBlocks <= block {
+			order.OrderStatus = "Success"
+		}
+	}
+}
+
+// fail takes the failure set by FailNext, it is called with lock held
+func (chain *MockChain) fail(call string) error {
+	err, ok := chain.failures[call]
+	if !ok {
+		return nil
+	}
+	delete(chain.failures, call)
+	return err
+}
+
+// lose takes the failure set by LoseNext, it is called with lock held
+func (chain *MockChain) lose(call string) error {
+	err, ok := chain.losses[call]
+	if !ok {
+		return nil
+	}
+	delete(chain.losses, call)
+	return err
+}
+
+// MockClient is the client of MockChain
+type MockClient struct {
+	chain   *MockChain
+	address string
+}
+
+func (c *MockClient) Register(karstAddr string, price uint64) error {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("register"); err != nil {
+		return err
+	}
+
+	if c.address == "" {
+		return NewError(KindCredentials, "Crust account isn't configured")
+	}
+	if karstAddr == "" {
+		return NewError(KindRejected, "Karst address is empty")
+	}
+	c.chain.providers[c.address] = karstAddr
+	c.chain.prices[c.address] = price
+	return c.chain.lose("register")
+}
+
+func (c *MockClient) GetProviderAddr(pChainAddr string) (string, error) {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("get_provider"); err != nil {
+		return "", err
+	}
+
+	addr, ok := c.chain.providers[pChainAddr]
+	if !ok {
+		return "", NewError(KindNotFound, "Provider '%s' isn't registered", pChainAddr)
+	}
+	return addr, nil
+}
+
+func (c *MockClient) GetProviderPrice(pChainAddr string) (uint64, error) {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("get_provider_price"); err != nil {
+		return 0, err
+	}
+
+	price, ok := c.chain.prices[pChainAddr]
+	if !ok {
+		return 0, NewError(KindNotFound, "Provider '%s' isn't registered", pChainAddr)
+	}
+	return price, nil
+}
+
+func (c *MockClient) GetProviders() ([]RegisteredProvider, error) {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("get_providers"); err != nil {
+		return nil, err
+	}
+
+	providers := make([]RegisteredProvider, 0, len(c.chain.providers))
+	for account, addr := range c.chain.providers {
+		providers = append(providers, RegisteredProvider{
+			Account:      account,
+			Address:      addr,
+			StoragePrice: c.chain.prices[account],
+		})
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Account < providers[j].Account
+	})
+	return providers, nil
+}
+
+func (c *MockClient) PlaceStorageOrder(provider string, fId string, fSize uint64, duration uint64, amount uint64) (string, error) {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("place_storage_order"); err != nil {
+		return "", err
+	}
+
+	if c.address == "" {
+		return "", NewError(KindCredentials, "Crust account isn't configured")
+	}
+	price, ok := c.chain.prices[provider]
+	if !ok {
+		return "", NewError(KindNotFound, "Provider '%s' isn't registered", provider)
+	}
+	if duration == 0 {
+		return "", NewError(KindRejected, "Duration of storage order is 0")
+	}
+	if quote := Quote(price, fSize, duration); amount < quote {
+		return "", NewError(KindRejected, "Amount %d is less than %d asked by provider", amount, quote)
+	}
+
+	// Order id is the hash of order content like chain does, nonce makes it unique
+	c.chain.nonce++
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, c.chain.nonce)
+	hash := sha256.Sum256([]byte(c.address + provider + fId + string(nonce)))
+	orderId := fmt.Sprintf("0x%x", hash)
+
+	block := c.chain.block()
+	c.chain.orders[orderId] = &FullStorageOrder{
+		Provider:       provider,
+		Client:         c.address,
+		Amount:         amount,
+		FileIdentifier: fId,
+		FileSize:       fSize,
+		Duration:       duration,
+		CreatedOn:      block,
+		ExpiredOn:      block + duration,
+		OrderStatus:    "Pending",
+	}
+	c.chain.clients[c.address] = append(c.chain.clients[c.address], orderId)
+	if err := c.chain.lose("place_storage_order"); err != nil {
+		return "", err
+	}
+	return orderId, nil
+}
+
+func (c *MockClient) GetStorageOrder(orderId string) (FullStorageOrder, error) {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("get_storage_order"); err != nil {
+		return FullStorageOrder{}, err
+	}
+
+	c.chain.update()
+	order, ok := c.chain.orders[orderId]
+	if !ok {
+		return FullStorageOrder{}, NewError(KindNotFound, "Storage order '%s' not found", orderId)
+	}
+	return *order, nil
+}
+
+func (c *MockClient) RenewStorageOrder(orderId string, duration uint64, amount uint64) error {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("renew_storage_order"); err != nil {
+		return err
+	}
+
+	order, err := c.clientOrder(orderId)
+	if err != nil {
+		return err
+	}
+	if duration == 0 {
+		return NewError(KindRejected, "Duration of storage order is 0")
+	}
+	if quote := Quote(c.chain.prices[order.Provider], order.FileSize, duration); amount < quote {
+		return NewError(KindRejected, "Amount %d is less than %d asked by provider", amount, quote)
+	}
+
+	order.Amount += amount
+	order.Duration += duration
+	order.ExpiredOn += duration
+	return c.chain.lose("renew_storage_order")
+}
+
+func (c *MockClient) CancelStorageOrder(orderId string) error {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("cancel_storage_order"); err != nil {
+		return err
+	}
+
+	order, err := c.clientOrder(orderId)
+	if err != nil {
+		return err
+	}
+
+	order.ExpiredOn = c.chain.block()
+	order.Duration = order.ExpiredOn - order.CreatedOn
+	return c.chain.lose("cancel_storage_order")
+}
+
+// clientOrder gets unexpired order placed by client, it is called with lock held
+func (c *MockClient) clientOrder(orderId string) (*FullStorageOrder, error) {
+	order, ok := c.chain.orders[orderId]
+	if !ok {
+		return nil, NewError(KindNotFound, "Storage order '%s' not found", orderId)
+	}
+	if order.Client != c.address {
+		return nil, NewError(KindRejected, "Storage order '%s' isn't placed by '%s'", orderId, c.address)
+	}
+	if c.chain.block() >= order.ExpiredOn {
+		return nil, NewError(KindRejected, "Storage order '%s' is expired", orderId)
+	}
+	return order, nil
+}
+
+func (c *MockClient) GetProviderOrders(provider string) ([]string, error) {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("get_provider_orders"); err != nil {
+		return nil, err
+	}
+
+	orderIds := make([]string, 0)
+	for orderId, order := range c.chain.orders {
+		if order.Provider == provider {
+			orderIds = append(orderIds, orderId)
+		}
+	}
+	sort.Strings(orderIds)
+	return orderIds, nil
+}
+
+func (c *MockClient) GetBlockNumber() (uint64, error) {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	if err := c.chain.fail("get_block_number"); err != nil {
+		return 0, err
+	}
+	return c.chain.block(), nil
+}
+
+func (c *MockClient) Ping(timeout time.Duration) error {
+	c.chain.lock.Lock()
+	defer c.chain.lock.Unlock()
+	return c.chain.fail("ping")
+}
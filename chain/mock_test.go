@@ -0,0 +1,141 @@
+package chain
+
+import (
+	"testing"
+)
+
+func TestMockRegister(t *testing.T) {
+	mock := NewMockChain(0)
+
+	if err := mock.Client("").Register(MockProviderAddr, MockProviderPrice); KindOf(err) != KindCredentials {
+		t.Errorf("Register without account: got %v, want credentials", err)
+	}
+	client := mock.Client(MockProviderAccount)
+	if _, err := client.GetProviderAddr(MockProviderAccount); KindOf(err) != KindNotFound {
+		t.Errorf("Get unregistered provider: got %v, want not found", err)
+	}
+
+	if err := client.Register(MockProviderAddr, MockProviderPrice); err != nil {
+		t.Fatalf("Register: %s", err)
+	}
+	if addr, err := client.GetProviderAddr(MockProviderAccount); err != nil || addr != MockProviderAddr {
+		t.Errorf("Registered address is '%s' (%v)", addr, err)
+	}
+	if err := client.Register(MockProviderAddr, 4); err != nil {
+		t.Fatalf("Register again: %s", err)
+	}
+	if price, err := client.GetProviderPrice(MockProviderAccount); err != nil || price != 4 {
+		t.Errorf("Registered price is %d (%v), want 4", price, err)
+	}
+
+	providers, err := client.GetProviders()
+	if err != nil || len(providers) != 1 || providers[0].Account != MockProviderAccount {
+		t.Errorf("Registered providers are %+v (%v)", providers, err)
+	}
+}
+
+func TestMockOrderStatus(t *testing.T) {
+	mock := NewTestMockChain()
+	orderId, err := mock.PlaceMockOrder(MockFileIdentifier, 10)
+	if err != nil {
+		t.Fatalf("Place order: %s", err)
+	}
+	client := mock.Client(MockClientAccount)
+
+	status := func() string {
+		sOrder, err := client.GetStorageOrder(orderId)
+		if err != nil {
+			t.Fatalf("Get order: %s", err)
+		}
+		return sOrder.OrderStatus
+	}
+	if s := status(); s != "Pending" {
+		t.Errorf("New order is %s, want Pending", s)
+	}
+	mock.Advance(mock.ConfirmBlocks - 1)
+	if s := status(); s != "Pending" {
+		t.Errorf("Order before confirmation is %s, want Pending", s)
+	}
+	mock.Advance(1)
+	if s := status(); s != "Success" {
+		t.Errorf("Confirmed order is %s, want Success", s)
+	}
+	if err := mock.SetOrderStatus(orderId, "Failed"); err != nil {
+		t.Fatalf("Set order status: %s", err)
+	}
+	if s := status(); s != "Failed" {
+		t.Errorf("Failed order is %s", s)
+	}
+	if err := mock.SetOrderStatus("0x00", "Failed"); KindOf(err) != KindNotFound {
+		t.Errorf("Set status of missing order: got %v, want not found", err)
+	}
+
+	orderIds, err := client.GetProviderOrders(MockProviderAccount)
+	if err != nil || len(orderIds) != 1 || orderIds[0] != orderId {
+		t.Errorf("Orders of provider are %v (%v)", orderIds, err)
+	}
+	if orders := mock.Orders(MockClientAccount); len(orders) != 1 || orders[0].Provider != MockProviderAccount {
+		t.Errorf("Orders of client are %+v", orders)
+	}
+}
+
+func TestMockPlaceRejected(t *testing.T) {
+	mock := NewTestMockChain()
+	client := mock.Client(MockClientAccount)
+
+	if _, err := client.PlaceStorageOrder(MockClientAccount, MockFileIdentifier, MockFileSize, 10, 1000); KindOf(err) != KindNotFound {
+		t.Errorf("Place to unregistered provider: got %v, want not found", err)
+	}
+	if _, err := client.PlaceStorageOrder(MockProviderAccount, MockFileIdentifier, MockFileSize, 10, 1); KindOf(err) != KindRejected {
+		t.Errorf("Place under quote: got %v, want rejected", err)
+	}
+	if _, err := mock.Client("").PlaceStorageOrder(MockProviderAccount, MockFileIdentifier, MockFileSize, 10, 1000); KindOf(err) != KindCredentials {
+		t.Errorf("Place without account: got %v, want credentials", err)
+	}
+	if orders := mock.Orders(MockClientAccount); len(orders) != 0 {
+		t.Errorf("Rejected orders are placed: %+v", orders)
+	}
+}
+
+func TestMockRenewAndCancel(t *testing.T) {
+	mock := NewTestMockChain()
+	orderId, err := mock.PlaceMockOrder(MockFileIdentifier, 10)
+	if err != nil {
+		t.Fatalf("Place order: %s", err)
+	}
+	client := mock.Client(MockClientAccount)
+
+	if err := client.RenewStorageOrder(orderId, 20, 1); KindOf(err) != KindRejected {
+		t.Errorf("Renew under quote: got %v, want rejected", err)
+	}
+	if err := mock.Client(MockProviderAccount).RenewStorageOrder(orderId, 20, 1000); KindOf(err) != KindRejected {
+		t.Errorf("Renew order of others: got %v, want rejected", err)
+	}
+	if err := client.RenewStorageOrder("0x00", 20, 1000); KindOf(err) != KindNotFound {
+		t.Errorf("Renew missing order: got %v, want not found", err)
+	}
+
+	amount := Quote(MockProviderPrice, MockFileSize, 20)
+	if err := client.RenewStorageOrder(orderId, 20, amount); err != nil {
+		t.Fatalf("Renew: %s", err)
+	}
+	sOrder, _ := client.GetStorageOrder(orderId)
+	if sOrder.ExpiredOn != 30 || sOrder.Duration != 30 || sOrder.Amount != Quote(MockProviderPrice, MockFileSize, 10)+amount {
+		t.Errorf("Renewed order expires on %d after %d blocks with amount %d", sOrder.ExpiredOn, sOrder.Duration, sOrder.Amount)
+	}
+
+	mock.Advance(5)
+	if err := client.CancelStorageOrder(orderId); err != nil {
+		t.Fatalf("Cancel: %s", err)
+	}
+	sOrder, _ = client.GetStorageOrder(orderId)
+	if sOrder.ExpiredOn != 5 || sOrder.Duration != 5 {
+		t.Errorf("Canceled order expires on %d after %d blocks, want 5", sOrder.ExpiredOn, sOrder.Duration)
+	}
+	if err := client.CancelStorageOrder(orderId); KindOf(err) != KindRejected {
+		t.Errorf("Cancel expired order: got %v, want rejected", err)
+	}
+	if err := client.RenewStorageOrder(orderId, 20, amount); KindOf(err) != KindRejected {
+		t.Errorf("Renew expired order: got %v, want rejected", err)
+	}
+}
@@ -0,0 +1,246 @@
+package chain
+
+import (
+	"karst/logger"
+	"karst/metrics"
+	"strings"
+	"time"
+)
+
+// Backoff before the first retry, it doubles after each retry up to retryMaxBackoff
+const (
+	retryBackoff    = time.Second
+	retryMaxBackoff = 16 * time.Second
+)
+
+// retryClient retries calls of backend after network errors. Before resubmitting a call which changes chain,
+// it checks whether the last submission has landed, so a lost response doesn't register, place or renew twice.
+// Orders which can't be checked aren't submitted again, KindOutcomeUnknown is returned instead
+type retryClient struct {
+	Client
+	address string
+	retries int
+	// backoff is the wait before the first retry
+	backoff time.Duration
+}
+
+func newRetryClient(client Client, address string, retries int) *retryClient {
+	return &retryClient{
+		Client:  client,
+		address: address,
+		retries: retries,
+		backoff: retryBackoff,
+	}
+}
+
+// retry runs call until it succeeds, fails with a non-network error or runs out of retries, errors are typed
+func (c *retryClient) retry(call string, run func() error) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := typed(run())
+		if !IsTransient(err) || attempt >= c.retries {
+			return err
+		}
+
+		logger.Warn("Chain call '%s' failed, retry in %s: %s", call, backoff, err)
+		metrics.ChainRetries.WithLabelValues(call).Inc()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+func (c *retryClient) Register(karstAddr string, price uint64) error {
+	submitted := false
+	return c.retry("register", func() error {
+		if submitted {
+			landed, err := c.registered(karstAddr, price)
+			if err != nil || landed {
+				return err
+			}
+		}
+		submitted = true
+		return c.Client.Register(karstAddr, price)
+	})
+}
+
+// registered checks whether this provider is registered with karstAddr and price
+func (c *retryClient) registered(karstAddr string, price uint64) (bool, error) {
+	addr, err := c.Client.GetProviderAddr(c.address)
+	if KindOf(err) == KindNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	registeredPrice, err := c.Client.GetProviderPrice(c.address)
+	if err != nil {
+		return false, err
+	}
+	return addr == karstAddr && registeredPrice == price, nil
+}
+
+func (c *retryClient) GetProviderAddr(pChainAddr string) (addr string, err error) {
+	err = c.retry("get_provider", func() (err error) {
+		addr, err = c.Client.GetProviderAddr(pChainAddr)
+		return err
+	})
+	return addr, err
+}
+
+func (c *retryClient) GetProviderPrice(pChainAddr string) (price uint64, err error) {
+	err = c.retry("get_provider_price", func() (err error) {
+		price, err = c.Client.GetProviderPrice(pChainAddr)
+		return err
+	})
+	return price, err
+}
+
+func (c *retryClient) GetProviders() (providers []RegisteredProvider, err error) {
+	err = c.retry("get_providers", func() (err error) {
+		providers, err = c.Client.GetProviders()
+		return err
+	})
+	return providers, err
+}
+
+func (c *retryClient) PlaceStorageOrder(provider string, fId string, fSize uint64, duration uint64, amount uint64) (orderId string, err error) {
+	// Orders of provider before submission, a new order of ours for the same file means the submission has landed.
+	// Without them (like a shim which can't list orders) a lost submission can't be checked and isn't submitted again
+	var before map[string]bool
+	submitted := false
+	err = c.retry("place_storage_order", func() (err error) {
+		if !submitted {
+			if orderIds, err := c.Client.GetProviderOrders(provider); err != nil {
+				logger.Warn("List orders of provider '%s' failed, order isn't submitted again if its response is lost: %s", provider, err)
+			} else {
+				before = make(map[string]bool, len(orderIds))
+				for _, id := range orderIds {
+					before[id] = true
+				}
+			}
+		}
+
+		if submitted {
+			if before == nil {
+				return NewError(KindOutcomeUnknown, "Storage order to '%s' for file '%s' may have been placed, orders of provider can't be listed to check it", provider, fId)
+			}
+			orderId, err = c.placedOrder(provider, fId, fSize, before)
+			if IsTransient(err) || orderId != "" {
+				return err
+			}
+			if err != nil {
+				return NewError(KindOutcomeUnknown, "Storage order to '%s' for file '%s' may have been placed, look up failed: %s", provider, fId, err)
+			}
+		}
+		submitted = true
+		orderId, err = c.Client.PlaceStorageOrder(provider, fId, fSize, duration, amount)
+		return err
+	})
+	if submitted && IsTransient(err) {
+		err = NewError(KindOutcomeUnknown, "Storage order to '%s' for file '%s' may have been placed, chain can't be reached to check it: %s", provider, fId, err)
+	}
+	return orderId, err
+}
+
+// placedOrder finds order of this client for the file which isn't in before, it returns empty id if there isn't
+func (c *retryClient) placedOrder(provider string, fId string, fSize uint64, before map[string]bool) (string, error) {
+	orderIds, err := c.Client.GetProviderOrders(provider)
+	if err != nil {
+		return "", err
+	}
+
+	for _, id := range orderIds {
+		if before[id] {
+			continue
+		}
+		sOrder, err := c.Client.GetStorageOrder(id)
+		if err != nil {
+			return "", err
+		}
+		if sOrder.Client == c.address && sOrder.FileSize == fSize && sameHex(sOrder.FileIdentifier, fId) {
+			logger.Info("Storage order '%s' has been placed before retry", id)
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+func (c *retryClient) GetStorageOrder(orderId string) (sOrder FullStorageOrder, err error) {
+	err = c.retry("get_storage_order", func() (err error) {
+		sOrder, err = c.Client.GetStorageOrder(orderId)
+		return err
+	})
+	return sOrder, err
+}
+
+func (c *retryClient) RenewStorageOrder(orderId string, duration uint64, amount uint64) error {
+	// Expiry before submission, it grows by duration once the submission has landed
+	var expiredOn uint64
+	submitted := false
+	err := c.retry("renew_storage_order", func() error {
+		sOrder, err := c.Client.GetStorageOrder(orderId)
+		if err != nil {
+			return err
+		}
+		if !submitted {
+			expiredOn = sOrder.ExpiredOn
+		} else if sOrder.ExpiredOn >= expiredOn+duration {
+			logger.Info("Storage order '%s' has been renewed before retry", orderId)
+			return nil
+		}
+
+		submitted = true
+		return c.Client.RenewStorageOrder(orderId, duration, amount)
+	})
+	if submitted && IsTransient(err) {
+		err = NewError(KindOutcomeUnknown, "Storage order '%s' may have been renewed, chain can't be reached to check it: %s", orderId, err)
+	}
+	return err
+}
+
+func (c *retryClient) CancelStorageOrder(orderId string) error {
+	submitted := false
+	return c.retry("cancel_storage_order", func() error {
+		if submitted {
+			sOrder, err := c.Client.GetStorageOrder(orderId)
+			if err != nil {
+				return err
+			}
+			block, err := c.Client.GetBlockNumber()
+			if err != nil {
+				return err
+			}
+			if sOrder.ExpiredOn <= block {
+				logger.Info("Storage order '%s' has been cancelled before retry", orderId)
+				return nil
+			}
+		}
+
+		submitted = true
+		return c.Client.CancelStorageOrder(orderId)
+	})
+}
+
+func (c *retryClient) GetProviderOrders(provider string) (orderIds []string, err error) {
+	err = c.retry("get_provider_orders", func() (err error) {
+		orderIds, err = c.Client.GetProviderOrders(provider)
+		return err
+	})
+	return orderIds, err
+}
+
+func (c *retryClient) GetBlockNumber() (number uint64, err error) {
+	err = c.retry("get_block_number", func() (err error) {
+		number, err = c.Client.GetBlockNumber()
+		return err
+	})
+	return number, err
+}
+
+// sameHex compares hex strings regardless of '0x' prefix and case
+func sameHex(a string, b string) bool {
+	return strings.EqualFold(strings.TrimPrefix(a, "0x"), strings.TrimPrefix(b, "0x"))
+}
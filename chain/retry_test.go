@@ -0,0 +1,170 @@
+package chain
+
+import (
+	"testing"
+	"time"
+)
+
+func lostErr() error {
+	return NewError(KindNetwork, "Response is lost")
+}
+
+// newTestRetryClient acts as account on mock, it doesn't wait between retries
+func newTestRetryClient(mock *MockChain, account string, retries int) *retryClient {
+	client := newRetryClient(mock.Client(account), account, retries)
+	client.backoff = time.Millisecond
+	return client
+}
+
+func placeTestOrder(client Client) (string, error) {
+	return client.PlaceStorageOrder(MockProviderAccount, MockFileIdentifier, MockFileSize, 10, Quote(MockProviderPrice, MockFileSize, 10))
+}
+
+func TestRetryRegister(t *testing.T) {
+	mock := NewMockChain(0)
+	client := newTestRetryClient(mock, MockProviderAccount, 1)
+
+	mock.FailNext("register", NewError(KindRejected, "Insufficient balance"))
+	if err := client.Register(MockProviderAddr, MockProviderPrice); KindOf(err) != KindRejected {
+		t.Fatalf("Register rejected by chain: got %v, want rejected", err)
+	}
+	if _, err := client.GetProviderAddr(MockProviderAccount); KindOf(err) != KindNotFound {
+		t.Errorf("Rejected register is on chain: %v", err)
+	}
+
+	mock.FailNext("register", lostErr())
+	if err := client.Register(MockProviderAddr, MockProviderPrice); err != nil {
+		t.Fatalf("Register after network failure: %s", err)
+	}
+
+	mock.LoseNext("register", lostErr())
+	if err := client.Register(MockProviderAddr, 4); err != nil {
+		t.Fatalf("Register with lost response: %s", err)
+	}
+	if price, err := client.GetProviderPrice(MockProviderAccount); err != nil || price != 4 {
+		t.Errorf("Registered price is %d (%v), want 4", price, err)
+	}
+}
+
+func TestRetryPlaceLost(t *testing.T) {
+	mock := NewTestMockChain()
+	client := newTestRetryClient(mock, MockClientAccount, 1)
+
+	mock.LoseNext("place_storage_order", lostErr())
+	orderId, err := placeTestOrder(client)
+	if err != nil {
+		t.Fatalf("Place with lost response: %s", err)
+	}
+	orders := mock.Orders(MockClientAccount)
+	if len(orders) != 1 {
+		t.Fatalf("Lost order is placed %d times, want once", len(orders))
+	}
+	if _, err := client.GetStorageOrder(orderId); err != nil {
+		t.Errorf("Order found before retry isn't on chain: %s", err)
+	}
+}
+
+func TestRetryPlaceFailed(t *testing.T) {
+	mock := NewTestMockChain()
+	client := newTestRetryClient(mock, MockClientAccount, 1)
+
+	mock.FailNext("place_storage_order", lostErr())
+	if _, err := placeTestOrder(client); err != nil {
+		t.Fatalf("Place after network failure: %s", err)
+	}
+	if orders := mock.Orders(MockClientAccount); len(orders) != 1 {
+		t.Errorf("Got %d orders after network failure, want 1", len(orders))
+	}
+
+	_, err := client.PlaceStorageOrder(MockProviderAccount, MockFileIdentifier, MockFileSize, 10, 1)
+	if KindOf(err) != KindRejected {
+		t.Errorf("Place order under quote: got %v, want rejected", err)
+	}
+}
+
+func TestRetryPlaceOutcomeUnknown(t *testing.T) {
+	mock := NewTestMockChain()
+	client := newTestRetryClient(mock, MockClientAccount, 1)
+
+	// Orders of provider can't be listed before submission, so the lost order can't be looked up
+	mock.FailNext("get_provider_orders", NewError(KindUnsupported, "Not served"))
+	mock.LoseNext("place_storage_order", lostErr())
+	if _, err := placeTestOrder(client); KindOf(err) != KindOutcomeUnknown {
+		t.Errorf("Place which can't be checked: got %v, want outcome unknown", err)
+	}
+	if orders := mock.Orders(MockClientAccount); len(orders) != 1 {
+		t.Errorf("Got %d orders, want the lost one only", len(orders))
+	}
+
+	// Retries run out before the lost order is looked up
+	client.retries = 0
+	mock.LoseNext("place_storage_order", lostErr())
+	if _, err := placeTestOrder(client); KindOf(err) != KindOutcomeUnknown {
+		t.Errorf("Place without retries: got %v, want outcome unknown", err)
+	}
+	if orders := mock.Orders(MockClientAccount); len(orders) != 2 {
+		t.Errorf("Got %d orders, want 2", len(orders))
+	}
+}
+
+func TestRetryRenewLost(t *testing.T) {
+	mock := NewTestMockChain()
+	client := newTestRetryClient(mock, MockClientAccount, 1)
+	orderId, err := placeTestOrder(client)
+	if err != nil {
+		t.Fatalf("Place order: %s", err)
+	}
+
+	mock.LoseNext("renew_storage_order", lostErr())
+	if err := client.RenewStorageOrder(orderId, 20, Quote(MockProviderPrice, MockFileSize, 20)); err != nil {
+		t.Fatalf("Renew with lost response: %s", err)
+	}
+	sOrder, err := client.GetStorageOrder(orderId)
+	if err != nil {
+		t.Fatalf("Get order: %s", err)
+	}
+	if sOrder.ExpiredOn != 30 || sOrder.Duration != 30 {
+		t.Errorf("Lost renew isn't applied once, order expires on %d after %d blocks", sOrder.ExpiredOn, sOrder.Duration)
+	}
+
+	client.retries = 0
+	mock.LoseNext("renew_storage_order", lostErr())
+	if err := client.RenewStorageOrder(orderId, 20, Quote(MockProviderPrice, MockFileSize, 20)); KindOf(err) != KindOutcomeUnknown {
+		t.Errorf("Renew without retries: got %v, want outcome unknown", err)
+	}
+}
+
+func TestRetryCancelLost(t *testing.T) {
+	mock := NewTestMockChain()
+	client := newTestRetryClient(mock, MockClientAccount, 1)
+	orderId, err := placeTestOrder(client)
+	if err != nil {
+		t.Fatalf("Place order: %s", err)
+	}
+	mock.Advance(3)
+
+	mock.LoseNext("cancel_storage_order", lostErr())
+	if err := client.CancelStorageOrder(orderId); err != nil {
+		t.Fatalf("Cancel with lost response: %s", err)
+	}
+	sOrder, err := client.GetStorageOrder(orderId)
+	if err != nil {
+		t.Fatalf("Get order: %s", err)
+	}
+	if sOrder.ExpiredOn != 3 {
+		t.Errorf("Canceled order expires on %d, want 3", sOrder.ExpiredOn)
+	}
+}
+
+func TestRetryRunsOut(t *testing.T) {
+	mock := NewTestMockChain()
+	client := newTestRetryClient(mock, MockClientAccount, 0)
+
+	mock.FailNext("get_block_number", lostErr())
+	if _, err := client.GetBlockNumber(); !IsTransient(err) {
+		t.Errorf("Call after retries run out: got %v, want network error", err)
+	}
+	if _, err := client.GetBlockNumber(); err != nil {
+		t.Errorf("Call after chain is back: %s", err)
+	}
+}
@@ -0,0 +1,737 @@
+package chain
+
+import (
+	"fmt"
+	"karst/logger"
+	"karst/metrics"
+	"math"
+	"math/big"
+	"sync"
+	"time"
+
+	gsrpc "github.com/centrifuge/go-substrate-rpc-client/v2"
+	"github.com/centrifuge/go-substrate-rpc-client/v2/rpc/author"
+	"github.com/centrifuge/go-substrate-rpc-client/v2/scale"
+	"github.com/centrifuge/go-substrate-rpc-client/v2/types"
+	"github.com/centrifuge/go-substrate-rpc-client/v2/xxhash"
+	"golang.org/x/crypto/blake2b"
+)
+
+// provisionScale is the value of 'Market.Providers', file map is a BTreeMap from file identifier to order ids
+type provisionScale struct {
+	Address      types.Bytes
+	StoragePrice types.U128
+	FileMap      []fileOrdersScale
+}
+
+type fileOrdersScale struct {
+	FileIdentifier types.Bytes
+	OrderIds       []types.Hash
+}
+
+// storageOrderScale is the value of 'Market.StorageOrders'
+type storageOrderScale struct {
+	FileIdentifier types.Bytes
+	FileSize       types.U64
+	CreatedOn      types.U32
+	ExpiredOn      types.U32
+	Provider       types.AccountID
+	Client         types.AccountID
+	Amount         types.U128
+	OrderStatus    orderStatus
+}
+
+type orderStatus string
+
+var orderStatusNames = []orderStatus{"Success", "Failed", "Pending"}
+
+func (s *orderStatus) Decode(decoder scale.Decoder) error {
+	b, err := decoder.ReadOneByte()
+	if err != nil {
+		return err
+	}
+	if int(b) >= len(orderStatusNames) {
+		return fmt.Errorf("Unknown order status %d", b)
+	}
+	*s = orderStatusNames[b]
+	return nil
+}
+
+func (s orderStatus) Encode(encoder scale.Encoder) error {
+	for i, name := range orderStatusNames {
+		if name == s {
+			return encoder.PushByte(byte(i))
+		}
+	}
+	return fmt.Errorf("Unknown order status '%s'", s)
+}
+
+// SubstrateClient speaks substrate json-rpc to crust node directly and signs extrinsics locally
+type SubstrateClient struct {
+	url     string
+	keypair *Keypair
+	// timeout of each rpc and of waiting for extrinsic to be included in block
+	timeout time.Duration
+
+	// Connection is created on first use and dropped after rpc errors
+	lock        sync.Mutex
+	api         *gsrpc.SubstrateAPI
+	meta        *types.Metadata
+	genesisHash types.Hash
+
+	// Extrinsics are submitted one by one to keep nonce in order
+	submitLock sync.Mutex
+}
+
+// NewSubstrateClient decrypts account backup for signing, it can only query chain without backup
+func NewSubstrateClient(url string, backup string, password string, timeout time.Duration) (*SubstrateClient, error) {
+	c := &SubstrateClient{url: url, timeout: timeout}
+	if backup != "" {
+		kp, err := NewKeypair(backup, password)
+		if err != nil {
+			return nil, &Error{Kind: KindCredentials, Err: err}
+		}
+		c.keypair = kp
+	}
+
+	return c, nil
+}
+
+func (c *SubstrateClient) Register(karstAddr string, price uint64) (err error) {
+	defer func() { metrics.ObserveChain("register", err) }()
+
+	if err = c.checkKeypair(); err != nil {
+		return err
+	}
+
+	meta, err := c.metadata()
+	if err != nil {
+		return err
+	}
+
+	call, err := types.NewCall(meta, "Market.register", types.NewBytes([]byte(karstAddr)), types.NewU128(*new(big.Int).SetUint64(price)))
+	if err != nil {
+		return err
+	}
+
+	blockHash, err := c.submit(call)
+	if err != nil {
+		return err
+	}
+
+	// Extrinsic failure isn't reported by status, check the result in storage
+	provision := provisionScale{}
+	ok, err := c.getStorage("Providers", c.keypair.PublicKey[:], &provision, &blockHash)
+	if err != nil {
+		return err
+	}
+	if !ok || string(provision.Address) != karstAddr || provision.StoragePrice.Uint64() != price {
+		return NewError(KindRejected, "Register is included in block %s but doesn't take effect, please check your qualification", blockHash.Hex())
+	}
+
+	return nil
+}
+
+func (c *SubstrateClient) GetProviderAddr(pChainAddr string) (addr string, err error) {
+	defer func() { metrics.ObserveChain("get_provider", err) }()
+
+	provision, err := c.getProvision(pChainAddr)
+	if err != nil {
+		return "", err
+	}
+	return string(provision.Address), nil
+}
+
+func (c *SubstrateClient) GetProviderPrice(pChainAddr string) (price uint64, err error) {
+	defer func() { metrics.ObserveChain("get_provider_price", err) }()
+
+	provision, err := c.getProvision(pChainAddr)
+	if err != nil {
+		return 0, err
+	}
+	return provision.StoragePrice.Uint64(), nil
+}
+
+func (c *SubstrateClient) GetProviders() (providers []RegisteredProvider, err error) {
+	defer func() { metrics.ObserveChain("get_providers", err) }()
+
+	api, _, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys of map are the prefix followed by hashed account, concat hashers put the account at the end
+	prefix := append(xxhash.New128([]byte("Market")).Sum(nil), xxhash.New128([]byte("Providers")).Sum(nil)...)
+	var keys []types.StorageKey
+	err = c.call(func() (err error) {
+		keys, err = api.RPC.State.GetKeysLatest(prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	providers = make([]RegisteredProvider, 0, len(keys))
+	for _, key := range keys {
+		if len(key) < len(prefix)+32 {
+			continue
+		}
+
+		provision := provisionScale{}
+		var ok bool
+		err := c.call(func() (err error) {
+			ok, err = api.RPC.State.GetStorageLatest(key, &provision)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		var account [32]byte
+		copy(account[:], key[len(key)-32:])
+		providers = append(providers, RegisteredProvider{
+			Account:      EncodeAddress(account, defaultSs58Prefix),
+			Address:      string(provision.Address),
+			StoragePrice: provision.StoragePrice.Uint64(),
+		})
+	}
+	return providers, nil
+}
+
+func (c *SubstrateClient) getProvision(pChainAddr string) (*provisionScale, error) {
+	publicKey, err := DecodeAddress(pChainAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	provision := &provisionScale{}
+	ok, err := c.getStorage("Providers", publicKey[:], provision, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, NewError(KindNotFound, "Provider '%s' isn't registered", pChainAddr)
+	}
+	return provision, nil
+}
+
+func (c *SubstrateClient) PlaceStorageOrder(provider string, fId string, fSize uint64, duration uint64, amount uint64) (orderId string, err error) {
+	defer func() { metrics.ObserveChain("place_storage_order", err) }()
+
+	if err = c.checkKeypair(); err != nil {
+		return "", err
+	}
+
+	providerKey, err := DecodeAddress(provider)
+	if err != nil {
+		return "", err
+	}
+
+	blocks, err := blocksOf(duration)
+	if err != nil {
+		return "", err
+	}
+
+	meta, err := c.metadata()
+	if err != nil {
+		return "", err
+	}
+
+	fileIdentifier, err := types.HexDecodeString(fId)
+	if err != nil {
+		return "", fmt.Errorf("Wrong file identifier '%s': %s", fId, err)
+	}
+
+	call, err := types.NewCall(meta, "Market.place_storage_order",
+		types.NewAccountID(providerKey[:]),
+		types.NewU128(*new(big.Int).SetUint64(amount)),
+		types.NewBytes(fileIdentifier),
+		types.NewU64(fSize),
+		blocks,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	// Order id is appended to the client's orders, there is no other order of ours in between
+	c.submitLock.Lock()
+	defer c.submitLock.Unlock()
+
+	before := make([]types.Hash, 0)
+	if _, err = c.getStorage("Clients", c.keypair.PublicKey[:], &before, nil); err != nil {
+		return "", err
+	}
+
+	blockHash, err := c.submitLocked(call)
+	if err != nil {
+		return "", err
+	}
+
+	after := make([]types.Hash, 0)
+	if _, err = c.getStorage("Clients", c.keypair.PublicKey[:], &after, &blockHash); err != nil {
+		return "", err
+	}
+	if len(after) <= len(before) {
+		return "", NewError(KindRejected, "Storage order is included in block %s but isn't placed, please check your balance and provider", blockHash.Hex())
+	}
+
+	return after[len(after)-1].Hex(), nil
+}
+
+func (c *SubstrateClient) GetStorageOrder(orderId string) (sOrder FullStorageOrder, err error) {
+	defer func() { metrics.ObserveChain("get_storage_order", err) }()
+
+	order, err := c.getStorageOrder(orderId, nil)
+	if err != nil {
+		return sOrder, err
+	}
+
+	var provider, client [32]byte
+	copy(provider[:], order.Provider[:])
+	copy(client[:], order.Client[:])
+	sOrder = FullStorageOrder{
+		Provider:       EncodeAddress(provider, defaultSs58Prefix),
+		Client:         EncodeAddress(client, defaultSs58Prefix),
+		Amount:         order.Amount.Uint64(),
+		FileIdentifier: types.HexEncodeToString(order.FileIdentifier),
+		FileSize:       uint64(order.FileSize),
+		Duration:       uint64(order.ExpiredOn - order.CreatedOn),
+		CreatedOn:      uint64(order.CreatedOn),
+		ExpiredOn:      uint64(order.ExpiredOn),
+		OrderStatus:    string(order.OrderStatus),
+	}
+	return sOrder, nil
+}
+
+func (c *SubstrateClient) RenewStorageOrder(orderId string, duration uint64, amount uint64) (err error) {
+	defer func() { metrics.ObserveChain("renew_storage_order", err) }()
+
+	if err = c.checkKeypair(); err != nil {
+		return err
+	}
+
+	blocks, err := blocksOf(duration)
+	if err != nil {
+		return err
+	}
+
+	return c.changeStorageOrder(orderId, "Market.renew_storage_order",
+		types.NewU128(*new(big.Int).SetUint64(amount)),
+		blocks,
+	)
+}
+
+// blocksOf converts duration to block number of chain, which is 32 bits
+func blocksOf(duration uint64) (types.U32, error) {
+	if duration > math.MaxUint32 {
+		return 0, NewError(KindRejected, "Duration %d is more than %d blocks chain can take", duration, uint32(math.MaxUint32))
+	}
+	return types.NewU32(uint32(duration)), nil
+}
+
+func (c *SubstrateClient) CancelStorageOrder(orderId string) (err error) {
+	defer func() { metrics.ObserveChain("cancel_storage_order", err) }()
+
+	if err = c.checkKeypair(); err != nil {
+		return err
+	}
+
+	return c.changeStorageOrder(orderId, "Market.cancel_storage_order")
+}
+
+// changeStorageOrder calls method with order id and args, the call takes effect if order's expiry is changed
+func (c *SubstrateClient) changeStorageOrder(orderId string, method string, args ...interface{}) error {
+	orderHash, err := types.NewHashFromHexString(orderId)
+	if err != nil {
+		return fmt.Errorf("Wrong order id '%s': %s", orderId, err)
+	}
+
+	meta, err := c.metadata()
+	if err != nil {
+		return err
+	}
+
+	call, err := types.NewCall(meta, method, append([]interface{}{orderHash}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	c.submitLock.Lock()
+	defer c.submitLock.Unlock()
+
+	before, err := c.getStorageOrder(orderId, nil)
+	if err != nil {
+		return err
+	}
+
+	blockHash, err := c.submitLocked(call)
+	if err != nil {
+		return err
+	}
+
+	after, err := c.getStorageOrder(orderId, &blockHash)
+	if err != nil {
+		return err
+	}
+	if after.ExpiredOn == before.ExpiredOn {
+		return NewError(KindRejected, "'%s' is included in block %s but doesn't take effect, please check your balance and order", method, blockHash.Hex())
+	}
+	return nil
+}
+
+func (c *SubstrateClient) getStorageOrder(orderId string, blockHash *types.Hash) (*storageOrderScale, error) {
+	orderHash, err := types.NewHashFromHexString(orderId)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong order id '%s': %s", orderId, err)
+	}
+
+	order := &storageOrderScale{}
+	ok, err := c.getStorage("StorageOrders", orderHash[:], order, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, NewError(KindNotFound, "Storage order '%s' not found", orderId)
+	}
+	return order, nil
+}
+
+func (c *SubstrateClient) GetProviderOrders(provider string) (orderIds []string, err error) {
+	defer func() { metrics.ObserveChain("get_provider_orders", err) }()
+
+	publicKey, err := DecodeAddress(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unregistered provider has no orders
+	provision := provisionScale{}
+	if _, err = c.getStorage("Providers", publicKey[:], &provision, nil); err != nil {
+		return nil, err
+	}
+
+	orderIds = make([]string, 0)
+	for _, file := range provision.FileMap {
+		for _, orderId := range file.OrderIds {
+			orderIds = append(orderIds, orderId.Hex())
+		}
+	}
+	return orderIds, nil
+}
+
+func (c *SubstrateClient) GetBlockNumber() (number uint64, err error) {
+	defer func() { metrics.ObserveChain("get_block_number", err) }()
+
+	api, _, err := c.conn()
+	if err != nil {
+		return 0, err
+	}
+
+	var header *types.Header
+	err = c.call(func() (err error) {
+		header, err = api.RPC.Chain.GetHeaderLatest()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(header.Number), nil
+}
+
+func (c *SubstrateClient) Ping(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		api, _, err := c.conn()
+		if err == nil {
+			_, err = api.RPC.System.Health()
+			c.check(err)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("Crust node doesn't respond in %s", timeout)
+	}
+}
+
+// substrateConn is a connection to node with what signing needs from it
+type substrateConn struct {
+	api         *gsrpc.SubstrateAPI
+	meta        *types.Metadata
+	genesisHash types.Hash
+	err         error
+}
+
+// conn connects to node and caches metadata. Connecting gives up after timeout and doesn't hold the lock,
+// so an unreachable node doesn't block other calls
+func (c *SubstrateClient) conn() (*gsrpc.SubstrateAPI, *types.Metadata, error) {
+	c.lock.Lock()
+	api, meta := c.api, c.meta
+	c.lock.Unlock()
+	if api != nil {
+		return api, meta, nil
+	}
+
+	done := make(chan *substrateConn, 1)
+	go func() {
+		done <- c.dial()
+	}()
+
+	var conn *substrateConn
+	select {
+	case conn = <-done:
+	case <-time.After(c.timeout):
+		// The dial goes on in background, its connection is closed once it is made
+		go func() {
+			if late := <-done; late.err == nil {
+				closeApi(late.api)
+			}
+		}()
+		return nil, nil, NewError(KindNetwork, "Connect to crust node '%s' doesn't finish in %s", c.url, c.timeout)
+	}
+	if conn.err != nil {
+		return nil, nil, conn.err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.api != nil {
+		// Another call has connected meanwhile
+		closeApi(conn.api)
+		return c.api, c.meta, nil
+	}
+	logger.Info("Connected to crust node '%s'", c.url)
+	c.api = conn.api
+	c.meta = conn.meta
+	c.genesisHash = conn.genesisHash
+	return conn.api, conn.meta, nil
+}
+
+// dial connects to node and reads metadata and genesis hash
+func (c *SubstrateClient) dial() *substrateConn {
+	api, err := gsrpc.NewSubstrateAPI(c.url)
+	if err != nil {
+		return &substrateConn{err: NewError(KindNetwork, "Connect to crust node '%s' failed: %s", c.url, err)}
+	}
+
+	meta, err := api.RPC.State.GetMetadataLatest()
+	if err != nil {
+		closeApi(api)
+		return &substrateConn{err: NewError(KindNetwork, "Get metadata failed: %s", err)}
+	}
+
+	genesisHash, err := api.RPC.Chain.GetBlockHash(0)
+	if err != nil {
+		closeApi(api)
+		return &substrateConn{err: NewError(KindNetwork, "Get genesis hash failed: %s", err)}
+	}
+	return &substrateConn{api: api, meta: meta, genesisHash: genesisHash}
+}
+
+func (c *SubstrateClient) metadata() (*types.Metadata, error) {
+	_, meta, err := c.conn()
+	return meta, err
+}
+
+// check drops connection after rpc error, the next call reconnects
+func (c *SubstrateClient) check(err error) {
+	if err == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.api != nil {
+		closeApi(c.api)
+		c.api = nil
+		c.meta = nil
+	}
+}
+
+// call runs rpc and gives up after timeout, connection is dropped after rpc errors and timeouts
+func (c *SubstrateClient) call(rpc func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- rpc()
+	}()
+
+	select {
+	case err := <-done:
+		c.check(err)
+		return err
+	case <-time.After(c.timeout):
+		err := NewError(KindNetwork, "Crust node doesn't respond in %s", c.timeout)
+		c.check(err)
+		return err
+	}
+}
+
+func closeApi(api *gsrpc.SubstrateAPI) {
+	if closer, ok := api.Client.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+// getStorage reads a map entry of market module, blockHash is nil for the latest block
+func (c *SubstrateClient) getStorage(method string, arg []byte, target interface{}, blockHash *types.Hash) (bool, error) {
+	api, meta, err := c.conn()
+	if err != nil {
+		return false, err
+	}
+
+	key, err := types.CreateStorageKey(meta, "Market", method, arg, nil)
+	if err != nil {
+		return false, err
+	}
+
+	var ok bool
+	err = c.call(func() (err error) {
+		if blockHash == nil {
+			ok, err = api.RPC.State.GetStorageLatest(key, target)
+		} else {
+			ok, err = api.RPC.State.GetStorage(key, target, *blockHash)
+		}
+		return err
+	})
+	return ok, err
+}
+
+// checkKeypair fails write calls early without crust account, keypair is nil if no backup is configured
+func (c *SubstrateClient) checkKeypair() error {
+	if c.keypair == nil {
+		return NewError(KindCredentials, "Crust account isn't configured, can't sign extrinsic")
+	}
+	return nil
+}
+
+func (c *SubstrateClient) submit(call types.Call) (types.Hash, error) {
+	c.submitLock.Lock()
+	defer c.submitLock.Unlock()
+	return c.submitLocked(call)
+}
+
+// submitLocked signs call and waits until it is included in block, it is called with submit lock held
+func (c *SubstrateClient) submitLocked(call types.Call) (types.Hash, error) {
+	if err := c.checkKeypair(); err != nil {
+		return types.Hash{}, err
+	}
+
+	api, _, err := c.conn()
+	if err != nil {
+		return types.Hash{}, err
+	}
+
+	var rv *types.RuntimeVersion
+	if err = c.call(func() (err error) {
+		rv, err = api.RPC.State.GetRuntimeVersionLatest()
+		return err
+	}); err != nil {
+		return types.Hash{}, err
+	}
+
+	var nonce uint32
+	if err = c.call(func() error {
+		return api.Client.Call(&nonce, "system_accountNextIndex", c.keypair.Address)
+	}); err != nil {
+		return types.Hash{}, err
+	}
+
+	c.lock.Lock()
+	genesisHash := c.genesisHash
+	c.lock.Unlock()
+
+	ext := types.NewExtrinsic(call)
+	if err = c.sign(&ext, types.SignatureOptions{
+		Era:                types.ExtrinsicEra{IsImmortalEra: true},
+		Nonce:              types.NewUCompactFromUInt(uint64(nonce)),
+		Tip:                types.NewUCompactFromUInt(0),
+		SpecVersion:        rv.SpecVersion,
+		GenesisHash:        genesisHash,
+		BlockHash:          genesisHash,
+		TransactionVersion: rv.TransactionVersion,
+	}); err != nil {
+		return types.Hash{}, err
+	}
+
+	var sub *author.ExtrinsicStatusSubscription
+	if err = c.call(func() (err error) {
+		sub, err = api.RPC.Author.SubmitAndWatchExtrinsic(ext)
+		return err
+	}); err != nil {
+		return types.Hash{}, err
+	}
+	defer sub.Unsubscribe()
+
+	timeout := time.After(c.timeout)
+	for {
+		select {
+		case status := <-sub.Chan():
+			switch {
+			case status.IsInBlock:
+				logger.Debug("Extrinsic is included in block %s", status.AsInBlock.Hex())
+				return status.AsInBlock, nil
+			case status.IsFinalized:
+				return status.AsFinalized, nil
+			case status.IsDropped, status.IsInvalid, status.IsUsurped:
+				return types.Hash{}, NewError(KindRejected, "Extrinsic is rejected by crust node: %+v", status)
+			}
+		case err := <-sub.Err():
+			c.check(err)
+			return types.Hash{}, NewError(KindNetwork, "Watch extrinsic failed: %s", err)
+		case <-timeout:
+			return types.Hash{}, NewError(KindNetwork, "Extrinsic isn't included in block in %s", c.timeout)
+		}
+	}
+}
+
+// sign is the same as types.Extrinsic.Sign but signs with local keypair instead of subkey command
+func (c *SubstrateClient) sign(ext *types.Extrinsic, o types.SignatureOptions) error {
+	method, err := types.EncodeToBytes(ext.Method)
+	if err != nil {
+		return err
+	}
+
+	payload := types.ExtrinsicPayloadV4{
+		ExtrinsicPayloadV3: types.ExtrinsicPayloadV3{
+			Method:      method,
+			Era:         o.Era,
+			Nonce:       o.Nonce,
+			Tip:         o.Tip,
+			SpecVersion: o.SpecVersion,
+			GenesisHash: o.GenesisHash,
+			BlockHash:   o.BlockHash,
+		},
+		TransactionVersion: o.TransactionVersion,
+	}
+	payloadBytes, err := types.EncodeToBytes(payload)
+	if err != nil {
+		return err
+	}
+
+	// Substrate signs the hash of payload longer than 256 bytes
+	if len(payloadBytes) > 256 {
+		hash := blake2b.Sum256(payloadBytes)
+		payloadBytes = hash[:]
+	}
+
+	sig, err := c.keypair.Sign(payloadBytes)
+	if err != nil {
+		return err
+	}
+
+	ext.Signature = types.ExtrinsicSignatureV4{
+		Signer:    types.NewAddressFromAccountID(c.keypair.PublicKey[:]),
+		Signature: types.MultiSignature{IsSr25519: true, AsSr25519: types.NewSignature(sig)},
+		Era:       o.Era,
+		Nonce:     o.Nonce,
+		Tip:       o.Tip,
+	}
+	ext.Version |= types.ExtrinsicBitSigned
+	return nil
+}
@@ -0,0 +1,132 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/centrifuge/go-substrate-rpc-client/v2/types"
+)
+
+func TestDecodeStorageOrder(t *testing.T) {
+	encoded := strings.Join([]string{
+		"10aabbccdd",                       // file identifier, compact length 4
+		"0000300000000000",                 // file size 3MB
+		"64000000",                         // created on 100
+		"a4010000",                         // expired on 420
+		alicePublicKey,                     // provider
+		bobPublicKey,                       // client
+		"e8030000000000000000000000000000", // amount 1000
+		"02",                               // pending
+	}, "")
+
+	order := storageOrderScale{}
+	if err := types.DecodeFromBytes(mustHex(t, encoded), &order); err != nil {
+		t.Fatalf("Decode storage order: %s", err)
+	}
+	if hex.EncodeToString(order.FileIdentifier) != "aabbccdd" || order.FileSize != 3*1024*1024 || order.CreatedOn != 100 || order.ExpiredOn != 420 {
+		t.Errorf("Storage order is %+v", order)
+	}
+	if hex.EncodeToString(order.Provider[:]) != alicePublicKey || hex.EncodeToString(order.Client[:]) != bobPublicKey {
+		t.Errorf("Provider is %x and client is %x", order.Provider, order.Client)
+	}
+	if order.Amount.Uint64() != 1000 || order.OrderStatus != "Pending" {
+		t.Errorf("Amount is %s and status is %s", order.Amount.String(), order.OrderStatus)
+	}
+
+	reencoded, err := types.EncodeToBytes(order)
+	if err != nil || hex.EncodeToString(reencoded) != encoded {
+		t.Errorf("Storage order is encoded as %x (%v), want %s", reencoded, err, encoded)
+	}
+
+	if err := types.DecodeFromBytes(mustHex(t, encoded[:len(encoded)-2]+"03"), &order); err == nil {
+		t.Error("Unknown order status is decoded")
+	}
+}
+
+func TestDecodeProvision(t *testing.T) {
+	orderId := bytes.Repeat([]byte{0x11}, 32)
+	encoded := "18" + hex.EncodeToString([]byte("ws://a")) + // address, compact length 6
+		"03000000000000000000000000000000" + // storage price 3
+		"04" + "08aabb" + "04" + hex.EncodeToString(orderId) // one file with one order
+
+	provision := provisionScale{}
+	if err := types.DecodeFromBytes(mustHex(t, encoded), &provision); err != nil {
+		t.Fatalf("Decode provision: %s", err)
+	}
+	if string(provision.Address) != "ws://a" || provision.StoragePrice.Uint64() != 3 {
+		t.Errorf("Provision is %s at price %s", provision.Address, provision.StoragePrice.String())
+	}
+	if len(provision.FileMap) != 1 || hex.EncodeToString(provision.FileMap[0].FileIdentifier) != "aabb" ||
+		len(provision.FileMap[0].OrderIds) != 1 || !bytes.Equal(provision.FileMap[0].OrderIds[0][:], orderId) {
+		t.Errorf("File map is %+v", provision.FileMap)
+	}
+}
+
+func TestBlocksOf(t *testing.T) {
+	if blocks, err := blocksOf(math.MaxUint32); err != nil || blocks != math.MaxUint32 {
+		t.Errorf("Blocks of max duration are %d (%v)", blocks, err)
+	}
+	if _, err := blocksOf(math.MaxUint32 + 1); KindOf(err) != KindRejected {
+		t.Errorf("Duration beyond 32 bits: got %v, want rejected", err)
+	}
+}
+
+func TestSubstrateUnreachableNode(t *testing.T) {
+	// Node accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	var lock sync.Mutex
+	conns := make([]net.Conn, 0)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+		}
+	}()
+	defer func() {
+		listener.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	client, err := NewSubstrateClient("ws://"+listener.Addr().String(), "", "", 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Create client: %s", err)
+	}
+
+	// Calls don't wait for each other's connection
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetBlockNumber(); !IsTransient(err) {
+				t.Errorf("Call to unreachable node: got %v, want network error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := client.Ping(time.Second); err == nil {
+		t.Error("Unreachable node is pinged")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Calls to unreachable node take %s", elapsed)
+	}
+}
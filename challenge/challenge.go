@@ -0,0 +1,224 @@
+package challenge
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"karst/fs"
+	"karst/merkletree"
+	"karst/model"
+	"karst/util"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Path is where karst answers challenges
+const Path = "/api/v0/challenge"
+
+// Limits of a challenge, they bound the work of answering it
+const (
+	MaxIndices   = 64
+	MaxNonceSize = 64
+)
+
+// Challenge asks provider to prove it holds parts at indices of the file of root hash
+type Challenge struct {
+	Root    string   `json:"root"`
+	Indices []uint64 `json:"indices"`
+	Nonce   string   `json:"nonce"`
+}
+
+// Answer is sha256(nonce || part) in hex with the inclusion proof of part
+type Answer struct {
+	Response string            `json:"response"`
+	Proof    *merkletree.Proof `json:"proof"`
+}
+
+type Response struct {
+	Root    string   `json:"root"`
+	Nonce   string   `json:"nonce"`
+	Answers []Answer `json:"answers"`
+}
+
+// PartReader reads the data of part at index, node is the part in merkle tree
+type PartReader func(index int, node *merkletree.MerkleTreeNode) ([]byte, error)
+
+var ErrNotFound = errors.New("File is not found")
+
+// ErrUnverified is returned when only merkle proofs are checked, they can be built from merkle tree without parts
+var ErrUnverified = errors.New("Responses aren't checked without parts in this karst")
+
+// New challenges count random parts of tree with a random nonce
+func New(tree *merkletree.MerkleTreeNode, count int) (*Challenge, error) {
+	if count <= 0 || count > MaxIndices {
+		return nil, fmt.Errorf("Count of parts should be in 1 to %d", MaxIndices)
+	}
+	if count > len(tree.Links) {
+		count = len(tree.Links)
+	}
+
+	// Pick distinct indices by partial shuffle
+	indices := make([]uint64, len(tree.Links))
+	for i := range indices {
+		indices[i] = uint64(i)
+	}
+	for i := 0; i < count; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(len(indices)-i)))
+		if err != nil {
+			return nil, err
+		}
+		k := i + int(j.Int64())
+		indices[i], indices[k] = indices[k], indices[i]
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &Challenge{
+		Root:    tree.Hash,
+		Indices: indices[:count],
+		Nonce:   hex.EncodeToString(nonce),
+	}, nil
+}
+
+// Check checks challenge from others
+func (c *Challenge) Check() error {
+	if c.Root == "" {
+		return errors.New("Root hash is needed")
+	}
+	if len(c.Indices) == 0 || len(c.Indices) > MaxIndices {
+		return fmt.Errorf("Count of indices should be in 1 to %d", MaxIndices)
+	}
+	nonce, err := hex.DecodeString(c.Nonce)
+	if err != nil || len(nonce) == 0 || len(nonce) > MaxNonceSize {
+		return fmt.Errorf("Nonce should be hex of 1 to %d bytes", MaxNonceSize)
+	}
+	return nil
+}
+
+// Respond answers challenge with parts of tree read by read
+func Respond(c *Challenge, tree *merkletree.MerkleTreeNode, read PartReader) (*Response, error) {
+	nonce, _ := hex.DecodeString(c.Nonce)
+	answers := make([]Answer, 0, len(c.Indices))
+	for _, index := range c.Indices {
+		proof, err := tree.Proof(index)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := read(int(index), &tree.Links[index])
+		if err != nil {
+			return nil, err
+		}
+		if responseOf(nil, data) != proof.Hash {
+			return nil, fmt.Errorf("Part %d of '%s' is broken", index, tree.Hash)
+		}
+
+		answers = append(answers, Answer{
+			Response: responseOf(nonce, data),
+			Proof:    proof,
+		})
+	}
+
+	return &Response{
+		Root:    c.Root,
+		Nonce:   c.Nonce,
+		Answers: answers,
+	}, nil
+}
+
+// Verify checks response against challenge and tree of verifier, ErrUnverified (or an error wrapping it) is returned
+// if proofs are right but parts can't be read, since proofs can be built from merkle tree without parts
+func Verify(c *Challenge, tree *merkletree.MerkleTreeNode, r *Response, read PartReader) error {
+	if r.Root != c.Root || r.Nonce != c.Nonce {
+		return errors.New("Response isn't for the challenge")
+	}
+	if len(r.Answers) != len(c.Indices) {
+		return fmt.Errorf("%d parts are challenged, but %d are answered", len(c.Indices), len(r.Answers))
+	}
+
+	nonce, _ := hex.DecodeString(c.Nonce)
+	for i, answer := range r.Answers {
+		index := c.Indices[i]
+		if answer.Proof == nil || answer.Proof.Index != index {
+			return fmt.Errorf("Part %d isn't answered", index)
+		}
+		if root, err := answer.Proof.Root(); err != nil || root != tree.Hash {
+			return fmt.Errorf("Proof of part %d doesn't lead to root '%s'", index, tree.Hash)
+		}
+		if index >= uint64(len(tree.Links)) || answer.Proof.Hash != tree.Links[index].Hash {
+			return fmt.Errorf("Part %d isn't the one in merkle tree", index)
+		}
+
+		if read == nil {
+			continue
+		}
+		data, err := read(int(index), &tree.Links[index])
+		if err != nil {
+			return fmt.Errorf("%w, part %d can't be read: %s", ErrUnverified, index, err)
+		}
+		if answer.Response != responseOf(nonce, data) {
+			return fmt.Errorf("Response of part %d is wrong", index)
+		}
+	}
+
+	if read == nil {
+		return ErrUnverified
+	}
+	return nil
+}
+
+func responseOf(nonce []byte, data []byte) string {
+	hash := sha256.New()
+	hash.Write(nonce)
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// LocalParts finds the file of hash in this karst: sealed parts in fs, or parts split into files directory.
+// The returned reader uses temporary files for parts in fs
+func LocalParts(hash string, db *leveldb.DB, fs fs.FsInterface, karstPaths *util.KarstPaths) (*merkletree.MerkleTreeNode, PartReader, error) {
+	fileInfo := model.GetFileInfoFromDb(hash, db)
+	if fileInfo != nil && fileInfo.MerkleTreeSealed != nil && fileInfo.MerkleTreeSealed.Hash == hash {
+		if len(fileInfo.StoredKeys) != len(fileInfo.MerkleTreeSealed.Links) {
+			return nil, nil, fmt.Errorf("There are %d sealed parts in fs, but %d in sealed merkle tree", len(fileInfo.StoredKeys), len(fileInfo.MerkleTreeSealed.Links))
+		}
+		return fileInfo.MerkleTreeSealed, func(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+			partPath := filepath.FromSlash(karstPaths.TempFilesPath + "/" + node.Hash + "_" + strconv.FormatInt(time.Now().UnixNano(), 10))
+			defer os.Remove(partPath)
+			if err := fs.Get(fileInfo.StoredKeys[index], partPath); err != nil {
+				return nil, fmt.Errorf("Get sealed part '%s' from fs failed: %s", fileInfo.StoredKeys[index], err)
+			}
+			return ioutil.ReadFile(partPath)
+		}, nil
+	}
+
+	partsPath := filepath.FromSlash(karstPaths.FilesPath + "/" + hash)
+	if fileInfo != nil && fileInfo.MerkleTree != nil && fileInfo.MerkleTree.Hash == hash && fileInfo.StoredPath != "" {
+		partsPath = fileInfo.StoredPath
+	}
+	if !util.IsDirOrFileExist(partsPath) {
+		return nil, nil, ErrNotFound
+	}
+
+	tree, err := merkletree.CreateMerkleTreeFromDir(partsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tree.Hash != hash {
+		return nil, nil, fmt.Errorf("Parts in '%s' are of '%s'", partsPath, tree.Hash)
+	}
+	return tree, func(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+		return ioutil.ReadFile(filepath.FromSlash(partsPath + "/" + strconv.Itoa(index) + "_" + node.Hash))
+	}, nil
+}
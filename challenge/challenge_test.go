@@ -0,0 +1,165 @@
+package challenge
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"karst/merkletree"
+	"strings"
+	"testing"
+)
+
+// testFile gives parts and their merkle tree
+func testFile(parts int) ([][]byte, *merkletree.MerkleTreeNode) {
+	data := make([][]byte, 0, parts)
+	hashs := make([][]byte, 0, parts)
+	sizes := make([]uint64, 0, parts)
+	for i := 0; i < parts; i++ {
+		part := []byte(fmt.Sprintf("part %d of file", i))
+		hash := sha256.Sum256(part)
+		data = append(data, part)
+		hashs = append(hashs, hash[:])
+		sizes = append(sizes, uint64(len(part)))
+	}
+	return data, merkletree.CreateMerkleTree(hashs, sizes)
+}
+
+func readerOf(data [][]byte) PartReader {
+	return func(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+		return data[index], nil
+	}
+}
+
+func TestProof(t *testing.T) {
+	_, tree := testFile(5)
+	for index := range tree.Links {
+		proof, err := tree.Proof(uint64(index))
+		if err != nil {
+			t.Fatalf("Proof of part %d: %s", index, err)
+		}
+		if proof.Hash != tree.Links[index].Hash || proof.Size != tree.Links[index].Size || len(proof.Siblings) != 4 {
+			t.Errorf("Proof of part %d is %+v", index, proof)
+		}
+		if root, err := proof.Root(); err != nil || root != tree.Hash {
+			t.Errorf("Proof of part %d leads to '%s' (%v), want '%s'", index, root, err, tree.Hash)
+		}
+	}
+
+	// Proof of single part file has no siblings
+	_, single := testFile(1)
+	if proof, err := single.Proof(0); err != nil || len(proof.Siblings) != 0 {
+		t.Errorf("Proof of single part is %+v (%v)", proof, err)
+	} else if root, _ := proof.Root(); root != single.Hash {
+		t.Errorf("Proof of single part leads to '%s', want '%s'", root, single.Hash)
+	}
+
+	if _, err := tree.Proof(5); err == nil {
+		t.Error("Proof of part out of tree is given")
+	}
+	proof, _ := tree.Proof(2)
+	proof.Index = 3
+	if root, _ := proof.Root(); root == tree.Hash {
+		t.Error("Proof with moved index leads to root")
+	}
+	proof.Index = 6
+	if _, err := proof.Root(); err == nil {
+		t.Error("Proof with index out of siblings leads to root")
+	}
+	proof, _ = tree.Proof(2)
+	proof.Siblings[0] = "zz"
+	if _, err := proof.Root(); err == nil {
+		t.Error("Proof with wrong sibling hash leads to root")
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, tree := testFile(10)
+	c, err := New(tree, 4)
+	if err != nil {
+		t.Fatalf("New challenge: %s", err)
+	}
+	if c.Root != tree.Hash || len(c.Indices) != 4 || c.Check() != nil {
+		t.Fatalf("Challenge is %+v", c)
+	}
+	seen := make(map[uint64]bool)
+	for _, index := range c.Indices {
+		if index >= 10 || seen[index] {
+			t.Errorf("Indices are %v", c.Indices)
+		}
+		seen[index] = true
+	}
+
+	// Count is limited by parts
+	if c, err := New(tree, MaxIndices); err != nil || len(c.Indices) != 10 {
+		t.Errorf("Challenge of all parts is %+v (%v)", c, err)
+	}
+	if _, err := New(tree, MaxIndices+1); err == nil {
+		t.Error("Challenge beyond max indices is made")
+	}
+
+	bad := []*Challenge{
+		{Indices: []uint64{0}, Nonce: "aa"},
+		{Root: tree.Hash, Nonce: "aa"},
+		{Root: tree.Hash, Indices: []uint64{0}, Nonce: "xyz"},
+		{Root: tree.Hash, Indices: []uint64{0}, Nonce: strings.Repeat("aa", MaxNonceSize+1)},
+	}
+	for _, c := range bad {
+		if err := c.Check(); err == nil {
+			t.Errorf("Challenge %+v is accepted", c)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	data, tree := testFile(6)
+	c := &Challenge{Root: tree.Hash, Indices: []uint64{4, 1}, Nonce: "0102"}
+	r, err := Respond(c, tree, readerOf(data))
+	if err != nil {
+		t.Fatalf("Respond: %s", err)
+	}
+	if err := Verify(c, tree, r, readerOf(data)); err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	// Proofs alone can be built from merkle tree
+	if err := Verify(c, tree, r, nil); err != ErrUnverified {
+		t.Errorf("Verify without parts: got %v, want %v", err, ErrUnverified)
+	}
+	if err := Verify(c, tree, r, func(int, *merkletree.MerkleTreeNode) ([]byte, error) {
+		return nil, errors.New("gone")
+	}); !errors.Is(err, ErrUnverified) {
+		t.Errorf("Verify with unreadable parts: got %v, want %v", err, ErrUnverified)
+	}
+
+	// Response of another nonce
+	other := &Challenge{Root: tree.Hash, Indices: []uint64{4, 1}, Nonce: "0103"}
+	if otherR, _ := Respond(other, tree, readerOf(data)); Verify(c, tree, otherR, readerOf(data)) == nil {
+		t.Error("Response of another nonce is verified")
+	}
+
+	tamper := func(name string, change func(r *Response)) {
+		tampered, _ := Respond(c, tree, readerOf(data))
+		change(tampered)
+		if err := Verify(c, tree, tampered, readerOf(data)); err == nil {
+			t.Errorf("%s is verified", name)
+		}
+	}
+	tamper("Wrong response", func(r *Response) { r.Answers[0].Response = r.Answers[1].Response })
+	tamper("Missing answer", func(r *Response) { r.Answers = r.Answers[:1] })
+	tamper("Answers out of order", func(r *Response) { r.Answers[0], r.Answers[1] = r.Answers[1], r.Answers[0] })
+	tamper("Answer without proof", func(r *Response) { r.Answers[1].Proof = nil })
+	tamper("Proof of another part", func(r *Response) {
+		r.Answers[0].Proof.Hash, r.Answers[0].Proof.Siblings[0] = r.Answers[0].Proof.Siblings[0], r.Answers[0].Proof.Hash
+	})
+	tamper("Proof of another tree", func(r *Response) {
+		_, otherTree := testFile(7)
+		r.Answers[0].Proof, _ = otherTree.Proof(4)
+	})
+	tamper("Response of another root", func(r *Response) { r.Root = "aa" })
+
+	// Provider doesn't answer with broken part
+	broken := append([][]byte{}, data...)
+	broken[1] = []byte("broken")
+	if _, err := Respond(c, tree, readerOf(broken)); err == nil {
+		t.Error("Broken part is answered")
+	}
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"karst/capacity"
+	"karst/logger"
+	"karst/order"
+	"karst/wscmd"
+
+	"github.com/spf13/cobra"
+)
+
+type CapacityData struct {
+	Report *capacity.Report `json:"report"`
+}
+
+func init() {
+	capacityWsCmd.ConnectCmdAndWs()
+	rootCmd.AddCommand(capacityWsCmd.Cmd)
+}
+
+var capacityWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "capacity",
+		Short: "Show used and available capacity",
+		Long:  "Show 'capacity.total' and 'capacity.reserved', bytes used by every file on disk and in fastdfs, and bytes committed by storage orders whose files aren't stored yet",
+	},
+	Request: struct{}{},
+	Data:    CapacityData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return nil, nil
+	},
+	WsEndpoint: "capacity",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		report, err := capacity.New(wsc.Db, wsc.Cfg, order.Usage).Report()
+		if err != nil {
+			logger.Error("Get capacity failed: %s", err)
+			return wscmd.Failure(err)
+		}
+
+		info := fmt.Sprintf("Used %d bytes of %d files, %d bytes are committed by storage orders, capacity isn't limited", report.Used, len(report.Files), report.Committed)
+		if report.Total != 0 {
+			info = fmt.Sprintf("Used %d bytes of %d files, %d bytes are committed by storage orders, %d bytes are available with %d of %d bytes reserved", report.Used, len(report.Files), report.Committed, report.Available, report.Reserved, report.Total)
+		}
+		return wscmd.Success(info, CapacityData{
+			Report: report,
+		})
+	},
+}
+
+// capacityError turns rejection of incoming files into insufficient storage
+func capacityError(err error) error {
+	if quotaErr, ok := err.(*capacity.QuotaError); ok {
+		return wscmd.NewError(wscmd.CodeInsufficient, "Capacity is exceeded: %s", quotaErr)
+	}
+	return err
+}
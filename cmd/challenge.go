@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"karst/challenge"
+	"karst/logger"
+	"karst/merkletree"
+	"karst/metrics"
+	"karst/model"
+	"karst/provider"
+	"karst/wscmd"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Time to wait for provider to answer a challenge, it reads challenged parts from its storage
+const challengeTimeout = 60 * time.Second
+
+type ChallengeRequest struct {
+	Provider string `json:"provider" validate:"required" desc:"Crust account or karst address like 'ws://127.0.0.1:17000' of provider"`
+	FileHash string `json:"file_hash" validate:"required" desc:"Hash or sealed hash of the file to challenge"`
+	Count    int    `json:"count" desc:"Number of random parts to challenge, 4 by default"`
+}
+
+type ChallengeData struct {
+	Address string   `json:"address"`
+	Root    string   `json:"root"`
+	Indices []uint64 `json:"indices"`
+	Passed  bool     `json:"passed"`
+	// Only merkle proofs are checked, passed is false
+	Unverified bool   `json:"unverified,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+func (req *ChallengeRequest) Validate() error {
+	if req.Count == 0 {
+		req.Count = 4
+	}
+	if req.Count < 0 || req.Count > challenge.MaxIndices {
+		return fmt.Errorf("Count of parts should be in 1 to %d", challenge.MaxIndices)
+	}
+	return nil
+}
+
+func init() {
+	challengeWsCmd.ConnectCmdAndWs()
+	challengeWsCmd.Cmd.Flags().Int("count", 4, "number of random parts to challenge")
+	rootCmd.AddCommand(challengeWsCmd.Cmd)
+}
+
+var challengeWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "challenge [provider] [file_hash]",
+		Short: "Challenge provider to prove it holds file",
+		Long:  "Challenge random parts of file with a random nonce, provider answers sha256(nonce || part) with merkle proofs which are checked against the merkle tree in this karst",
+		Args:  cobra.MinimumNArgs(2),
+	},
+	Request: ChallengeRequest{},
+	Data:    ChallengeData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		count, _ := cmd.Flags().GetInt("count")
+		return ChallengeRequest{
+			Provider: args[0],
+			FileHash: args[1],
+			Count:    count,
+		}, nil
+	},
+	WsEndpoint: "challenge",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*ChallengeRequest)
+
+		// Merkle tree is needed, responses are also checked if parts are here
+		tree, read, localErr := challenge.LocalParts(req.FileHash, wsc.Db, wsc.Fs, wsc.Cfg.KarstPaths)
+		if localErr != nil {
+			read = nil
+			tree = knownMerkleTree(req.FileHash, wsc)
+		}
+		if tree == nil {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeNotFound, "Merkle tree of '%s' is not found", req.FileHash))
+		}
+
+		var err error
+		address := req.Provider
+		if !strings.Contains(address, "://") {
+			if address, err = wsc.Chain.GetProviderAddr(req.Provider); err != nil {
+				logger.Error("Get karst address of provider '%s' failed: %s", req.Provider, err)
+				return chainFailure(err)
+			}
+		}
+		challengeUrl, err := provider.ApiUrl(address, challenge.Path)
+		if err != nil {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeInvalidArgument, "%s", err))
+		}
+
+		c, err := challenge.New(tree, req.Count)
+		if err != nil {
+			return wscmd.Failure(err)
+		}
+		data := ChallengeData{
+			Address: address,
+			Root:    c.Root,
+			Indices: c.Indices,
+		}
+
+		response, reason, err := sendChallenge(challengeUrl, c)
+		if err != nil {
+			logger.Error("Challenge '%s' failed: %s", address, err)
+			metrics.ChallengesVerified.WithLabelValues("error").Inc()
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeUnavailable, "Challenge '%s' failed: %s", address, err))
+		}
+		if response != nil {
+			err = challenge.Verify(c, tree, response, read)
+			if errors.Is(err, challenge.ErrUnverified) {
+				reason = err.Error()
+				if localErr != nil {
+					reason = fmt.Sprintf("%s, parts can't be read: %s", err, localErr)
+				}
+				logger.Warn("Challenge of '%s' to provider '%s' is unverified: %s", c.Root, address, reason)
+				metrics.ChallengesVerified.WithLabelValues("unverified").Inc()
+				data.Unverified = true
+				data.Reason = reason
+				return wscmd.Success(fmt.Sprintf("Answers of provider '%s' to the challenge of %d parts are unverified: %s", address, len(c.Indices), reason), data)
+			} else if err != nil {
+				reason = err.Error()
+			}
+		}
+
+		if reason != "" {
+			logger.Warn("Provider '%s' fails the challenge of '%s': %s", address, c.Root, reason)
+			metrics.ChallengesVerified.WithLabelValues("failed").Inc()
+			data.Reason = reason
+			return wscmd.Success(fmt.Sprintf("Provider '%s' fails the challenge of %d parts: %s", address, len(c.Indices), reason), data)
+		}
+
+		metrics.ChallengesVerified.WithLabelValues("passed").Inc()
+		data.Passed = true
+		return wscmd.Success(fmt.Sprintf("Provider '%s' passes the challenge of %d parts", address, len(c.Indices)), data)
+	},
+}
+
+// sendChallenge posts challenge to provider, a refused challenge returns the reason instead of response
+func sendChallenge(challengeUrl string, c *challenge.Challenge) (*challenge.Response, string, error) {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	httpClient := &http.Client{Timeout: challengeTimeout}
+	resp, err := httpClient.Post(challengeUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		failure := struct {
+			Info string `json:"info"`
+		}{}
+		_ = json.NewDecoder(resp.Body).Decode(&failure)
+		return nil, fmt.Sprintf("Provider returns %d: %s", resp.StatusCode, failure.Info), nil
+	}
+
+	response := &challenge.Response{}
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return nil, fmt.Sprintf("Wrong response: %s", err), nil
+	}
+	return response, "", nil
+}
+
+// knownMerkleTree gets merkle tree of hash from leveldb, it is nil if hash is unknown
+func knownMerkleTree(hash string, wsc *wscmd.WsCmd) *merkletree.MerkleTreeNode {
+	fileInfo := model.GetFileInfoFromDb(hash, wsc.Db)
+	if fileInfo == nil {
+		return nil
+	}
+	if fileInfo.MerkleTreeSealed != nil && fileInfo.MerkleTreeSealed.Hash == hash {
+		return fileInfo.MerkleTreeSealed
+	}
+	if fileInfo.MerkleTree != nil && fileInfo.MerkleTree.Hash == hash {
+		return fileInfo.MerkleTree
+	}
+	return nil
+}
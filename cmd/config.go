@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"karst/config"
+	"karst/logger"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage karst configuration",
+	Long:  "Show, set and validate karst configuration, values of config file are overridden by KARST_* environment variables and flags, like KARST_CRUST_BASE_URL or --crust-base-url for 'crust.base_url'",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show configuration",
+	Long:  "Show configuration in effect, secrets are masked unless --secrets is given",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, _, err := config.Inspect()
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(-1)
+		}
+
+		showSecrets, _ := cmd.Flags().GetBool("secrets")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE")
+		for _, item := range cfg.Items(showSecrets) {
+			fmt.Fprintf(w, "%s\t%s\n", item.Key, item.Value)
+		}
+		w.Flush()
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set [key] [value]",
+	Short: "Set a key in config file",
+	Long:  "Set a key like 'crust.base_url' in config file, lists are separated by commas and 'log.levels' is a json object, send SIGHUP to running daemon to reload it",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := config.Set(args[0], args[1]); err != nil {
+			logger.Error("%s", err)
+			os.Exit(-1)
+		}
+
+		logger.Info("Set '%s' successfully", args[0])
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate configuration",
+	Long:  "Validate configuration in effect, exit with non-zero code if there are errors",
+	Run: func(cmd *cobra.Command, args []string) {
+		_, validation, err := config.Inspect()
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(-1)
+		}
+
+		for _, warning := range validation.Warnings {
+			fmt.Printf("WARN  %s\n", warning)
+		}
+		for _, e := range validation.Errors {
+			fmt.Printf("ERROR %s\n", e)
+		}
+
+		if len(validation.Errors) != 0 {
+			os.Exit(-1)
+		}
+		fmt.Println("Configuration is valid")
+	},
+}
+
+func init() {
+	configShowCmd.Flags().Bool("secrets", false, "show crust backup and password")
+	configCmd.AddCommand(configShowCmd, configSetCmd, configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
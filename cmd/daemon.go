@@ -1,12 +1,21 @@
 package cmd
 
 import (
+	"context"
+	"karst/chain"
 	"karst/config"
 	"karst/fs"
+	"karst/job"
 	"karst/logger"
+	"karst/order"
+	"karst/scrub"
+	"karst/tee"
 	"karst/ws"
 	"karst/wscmd"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -22,41 +31,187 @@ var daemonCmd = &cobra.Command{
 	Long:  "Start karst service, it will use '$HOME/.karst' to run krast by default, set KARST_PATH to change execution space",
 	Run: func(cmd *cobra.Command, args []string) {
 		// Configuation
-		cfg := config.GetInstance()
+		cfg, err := config.GetInstance()
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(-1)
+		}
 		cfg.Show()
 
+		// Crust account
+		if err := cfg.UnlockAccount(); err != nil {
+			logger.Error("Fatal error in unlocking keystore: %s", err)
+			os.Exit(-1)
+		}
+
+		// Chain
+		chainClient, err := chain.NewClient(cfg)
+		if err != nil {
+			logger.Error("Fatal error in creating crust chain client: %s", err)
+			os.Exit(-1)
+		}
+
 		// DB
 		db, err := leveldb.OpenFile(cfg.KarstPaths.DbPath, nil)
 		if err != nil {
 			logger.Error("Fatal error in opening leveldb: %s", err)
 			os.Exit(-1)
 		}
-		defer db.Close()
 
 		// FS
 		// TODO: Support mulitable file system
 		fs, err := fs.OpenFastdfs(cfg)
 		if err != nil {
 			logger.Error("Fatal error in opening fastdfs: %s", err)
+			db.Close()
 			os.Exit(-1)
 		}
-		defer fs.Close()
+
+		// TEE, its sessions are shared by commands and storage orders
+		teeClient, err := tee.NewTee(cfg.TeeBaseUrl, cfg.Crust.Backup, cfg.Tee.Timeout, cfg.Tee.MaxSeals)
+		if err != nil {
+			logger.Warn("TEE isn't configured, seal and unseal are unavailable")
+			teeClient = nil
+		}
+
+		// Job queue
+		jobs := job.NewQueue(db, cfg.Job.MaxConcurrency, cfg.Job.Retention)
 
 		// Register cmd apis
 		var wsCommands = []*wscmd.WsCmd{
 			registerWsCmd,
 			splitWsCmd,
+			jobListWsCmd,
+			jobStatusWsCmd,
+			jobCancelWsCmd,
+			ordersWsCmd,
+			orderQuoteWsCmd,
+			orderPlaceWsCmd,
+			orderRenewWsCmd,
+			orderCancelWsCmd,
+			providersWsCmd,
+			sealWsCmd,
+			retrieveWsCmd,
+			challengeWsCmd,
+			scrubWsCmd,
+			scrubStatusWsCmd,
+			gcWsCmd,
+			deleteWsCmd,
+			capacityWsCmd,
 		}
 
 		for _, wsCmd := range wsCommands {
-			wsCmd.Register(db, fs, cfg)
+			wsCmd.Register(db, fs, chainClient, teeClient, cfg, jobs)
 		}
 
-		// Start websocket service
-		if err := ws.StartServer(db, cfg); err != nil {
-			logger.Error("%s", err)
+		wscmd.HandleOpenApi(version)
+
+		// Cli authenticates with api token instead of crust account
+		if err := wscmd.NewApiToken(cfg.KarstPaths.ApiTokenPath); err != nil {
+			logger.Error("Fatal error in creating api token: %s", err)
+			fs.Close()
+			db.Close()
+			os.Exit(-1)
+		}
+
+		// Start services
+		exitCode := 0
+		serveErr, err := ws.StartServer(db, fs, chainClient, cfg)
+		if err != nil {
+			logger.Error("Fatal error in starting ws: %s", err)
+			fs.Close()
+			db.Close()
+			os.Exit(-1)
+		}
+
+		// Storage orders to this provider
+		var watcher *order.Watcher
+		if cfg.Crust.Address != "" && (cfg.Crust.BaseUrl != "" || cfg.Crust.Backend == chain.BackendMock) {
+			watcher = order.NewWatcher(db, fs, chainClient, teeClient, cfg)
+			watcher.Start()
+		} else {
+			logger.Warn("Crust isn't configured, storage orders won't be watched")
+		}
+
+		// Integrity of stored parts
+		scrubber := scrub.New(db, fs, teeClient, cfg)
+		scrubber.Start()
+
+		if err := jobs.Start(); err != nil {
+			logger.Error("Fatal error in starting job queue: %s", err)
+			exitCode = -1
 		} else {
 			logger.Info("Karst daemon successfully!")
+
+			// Wait for signal, SIGHUP reloads configuration
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		wait:
+			for {
+				select {
+				case sig := <-signals:
+					if sig == syscall.SIGHUP {
+						reload(cfg, jobs)
+						continue
+					}
+					logger.Info("Receive signal '%s', shutting down in %s...", sig, cfg.GetShutdownTimeout())
+					break wait
+				case err := <-serveErr:
+					logger.Error("Fatal error in serving ws: %s", err)
+					exitCode = -1
+					break wait
+				}
+			}
+			signal.Stop(signals)
+		}
+
+		// Shutdown, stop accepting new requests first then drain the running ones
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.GetShutdownTimeout())
+
+		if err := ws.Shutdown(ctx); err != nil {
+			logger.Warn("Unfinished requests are dropped: %s", err)
+		}
+
+		if err := jobs.Stop(ctx); err != nil {
+			logger.Warn("Running jobs are interrupted, they will be rerun in next start: %s", err)
 		}
+
+		if watcher != nil {
+			if err := watcher.Stop(ctx); err != nil {
+				logger.Warn("Storage order sync is interrupted: %s", err)
+			}
+		}
+
+		if err := scrubber.Stop(ctx); err != nil {
+			logger.Warn("Scrubbing is interrupted: %s", err)
+		}
+		cancel()
+
+		if teeClient != nil {
+			teeClient.Close()
+		}
+		fs.Close()
+		if err := db.Close(); err != nil {
+			logger.Error("Close leveldb failed: %s", err)
+			exitCode = -1
+		}
+
+		logger.Info("Karst daemon is stopped")
+		os.Exit(exitCode)
 	},
 }
+
+// reload applies log levels, job concurrency and shutdown timeout, other settings need restart
+func reload(cfg *config.Configuration, jobs *job.Queue) {
+	unapplied, err := cfg.Reload()
+	if err != nil {
+		logger.Error("Reload configuration failed, keep the current one: %s", err)
+		return
+	}
+
+	jobs.SetMaxConcurrency(cfg.GetJobMaxConcurrency())
+	logger.Info("Configuration is reloaded")
+	if len(unapplied) != 0 {
+		logger.Warn("Restart karst daemon to apply: %s", strings.Join(unapplied, ", "))
+	}
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"karst/logger"
+	"karst/merkletree"
+	"karst/model"
+	"karst/order"
+	"karst/store"
+	"karst/util"
+	"karst/wscmd"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type DeleteRequest struct {
+	FileHash string `json:"file_hash" validate:"required" desc:"Hash or sealed hash of the file to delete"`
+	Force    bool   `json:"force" desc:"Delete even if active storage orders reference the file"`
+}
+
+type DeleteData struct {
+	FileHash   string `json:"file_hash"`
+	SealedHash string `json:"sealed_hash,omitempty"`
+}
+
+func (req *DeleteRequest) Validate() error {
+	if hashBytes, err := hex.DecodeString(req.FileHash); err != nil || len(hashBytes) != sha256.Size {
+		return fmt.Errorf("File hash '%s' should be 64 hex characters", req.FileHash)
+	}
+	return nil
+}
+
+func init() {
+	deleteWsCmd.ConnectCmdAndWs()
+	deleteWsCmd.Cmd.Flags().Bool("force", false, "delete even if active storage orders reference the file")
+	rootCmd.AddCommand(deleteWsCmd.Cmd)
+}
+
+var deleteWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "delete [file_hash]",
+		Short: "Delete file everywhere it lives",
+		Long:  "Delete sealed parts from fastdfs and TEE, parts from '$KARST_PATH/files/' and part store, and records of both file hash and sealed hash from leveldb. Files referenced by active storage orders are kept unless --force",
+		Args:  cobra.MinimumNArgs(1),
+	},
+	Request: DeleteRequest{},
+	Data:    DeleteData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		force, _ := cmd.Flags().GetBool("force")
+		return DeleteRequest{
+			FileHash: args[0],
+			Force:    force,
+		}, nil
+	},
+	Async:      true,
+	WsEndpoint: "delete",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*DeleteRequest)
+
+		// Files which are only split have no record but their parts
+		fileInfo := model.GetFileInfoFromDb(req.FileHash, wsc.Db)
+		if fileInfo == nil {
+			partsPath := filepath.FromSlash(wsc.Cfg.KarstPaths.FilesPath + "/" + req.FileHash)
+			if !util.IsDirOrFileExist(partsPath) && !store.New(wsc.Db, wsc.Cfg.KarstPaths).HasFile(req.FileHash) {
+				return wscmd.Failure(wscmd.NewError(wscmd.CodeNotFound, "File '%s' is not found", req.FileHash))
+			}
+			fileInfo = &model.FileInfo{
+				MerkleTree: &merkletree.MerkleTreeNode{Hash: req.FileHash},
+				StoredPath: partsPath,
+			}
+		}
+		data := DeleteData{
+			FileHash: fileInfo.MerkleTree.Hash,
+		}
+		if fileInfo.MerkleTreeSealed != nil {
+			data.SealedHash = fileInfo.MerkleTreeSealed.Hash
+		}
+
+		orders, err := order.Referencing(wsc.Db, data.FileHash, data.SealedHash)
+		if err != nil {
+			logger.Error("List storage orders failed: %s", err)
+			return wscmd.Failure(err)
+		}
+		if len(orders) != 0 {
+			orderIds := make([]string, 0, len(orders))
+			for _, o := range orders {
+				orderIds = append(orderIds, o.Id)
+			}
+			if !req.Force {
+				return wscmd.Failure(wscmd.NewError(wscmd.CodeConflict, "File '%s' is referenced by active storage orders %s, use force to delete it", req.FileHash, strings.Join(orderIds, ", ")))
+			}
+			logger.Warn("File '%s' is deleted by force, active storage orders %s can't be served", req.FileHash, strings.Join(orderIds, ", "))
+		}
+
+		if err = fileInfo.Remove(wsc.Db, wsc.Fs, wsc.Tee, store.New(wsc.Db, wsc.Cfg.KarstPaths)); err != nil {
+			logger.Error("Delete file '%s' failed: %s", req.FileHash, err)
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeUnavailable, "Delete file '%s' failed, run it again to go on: %s", req.FileHash, err))
+		}
+
+		returnInfo := fmt.Sprintf("Delete file '%s' successfully !", req.FileHash)
+		logger.Info(returnInfo)
+		return wscmd.Success(returnInfo, data)
+	},
+}
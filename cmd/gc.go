@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"karst/gc"
+	"karst/logger"
+	"karst/wscmd"
+
+	"github.com/spf13/cobra"
+)
+
+type GcRequest struct {
+	DryRun bool `json:"dry_run" desc:"Only report garbage without removing it"`
+}
+
+type GcData struct {
+	Report *gc.Report `json:"report"`
+}
+
+func init() {
+	gcWsCmd.ConnectCmdAndWs()
+	gcWsCmd.Cmd.Flags().Bool("dry-run", false, "only report garbage without removing it")
+	rootCmd.AddCommand(gcWsCmd.Cmd)
+}
+
+var gcWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "gc",
+		Short: "Collect garbage of karst",
+		Long:  "Remove unfinished split directories, temporary files, parts and records nothing references and file records of deleted parts, which are older than 'gc.age'",
+	},
+	Request: GcRequest{},
+	Data:    GcData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		return GcRequest{
+			DryRun: dryRun,
+		}, nil
+	},
+	Async:      true,
+	WsEndpoint: "gc",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*GcRequest)
+
+		report, err := gc.New(wsc.Db, wsc.Cfg).Run(req.DryRun)
+		if err != nil {
+			logger.Error("Garbage collection failed: %s", err)
+			return wscmd.Failure(err)
+		}
+
+		info := fmt.Sprintf("Collected %d items of %d bytes", len(report.Items), report.Freed)
+		if req.DryRun {
+			info = fmt.Sprintf("Found %d items of %d bytes to collect, nothing is removed", len(report.Items), report.Freed)
+		}
+		return wscmd.Success(info, GcData{
+			Report: report,
+		})
+	},
+}
@@ -10,6 +10,8 @@ import (
 )
 
 func init() {
+	initCmd.Flags().String("backup", "", "crust account backup file to create encrypted keystore, or run 'karst keystore import' later")
+	initCmd.Flags().String("password-file", "", "read crust account password from file instead of terminal")
 	rootCmd.AddCommand(initCmd)
 }
 
@@ -35,6 +37,11 @@ var initCmd = &cobra.Command{
 				os.Exit(-1)
 			}
 
+			if err := os.MkdirAll(karstPaths.PartsPath, os.ModePerm); err != nil {
+				logger.Error("Fatal error in creating karst parts directory: %s", err)
+				os.Exit(-1)
+			}
+
 			if err := os.MkdirAll(karstPaths.TempFilesPath, os.ModePerm); err != nil {
 				logger.Error("Fatal error in creating karst temp files directory: %s", err)
 				os.Exit(-1)
@@ -45,8 +52,20 @@ var initCmd = &cobra.Command{
 				os.Exit(-1)
 			}
 
-			config.WriteDefault(karstPaths.ConfigFilePath)
+			if err := config.WriteDefault(karstPaths.ConfigFilePath); err != nil {
+				logger.Error("%s", err)
+				os.Exit(-1)
+			}
 			logger.Info("Initialize karst in '%s' successfully!", karstPaths.KarstPath)
 		}
+
+		// Keystore
+		if backupFile, _ := cmd.Flags().GetString("backup"); backupFile != "" {
+			passwordFile, _ := cmd.Flags().GetString("password-file")
+			if err := importAccount(backupFile, passwordFile); err != nil {
+				logger.Error("Fatal error in creating keystore: %s", err)
+				os.Exit(-1)
+			}
+		}
 	},
 }
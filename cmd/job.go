@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"karst/job"
+	"karst/logger"
+	"karst/wscmd"
+
+	"github.com/spf13/cobra"
+)
+
+type JobRequest struct {
+	JobId string `json:"job_id" validate:"required" desc:"Job id returned by asynchronous commands"`
+}
+
+type JobData struct {
+	Job *job.Job `json:"job"`
+}
+
+type JobListData struct {
+	Jobs []*job.Job `json:"jobs"`
+}
+
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "Manage background jobs",
+	Long:  "List, query and cancel background jobs of karst daemon",
+}
+
+func init() {
+	jobListWsCmd.ConnectCmdAndWs()
+	jobStatusWsCmd.ConnectCmdAndWs()
+	jobCancelWsCmd.ConnectCmdAndWs()
+	jobCmd.AddCommand(jobListWsCmd.Cmd, jobStatusWsCmd.Cmd, jobCancelWsCmd.Cmd)
+	rootCmd.AddCommand(jobCmd)
+}
+
+var jobListWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "list",
+		Short: "List all jobs",
+		Long:  "List all jobs with their status",
+	},
+	Request: struct{}{},
+	Data:    JobListData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return nil, nil
+	},
+	WsEndpoint: "job/list",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		jobs, err := wsc.Jobs.List()
+		if err != nil {
+			logger.Error("List jobs failed: %s", err)
+			return wscmd.Failure(err)
+		}
+
+		return wscmd.Success(fmt.Sprintf("There are %d jobs", len(jobs)), JobListData{
+			Jobs: jobs,
+		})
+	},
+}
+
+var jobStatusWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "status [job_id]",
+		Short: "Show job status",
+		Long:  "Show job status, its result will be shown once job is finished",
+		Args:  cobra.MinimumNArgs(1),
+	},
+	Request: JobRequest{},
+	Data:    JobData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return JobRequest{
+			JobId: args[0],
+		}, nil
+	},
+	WsEndpoint: "job/status",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*JobRequest)
+		j, err := wsc.Jobs.Get(req.JobId)
+		if err != nil {
+			return jobFailure(req.JobId, err)
+		}
+
+		return wscmd.Success(fmt.Sprintf("Job '%s' is %s", j.Id, j.Status), JobData{
+			Job: j,
+		})
+	},
+}
+
+var jobCancelWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "cancel [job_id]",
+		Short: "Cancel job",
+		Long:  "Cancel pending or running job, the result of canceled running job will be dropped",
+		Args:  cobra.MinimumNArgs(1),
+	},
+	Request: JobRequest{},
+	Data:    JobData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return JobRequest{
+			JobId: args[0],
+		}, nil
+	},
+	WsEndpoint: "job/cancel",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*JobRequest)
+		j, err := wsc.Jobs.Cancel(req.JobId)
+		if err != nil {
+			return jobFailure(req.JobId, err)
+		}
+
+		return wscmd.Success(fmt.Sprintf("Job '%s' is canceled", j.Id), JobData{
+			Job: j,
+		})
+	},
+}
+
+func jobFailure(jobId string, err error) *wscmd.Response {
+	if err == job.ErrNotFound {
+		return wscmd.Failure(wscmd.NewError(wscmd.CodeNotFound, "Job '%s' is not found", jobId))
+	}
+
+	logger.Error("Deal with job '%s' failed: %s", jobId, err)
+	if err == job.ErrFinished {
+		return wscmd.Failure(wscmd.NewError(wscmd.CodeConflict, "Job '%s' is already finished", jobId))
+	}
+	return wscmd.Failure(err)
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"karst/config"
+	"karst/keystore"
+	"karst/logger"
+	"karst/util"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var keystoreCmd = &cobra.Command{
+	Use:   "keystore",
+	Short: "Manage encrypted keystore of crust account",
+	Long:  "Manage encrypted keystore of crust account, daemon unlocks it at start by KARST_KEYSTORE_PASSPHRASE, 'keystore.passphrase_file' or asking on terminal",
+}
+
+var keystoreImportCmd = &cobra.Command{
+	Use:   "import [backup_file]",
+	Short: "Import crust account into keystore",
+	Long:  "Encrypt crust account backup file and its password into keystore, and set 'crust.address' in config file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		passwordFile, _ := cmd.Flags().GetString("password-file")
+		if err := importAccount(args[0], passwordFile); err != nil {
+			logger.Error("Import crust account failed: %s", err)
+			os.Exit(-1)
+		}
+	},
+}
+
+var keystoreMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move plaintext crust backup and password from config file into keystore",
+	Long:  "Encrypt 'crust.backup' and 'crust.password' of config file into keystore, then remove them from config file",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, _, err := config.Inspect()
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(-1)
+		}
+
+		if cfg.Crust.Backup == "" || cfg.Crust.Password == "" {
+			logger.Error("There are no 'crust.backup' and 'crust.password' in config file to migrate")
+			os.Exit(-1)
+		}
+
+		account, err := keystore.NewAccount(cfg.Crust.Backup, cfg.Crust.Password)
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(-1)
+		}
+
+		if err := createKeystore(cfg.KarstPaths, account, cfg.Keystore.PassphraseFile); err != nil {
+			logger.Error("Migrate crust account failed: %s", err)
+			os.Exit(-1)
+		}
+
+		for _, key := range []string{"crust.backup", "crust.password"} {
+			if err := config.Set(key, ""); err != nil {
+				logger.Error("Remove '%s' from config file failed, please remove it manually: %s", key, err)
+				os.Exit(-1)
+			}
+		}
+		logger.Info("Crust account '%s' is moved into keystore '%s'", account.Address, cfg.KarstPaths.KeystorePath)
+	},
+}
+
+func init() {
+	keystoreImportCmd.Flags().String("password-file", "", "read crust account password from file instead of terminal")
+	keystoreCmd.AddCommand(keystoreImportCmd, keystoreMigrateCmd)
+	rootCmd.AddCommand(keystoreCmd)
+}
+
+// importAccount reads backup file and password, then creates keystore with passphrase of config
+func importAccount(backupFile string, passwordFile string) error {
+	cfg, _, err := config.Inspect()
+	if err != nil {
+		return err
+	}
+
+	backup, err := ioutil.ReadFile(backupFile)
+	if err != nil {
+		return err
+	}
+
+	var password string
+	if passwordFile != "" {
+		passwordBytes, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimRight(string(passwordBytes), "\r\n")
+	} else if password, err = keystore.ReadPassphrase("Crust account password: "); err != nil {
+		return err
+	}
+	if password == "" {
+		return errors.New("Crust account password is empty")
+	}
+
+	account, err := keystore.NewAccount(strings.TrimSpace(string(backup)), password)
+	if err != nil {
+		return err
+	}
+
+	if err := createKeystore(cfg.KarstPaths, account, cfg.Keystore.PassphraseFile); err != nil {
+		return err
+	}
+
+	if err := config.Set("crust.address", account.Address); err != nil {
+		return err
+	}
+	logger.Info("Crust account '%s' is imported into keystore '%s'", account.Address, cfg.KarstPaths.KeystorePath)
+	return nil
+}
+
+func createKeystore(karstPaths *util.KarstPaths, account *keystore.Account, passphraseFile string) error {
+	passphrase, err := keystore.NewPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	return keystore.Create(karstPaths.KeystorePath, account, passphrase)
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"karst/logger"
+	"karst/tee"
+	"karst/util"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	mockTeeCmd.Flags().String("listen", "127.0.0.1:12222", "address to serve mock TEE, 'tee_base_url' is it with '/api/v0'")
+	mockTeeCmd.Flags().String("data-path", "", "directory of sealed and unsealed parts, it is '$KARST_PATH/mock_tee' by default")
+	rootCmd.AddCommand(mockTeeCmd)
+}
+
+var mockTeeCmd = &cobra.Command{
+	Use:   "mock-tee",
+	Short: "Start a mock TEE for local development",
+	Long:  "Start a mock TEE which serves '/api/v0/storage/seal', '/api/v0/storage/unseal' and '/api/v0/storage/delete' in both path and stream mode, it seals parts by xor with the hash of account backup instead of SGX",
+	Run: func(cmd *cobra.Command, args []string) {
+		listen, _ := cmd.Flags().GetString("listen")
+		dataPath, _ := cmd.Flags().GetString("data-path")
+		if dataPath == "" {
+			dataPath = filepath.FromSlash(util.GetKarstPaths().KarstPath + "/mock_tee")
+		}
+		if err := os.MkdirAll(dataPath, os.ModePerm); err != nil {
+			logger.Error("Fatal error in creating mock TEE data directory: %s", err)
+			os.Exit(-1)
+		}
+
+		mock := tee.NewMockServer(dataPath)
+		baseUrl, err := mock.Start(listen)
+		if err != nil {
+			logger.Error("Fatal error in starting mock TEE: %s", err)
+			os.Exit(-1)
+		}
+		logger.Info("Mock TEE is serving, set 'tee_base_url' to '%s'", baseUrl)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		logger.Info("Receive signal '%s', mock TEE is stopped", sig)
+		mock.Close()
+	},
+}
@@ -0,0 +1,373 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"karst/chain"
+	"karst/logger"
+	"karst/provider"
+	"karst/wscmd"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type OrderQuoteRequest struct {
+	Provider string `json:"provider" validate:"required" desc:"Chain address of provider"`
+	FileSize uint64 `json:"file_size" validate:"required,min=1" desc:"Size of file in bytes"`
+	Duration uint64 `json:"duration" desc:"Storage duration in blocks, 320 by default"`
+}
+
+type OrderQuoteData struct {
+	Price    uint64 `json:"price"`
+	Duration uint64 `json:"duration"`
+	Amount   uint64 `json:"amount"`
+}
+
+type OrderPlaceRequest struct {
+	FileIdentifier string `json:"file_identifier" validate:"required" desc:"Merkle root hash of file"`
+	FileSize       uint64 `json:"file_size" validate:"required,min=1" desc:"Size of file in bytes"`
+	Provider       string `json:"provider" desc:"Chain address of provider, providers are chosen by policy if it is empty"`
+	Policy         string `json:"policy" desc:"Policy of choosing providers: cheapest, fastest or spread, 'provider.policy' by default"`
+	Count          int    `json:"count" desc:"Number of providers to place orders with, 'provider.count' by default"`
+	Duration       uint64 `json:"duration" desc:"Storage duration in blocks, 320 by default"`
+	Amount         uint64 `json:"amount" desc:"Amount paid to each provider, the quote of provider's price by default"`
+}
+
+type PlacedOrder struct {
+	Provider string `json:"provider"`
+	OrderId  string `json:"order_id"`
+	Duration uint64 `json:"duration"`
+	Amount   uint64 `json:"amount"`
+}
+
+type OrderPlaceData struct {
+	Orders []PlacedOrder `json:"orders"`
+}
+
+type OrderRenewRequest struct {
+	OrderId  string `json:"order_id" validate:"required" desc:"Id of storage order"`
+	Duration uint64 `json:"duration" desc:"Blocks added to storage duration, 320 by default"`
+	Amount   uint64 `json:"amount" desc:"Amount paid to provider, the quote of provider's price by default"`
+}
+
+type OrderCancelRequest struct {
+	OrderId string `json:"order_id" validate:"required" desc:"Id of storage order"`
+}
+
+type OrderData struct {
+	Order chain.FullStorageOrder `json:"order"`
+}
+
+func (req *OrderQuoteRequest) Validate() error {
+	if req.Duration == 0 {
+		req.Duration = chain.DefaultDuration
+	}
+	return nil
+}
+
+func (req *OrderPlaceRequest) Validate() error {
+	if req.Duration == 0 {
+		req.Duration = chain.DefaultDuration
+	}
+	if req.Policy != "" && req.Policy != provider.PolicyCheapest && req.Policy != provider.PolicyFastest && req.Policy != provider.PolicySpread {
+		return fmt.Errorf("Unknown provider policy '%s', it should be cheapest, fastest or spread", req.Policy)
+	}
+	if req.Count < 0 {
+		return errors.New("Count of providers should be positive")
+	}
+	return nil
+}
+
+func (req *OrderRenewRequest) Validate() error {
+	if req.Duration == 0 {
+		req.Duration = chain.DefaultDuration
+	}
+	return nil
+}
+
+var orderCmd = &cobra.Command{
+	Use:   "order",
+	Short: "Manage storage orders placed by this client",
+	Long:  "Quote, place, renew and cancel storage orders placed by this client",
+}
+
+func init() {
+	orderQuoteWsCmd.ConnectCmdAndWs()
+	orderPlaceWsCmd.ConnectCmdAndWs()
+	orderRenewWsCmd.ConnectCmdAndWs()
+	orderCancelWsCmd.ConnectCmdAndWs()
+	for _, c := range []*cobra.Command{orderQuoteWsCmd.Cmd, orderPlaceWsCmd.Cmd, orderRenewWsCmd.Cmd} {
+		c.Flags().Uint64("duration", chain.DefaultDuration, "storage duration in blocks")
+	}
+	for _, c := range []*cobra.Command{orderPlaceWsCmd.Cmd, orderRenewWsCmd.Cmd} {
+		c.Flags().Uint64("amount", 0, "amount paid to provider, the quote of provider's price by default")
+	}
+	orderPlaceWsCmd.Cmd.Flags().String("provider", "", "chain address of provider, providers are chosen by policy if it is empty")
+	orderPlaceWsCmd.Cmd.Flags().String("policy", "", "policy of choosing providers: cheapest, fastest or spread ('provider.policy' by default)")
+	orderPlaceWsCmd.Cmd.Flags().Int("count", 0, "number of providers to place orders with ('provider.count' by default)")
+	orderCmd.AddCommand(orderQuoteWsCmd.Cmd, orderPlaceWsCmd.Cmd, orderRenewWsCmd.Cmd, orderCancelWsCmd.Cmd)
+	rootCmd.AddCommand(orderCmd)
+}
+
+var orderQuoteWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "quote [provider] [file_size]",
+		Short: "Get the amount asked by provider",
+		Long:  "Get the amount asked by provider for storing file_size bytes, it is computed from provider's price on chain",
+		Args:  cobra.MinimumNArgs(2),
+	},
+	Request: OrderQuoteRequest{},
+	Data:    OrderQuoteData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		fileSize, err := parseUint(args[1], "file_size")
+		if err != nil {
+			return nil, err
+		}
+		duration, _ := cmd.Flags().GetUint64("duration")
+		return OrderQuoteRequest{
+			Provider: args[0],
+			FileSize: fileSize,
+			Duration: duration,
+		}, nil
+	},
+	WsEndpoint: "order/quote",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*OrderQuoteRequest)
+		price, err := wsc.Chain.GetProviderPrice(req.Provider)
+		if err != nil {
+			logger.Error("Get price of provider '%s' failed: %s", req.Provider, err)
+			return chainFailure(err)
+		}
+
+		amount := chain.Quote(price, req.FileSize, req.Duration)
+		return wscmd.Success(fmt.Sprintf("Provider '%s' asks %d for %d bytes in %d blocks", req.Provider, amount, req.FileSize, req.Duration), OrderQuoteData{
+			Price:    price,
+			Duration: req.Duration,
+			Amount:   amount,
+		})
+	},
+}
+
+var orderPlaceWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "place [file_identifier] [file_size]",
+		Short: "Place storage orders",
+		Long:  "Place storage orders to the given provider, or to providers chosen by policy among the alive ones registered on chain. The amount is provider's quote if it isn't set",
+		Args:  cobra.MinimumNArgs(2),
+	},
+	Request: OrderPlaceRequest{},
+	Data:    OrderPlaceData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		fileSize, err := parseUint(args[1], "file_size")
+		if err != nil {
+			return nil, err
+		}
+		providerAddr, _ := cmd.Flags().GetString("provider")
+		policy, _ := cmd.Flags().GetString("policy")
+		count, _ := cmd.Flags().GetInt("count")
+		duration, _ := cmd.Flags().GetUint64("duration")
+		amount, _ := cmd.Flags().GetUint64("amount")
+		return OrderPlaceRequest{
+			FileIdentifier: args[0],
+			FileSize:       fileSize,
+			Provider:       providerAddr,
+			Policy:         policy,
+			Count:          count,
+			Duration:       duration,
+			Amount:         amount,
+		}, nil
+	},
+	Async:      true,
+	WsEndpoint: "order/place",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		timeStart := time.Now()
+		req := r.(*OrderPlaceRequest)
+
+		// Choose providers
+		providers := make([]*provider.Candidate, 0)
+		if req.Provider != "" {
+			price, err := wsc.Chain.GetProviderPrice(req.Provider)
+			if err != nil {
+				logger.Error("Get price of provider '%s' failed: %s", req.Provider, err)
+				return chainFailure(err)
+			}
+			providers = append(providers, &provider.Candidate{Account: req.Provider, Price: price})
+		} else {
+			policy, count := req.Policy, req.Count
+			if policy == "" {
+				policy = wsc.Cfg.Provider.Policy
+			}
+			if count == 0 {
+				count = wsc.Cfg.Provider.Count
+			}
+
+			candidates, err := provider.Discover(wsc.Chain, providerProbeTimeout)
+			if err != nil {
+				logger.Error("Discover providers failed: %s", err)
+				return chainFailure(err)
+			}
+			if providers, err = provider.Select(candidates, policy, count, req.FileSize); err != nil {
+				logger.Error("Choose providers failed: %s", err)
+				return wscmd.Failure(wscmd.NewError(wscmd.CodeUnavailable, "%s", err))
+			}
+		}
+
+		// Place orders one by one, the placed ones are kept if others fail
+		placed := make([]PlacedOrder, 0)
+		failures := make([]string, 0)
+		var lastErr error
+		for _, p := range providers {
+			amount := req.Amount
+			if amount == 0 {
+				amount = chain.Quote(p.Price, req.FileSize, req.Duration)
+			}
+
+			orderId, err := wsc.Chain.PlaceStorageOrder(p.Account, req.FileIdentifier, req.FileSize, req.Duration, amount)
+			if err != nil {
+				logger.Error("Place storage order to '%s' failed: %s", p.Account, err)
+				failures = append(failures, fmt.Sprintf("'%s': %s", p.Account, err))
+				lastErr = err
+				continue
+			}
+			logger.Info("Storage order '%s' is placed to '%s', it pays %d for %d blocks", orderId, p.Account, amount, req.Duration)
+			placed = append(placed, PlacedOrder{
+				Provider: p.Account,
+				OrderId:  orderId,
+				Duration: req.Duration,
+				Amount:   amount,
+			})
+		}
+
+		if len(placed) == 0 {
+			return wscmd.Failure(wscmd.NewError(chainCode(lastErr), "Place storage order failed: %s", strings.Join(failures, "; ")))
+		}
+
+		info := fmt.Sprintf("Place %d storage orders successfully in %s !", len(placed), time.Since(timeStart))
+		if len(failures) != 0 {
+			info += fmt.Sprintf(" %d failed: %s", len(failures), strings.Join(failures, "; "))
+		}
+		return wscmd.Success(info, OrderPlaceData{
+			Orders: placed,
+		})
+	},
+}
+
+var orderRenewWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "renew [order_id]",
+		Short: "Renew storage order",
+		Long:  "Extend storage order by duration blocks before it expires, the amount is provider's quote if it isn't set",
+		Args:  cobra.MinimumNArgs(1),
+	},
+	Request: OrderRenewRequest{},
+	Data:    OrderData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		duration, _ := cmd.Flags().GetUint64("duration")
+		amount, _ := cmd.Flags().GetUint64("amount")
+		return OrderRenewRequest{
+			OrderId:  args[0],
+			Duration: duration,
+			Amount:   amount,
+		}, nil
+	},
+	Async:      true,
+	WsEndpoint: "order/renew",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*OrderRenewRequest)
+		sOrder, err := unexpiredOrder(req.OrderId, wsc.Chain)
+		if err != nil {
+			return wscmd.Failure(err)
+		}
+
+		amount := req.Amount
+		if amount == 0 {
+			price, err := wsc.Chain.GetProviderPrice(sOrder.Provider)
+			if err != nil {
+				logger.Error("Get price of provider '%s' failed: %s", sOrder.Provider, err)
+				return chainFailure(err)
+			}
+			amount = chain.Quote(price, sOrder.FileSize, req.Duration)
+		}
+
+		if err = wsc.Chain.RenewStorageOrder(req.OrderId, req.Duration, amount); err != nil {
+			logger.Error("Renew storage order '%s' failed: %s", req.OrderId, err)
+			return chainFailure(err)
+		}
+
+		return orderSuccess(req.OrderId, wsc.Chain, fmt.Sprintf("Renew storage order '%s' by %d blocks, it pays %d", req.OrderId, req.Duration, amount))
+	},
+}
+
+var orderCancelWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "cancel [order_id]",
+		Short: "Cancel storage order",
+		Long:  "Cancel storage order, it expires at current block and provider deletes the file",
+		Args:  cobra.MinimumNArgs(1),
+	},
+	Request: OrderCancelRequest{},
+	Data:    OrderData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return OrderCancelRequest{
+			OrderId: args[0],
+		}, nil
+	},
+	Async:      true,
+	WsEndpoint: "order/cancel",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*OrderCancelRequest)
+		if _, err := unexpiredOrder(req.OrderId, wsc.Chain); err != nil {
+			return wscmd.Failure(err)
+		}
+
+		if err := wsc.Chain.CancelStorageOrder(req.OrderId); err != nil {
+			logger.Error("Cancel storage order '%s' failed: %s", req.OrderId, err)
+			return chainFailure(err)
+		}
+
+		return orderSuccess(req.OrderId, wsc.Chain, fmt.Sprintf("Storage order '%s' is canceled", req.OrderId))
+	},
+}
+
+// unexpiredOrder gets order from chain, expired orders can't be renewed or canceled
+func unexpiredOrder(orderId string, client chain.Client) (*chain.FullStorageOrder, error) {
+	sOrder, err := client.GetStorageOrder(orderId)
+	if err != nil {
+		logger.Error("Get storage order '%s' failed: %s", orderId, err)
+		return nil, wscmd.NewError(chainCode(err), "Get storage order '%s' failed: %s", orderId, err)
+	}
+
+	block, err := client.GetBlockNumber()
+	if err != nil {
+		logger.Error("Get block number failed: %s", err)
+		return nil, wscmd.NewError(chainCode(err), "Get block number failed: %s", err)
+	}
+	if block >= sOrder.ExpiredOn {
+		return nil, wscmd.NewError(wscmd.CodeConflict, "Storage order '%s' is expired on block %d", orderId, sOrder.ExpiredOn)
+	}
+	return &sOrder, nil
+}
+
+func orderSuccess(orderId string, client chain.Client, info string) *wscmd.Response {
+	sOrder, err := client.GetStorageOrder(orderId)
+	if err != nil {
+		logger.Warn("Get storage order '%s' failed: %s", orderId, err)
+		return wscmd.Success(info, nil)
+	}
+
+	return wscmd.Success(fmt.Sprintf("%s, it expires on block %d", info, sOrder.ExpiredOn), OrderData{
+		Order: sOrder,
+	})
+}
+
+func parseUint(value string, name string) (uint64, error) {
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' should be a number: %s", name, value)
+	}
+	return number, nil
+}
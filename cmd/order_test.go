@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"karst/chain"
+	"testing"
+)
+
+func placeRequest() *OrderPlaceRequest {
+	return &OrderPlaceRequest{
+		FileIdentifier: chain.MockFileIdentifier,
+		FileSize:       chain.MockFileSize,
+		Provider:       chain.MockProviderAccount,
+		Duration:       10,
+	}
+}
+
+func TestOrderQuote(t *testing.T) {
+	mock := chain.NewTestMockChain()
+	client := mockWsCmd(mock, chain.MockClientAccount)
+
+	resp := runCmd(t, orderQuoteWsCmd, &OrderQuoteRequest{Provider: chain.MockProviderAccount, FileSize: chain.MockFileSize}, client)
+	expectStatus(t, "Quote", resp, 200)
+	if data := resp.Data.(OrderQuoteData); data.Duration != chain.DefaultDuration || data.Amount != chain.Quote(chain.MockProviderPrice, chain.MockFileSize, chain.DefaultDuration) {
+		t.Errorf("Quote is %+v", data)
+	}
+	expectStatus(t, "Quote of unregistered provider", runCmd(t, orderQuoteWsCmd, &OrderQuoteRequest{Provider: chain.MockClientAccount, FileSize: 1}, client), 404)
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	mock := chain.NewTestMockChain()
+	client := mockWsCmd(mock, chain.MockClientAccount)
+
+	resp := runCmd(t, orderPlaceWsCmd, placeRequest(), client)
+	expectStatus(t, "Place", resp, 200)
+	placed := resp.Data.(OrderPlaceData).Orders
+	if len(placed) != 1 || placed[0].Amount != chain.Quote(chain.MockProviderPrice, chain.MockFileSize, 10) {
+		t.Fatalf("Placed orders are %+v", placed)
+	}
+	orderId := placed[0].OrderId
+
+	resp = runCmd(t, orderRenewWsCmd, &OrderRenewRequest{OrderId: orderId, Duration: 20}, client)
+	expectStatus(t, "Renew", resp, 200)
+	if sOrder := resp.Data.(OrderData).Order; sOrder.ExpiredOn != 30 {
+		t.Errorf("Renewed order expires on %d, want 30", sOrder.ExpiredOn)
+	}
+
+	// Orders of others and missing orders can't be renewed
+	provider := mockWsCmd(mock, chain.MockProviderAccount)
+	expectStatus(t, "Renew by provider", runCmd(t, orderRenewWsCmd, &OrderRenewRequest{OrderId: orderId, Duration: 20}, provider), 400)
+	expectStatus(t, "Renew missing order", runCmd(t, orderRenewWsCmd, &OrderRenewRequest{OrderId: "0x00", Duration: 20}, client), 404)
+
+	mock.Advance(5)
+	resp = runCmd(t, orderCancelWsCmd, &OrderCancelRequest{OrderId: orderId}, client)
+	expectStatus(t, "Cancel", resp, 200)
+	if sOrder := resp.Data.(OrderData).Order; sOrder.ExpiredOn != 5 {
+		t.Errorf("Canceled order expires on %d, want 5", sOrder.ExpiredOn)
+	}
+	expectStatus(t, "Cancel expired order", runCmd(t, orderCancelWsCmd, &OrderCancelRequest{OrderId: orderId}, client), 409)
+	expectStatus(t, "Renew expired order", runCmd(t, orderRenewWsCmd, &OrderRenewRequest{OrderId: orderId, Duration: 20}, client), 409)
+}
+
+func TestOrderPlaceRejected(t *testing.T) {
+	mock := chain.NewTestMockChain()
+	client := mockWsCmd(mock, chain.MockClientAccount)
+
+	unregistered := placeRequest()
+	unregistered.Provider = chain.MockClientAccount
+	expectStatus(t, "Place to unregistered provider", runCmd(t, orderPlaceWsCmd, unregistered, client), 404)
+
+	underQuote := placeRequest()
+	underQuote.Amount = 1
+	expectStatus(t, "Place under quote", runCmd(t, orderPlaceWsCmd, underQuote, client), 400)
+
+	if err := (&OrderPlaceRequest{Policy: "random"}).Validate(); err == nil {
+		t.Error("Unknown policy is accepted")
+	}
+	if orders := mock.Orders(chain.MockClientAccount); len(orders) != 0 {
+		t.Errorf("Got %d orders on chain, want none", len(orders))
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"karst/logger"
+	"karst/order"
+	"karst/wscmd"
+
+	"github.com/spf13/cobra"
+)
+
+type OrdersRequest struct {
+	Status string `json:"status" desc:"Only list orders in this status: pending, receiving, sealed, expired or failed"`
+}
+
+type OrdersData struct {
+	Orders []*order.Order `json:"orders"`
+}
+
+func (req *OrdersRequest) Validate() error {
+	if req.Status == "" {
+		return nil
+	}
+	for _, status := range order.Statuses {
+		if req.Status == string(status) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown order status '%s'", req.Status)
+}
+
+func init() {
+	ordersWsCmd.ConnectCmdAndWs()
+	ordersWsCmd.Cmd.Flags().String("status", "", "only list orders in this status (pending, receiving, sealed, expired, failed)")
+	rootCmd.AddCommand(ordersWsCmd.Cmd)
+}
+
+var ordersWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "orders",
+		Short: "List storage orders placed to this provider",
+		Long:  "List storage orders placed to this provider, daemon picks them up from chain and tracks their status",
+	},
+	Request: OrdersRequest{},
+	Data:    OrdersData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		status, _ := cmd.Flags().GetString("status")
+		return OrdersRequest{
+			Status: status,
+		}, nil
+	},
+	WsEndpoint: "order/list",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		req := r.(*OrdersRequest)
+		orders, err := order.List(wsc.Db)
+		if err != nil {
+			logger.Error("List storage orders failed: %s", err)
+			return wscmd.Failure(err)
+		}
+
+		if req.Status != "" {
+			filtered := make([]*order.Order, 0)
+			for _, o := range orders {
+				if string(o.Status) == req.Status {
+					filtered = append(filtered, o)
+				}
+			}
+			orders = filtered
+		}
+
+		return wscmd.Success(fmt.Sprintf("There are %d storage orders", len(orders)), OrdersData{
+			Orders: orders,
+		})
+	},
+}
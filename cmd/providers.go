@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"karst/logger"
+	"karst/provider"
+	"karst/wscmd"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Time to wait for a provider's karst to answer probing
+const providerProbeTimeout = 3 * time.Second
+
+type ProvidersData struct {
+	Providers []*provider.Candidate `json:"providers"`
+}
+
+func init() {
+	providersWsCmd.ConnectCmdAndWs()
+	rootCmd.AddCommand(providersWsCmd.Cmd)
+}
+
+var providersWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "providers",
+		Short: "List providers registered on chain",
+		Long:  "List providers registered on chain with their price, and probe their karst for liveness, latency and capacity",
+	},
+	Request: struct{}{},
+	Data:    ProvidersData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return nil, nil
+	},
+	WsEndpoint: "provider/list",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		candidates, err := provider.Discover(wsc.Chain, providerProbeTimeout)
+		if err != nil {
+			logger.Error("Discover providers failed: %s", err)
+			return chainFailure(err)
+		}
+
+		alive := 0
+		for _, candidate := range candidates {
+			if candidate.Alive {
+				alive++
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Alive && !candidates[j].Alive
+		})
+
+		return wscmd.Success(fmt.Sprintf("There are %d providers, %d of them are alive", len(candidates), alive), ProvidersData{
+			Providers: candidates,
+		})
+	},
+}
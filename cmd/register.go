@@ -1,9 +1,9 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"karst/chain"
-	"karst/config"
 	"karst/logger"
 	"karst/wscmd"
 	"time"
@@ -11,13 +11,14 @@ import (
 	"github.com/spf13/cobra"
 )
 
-type RegisterReturnMsg struct {
-	Info   string `json:"info"`
-	Status int    `json:"status"`
+type RegisterRequest struct {
+	KarstAddress string `json:"karst_address" validate:"required" desc:"External karst address to register"`
+	Price        uint64 `json:"price" desc:"Storage price, the amount for a MB per block"`
 }
 
 func init() {
 	registerWsCmd.ConnectCmdAndWs()
+	registerWsCmd.Cmd.Flags().Uint64("price", 0, "storage price, the amount for a MB per block")
 	rootCmd.AddCommand(registerWsCmd.Cmd)
 }
 
@@ -25,55 +26,60 @@ var registerWsCmd = &wscmd.WsCmd{
 	Cmd: &cobra.Command{
 		Use:   "register [karst_address]",
 		Short: "Register to chain as provider",
-		Long:  "Check your qualification, register karst address to chain.",
+		Long:  "Check your qualification, register karst address and storage price to chain.",
 		Args:  cobra.MinimumNArgs(1),
 	},
-	Connecter: func(cmd *cobra.Command, args []string) (map[string]string, error) {
-		reqBody := map[string]string{
-			"karst_address": args[0],
-		}
-
-		return reqBody, nil
+	Request: RegisterRequest{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		price, _ := cmd.Flags().GetUint64("price")
+		return RegisterRequest{
+			KarstAddress: args[0],
+			Price:        price,
+		}, nil
 	},
+	Async:      true,
 	WsEndpoint: "register",
-	WsRunner: func(args map[string]string, wsc *wscmd.WsCmd) interface{} {
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
 		// Base class
 		timeStart := time.Now()
-
-		// Check input
-		karstAddr := args["karst_address"]
-		if karstAddr == "" {
-			errString := "Provider's address is needed"
-			logger.Error(errString)
-			return RegisterReturnMsg{
-				Info:   errString,
-				Status: 400,
-			}
-		}
+		req := r.(*RegisterRequest)
 
 		// Register karst address
-		registerReturnMsg := RegisterToChain(karstAddr, wsc.Cfg)
-		if registerReturnMsg.Status != 200 {
-			logger.Error("Register to crust failed, error is: %s", registerReturnMsg.Info)
-			return registerReturnMsg
-		} else {
-			return RegisterReturnMsg{
-				Info:   fmt.Sprintf("Register '%s' successful in %s ! You can check it on crust.", karstAddr, time.Since(timeStart)),
-				Status: 200,
-			}
+		if err := RegisterToChain(req.KarstAddress, req.Price, wsc.Chain); err != nil {
+			logger.Error("Register to crust failed, error is: %s", err)
+			return wscmd.Failure(err)
 		}
+
+		return wscmd.Success(fmt.Sprintf("Register '%s' successful in %s ! You can check it on crust.", req.KarstAddress, time.Since(timeStart)), nil)
 	},
 }
 
-func RegisterToChain(karstAddr string, cfg *config.Configuration) RegisterReturnMsg {
-	if err := chain.Register(cfg.Crust.BaseUrl, cfg.Crust.Backup, cfg.Crust.Password, karstAddr); err != nil {
-		return RegisterReturnMsg{
-			Info:   fmt.Sprintf("Register failed, please make sure:\n1. Your `backup`, `password` is correct\n2. You have report works, err is: %s", err.Error()),
-			Status: 400,
-		}
+func RegisterToChain(karstAddr string, price uint64, client chain.Client) error {
+	if err := client.Register(karstAddr, price); err != nil {
+		return wscmd.NewError(chainCode(err), "Register failed, please make sure:\n1. Your `backup`, `password` is correct\n2. You have report works, err is: %s", err.Error())
 	}
 
-	return RegisterReturnMsg{
-		Status: 200,
+	return nil
+}
+
+// chainCode tells client whether chain call failed for credentials, network, missing target, rejection or lost response
+func chainCode(err error) wscmd.ErrorCode {
+	switch chain.KindOf(err) {
+	case chain.KindCredentials:
+		return wscmd.CodeUnauthorized
+	case chain.KindNetwork:
+		return wscmd.CodeUnavailable
+	case chain.KindNotFound:
+		return wscmd.CodeNotFound
+	case chain.KindUnsupported:
+		return wscmd.CodeNotImplemented
+	case chain.KindOutcomeUnknown:
+		return wscmd.CodeOutcomeUnknown
+	default:
+		return wscmd.CodeBadRequest
 	}
 }
+
+func chainFailure(err error) *wscmd.Response {
+	return wscmd.Failure(wscmd.NewError(chainCode(err), "%s", err))
+}
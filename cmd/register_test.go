@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"context"
+	"karst/chain"
+	"karst/config"
+	"karst/wscmd"
+	"testing"
+)
+
+// mockWsCmd runs commands as account on mock chain
+func mockWsCmd(mock *chain.MockChain, account string) *wscmd.WsCmd {
+	return &wscmd.WsCmd{
+		Cfg: &config.Configuration{
+			Crust: config.CrustConfiguration{
+				Backend: chain.BackendMock,
+				Address: account,
+			},
+		},
+		Chain: mock.Client(account),
+	}
+}
+
+// runCmd validates req like wscmd does and runs command
+func runCmd(t *testing.T, wsCmd *wscmd.WsCmd, req interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+	if validator, ok := req.(wscmd.Validator); ok {
+		if err := validator.Validate(); err != nil {
+			t.Fatalf("Validate request of '%s': %s", wsCmd.WsEndpoint, err)
+		}
+	}
+	return wsCmd.WsRunner(context.Background(), req, wsc)
+}
+
+func expectStatus(t *testing.T, step string, resp *wscmd.Response, status int) {
+	if resp.Status != status {
+		t.Fatalf("%s: got %d (%s), want %d", step, resp.Status, resp.Info, status)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	mock := chain.NewMockChain(0)
+	req := &RegisterRequest{KarstAddress: chain.MockProviderAddr, Price: chain.MockProviderPrice}
+
+	expectStatus(t, "Register without account", runCmd(t, registerWsCmd, req, mockWsCmd(mock, "")), 401)
+
+	provider := mockWsCmd(mock, chain.MockProviderAccount)
+	expectStatus(t, "Register", runCmd(t, registerWsCmd, req, provider), 200)
+	if addr, err := provider.Chain.GetProviderAddr(chain.MockProviderAccount); err != nil || addr != chain.MockProviderAddr {
+		t.Errorf("Registered address is '%s' (%v)", addr, err)
+	}
+}
+
+func TestChainCode(t *testing.T) {
+	codes := map[chain.ErrorKind]wscmd.ErrorCode{
+		chain.KindCredentials:    wscmd.CodeUnauthorized,
+		chain.KindNetwork:        wscmd.CodeUnavailable,
+		chain.KindNotFound:       wscmd.CodeNotFound,
+		chain.KindRejected:       wscmd.CodeBadRequest,
+		chain.KindUnsupported:    wscmd.CodeNotImplemented,
+		chain.KindOutcomeUnknown: wscmd.CodeOutcomeUnknown,
+	}
+	for kind, code := range codes {
+		if got := chainCode(chain.NewError(kind, "Failed")); got != code {
+			t.Errorf("Code of %s is %s, want %s", kind, got, code)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"karst/logger"
+	"karst/merkletree"
+	"karst/model"
+	"karst/tee"
+	"karst/util"
+	"karst/wscmd"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type RetrieveRequest struct {
+	FileHash   string `json:"file_hash" validate:"required" desc:"Hash or sealed hash of the file"`
+	OutputPath string `json:"output_path" validate:"required" desc:"Absolute path of the file to write, it shouldn't exist"`
+}
+
+type RetrieveData struct {
+	MerkleTree *merkletree.MerkleTreeNode `json:"merkle_tree"`
+	OutputPath string                     `json:"output_path"`
+}
+
+func (req *RetrieveRequest) Validate() error {
+	if !filepath.IsAbs(req.OutputPath) {
+		return errors.New("Output path should be absolute")
+	}
+	return nil
+}
+
+func init() {
+	retrieveWsCmd.ConnectCmdAndWs()
+	rootCmd.AddCommand(retrieveWsCmd.Cmd)
+}
+
+var retrieveWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "retrieve [file_hash] [output_path]",
+		Short: "Retrieve sealed file",
+		Long:  "Get sealed parts of file from fastdfs, unseal them in TEE, check them against the original merkle tree and merge them into output_path",
+		Args:  cobra.MinimumNArgs(2),
+	},
+	Request: RetrieveRequest{},
+	Data:    RetrieveData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		outputPath, err := filepath.Abs(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return RetrieveRequest{
+			FileHash:   args[0],
+			OutputPath: outputPath,
+		}, nil
+	},
+	Async:      true,
+	WsEndpoint: "retrieve",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		timeStart := time.Now()
+		req := r.(*RetrieveRequest)
+		if wsc.Tee == nil {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeUnavailable, "TEE isn't configured"))
+		}
+
+		fileInfo := model.GetFileInfoFromDb(req.FileHash, wsc.Db)
+		if fileInfo == nil || fileInfo.MerkleTree == nil || fileInfo.MerkleTreeSealed == nil {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeNotFound, "Sealed file '%s' is not found", req.FileHash))
+		}
+		if util.IsDirOrFileExist(req.OutputPath) {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeConflict, "'%s' already exists", req.OutputPath))
+		}
+
+		if err := retrieveFile(ctx, fileInfo, req.OutputPath, wsc); err != nil {
+			logger.Error("%s", err)
+			os.Remove(req.OutputPath)
+			return wscmd.Failure(err)
+		}
+
+		returnInfo := fmt.Sprintf("Retrieve '%s' to '%s' successfully in %s !", fileInfo.MerkleTree.Hash, req.OutputPath, time.Since(timeStart))
+		logger.Info(returnInfo)
+		return wscmd.Success(returnInfo, RetrieveData{
+			MerkleTree: fileInfo.MerkleTree,
+			OutputPath: req.OutputPath,
+		})
+	},
+}
+
+// retrieveFile unseals sealed parts in fs and merges them into outputPath, it stops between parts when ctx is canceled
+func retrieveFile(ctx context.Context, fileInfo *model.FileInfo, outputPath string, wsc *wscmd.WsCmd) error {
+	merkleTreeSealed := fileInfo.MerkleTreeSealed
+	if len(fileInfo.StoredKeys) != len(merkleTreeSealed.Links) {
+		return fmt.Errorf("There are %d sealed parts in fs, but %d in sealed merkle tree", len(fileInfo.StoredKeys), len(merkleTreeSealed.Links))
+	}
+
+	// Sealed parts are got from fs into a temporary directory
+	tempPath := filepath.FromSlash(wsc.Cfg.KarstPaths.TempFilesPath + "/" + merkleTreeSealed.Hash + "_" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := os.MkdirAll(tempPath, os.ModePerm); err != nil {
+		return fmt.Errorf("Fatal error in creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	getSealedPart := func(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Retrieve '%s' is canceled", fileInfo.MerkleTree.Hash)
+		}
+		partPath := filepath.FromSlash(tempPath + "/" + strconv.Itoa(index) + "_" + node.Hash)
+		if err := wsc.Fs.Get(fileInfo.StoredKeys[index], partPath); err != nil {
+			return nil, fmt.Errorf("Get sealed part '%s' from fs failed: %s", fileInfo.StoredKeys[index], err)
+		}
+		return ioutil.ReadFile(partPath)
+	}
+
+	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("Fatal error in creating '%s': %s", outputPath, err)
+	}
+	defer output.Close()
+
+	// Parts are merged in order, each one must be the part of original merkle tree
+	mergePart := func(index int, node *merkletree.MerkleTreeNode, data []byte) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Retrieve '%s' is canceled", fileInfo.MerkleTree.Hash)
+		}
+		if index >= len(fileInfo.MerkleTree.Links) || fileInfo.MerkleTree.Links[index].Hash != node.Hash {
+			return fmt.Errorf("Unsealed part %d '%s' isn't in original merkle tree", index, node.Hash)
+		}
+		if _, err := output.Write(data); err != nil {
+			return fmt.Errorf("Fatal error in writing '%s': %s", outputPath, err)
+		}
+		return nil
+	}
+
+	var merkleTree *merkletree.MerkleTreeNode
+	if wsc.Cfg.Tee.Mode == tee.ModeStream {
+		if merkleTree, err = wsc.Tee.UnsealStream(merkleTreeSealed, getSealedPart, mergePart); err != nil {
+			return err
+		}
+	} else {
+		for index := range merkleTreeSealed.Links {
+			if _, err = getSealedPart(index, &merkleTreeSealed.Links[index]); err != nil {
+				return err
+			}
+		}
+
+		var unsealedPath string
+		if merkleTree, unsealedPath, err = wsc.Tee.Unseal(tempPath); err != nil {
+			return err
+		}
+		defer os.RemoveAll(unsealedPath)
+		if err = checkUnsealed(fileInfo.MerkleTree, merkleTree); err != nil {
+			return err
+		}
+
+		read := readPart(unsealedPath)
+		for index := range merkleTree.Links {
+			node := &merkleTree.Links[index]
+			data, err := read(index, node)
+			if err != nil {
+				return err
+			}
+			if err = tee.CheckPart(node.Hash, data); err != nil {
+				return fmt.Errorf("Unsealed part %d is broken: %s", index, err)
+			}
+			if err = mergePart(index, node, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return checkUnsealed(fileInfo.MerkleTree, merkleTree)
+}
+
+// checkUnsealed makes sure TEE gives back the original file
+func checkUnsealed(original *merkletree.MerkleTreeNode, unsealed *merkletree.MerkleTreeNode) error {
+	if !unsealed.IsLegal() {
+		return fmt.Errorf("Unsealed merkle tree '%s' is illegal", unsealed.Hash)
+	}
+	if unsealed.Hash != original.Hash {
+		return fmt.Errorf("Unsealed file is '%s', it should be '%s'", unsealed.Hash, original.Hash)
+	}
+	return nil
+}
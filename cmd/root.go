@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -12,6 +13,22 @@ var (
 	}
 )
 
+func init() {
+	// Flags override config file and KARST_* environment variables
+	flags := rootCmd.PersistentFlags()
+	flags.String("base-url", "", "override 'base_url' in config file")
+	flags.String("tee-base-url", "", "override 'tee_base_url' in config file")
+	flags.String("log-level", "", "override 'log_level' in config file")
+	flags.String("crust-base-url", "", "override 'crust.base_url' in config file")
+	flags.StringSlice("fastdfs-tracker-addrs", nil, "override 'fastdfs.tracker_addrs' in config file")
+
+	_ = viper.BindPFlag("base_url", flags.Lookup("base-url"))
+	_ = viper.BindPFlag("tee_base_url", flags.Lookup("tee-base-url"))
+	_ = viper.BindPFlag("log_level", flags.Lookup("log-level"))
+	_ = viper.BindPFlag("crust.base_url", flags.Lookup("crust-base-url"))
+	_ = viper.BindPFlag("fastdfs.tracker_addrs", flags.Lookup("fastdfs-tracker-addrs"))
+}
+
 // Execute executes the root command.
 func Execute() error {
 	return rootCmd.Execute()
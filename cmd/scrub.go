@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"karst/logger"
+	"karst/scrub"
+	"karst/wscmd"
+
+	"github.com/spf13/cobra"
+)
+
+type ScrubData struct {
+	Report *scrub.Report `json:"report"`
+}
+
+func init() {
+	scrubWsCmd.ConnectCmdAndWs()
+	scrubStatusWsCmd.ConnectCmdAndWs()
+	scrubWsCmd.Cmd.AddCommand(scrubStatusWsCmd.Cmd)
+	rootCmd.AddCommand(scrubWsCmd.Cmd)
+}
+
+var scrubWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "scrub",
+		Short: "Check and repair stored parts now",
+		Long:  "Re-hash parts in '$KARST_PATH/files/' against their names and merkle trees, corrupted parts are repaired from intact copies or sealed parts in fastdfs, the pass is limited by 'scrub.rate'",
+	},
+	Request: struct{}{},
+	Data:    ScrubData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return nil, nil
+	},
+	Async:      true,
+	WsEndpoint: "scrub",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		report, err := scrub.New(wsc.Db, wsc.Fs, wsc.Tee, wsc.Cfg).Run(ctx.Done())
+		if err == scrub.ErrRunning {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeConflict, "%s", err))
+		} else if err != nil {
+			logger.Error("Scrub failed: %s", err)
+			return wscmd.Failure(err)
+		}
+
+		return wscmd.Success(scrubInfo(report), ScrubData{
+			Report: report,
+		})
+	},
+}
+
+var scrubStatusWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "status",
+		Short: "Show the last scrubbing report",
+		Long:  "Show the report of the last scrubbing pass, run in background every 'scrub.interval' or by 'karst scrub'",
+	},
+	Request: struct{}{},
+	Data:    ScrubData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return nil, nil
+	},
+	WsEndpoint: "scrub/status",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		report, err := scrub.LastReport(wsc.Db)
+		if err != nil {
+			logger.Error("Get scrubbing report failed: %s", err)
+			return wscmd.Failure(err)
+		}
+		if report == nil {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeNotFound, "There is no scrubbing pass yet"))
+		}
+
+		return wscmd.Success(scrubInfo(report), ScrubData{
+			Report: report,
+		})
+	},
+}
+
+func scrubInfo(report *scrub.Report) string {
+	info := fmt.Sprintf("Scrubbed %d parts of %d files at %s, %d are corrupted and %d are repaired",
+		report.Parts, report.Files, report.FinishedAt.Format("2006-01-02 15:04:05"), len(report.Corruptions), report.Repaired())
+	if report.Interrupted {
+		info += ", the pass was interrupted"
+	}
+	return info
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"karst/config"
+	"karst/util"
+	"karst/wscmd"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestScrubStopsWithJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "karst_scrub_")
+	if err != nil {
+		t.Fatalf("Create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Open db: %s", err)
+	}
+	defer db.Close()
+
+	// One file of one part
+	data := []byte("part")
+	hash := sha256.Sum256(data)
+	root := sha256.Sum256(hash[:])
+	fileDir := filepath.Join(dir, hex.EncodeToString(root[:]))
+	if err := os.MkdirAll(fileDir, 0755); err != nil {
+		t.Fatalf("Create file directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fileDir, "0_"+hex.EncodeToString(hash[:])), data, 0644); err != nil {
+		t.Fatalf("Write part: %s", err)
+	}
+
+	wsc := &wscmd.WsCmd{
+		Db:  db,
+		Cfg: &config.Configuration{KarstPaths: &util.KarstPaths{FilesPath: dir}},
+	}
+
+	// Job cancel and daemon shutdown cancel ctx of the job
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp := scrubWsCmd.WsRunner(ctx, &struct{}{}, wsc)
+	expectStatus(t, "Scrub with canceled job", resp, 200)
+	report := resp.Data.(ScrubData).Report
+	if !report.Interrupted || report.Parts != 0 || !strings.Contains(resp.Info, "interrupted") {
+		t.Errorf("Scrub with canceled job checked %d parts: %s", report.Parts, resp.Info)
+	}
+
+	resp = scrubWsCmd.WsRunner(context.Background(), &struct{}{}, wsc)
+	expectStatus(t, "Scrub", resp, 200)
+	if report := resp.Data.(ScrubData).Report; report.Interrupted || report.Parts != 1 {
+		t.Errorf("Scrub checked %d parts: %s", report.Parts, resp.Info)
+	}
+}
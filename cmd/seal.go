@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"karst/capacity"
+	"karst/fs"
+	"karst/logger"
+	"karst/merkletree"
+	"karst/model"
+	"karst/order"
+	"karst/tee"
+	"karst/wscmd"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type SealRequest struct {
+	FileHash string `json:"file_hash" validate:"required" desc:"Merkle root hash of the file split into karst files directory"`
+}
+
+type SealData struct {
+	MerkleTreeSealed *merkletree.MerkleTreeNode `json:"merkle_tree_sealed"`
+	StoredKeys       []string                   `json:"stored_keys"`
+}
+
+func init() {
+	sealWsCmd.ConnectCmdAndWs()
+	rootCmd.AddCommand(sealWsCmd.Cmd)
+}
+
+var sealWsCmd = &wscmd.WsCmd{
+	Cmd: &cobra.Command{
+		Use:   "seal [file_hash]",
+		Short: "Seal file in TEE",
+		Long:  "Seal file split into '$KARST_PATH/files/file_hash/' in TEE and put sealed parts into fastdfs, parts are read by TEE itself or streamed to it by 'tee.mode'",
+		Args:  cobra.MinimumNArgs(1),
+	},
+	Request: SealRequest{},
+	Data:    SealData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return SealRequest{
+			FileHash: args[0],
+		}, nil
+	},
+	Async:      true,
+	WsEndpoint: "seal",
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
+		timeStart := time.Now()
+		req := r.(*SealRequest)
+		if wsc.Tee == nil {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeUnavailable, "TEE isn't configured"))
+		}
+		if fileInfo := model.GetFileInfoFromDb(req.FileHash, wsc.Db); fileInfo != nil && fileInfo.MerkleTreeSealed != nil {
+			return wscmd.Failure(wscmd.NewError(wscmd.CodeConflict, "'%s' is already sealed as '%s'", req.FileHash, fileInfo.MerkleTreeSealed.Hash))
+		}
+
+		fileInfo, err := sealFile(ctx, req.FileHash, wsc)
+		if err != nil {
+			logger.Error("%s", err)
+			return wscmd.Failure(err)
+		}
+
+		returnInfo := fmt.Sprintf("Seal '%s' successfully in %s ! Its sealed hash is '%s'.", req.FileHash, time.Since(timeStart), fileInfo.MerkleTreeSealed.Hash)
+		logger.Info(returnInfo)
+		return wscmd.Success(returnInfo, SealData{
+			MerkleTreeSealed: fileInfo.MerkleTreeSealed,
+			StoredKeys:       fileInfo.StoredKeys,
+		})
+	},
+}
+
+// sealFile seals parts in files directory, it stops between parts when ctx is canceled
+func sealFile(ctx context.Context, fileHash string, wsc *wscmd.WsCmd) (*model.FileInfo, error) {
+	partsPath := filepath.FromSlash(wsc.Cfg.KarstPaths.FilesPath + "/" + fileHash)
+	merkleTree, err := merkletree.CreateMerkleTreeFromDir(partsPath)
+	if err != nil {
+		return nil, err
+	}
+	if merkleTree.Hash != fileHash {
+		return nil, fmt.Errorf("Parts in '%s' are of '%s'", partsPath, merkleTree.Hash)
+	}
+
+	// Sealed parts are about as large as parts, they are counted in capacity while sealing
+	accountant := capacity.New(wsc.Db, wsc.Cfg, order.Usage)
+	release, err := accountant.Reserve(merkleTree.Size)
+	if err != nil {
+		return nil, capacityError(err)
+	}
+	defer release()
+
+	// Sealed parts are put into fs, they are deleted from fs if sealing fails
+	storedKeys := make([]string, 0)
+	storePart := func(index int, node *merkletree.MerkleTreeNode, data []byte) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Seal '%s' is canceled", fileHash)
+		}
+		key, err := putPart(wsc.Fs, wsc.Cfg.KarstPaths.TempFilesPath, node.Hash, data)
+		if err != nil {
+			return err
+		}
+		storedKeys = append(storedKeys, key)
+		return nil
+	}
+
+	var merkleTreeSealed *merkletree.MerkleTreeNode
+	if wsc.Cfg.Tee.Mode == tee.ModeStream {
+		read := readPart(partsPath)
+		merkleTreeSealed, err = wsc.Tee.SealStream(merkleTree, func(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("Seal '%s' is canceled", fileHash)
+			}
+			return read(index, node)
+		}, storePart)
+	} else {
+		var sealedPath string
+		if merkleTreeSealed, sealedPath, err = wsc.Tee.Seal(partsPath, merkleTree); err == nil {
+			err = storeSealedParts(sealedPath, merkleTreeSealed, storePart)
+		}
+	}
+	if err != nil {
+		for _, key := range storedKeys {
+			if err := wsc.Fs.Delete(key); err != nil {
+				logger.Warn("Delete sealed part '%s' failed: %s", key, err)
+			}
+		}
+		return nil, err
+	}
+
+	fileInfo := &model.FileInfo{
+		MerkleTree:       merkleTree,
+		MerkleTreeSealed: merkleTreeSealed,
+		StoredPath:       partsPath,
+		StoredKeys:       storedKeys,
+	}
+	fileInfo.SaveToDb(wsc.Db)
+	if err = accountant.SealFile(merkleTree.Hash, merkleTreeSealed.Hash, merkleTreeSealed.Size); err != nil {
+		logger.Warn("Record usage of '%s' failed: %s", merkleTree.Hash, err)
+	}
+	return fileInfo, nil
+}
+
+// storeSealedParts moves parts sealed by TEE in sealedPath into fs
+func storeSealedParts(sealedPath string, merkleTreeSealed *merkletree.MerkleTreeNode, storePart tee.PartWriter) error {
+	read := readPart(sealedPath)
+	for index := range merkleTreeSealed.Links {
+		node := &merkleTreeSealed.Links[index]
+		data, err := read(index, node)
+		if err != nil {
+			return err
+		}
+		if err = storePart(index, node, data); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(sealedPath); err != nil {
+		logger.Warn("Remove sealed parts in '%s' failed: %s", sealedPath, err)
+	}
+	return nil
+}
+
+// readPart reads parts named 'index_hash' in dir
+func readPart(dir string) tee.PartReader {
+	return func(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+		partPath := filepath.FromSlash(dir + "/" + strconv.Itoa(index) + "_" + node.Hash)
+		data, err := ioutil.ReadFile(partPath)
+		if err != nil {
+			return nil, fmt.Errorf("Read part '%s' failed: %s", partPath, err)
+		}
+		return data, nil
+	}
+}
+
+// putPart puts data into fs through a temporary file named by hash and a unique suffix, jobs sealing the same part
+// don't share it
+func putPart(fs fs.FsInterface, tempPath string, hash string, data []byte) (string, error) {
+	partFile, err := ioutil.TempFile(tempPath, hash+"_*")
+	if err != nil {
+		return "", fmt.Errorf("Create temporary file of part '%s' failed: %s", hash, err)
+	}
+	partPath := partFile.Name()
+	defer os.Remove(partPath)
+
+	_, err = partFile.Write(data)
+	if closeErr := partFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Write part '%s' failed: %s", partPath, err)
+	}
+
+	key, err := fs.Put(partPath)
+	if err != nil {
+		return "", fmt.Errorf("Put part '%s' into fs failed: %s", hash, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFs keeps files put into it in memory, Put takes a while like uploading does
+type memFs struct {
+	lock  sync.Mutex
+	files map[string][]byte
+}
+
+func newMemFs() *memFs {
+	return &memFs{files: make(map[string][]byte)}
+}
+
+func (m *memFs) Close() {}
+
+func (m *memFs) Put(fileName string) (string, error) {
+	time.Sleep(10 * time.Millisecond)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := fmt.Sprintf("group1/%d", len(m.files))
+	m.files[key] = data
+	return key, nil
+}
+
+func (m *memFs) Get(key string, outFileName string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.files[key]
+	if !ok {
+		return fmt.Errorf("Key '%s' not found", key)
+	}
+	return ioutil.WriteFile(outFileName, data, 0644)
+}
+
+func (m *memFs) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.files, key)
+	return nil
+}
+
+func (m *memFs) Ping() error {
+	return nil
+}
+
+func TestPutSamePartConcurrently(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "karst_seal_")
+	if err != nil {
+		t.Fatalf("Create temp dir: %s", err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	fs := newMemFs()
+	data := bytes.Repeat([]byte("part"), 1024)
+	hash := "5e9b98f62cf8b6ba6b8a9b1ab55ab5ed4dbd1be9b9e8a0b7c5a1d4c2b3a49586"
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := putPart(fs, tempPath, hash, data); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Put part: %s", err)
+	}
+
+	if len(fs.files) != 8 {
+		t.Errorf("Got %d parts in fs, want 8", len(fs.files))
+	}
+	for key, put := range fs.files {
+		if !bytes.Equal(put, data) {
+			t.Errorf("Part '%s' in fs is %d bytes, want %d", key, len(put), len(data))
+		}
+	}
+	if files, _ := ioutil.ReadDir(tempPath); len(files) != 0 {
+		t.Errorf("%d temporary files are left", len(files))
+	}
+}
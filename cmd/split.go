@@ -1,14 +1,20 @@
 package cmd
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"karst/capacity"
 	"karst/config"
 	"karst/logger"
 	"karst/merkletree"
+	"karst/metrics"
 	"karst/model"
+	"karst/order"
+	"karst/store"
 	"karst/util"
 	"karst/wscmd"
 	"math"
@@ -22,10 +28,21 @@ import (
 	"github.com/spf13/cobra"
 )
 
-type SplitReturnMsg struct {
-	Info       string `json:"info"`
-	MerkleTree string `json:"merkle_tree"`
-	Status     int    `json:"status"`
+type SplitRequest struct {
+	FilePath   string `json:"file_path" validate:"required" desc:"Absolute path of the file to split"`
+	OutputPath string `json:"output_path" validate:"required" desc:"Absolute path of the directory to save parts"`
+}
+
+type SplitData struct {
+	MerkleTree *merkletree.MerkleTreeNode `json:"merkle_tree"`
+}
+
+func (req *SplitRequest) Validate() error {
+	req.OutputPath = strings.TrimRight(strings.TrimRight(req.OutputPath, "/"), "\\")
+	if req.OutputPath == "" {
+		return errors.New("Output path is needed")
+	}
+	return nil
 }
 
 func init() {
@@ -40,63 +57,65 @@ var splitWsCmd = &wscmd.WsCmd{
 		Long:  "Split file to merkle tree structure, splited files will be saved in output_path/root_hash/",
 		Args:  cobra.MinimumNArgs(2),
 	},
-	Connecter: func(cmd *cobra.Command, args []string) (map[string]string, error) {
-		reqBody := map[string]string{
-			"file_path":   args[0],
-			"output_path": args[1],
-		}
-
-		return reqBody, nil
+	Request: SplitRequest{},
+	Data:    SplitData{},
+	Connecter: func(cmd *cobra.Command, args []string) (interface{}, error) {
+		return SplitRequest{
+			FilePath:   args[0],
+			OutputPath: args[1],
+		}, nil
 	},
+	Async:      true,
 	WsEndpoint: "split",
-	WsRunner: func(args map[string]string, wsc *wscmd.WsCmd) interface{} {
+	WsRunner: func(ctx context.Context, r interface{}, wsc *wscmd.WsCmd) *wscmd.Response {
 		timeStart := time.Now()
-
-		// Check input
-		filePath := args["file_path"]
-		if filePath == "" {
-			errString := "File path is needed"
-			logger.Error(errString)
-			return SplitReturnMsg{
-				Info:   errString,
-				Status: 400,
-			}
-		}
-
-		outputPath := strings.TrimRight(strings.TrimRight(args["output_path"], "/"), "\\")
-		if outputPath == "" {
-			errString := "Output path is needed"
-			logger.Error(errString)
-			return SplitReturnMsg{
-				Info:   errString,
-				Status: 400,
+		req := r.(*SplitRequest)
+
+		// Parts split into files directory are kept once in part store and counted in capacity
+		var st *store.Store
+		var accountant *capacity.Accountant
+		if filepath.Clean(req.OutputPath) == filepath.Clean(wsc.Cfg.KarstPaths.FilesPath) {
+			st = store.New(wsc.Db, wsc.Cfg.KarstPaths)
+			accountant = capacity.New(wsc.Db, wsc.Cfg, order.Usage)
+			if fileStat, err := os.Stat(req.FilePath); err == nil {
+				release, err := accountant.Reserve(uint64(fileStat.Size()))
+				if err != nil {
+					logger.Error("Split '%s' is rejected: %s", req.FilePath, err)
+					return wscmd.Failure(capacityError(err))
+				}
+				defer release()
 			}
 		}
 
-		fileInfo, err := splitFile(filePath, outputPath, wsc.Cfg)
+		fileInfo, err := splitFile(ctx, req.FilePath, req.OutputPath, wsc.Cfg, st)
 		if err != nil {
 			logger.Error("%s", err)
 			fileInfo.ClearFile()
-			return SplitReturnMsg{
-				Info:   err.Error(),
-				Status: 500,
+			return wscmd.Failure(err)
+		}
+
+		if accountant != nil {
+			if err = accountant.SaveFile(fileInfo.MerkleTree.Hash, fileInfo.MerkleTree.Size); err != nil {
+				logger.Warn("Record usage of '%s' failed: %s", fileInfo.MerkleTree.Hash, err)
 			}
 		}
 
 		merkleTreeBytes, _ := json.Marshal(fileInfo.MerkleTree)
 		logger.Debug("Splited merkleTree is %s", string(merkleTreeBytes))
 
-		returnInfo := fmt.Sprintf("Split '%s' successfully in %s ! It root hash is '%s'.", filePath, time.Since(timeStart), fileInfo.MerkleTree.Hash)
+		returnInfo := fmt.Sprintf("Split '%s' successfully in %s ! It root hash is '%s'.", req.FilePath, time.Since(timeStart), fileInfo.MerkleTree.Hash)
 		logger.Info(returnInfo)
-		return SplitReturnMsg{
-			Info:       returnInfo,
-			MerkleTree: string(merkleTreeBytes),
-			Status:     200,
-		}
+		return wscmd.Success(returnInfo, SplitData{
+			MerkleTree: fileInfo.MerkleTree,
+		})
 	},
 }
 
-func splitFile(filePath string, outputPath string, cfg *config.Configuration) (*model.FileInfo, error) {
+// splitFile writes parts into 'outputPath/root_hash', they are linked to part store st if it isn't nil.
+// It stops when ctx is canceled
+func splitFile(ctx context.Context, filePath string, outputPath string, cfg *config.Configuration, st *store.Store) (*model.FileInfo, error) {
+	timeStart := time.Now()
+
 	// Create file information class
 	fileInfo := &model.FileInfo{
 		StoredPath:       "",
@@ -132,6 +151,10 @@ func splitFile(filePath string, outputPath string, cfg *config.Configuration) (*
 	logger.Info("Splitting '%s' to %d parts.", filePath, totalPartsNum)
 	bar := pb.StartNew(int(totalPartsNum))
 	for i := uint64(0); i < totalPartsNum; i++ {
+		if ctx.Err() != nil {
+			return fileInfo, fmt.Errorf("Split '%s' is canceled", filePath)
+		}
+
 		// Bar
 		bar.Increment()
 
@@ -150,7 +173,19 @@ func splitFile(filePath string, outputPath string, cfg *config.Configuration) (*
 		partHashString := hex.EncodeToString(partHash[:])
 		partFileName := filepath.FromSlash(fileInfo.StoredPath + "/" + strconv.FormatUint(i, 10) + "_" + partHashString)
 
-		// Write to disk
+		// Write to disk, or link the part in store
+		if st != nil {
+			if _, err = st.Put(partHashString, partBuffer); err != nil {
+				return fileInfo, fmt.Errorf("Fatal error in keeping the part '%s' of '%s' in store: %s", partHashString, filePath, err)
+			}
+			if err = st.Link(partHashString, partFileName); err != nil {
+				return fileInfo, fmt.Errorf("Fatal error in linking the part '%s' of '%s': %s", partFileName, filePath, err)
+			}
+			metrics.SplitParts.Inc()
+			metrics.SplitBytes.Add(float64(partSize))
+			continue
+		}
+
 		partFile, err := os.Create(partFileName)
 		if err != nil {
 			return fileInfo, fmt.Errorf("Fatal error in creating the part '%s' of '%s': %s", partFileName, filePath, err)
@@ -160,6 +195,8 @@ func splitFile(filePath string, outputPath string, cfg *config.Configuration) (*
 			return fileInfo, fmt.Errorf("Fatal error in writing the part '%s' of '%s': %s", partFileName, filePath, err)
 		}
 		partFile.Close()
+		metrics.SplitParts.Inc()
+		metrics.SplitBytes.Add(float64(partSize))
 	}
 	bar.Finish()
 
@@ -179,6 +216,12 @@ func splitFile(filePath string, outputPath string, cfg *config.Configuration) (*
 	}
 
 	fileInfo.MerkleTree = fileMerkleTree
+	if st != nil {
+		if err = st.AddFile(fileMerkleTree); err != nil {
+			logger.Warn("Record parts of '%s' in store failed, they are kept in '%s' only: %s", fileMerkleTree.Hash, fileInfo.StoredPath, err)
+		}
+	}
+	metrics.SplitDuration.Observe(time.Since(timeStart).Seconds())
 
 	return fileInfo, nil
 }
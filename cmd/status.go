@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"karst/config"
+	"karst/health"
+	"karst/logger"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/imroc/req"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show status of karst daemon",
+	Long:  "Show status of karst daemon and its dependencies (leveldb, fastdfs, TEE and crust api), exit with non-zero code if daemon isn't ready",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.GetInstance()
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(-1)
+		}
+
+		r := req.New()
+		r.SetTimeout(10 * time.Second)
+		resp, err := r.Get("http://" + cfg.BaseUrl + "/health")
+		if err != nil {
+			logger.Error("Karst daemon at '%s' is unreachable: %s", cfg.BaseUrl, err)
+			os.Exit(-1)
+		}
+
+		report := health.Report{}
+		if err = resp.ToJSON(&report); err != nil {
+			logger.Error("Wrong health report: %s", err)
+			os.Exit(-1)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Karst daemon at '%s' is %s\n\n", cfg.BaseUrl, report.Status)
+		fmt.Fprintln(w, "COMPONENT\tSTATUS\tLATENCY\tINFO")
+		for _, component := range report.Components {
+			latency := "-"
+			if component.Status != health.StatusDisabled {
+				latency = fmt.Sprintf("%.1fms", component.Latency)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", component.Name, component.Status, latency, component.Info)
+		}
+		w.Flush()
+
+		if !report.Ready {
+			os.Exit(-1)
+		}
+	},
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+const version = "0.1.0"
+
 func init() {
 	rootCmd.AddCommand(versionCmd)
 }
@@ -15,6 +17,6 @@ var versionCmd = &cobra.Command{
 	Short: "Karst version",
 	Long:  `Karst version`,
 	Run: func(cmd *cobra.Command, args []string) {
-		logger.Info("Karst 0.1.0")
+		logger.Info("Karst %s", version)
 	},
 }
@@ -1,19 +1,28 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"karst/keystore"
 	"karst/logger"
 	"karst/util"
-	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type CrustConfiguration struct {
+	Backend  string
 	BaseUrl  string
 	Backup   string
 	Address  string
 	Password string
+	Timeout  time.Duration
+	Retries  int
 }
 
 type FastdfsConfiguration struct {
@@ -21,95 +30,478 @@ type FastdfsConfiguration struct {
 	MaxConns     int
 }
 
+type LogConfiguration struct {
+	Format     string
+	Levels     map[string]string
+	File       string
+	MaxSize    int
+	MaxBackups int
+}
+
+type TeeConfiguration struct {
+	Mode     string
+	Timeout  time.Duration
+	MaxSeals int
+}
+
+type JobConfiguration struct {
+	MaxConcurrency int
+	// Finished jobs are removed after it, 0 keeps them
+	Retention time.Duration
+}
+
+type KeystoreConfiguration struct {
+	PassphraseFile string
+}
+
+type ProviderConfiguration struct {
+	Policy string
+	Count  int
+}
+
+type ScrubConfiguration struct {
+	Interval time.Duration
+	// MB read per second
+	Rate int
+}
+
+type GcConfiguration struct {
+	Age time.Duration
+}
+
+type CapacityConfiguration struct {
+	Total int64
+	// Bytes of headroom kept out of total
+	Reserved int64
+}
+
 type Configuration struct {
-	KarstPaths   *util.KarstPaths
-	BaseUrl      string
-	FilePartSize uint64
-	TeeBaseUrl   string
-	LogLevel     string
-	Crust        CrustConfiguration
-	Fastdfs      FastdfsConfiguration
+	KarstPaths      *util.KarstPaths
+	BaseUrl         string
+	FilePartSize    uint64
+	TeeBaseUrl      string
+	LogLevel        string
+	ShutdownTimeout time.Duration
+	Log             LogConfiguration
+	Crust           CrustConfiguration
+	Fastdfs         FastdfsConfiguration
+	Tee             TeeConfiguration
+	Job             JobConfiguration
+	Keystore        KeystoreConfiguration
+	Provider        ProviderConfiguration
+	Capacity        CapacityConfiguration
+	Scrub           ScrubConfiguration
+	Gc              GcConfiguration
+	// Guards the fields Reload changes: log_level, log.levels, job.max_concurrency and shutdown_timeout
+	reloadLock sync.RWMutex
 }
 
+// Environment variables like 'KARST_CRUST_BASE_URL' override 'crust.base_url' in config file
+const EnvPrefix = "KARST"
+
 var config *Configuration
+var configErr error
 var once sync.Once
 
-func GetInstance() *Configuration {
+// GetInstance reads configuration once, values are overridden by bound command-line flags and KARST_* environment variables
+func GetInstance() (*Configuration, error) {
 	once.Do(func() {
-		// Get base karst paths
-		karstPaths := util.GetKarstPaths()
+		config, configErr = load()
+		if configErr != nil {
+			return
+		}
 
-		// Check directory
-		if !util.IsDirOrFileExist(karstPaths.KarstPath) || !util.IsDirOrFileExist(karstPaths.ConfigFilePath) {
-			logger.Warn("Karst execution space '%s' is not initialized, please run 'karst init' to initialize karst.", karstPaths.KarstPath)
-			os.Exit(-1)
+		if err := config.applyLog(); err != nil {
+			configErr = err
 		}
+	})
+
+	return config, configErr
+}
+
+func load() (*Configuration, error) {
+	cfg, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	validation := cfg.Validate()
+	for _, warning := range validation.Warnings {
+		logger.Warn("%s", warning)
+	}
+	if err := validation.Err(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Inspect reads configuration like GetInstance but returns the problems instead of failing
+func Inspect() (*Configuration, *Validation, error) {
+	cfg, err := read()
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// Read configuration
-		viper.SetConfigFile(karstPaths.ConfigFilePath)
-		if err := viper.ReadInConfig(); err != nil {
-			logger.Error("Fatal error in reading config file: %s", err)
-			os.Exit(-1)
+	return cfg, cfg.Validate(), nil
+}
+
+func read() (*Configuration, error) {
+	// Get base karst paths
+	karstPaths := util.GetKarstPaths()
+
+	// Check directory
+	if !util.IsDirOrFileExist(karstPaths.KarstPath) || !util.IsDirOrFileExist(karstPaths.ConfigFilePath) {
+		return nil, fmt.Errorf("Karst execution space '%s' is not initialized, please run 'karst init' to initialize karst.", karstPaths.KarstPath)
+	}
+
+	// Read configuration
+	viper.SetConfigFile(karstPaths.ConfigFilePath)
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Fatal error in reading config file: %s", err)
+	}
+
+	return fromViper(viper.GetViper(), karstPaths), nil
+}
+
+func fromViper(v *viper.Viper, karstPaths *util.KarstPaths) *Configuration {
+	cfg := &Configuration{}
+	cfg.KarstPaths = karstPaths
+	cfg.FilePartSize = 1 * (1 << 20) // 1 MB
+	cfg.BaseUrl = v.GetString("base_url")
+	cfg.TeeBaseUrl = v.GetString("tee_base_url")
+	cfg.LogLevel = v.GetString("log_level")
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	cfg.ShutdownTimeout = time.Duration(v.GetInt("shutdown_timeout")) * time.Second
+	if !v.IsSet("shutdown_timeout") {
+		cfg.ShutdownTimeout = time.Duration(defaults["shutdown_timeout"].(int)) * time.Second
+	}
+	cfg.Log.Format = v.GetString("log.format")
+	cfg.Log.Levels = v.GetStringMapString("log.levels")
+	cfg.Log.File = v.GetString("log.file")
+	if cfg.Log.File != "" && !filepath.IsAbs(cfg.Log.File) {
+		cfg.Log.File = filepath.Join(karstPaths.KarstPath, cfg.Log.File)
+	}
+	cfg.Log.MaxSize = v.GetInt("log.max_size")
+	cfg.Log.MaxBackups = v.GetInt("log.max_backups")
+	cfg.Crust.Backend = v.GetString("crust.backend")
+	if cfg.Crust.Backend == "" {
+		cfg.Crust.Backend = defaults["crust.backend"].(string)
+	}
+	cfg.Crust.BaseUrl = v.GetString("crust.base_url")
+	cfg.Crust.Backup = v.GetString("crust.backup")
+	cfg.Crust.Address = v.GetString("crust.address")
+	cfg.Crust.Password = v.GetString("crust.password")
+	cfg.Crust.Timeout = time.Duration(v.GetInt("crust.timeout")) * time.Second
+	if !v.IsSet("crust.timeout") {
+		cfg.Crust.Timeout = time.Duration(defaults["crust.timeout"].(int)) * time.Second
+	}
+	cfg.Crust.Retries = v.GetInt("crust.retries")
+	if !v.IsSet("crust.retries") {
+		cfg.Crust.Retries = defaults["crust.retries"].(int)
+	}
+	cfg.Tee.Mode = v.GetString("tee.mode")
+	if cfg.Tee.Mode == "" {
+		cfg.Tee.Mode = defaults["tee.mode"].(string)
+	}
+	cfg.Tee.Timeout = time.Duration(v.GetInt("tee.timeout")) * time.Second
+	if !v.IsSet("tee.timeout") {
+		cfg.Tee.Timeout = time.Duration(defaults["tee.timeout"].(int)) * time.Second
+	}
+	cfg.Tee.MaxSeals = v.GetInt("tee.max_seals")
+	if !v.IsSet("tee.max_seals") {
+		cfg.Tee.MaxSeals = defaults["tee.max_seals"].(int)
+	}
+	cfg.Fastdfs.TrackerAddrs = v.GetStringSlice("fastdfs.tracker_addrs")
+	cfg.Fastdfs.MaxConns = v.GetInt("fastdfs.max_conns")
+	cfg.Job.MaxConcurrency = v.GetInt("job.max_concurrency")
+	if !v.IsSet("job.max_concurrency") {
+		cfg.Job.MaxConcurrency = defaults["job.max_concurrency"].(int)
+	}
+	cfg.Job.Retention = time.Duration(v.GetInt("job.retention")) * time.Second
+	if !v.IsSet("job.retention") {
+		cfg.Job.Retention = time.Duration(defaults["job.retention"].(int)) * time.Second
+	}
+	cfg.Keystore.PassphraseFile = v.GetString("keystore.passphrase_file")
+	if cfg.Keystore.PassphraseFile != "" && !filepath.IsAbs(cfg.Keystore.PassphraseFile) {
+		cfg.Keystore.PassphraseFile = filepath.Join(karstPaths.KarstPath, cfg.Keystore.PassphraseFile)
+	}
+	cfg.Provider.Policy = v.GetString("provider.policy")
+	if cfg.Provider.Policy == "" {
+		cfg.Provider.Policy = defaults["provider.policy"].(string)
+	}
+	cfg.Provider.Count = v.GetInt("provider.count")
+	if !v.IsSet("provider.count") {
+		cfg.Provider.Count = defaults["provider.count"].(int)
+	}
+	cfg.Capacity.Total = v.GetInt64("capacity.total")
+	cfg.Capacity.Reserved = v.GetInt64("capacity.reserved")
+	cfg.Scrub.Interval = time.Duration(v.GetInt("scrub.interval")) * time.Second
+	if !v.IsSet("scrub.interval") {
+		cfg.Scrub.Interval = time.Duration(defaults["scrub.interval"].(int)) * time.Second
+	}
+	cfg.Scrub.Rate = v.GetInt("scrub.rate")
+	if !v.IsSet("scrub.rate") {
+		cfg.Scrub.Rate = defaults["scrub.rate"].(int)
+	}
+	cfg.Gc.Age = time.Duration(v.GetInt("gc.age")) * time.Second
+	if !v.IsSet("gc.age") {
+		cfg.Gc.Age = time.Duration(defaults["gc.age"].(int)) * time.Second
+	}
+
+	return cfg
+}
+
+func (cfg *Configuration) applyLog() error {
+	return logger.Configure(logger.Options{
+		Level:      cfg.LogLevel,
+		Levels:     cfg.Log.Levels,
+		Format:     cfg.Log.Format,
+		File:       cfg.Log.File,
+		MaxSize:    cfg.Log.MaxSize,
+		MaxBackups: cfg.Log.MaxBackups,
+	})
+}
+
+// Reload reads configuration again and applies the settings which are safe to change while running:
+// log levels, job concurrency and shutdown timeout, the changed names of other settings are returned
+func (cfg *Configuration) Reload() ([]string, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Fatal error in reading config file: %s", err)
+	}
+
+	newCfg := fromViper(viper.GetViper(), cfg.KarstPaths)
+	if keystore.Exists(cfg.KarstPaths.KeystorePath) {
+		newCfg.Crust.Backup = cfg.Crust.Backup
+		newCfg.Crust.Password = cfg.Crust.Password
+	}
+	validation := newCfg.Validate()
+	for _, warning := range validation.Warnings {
+		logger.Warn("%s", warning)
+	}
+	if err := validation.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := logger.SetLevels(newCfg.LogLevel, newCfg.Log.Levels); err != nil {
+		return nil, err
+	}
+	cfg.reloadLock.Lock()
+	cfg.LogLevel = newCfg.LogLevel
+	cfg.Log.Levels = newCfg.Log.Levels
+	cfg.Job.MaxConcurrency = newCfg.Job.MaxConcurrency
+	cfg.ShutdownTimeout = newCfg.ShutdownTimeout
+	cfg.reloadLock.Unlock()
+
+	unapplied := make([]string, 0)
+	oldItems := cfg.Items(false)
+	for _, item := range newCfg.Items(false) {
+		for _, oldItem := range oldItems {
+			if item.Key == oldItem.Key && item.Value != oldItem.Value {
+				unapplied = append(unapplied, item.Key)
+			}
 		}
+	}
+
+	return unapplied, nil
+}
+
+// GetShutdownTimeout can be called while Reload changes it
+func (cfg *Configuration) GetShutdownTimeout() time.Duration {
+	cfg.reloadLock.RLock()
+	defer cfg.reloadLock.RUnlock()
+	return cfg.ShutdownTimeout
+}
 
-		// Set configuration
-		config = &Configuration{}
-		config.KarstPaths = karstPaths
-		config.FilePartSize = 1 * (1 << 20) // 1 MB
-		config.BaseUrl = viper.GetString("base_url")
-		if config.BaseUrl == "" {
-			logger.Error("Need 'base_url' in config file")
-			os.Exit(-1)
+// GetJobMaxConcurrency can be called while Reload changes it
+func (cfg *Configuration) GetJobMaxConcurrency() int {
+	cfg.reloadLock.RLock()
+	defer cfg.reloadLock.RUnlock()
+	return cfg.Job.MaxConcurrency
+}
+
+// UnlockAccount reads crust backup and password from keystore, passphrase comes from KARST_KEYSTORE_PASSPHRASE,
+// 'keystore.passphrase_file' or terminal. Plaintext ones in config file are only used if there is no keystore
+func (cfg *Configuration) UnlockAccount() error {
+	if !keystore.Exists(cfg.KarstPaths.KeystorePath) {
+		if cfg.Crust.Backup != "" || cfg.Crust.Password != "" {
+			logger.Warn("Crust backup and password are plaintext in config file, please run 'karst keystore migrate'")
 		}
-		config.TeeBaseUrl = viper.GetString("tee_base_url")
-		config.LogLevel = viper.GetString("log_level")
-		config.Crust.BaseUrl = viper.GetString("crust.base_url")
-		config.Crust.Backup = viper.GetString("crust.backup")
-		config.Crust.Address = viper.GetString("crust.address")
-		config.Crust.Password = viper.GetString("crust.password")
-		config.Fastdfs.TrackerAddrs = viper.GetStringSlice("fastdfs.tracker_addrs")
-		config.Fastdfs.MaxConns = viper.GetInt("fastdfs.max_conns")
-
-		// Use configuration
-		if config.LogLevel == "debug" {
-			logger.OpenDebug()
-		} else {
-			config.LogLevel = "info"
+		return nil
+	}
+
+	passphrase, err := keystore.GetPassphrase(cfg.Keystore.PassphraseFile, "Keystore passphrase: ")
+	if err != nil {
+		return err
+	}
+	account, err := keystore.Unlock(cfg.KarstPaths.KeystorePath, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Crust.Backup != "" || cfg.Crust.Password != "" {
+		logger.Warn("Crust backup and password in config file are ignored, keystore is used")
+	}
+	cfg.Crust.Backup = account.Backup
+	cfg.Crust.Password = account.Password
+	return nil
+}
+
+type Item struct {
+	Key   string
+	Value string
+}
+
+// Items lists configuration as key/value strings, secrets are masked unless showSecrets is true
+func (cfg *Configuration) Items(showSecrets bool) []Item {
+	mask := func(secret string) string {
+		if showSecrets || secret == "" {
+			return secret
 		}
-	})
+		return "******"
+	}
 
-	return config
+	cfg.reloadLock.RLock()
+	defer cfg.reloadLock.RUnlock()
+	levels := make([]string, 0)
+	for pkg, level := range cfg.Log.Levels {
+		levels = append(levels, pkg+"="+level)
+	}
+
+	return []Item{
+		{"karst_path", cfg.KarstPaths.KarstPath},
+		{"base_url", cfg.BaseUrl},
+		{"tee_base_url", cfg.TeeBaseUrl},
+		{"log_level", cfg.LogLevel},
+		{"log.format", cfg.Log.Format},
+		{"log.levels", strings.Join(sortedStrings(levels), ",")},
+		{"log.file", cfg.Log.File},
+		{"log.max_size", fmt.Sprint(cfg.Log.MaxSize)},
+		{"log.max_backups", fmt.Sprint(cfg.Log.MaxBackups)},
+		{"shutdown_timeout", fmt.Sprint(int(cfg.ShutdownTimeout / time.Second))},
+		{"crust.backend", cfg.Crust.Backend},
+		{"crust.base_url", cfg.Crust.BaseUrl},
+		{"crust.address", cfg.Crust.Address},
+		{"crust.backup", mask(cfg.Crust.Backup)},
+		{"crust.password", mask(cfg.Crust.Password)},
+		{"crust.timeout", fmt.Sprint(int(cfg.Crust.Timeout / time.Second))},
+		{"crust.retries", fmt.Sprint(cfg.Crust.Retries)},
+		{"tee.mode", cfg.Tee.Mode},
+		{"tee.timeout", fmt.Sprint(int(cfg.Tee.Timeout / time.Second))},
+		{"tee.max_seals", fmt.Sprint(cfg.Tee.MaxSeals)},
+		{"fastdfs.tracker_addrs", strings.Join(cfg.Fastdfs.TrackerAddrs, ",")},
+		{"fastdfs.max_conns", fmt.Sprint(cfg.Fastdfs.MaxConns)},
+		{"job.max_concurrency", fmt.Sprint(cfg.Job.MaxConcurrency)},
+		{"job.retention", fmt.Sprint(int(cfg.Job.Retention / time.Second))},
+		{"keystore.passphrase_file", cfg.Keystore.PassphraseFile},
+		{"provider.policy", cfg.Provider.Policy},
+		{"provider.count", fmt.Sprint(cfg.Provider.Count)},
+		{"capacity.total", fmt.Sprint(cfg.Capacity.Total)},
+		{"capacity.reserved", fmt.Sprint(cfg.Capacity.Reserved)},
+		{"scrub.interval", fmt.Sprint(int(cfg.Scrub.Interval / time.Second))},
+		{"scrub.rate", fmt.Sprint(cfg.Scrub.Rate)},
+		{"gc.age", fmt.Sprint(int(cfg.Gc.Age / time.Second))},
+	}
 }
 
 func (cfg *Configuration) Show() {
-	logger.Info("KarstPath = %s", cfg.KarstPaths.KarstPath)
-	logger.Info("BaseUrl = %s", cfg.BaseUrl)
-	logger.Info("TeeBaseUrl = %s", cfg.TeeBaseUrl)
-	logger.Info("LogLevel = %s", cfg.LogLevel)
-	logger.Info("Crust.BaseUrl = %s", cfg.Crust.BaseUrl)
-	logger.Info("Crust.Address = %s", cfg.Crust.Address)
-}
-
-func WriteDefault(configFilePath string) {
-	viper.SetConfigType("json")
-	// Base configuration
-	viper.Set("base_url", "0.0.0.0:17000")
-	viper.Set("tee_base_url", "127.0.0.1:12222/api/v0")
-	viper.Set("log_level", "")
-
-	// Crust chain configuration
-	viper.Set("crust.base_url", "")
-	viper.Set("crust.backup", "")
-	viper.Set("crust.address", "")
-	viper.Set("crust.password", "")
-
-	// Fastdfs configuration
-	viper.Set("fastdfs.tracker_addrs", make([]string, 0))
-	viper.Set("fastdfs.max_conns", 100)
+	for _, item := range cfg.Items(false) {
+		logger.Info("%s = %s", item.Key, item.Value)
+	}
+}
+
+func WriteDefault(configFilePath string) error {
+	v := viper.New()
+	v.SetConfigType("json")
+	for key, value := range defaults {
+		v.Set(key, value)
+	}
 
 	// Write
-	if err := viper.WriteConfigAs(configFilePath); err != nil {
-		logger.Error("Fatal error in creating karst configuration file: %s\n", err)
-		os.Exit(-1)
+	if err := v.WriteConfigAs(configFilePath); err != nil {
+		return fmt.Errorf("Fatal error in creating karst configuration file: %s", err)
+	}
+
+	return nil
+}
+
+// Set writes one key into config file, the file is untouched if the value is invalid
+func Set(key string, value string) error {
+	karstPaths := util.GetKarstPaths()
+	if !util.IsDirOrFileExist(karstPaths.ConfigFilePath) {
+		return fmt.Errorf("Karst execution space '%s' is not initialized, please run 'karst init' to initialize karst.", karstPaths.KarstPath)
+	}
+
+	// Use a new viper, values from environment variables and flags shouldn't be written
+	v := viper.New()
+	v.SetConfigFile(karstPaths.ConfigFilePath)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("Fatal error in reading config file: %s", err)
+	}
+
+	// Errors which are already in config file don't block setting other keys
+	existing := make(map[FieldError]bool)
+	for _, e := range fromViper(v, karstPaths).Validate().Errors {
+		existing[e] = true
+	}
+
+	defaultValue, ok := defaults[key]
+	if strings.HasPrefix(key, "log.levels.") {
+		defaultValue, ok = "", true
+	}
+	if !ok {
+		keys := make([]string, 0, len(defaults))
+		for k := range defaults {
+			keys = append(keys, k)
+		}
+		return fmt.Errorf("Unknown key '%s', it should be one of: %s", key, strings.Join(sortedStrings(keys), ", "))
+	}
+
+	switch defaultValue.(type) {
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("'%s' should be an integer", key)
+		}
+		v.Set(key, n)
+	case []string:
+		items := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(key, items)
+	case map[string]string:
+		items := make(map[string]string)
+		if value != "" {
+			if err := json.Unmarshal([]byte(value), &items); err != nil {
+				return fmt.Errorf("'%s' should be a json object: %s", key, err)
+			}
+		}
+		v.Set(key, items)
+	default:
+		v.Set(key, value)
+	}
+
+	validation := fromViper(v, karstPaths).Validate()
+	introduced := &Validation{}
+	for _, e := range validation.Errors {
+		if !existing[e] {
+			introduced.Errors = append(introduced.Errors, e)
+		}
+	}
+	if err := introduced.Err(); err != nil {
+		return err
+	}
+
+	if err := v.WriteConfig(); err != nil {
+		return fmt.Errorf("Fatal error in writing config file: %s", err)
 	}
+	return nil
 }
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReload should be run with -race, readers use cfg while SIGHUP reloads it
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "karst_config_")
+	if err != nil {
+		t.Fatalf("Create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("KARST_PATH", os.Getenv("KARST_PATH"))
+	os.Setenv("KARST_PATH", dir)
+	configFile := filepath.Join(dir, "config.json")
+	if err := WriteDefault(configFile); err != nil {
+		t.Fatalf("Write default config: %s", err)
+	}
+
+	cfg, err := read()
+	if err != nil {
+		t.Fatalf("Read config: %s", err)
+	}
+	baseUrl := cfg.BaseUrl
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				cfg.GetShutdownTimeout()
+				cfg.GetJobMaxConcurrency()
+				cfg.Items(false)
+			}
+		}()
+	}
+
+	for i := 1; i <= 20; i++ {
+		if err := Set("shutdown_timeout", strconv.Itoa(i)); err != nil {
+			t.Fatalf("Set shutdown timeout: %s", err)
+		}
+		if err := Set("base_url", fmt.Sprintf("127.0.0.1:%d", 18000+i)); err != nil {
+			t.Fatalf("Set base url: %s", err)
+		}
+		unapplied, err := cfg.Reload()
+		if err != nil {
+			t.Fatalf("Reload: %s", err)
+		}
+		if cfg.GetShutdownTimeout() != time.Duration(i)*time.Second {
+			t.Errorf("Shutdown timeout is %s after reload, want %ds", cfg.GetShutdownTimeout(), i)
+		}
+		if strings.Join(unapplied, ",") != "base_url" {
+			t.Errorf("Unapplied settings are %v, want base_url", unapplied)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if cfg.BaseUrl != baseUrl {
+		t.Errorf("Base url is changed to '%s' by reload", cfg.BaseUrl)
+	}
+}
@@ -0,0 +1,273 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"karst/keystore"
+	"karst/logger"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Same as the least connections of fastdfs pool
+const fastdfsLeastConns = 5
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) String() string {
+	return fmt.Sprintf("'%s': %s", e.Field, e.Message)
+}
+
+type Validation struct {
+	Errors   []FieldError
+	Warnings []FieldError
+}
+
+func (v *Validation) errorf(field string, format string, a ...interface{}) {
+	v.Errors = append(v.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+}
+
+func (v *Validation) warnf(field string, format string, a ...interface{}) {
+	v.Warnings = append(v.Warnings, FieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+}
+
+// Err joins all errors into one, it is nil if configuration is valid
+func (v *Validation) Err() error {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+
+	messages := make([]string, 0, len(v.Errors))
+	for _, e := range v.Errors {
+		messages = append(messages, e.String())
+	}
+	return fmt.Errorf("Invalid configuration:\n  %s", strings.Join(messages, "\n  "))
+}
+
+// Validate checks every field, missing optional services are reported as warnings
+func (cfg *Configuration) Validate() *Validation {
+	v := &Validation{}
+
+	// Base
+	if cfg.BaseUrl == "" {
+		v.errorf("base_url", "is required, like '0.0.0.0:17000'")
+	} else if err := checkHostPort(cfg.BaseUrl); err != nil {
+		v.errorf("base_url", "%s, it should be like '0.0.0.0:17000'", err)
+	}
+
+	if cfg.TeeBaseUrl == "" {
+		v.warnf("tee_base_url", "is empty, seal and unseal are unavailable")
+	} else {
+		hostPort := strings.SplitN(cfg.TeeBaseUrl, "/", 2)[0]
+		if err := checkHostPort(hostPort); err != nil {
+			v.errorf("tee_base_url", "%s, it should be like '127.0.0.1:12222/api/v0'", err)
+		}
+	}
+
+	if cfg.Tee.Mode != "path" && cfg.Tee.Mode != "stream" {
+		v.errorf("tee.mode", "unknown mode '%s', it should be path or stream", cfg.Tee.Mode)
+	}
+	if cfg.Tee.Timeout <= 0 {
+		v.errorf("tee.timeout", "should be positive seconds")
+	}
+	if cfg.Tee.MaxSeals <= 0 {
+		v.errorf("tee.max_seals", "should be positive")
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		v.errorf("shutdown_timeout", "should be positive seconds")
+	}
+
+	// Log
+	if _, err := logger.ParseLevel(cfg.LogLevel); err != nil {
+		v.errorf("log_level", "%s", err)
+	}
+	if cfg.Log.Format != "" && cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		v.errorf("log.format", "unknown format '%s', it should be text or json", cfg.Log.Format)
+	}
+	for pkg, level := range cfg.Log.Levels {
+		if _, err := logger.ParseLevel(level); err != nil {
+			v.errorf("log.levels."+pkg, "%s", err)
+		}
+	}
+	if cfg.Log.MaxSize < 0 {
+		v.errorf("log.max_size", "should not be negative")
+	}
+	if cfg.Log.MaxBackups < 0 {
+		v.errorf("log.max_backups", "should not be negative")
+	}
+
+	// Crust
+	if cfg.Crust.Backend != "http" && cfg.Crust.Backend != "substrate" && cfg.Crust.Backend != "mock" {
+		v.errorf("crust.backend", "unknown backend '%s', it should be http, substrate or mock", cfg.Crust.Backend)
+	}
+	if cfg.Crust.Backend == "mock" {
+		v.warnf("crust.backend", "is mock, chain is simulated in memory and nothing is stored on crust")
+	} else if cfg.Crust.BaseUrl == "" {
+		v.warnf("crust.base_url", "is empty, register and storage orders are unavailable")
+	} else {
+		switch cfg.Crust.Backend {
+		case "http":
+			if u, err := url.Parse(cfg.Crust.BaseUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				v.errorf("crust.base_url", "should be a http url of crust api, like 'http://127.0.0.1:56666'")
+			}
+		case "substrate":
+			if u, err := url.Parse(cfg.Crust.BaseUrl); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+				v.errorf("crust.base_url", "should be a websocket url of crust node, like 'ws://127.0.0.1:9944'")
+			}
+		}
+
+		if cfg.Crust.Address == "" {
+			v.errorf("crust.address", "is required when crust.base_url is set")
+		}
+	}
+
+	if cfg.Crust.Timeout <= 0 {
+		v.errorf("crust.timeout", "should be positive seconds")
+	}
+	if cfg.Crust.Retries < 0 {
+		v.errorf("crust.retries", "should not be negative")
+	}
+
+	if keystore.Exists(cfg.KarstPaths.KeystorePath) {
+		if address, err := keystore.Address(cfg.KarstPaths.KeystorePath); err != nil {
+			v.errorf("keystore", "%s", err)
+		} else if cfg.Crust.Address != "" && address != cfg.Crust.Address {
+			v.errorf("crust.address", "'%s' doesn't match keystore address '%s'", cfg.Crust.Address, address)
+		}
+	} else if cfg.Crust.BaseUrl != "" {
+		if cfg.Crust.Password == "" {
+			v.errorf("crust.password", "is required when crust.base_url is set, or run 'karst keystore import' to create keystore")
+		}
+		if cfg.Crust.Backup == "" {
+			v.errorf("crust.backup", "is required when crust.base_url is set, or run 'karst keystore import' to create keystore")
+		} else {
+			backup := struct {
+				Address string `json:"address"`
+			}{}
+			if err := json.Unmarshal([]byte(cfg.Crust.Backup), &backup); err != nil {
+				v.errorf("crust.backup", "should be the json of account backup: %s", err)
+			} else if cfg.Crust.Address != "" && backup.Address != cfg.Crust.Address {
+				v.errorf("crust.backup", "address '%s' doesn't match crust.address '%s'", backup.Address, cfg.Crust.Address)
+			}
+		}
+		if cfg.Crust.Backup != "" || cfg.Crust.Password != "" {
+			v.warnf("crust.password", "is plaintext in config file, run 'karst keystore migrate' to move it into keystore")
+		}
+	}
+
+	// Fastdfs
+	if len(cfg.Fastdfs.TrackerAddrs) == 0 {
+		v.warnf("fastdfs.tracker_addrs", "is empty, files can't be stored")
+	} else {
+		for _, addr := range cfg.Fastdfs.TrackerAddrs {
+			if err := checkHostPort(addr); err != nil {
+				v.errorf("fastdfs.tracker_addrs", "'%s': %s", addr, err)
+			}
+		}
+		if cfg.Fastdfs.MaxConns < fastdfsLeastConns {
+			v.errorf("fastdfs.max_conns", "should be at least %d", fastdfsLeastConns)
+		}
+	}
+
+	// Job
+	if cfg.Job.MaxConcurrency <= 0 {
+		v.errorf("job.max_concurrency", "should be positive")
+	}
+	if cfg.Job.Retention < 0 {
+		v.errorf("job.retention", "should not be negative, 0 keeps finished jobs")
+	}
+
+	// Provider selection
+	if cfg.Provider.Policy != "cheapest" && cfg.Provider.Policy != "fastest" && cfg.Provider.Policy != "spread" {
+		v.errorf("provider.policy", "unknown policy '%s', it should be cheapest, fastest or spread", cfg.Provider.Policy)
+	}
+	if cfg.Provider.Count <= 0 {
+		v.errorf("provider.count", "should be positive")
+	}
+
+	// Capacity
+	if cfg.Capacity.Total < 0 {
+		v.errorf("capacity.total", "should not be negative")
+	}
+	if cfg.Capacity.Reserved < 0 {
+		v.errorf("capacity.reserved", "should not be negative")
+	} else if cfg.Capacity.Total > 0 && cfg.Capacity.Reserved >= cfg.Capacity.Total {
+		v.errorf("capacity.reserved", "should be less than 'capacity.total'")
+	}
+
+	// Scrub
+	if cfg.Scrub.Interval < 0 {
+		v.errorf("scrub.interval", "should not be negative, 0 disables background scrubbing")
+	}
+	if cfg.Scrub.Rate < 0 {
+		v.errorf("scrub.rate", "should not be negative, 0 means unlimited")
+	}
+
+	// Garbage collection
+	if cfg.Gc.Age < 0 {
+		v.errorf("gc.age", "should not be negative")
+	}
+
+	return v
+}
+
+func checkHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("wrong address '%s'", addr)
+	}
+	if host == "" {
+		return fmt.Errorf("host is missing in '%s'", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("wrong port in '%s'", addr)
+	}
+	return nil
+}
+
+// Default values, they also tell 'config set' the type of each key
+var defaults = map[string]interface{}{
+	"base_url":                 "0.0.0.0:17000",
+	"tee_base_url":             "127.0.0.1:12222/api/v0",
+	"log_level":                "",
+	"log.format":               "text",
+	"log.levels":               map[string]string{},
+	"log.file":                 "",
+	"log.max_size":             100,
+	"log.max_backups":          5,
+	"shutdown_timeout":         30,
+	"crust.backend":            "http",
+	"crust.base_url":           "",
+	"crust.backup":             "",
+	"crust.address":            "",
+	"crust.password":           "",
+	"crust.timeout":            60,
+	"crust.retries":            3,
+	"tee.mode":                 "path",
+	"tee.timeout":              600,
+	"tee.max_seals":            2,
+	"fastdfs.tracker_addrs":    []string{},
+	"fastdfs.max_conns":        100,
+	"job.max_concurrency":      2,
+	"job.retention":            604800,
+	"keystore.passphrase_file": "",
+	"provider.policy":          "cheapest",
+	"provider.count":           1,
+	"capacity.total":           0,
+	"capacity.reserved":        0,
+	"scrub.interval":           86400,
+	"scrub.rate":               10,
+	"gc.age":                   86400,
+}
+
+func sortedStrings(s []string) []string {
+	sort.Strings(s)
+	return s
+}
@@ -3,6 +3,8 @@ package fs
 import (
 	"karst/config"
 	"karst/fs/fastdfs"
+	"karst/metrics"
+	"time"
 )
 
 type Fastdfs struct {
@@ -25,13 +27,26 @@ func (this *Fastdfs) Close() {
 }
 
 func (this *Fastdfs) Put(fileName string) (string, error) {
-	return this.client.UploadByFilename(fileName)
+	timeStart := time.Now()
+	key, err := this.client.UploadByFilename(fileName)
+	metrics.ObserveFastdfs("put", err, timeStart)
+	return key, err
 }
 
 func (this *Fastdfs) Get(key string, outFileName string) error {
-	return this.client.DownloadToFile(key, outFileName, 0, 0)
+	timeStart := time.Now()
+	err := this.client.DownloadToFile(key, outFileName, 0, 0)
+	metrics.ObserveFastdfs("get", err, timeStart)
+	return err
+}
+
+func (this *Fastdfs) Ping() error {
+	return this.client.PingTrackers()
 }
 
 func (this *Fastdfs) Delete(key string) error {
-	return this.client.DeleteFile(key)
+	timeStart := time.Now()
+	err := this.client.DeleteFile(key)
+	metrics.ObserveFastdfs("delete", err, timeStart)
+	return err
 }
@@ -45,6 +45,41 @@ func (this *Client) Destory() {
 	}
 }
 
+// PingTrackers sends active test to every tracker, it fails if any tracker is unreachable
+func (this *Client) PingTrackers() error {
+	if len(this.trackerPools) == 0 {
+		return fmt.Errorf("no tracker is configured")
+	}
+
+	for addr, trackerPool := range this.trackerPools {
+		trackerConn, err := trackerPool.get()
+		if err != nil {
+			return fmt.Errorf("tracker '%s': %s", addr, err)
+		}
+
+		header := &header{
+			cmd: FDFS_PROTO_CMD_ACTIVE_TEST,
+		}
+		err = header.SendHeader(trackerConn)
+		if err == nil {
+			err = header.RecvHeader(trackerConn)
+		}
+		if err == nil && (header.cmd != TRACKER_PROTO_CMD_RESP || header.status != 0) {
+			err = fmt.Errorf("wrong active test response, cmd is %d and status is %d", header.cmd, header.status)
+		}
+
+		if err != nil {
+			// Broken connection shouldn't go back to pool
+			_ = trackerConn.(pConn).Conn.Close()
+			trackerPool.drop()
+			return fmt.Errorf("tracker '%s': %s", addr, err)
+		}
+		trackerConn.Close()
+	}
+
+	return nil
+}
+
 func (this *Client) UploadByFilename(fileName string) (string, error) {
 	fileInfo, err := newFileInfo(fileName, nil, "")
 	if err != nil {
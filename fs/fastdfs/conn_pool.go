@@ -3,6 +3,7 @@ package fastdfs
 import (
 	"container/list"
 	"fmt"
+	"karst/metrics"
 	"net"
 	"sync"
 	"time"
@@ -98,6 +99,7 @@ func (this *connPool) CheckConns() error {
 			continue
 		}
 	}
+	this.updateMetrics()
 	return nil
 }
 
@@ -111,6 +113,7 @@ func (this *connPool) makeConn() error {
 		pool: this,
 	})
 	this.count++
+	this.updateMetrics()
 	return nil
 }
 
@@ -129,6 +132,7 @@ func (this *connPool) get() (net.Conn, error) {
 		}
 		this.conns.Remove(e)
 		conn := e.Value.(pConn)
+		this.updateMetrics()
 		return conn, nil
 	}
 }
@@ -137,5 +141,20 @@ func (this *connPool) put(pConn pConn) error {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 	pConn.pool.conns.PushBack(pConn)
+	this.updateMetrics()
 	return nil
 }
+
+// drop forgets a connection which is taken from pool and closed by caller
+func (this *connPool) drop() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.count--
+	this.updateMetrics()
+}
+
+// updateMetrics should be called with lock held
+func (this *connPool) updateMetrics() {
+	metrics.FastdfsPoolConns.WithLabelValues(this.addr, "idle").Set(float64(this.conns.Len()))
+	metrics.FastdfsPoolConns.WithLabelValues(this.addr, "total").Set(float64(this.count))
+}
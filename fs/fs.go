@@ -5,4 +5,5 @@ type FsInterface interface {
 	Put(fileName string) (string, error)
 	Get(key string, outFileName string) error
 	Delete(key string) error
+	Ping() error
 }
@@ -0,0 +1,211 @@
+package gc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"karst/capacity"
+	"karst/config"
+	"karst/logger"
+	"karst/metrics"
+	"karst/model"
+	"karst/store"
+	"karst/util"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Kinds of garbage besides the ones of part store
+const (
+	KindSplitDir = "split_dir"
+	KindFileInfo = "file_info"
+	KindUsage    = "usage"
+)
+
+// Item is a piece of garbage, it is removed or fixed unless it is a dry run
+type Item struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Size   uint64 `json:"size"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	DryRun bool   `json:"dry_run"`
+	Items  []Item `json:"items"`
+	// Bytes removed, or to be removed in a dry run
+	Freed uint64 `json:"freed"`
+}
+
+// Collector removes what failed or interrupted work leaves behind: unfinished split directories, temporary files,
+// parts and records nothing references, and file records pointing at deleted data
+type Collector struct {
+	db    *leveldb.DB
+	store *store.Store
+	paths *util.KarstPaths
+	age   time.Duration
+}
+
+func New(db *leveldb.DB, cfg *config.Configuration) *Collector {
+	return &Collector{
+		db:    db,
+		store: store.New(db, cfg.KarstPaths),
+		paths: cfg.KarstPaths,
+		age:   cfg.Gc.Age,
+	}
+}
+
+// Run collects garbage older than age, nothing is changed if dryRun is true
+func (collector *Collector) Run(dryRun bool) (*Report, error) {
+	report := &Report{
+		DryRun: dryRun,
+		Items:  make([]Item, 0),
+	}
+	add := func(item Item, do func() error) {
+		if !dryRun {
+			if err := do(); err != nil {
+				item.Error = err.Error()
+			}
+		}
+		collector.record(report, item)
+	}
+
+	// Part store first, file records of deleted directories are dropped before file infos are checked
+	fixes, err := collector.store.Reconcile(collector.age, dryRun)
+	for _, fix := range fixes {
+		collector.record(report, Item(fix))
+	}
+	if err != nil {
+		return report, err
+	}
+
+	// Directories of unfinished splits are named by time instead of root hash
+	infos, err := ioutil.ReadDir(collector.paths.FilesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	for _, info := range infos {
+		path := filepath.Join(collector.paths.FilesPath, info.Name())
+		if !info.IsDir() || isHash(info.Name()) || time.Since(info.ModTime()) < collector.age {
+			continue
+		}
+		add(Item{Kind: KindSplitDir, Target: path, Size: dirSize(path), Reason: "Split isn't finished"}, func() error {
+			return os.RemoveAll(path)
+		})
+	}
+
+	// Temporary files of seal, retrieve and challenges
+	infos, err = ioutil.ReadDir(collector.paths.TempFilesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	for _, info := range infos {
+		path := filepath.Join(collector.paths.TempFilesPath, info.Name())
+		if time.Since(info.ModTime()) < collector.age {
+			continue
+		}
+		add(Item{Kind: store.FixTempFile, Target: path, Size: dirSize(path), Reason: "Temporary file is left"}, func() error {
+			return os.RemoveAll(path)
+		})
+	}
+
+	collector.fileInfos(report, add)
+	if err = collector.usages(add); err != nil {
+		return report, err
+	}
+
+	logger.Info("Garbage collection found %d items of %d bytes, dry run: %t", len(report.Items), report.Freed, dryRun)
+	return report, nil
+}
+
+// fileInfos drops file infos whose parts are gone from both disk and fs, the ones still sealed in fs forget their path
+func (collector *Collector) fileInfos(report *Report, add func(Item, func() error)) {
+	seen := make(map[string]bool)
+	iter := collector.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		hash := string(iter.Key())
+		if !isHash(hash) || seen[hash] {
+			continue
+		}
+		fileInfo := &model.FileInfo{}
+		if err := json.Unmarshal(iter.Value(), fileInfo); err != nil {
+			continue
+		}
+		if fileInfo.MerkleTree != nil {
+			seen[fileInfo.MerkleTree.Hash] = true
+		}
+		if fileInfo.MerkleTreeSealed != nil {
+			seen[fileInfo.MerkleTreeSealed.Hash] = true
+		}
+		if fileInfo.StoredPath == "" || util.IsDirOrFileExist(fileInfo.StoredPath) {
+			continue
+		}
+
+		if len(fileInfo.StoredKeys) == 0 {
+			add(Item{Kind: KindFileInfo, Target: hash, Reason: fmt.Sprintf("Parts in '%s' are deleted and nothing is in fs", fileInfo.StoredPath)}, func() error {
+				fileInfo.ClearDb(collector.db)
+				return nil
+			})
+			continue
+		}
+		add(Item{Kind: KindFileInfo, Target: hash, Reason: fmt.Sprintf("Parts in '%s' are deleted, sealed parts in fs are kept", fileInfo.StoredPath)}, func() error {
+			fileInfo.StoredPath = ""
+			fileInfo.SaveToDb(collector.db)
+			return nil
+		})
+	}
+}
+
+// usages drops capacity usage of files which are neither in files directory nor recorded, they would be counted forever
+func (collector *Collector) usages(add func(Item, func() error)) error {
+	files, err := capacity.Files(collector.db)
+	if err != nil {
+		return err
+	}
+	for _, usage := range files {
+		hash := usage.Hash
+		if util.IsDirOrFileExist(filepath.Join(collector.paths.FilesPath, hash)) || model.GetFileInfoFromDb(hash, collector.db) != nil {
+			continue
+		}
+		add(Item{Kind: KindUsage, Target: hash, Reason: "File is neither in files directory nor recorded"}, func() error {
+			return capacity.RemoveFile(collector.db, hash)
+		})
+	}
+	return nil
+}
+
+func (collector *Collector) record(report *Report, item Item) {
+	if item.Error != "" {
+		logger.Warn("Collect %s '%s' failed: %s", item.Kind, item.Target, item.Error)
+	} else {
+		report.Freed += item.Size
+		if !report.DryRun {
+			metrics.GcCollected.WithLabelValues(item.Kind).Inc()
+			metrics.GcFreedBytes.Add(float64(item.Size))
+		}
+	}
+	report.Items = append(report.Items, item)
+}
+
+func isHash(name string) bool {
+	hashBytes, err := hex.DecodeString(name)
+	return err == nil && len(hashBytes) == 32 && strings.ToLower(name) == name
+}
+
+func dirSize(path string) uint64 {
+	var size uint64
+	_ = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size
+}
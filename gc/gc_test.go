@@ -0,0 +1,145 @@
+package gc
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"karst/capacity"
+	"karst/config"
+	"karst/merkletree"
+	"karst/model"
+	"karst/store"
+	"karst/util"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func treeOf(data string) *merkletree.MerkleTreeNode {
+	hash := sha256.Sum256([]byte(data))
+	return merkletree.CreateMerkleTree([][]byte{hash[:]}, []uint64{uint64(len(data))})
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Create directory: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("Write file: %s", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "karst_gc_")
+	if err != nil {
+		t.Fatalf("Create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Open db: %s", err)
+	}
+	defer db.Close()
+	cfg := &config.Configuration{KarstPaths: &util.KarstPaths{
+		FilesPath:     filepath.Join(dir, "files"),
+		PartsPath:     filepath.Join(dir, "parts"),
+		TempFilesPath: filepath.Join(dir, "temp_files"),
+	}}
+	st := store.New(db, cfg.KarstPaths)
+	accountant := capacity.New(db, cfg, nil)
+
+	// A file in use
+	live := treeOf("live part")
+	liveDir := filepath.Join(cfg.KarstPaths.FilesPath, live.Hash)
+	writeFile(t, filepath.Join(liveDir, "0_"+live.Links[0].Hash), "live part")
+	if err := st.AddFile(live); err != nil {
+		t.Fatalf("Add file: %s", err)
+	}
+	if err := accountant.SaveFile(live.Hash, 9); err != nil {
+		t.Fatalf("Save usage: %s", err)
+	}
+	(&model.FileInfo{MerkleTree: live, MerkleTreeSealed: treeOf("live sealed"), StoredPath: liveDir}).SaveToDb(db)
+
+	// Garbage: unfinished split, temporary file, unreferenced part, file infos of deleted parts and usage of nothing
+	splitDir := filepath.Join(cfg.KarstPaths.FilesPath, "1600000000")
+	writeFile(t, filepath.Join(splitDir, "0_part"), "0123456789")
+	tempPath := filepath.Join(cfg.KarstPaths.TempFilesPath, "seal")
+	writeFile(t, tempPath, "01234")
+	orphan := treeOf("orphan!").Links[0].Hash
+	if _, err := st.Put(orphan, []byte("orphan!")); err != nil {
+		t.Fatalf("Put part: %s", err)
+	}
+	deleted := &model.FileInfo{MerkleTree: treeOf("deleted"), MerkleTreeSealed: treeOf("deleted sealed"), StoredPath: filepath.Join(dir, "deleted")}
+	deleted.SaveToDb(db)
+	sealed := &model.FileInfo{MerkleTree: treeOf("sealed"), MerkleTreeSealed: treeOf("sealed sealed"), StoredPath: filepath.Join(dir, "sealed"), StoredKeys: []string{"key"}}
+	sealed.SaveToDb(db)
+	gone := treeOf("gone")
+	if err := accountant.SaveFile(gone.Hash, 4); err != nil {
+		t.Fatalf("Save usage: %s", err)
+	}
+
+	collector := New(db, cfg)
+	expectReport := func(step string, report *Report, err error, dryRun bool) {
+		if err != nil {
+			t.Fatalf("%s: %s", step, err)
+		}
+		kinds := map[string]int{store.FixPart: 1, KindSplitDir: 1, store.FixTempFile: 1, KindFileInfo: 2, KindUsage: 1}
+		got := make(map[string]int)
+		for _, item := range report.Items {
+			if item.Error != "" {
+				t.Errorf("%s: %s '%s' failed: %s", step, item.Kind, item.Target, item.Error)
+			}
+			got[item.Kind]++
+		}
+		for kind, n := range kinds {
+			if got[kind] != n {
+				t.Errorf("%s: %d items of %s, want %d: %+v", step, got[kind], kind, n, report.Items)
+			}
+		}
+		if report.DryRun != dryRun || report.Freed != 22 || len(report.Items) != 6 {
+			t.Errorf("%s: report is %+v, want 6 items of 22 bytes", step, report)
+		}
+	}
+
+	// Dry run reports the same as the real run but changes nothing
+	report, err := collector.Run(true)
+	expectReport("Dry run", report, err, true)
+	for _, path := range []string{splitDir, tempPath, st.Path(orphan)} {
+		if !util.IsDirOrFileExist(path) {
+			t.Errorf("Dry run removes '%s'", path)
+		}
+	}
+	if model.GetFileInfoFromDb(deleted.MerkleTree.Hash, db) == nil || model.GetFileInfoFromDb(sealed.MerkleTree.Hash, db).StoredPath == "" ||
+		!capacity.HasFile(db, gone.Hash) {
+		t.Error("Dry run changes records")
+	}
+
+	report, err = collector.Run(false)
+	expectReport("Run", report, err, false)
+	for _, path := range []string{splitDir, tempPath, st.Path(orphan)} {
+		if util.IsDirOrFileExist(path) {
+			t.Errorf("'%s' is left", path)
+		}
+	}
+	if model.GetFileInfoFromDb(deleted.MerkleTree.Hash, db) != nil || model.GetFileInfoFromDb(deleted.MerkleTreeSealed.Hash, db) != nil {
+		t.Error("File info of deleted parts is left")
+	}
+	if fileInfo := model.GetFileInfoFromDb(sealed.MerkleTree.Hash, db); fileInfo == nil || fileInfo.StoredPath != "" || len(fileInfo.StoredKeys) != 1 {
+		t.Errorf("File info of sealed parts is %+v", fileInfo)
+	}
+	if capacity.HasFile(db, gone.Hash) {
+		t.Error("Usage of nothing is left")
+	}
+
+	// The file in use is kept
+	if !st.HasFile(live.Hash) || !util.IsDirOrFileExist(st.Path(live.Links[0].Hash)) || !capacity.HasFile(db, live.Hash) ||
+		model.GetFileInfoFromDb(live.Hash, db) == nil {
+		t.Error("File in use is collected")
+	}
+
+	if report, err := collector.Run(false); err != nil || len(report.Items) != 0 || report.Freed != 0 {
+		t.Errorf("Run again: %+v (%v)", report, err)
+	}
+}
@@ -3,13 +3,18 @@ module karst
 go 1.13
 
 require (
+	github.com/ChainSafe/go-schnorrkel v0.0.0-20200405005733-88cbf1b4c40d
+	github.com/btcsuite/btcutil v1.0.2
+	github.com/centrifuge/go-substrate-rpc-client/v2 v2.0.1
 	github.com/cheggaaa/pb v2.0.7+incompatible
 	github.com/cheggaaa/pb/v3 v3.0.4 // indirect
 	github.com/gorilla/websocket v1.4.2
 	github.com/imroc/req v0.3.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.4.0
 	github.com/syndtr/goleveldb v1.0.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	gopkg.in/VividCortex/ewma.v1 v1.1.1 // indirect
 	gopkg.in/cheggaaa/pb.v2 v2.0.7 // indirect
 	gopkg.in/fatih/color.v1 v1.7.0 // indirect
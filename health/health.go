@@ -0,0 +1,127 @@
+package health
+
+import (
+	"fmt"
+	"karst/chain"
+	"karst/config"
+	"karst/fs"
+	"karst/tee"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const checkTimeout = 3 * time.Second
+
+const (
+	StatusOk       = "ok"
+	StatusError    = "error"
+	StatusDisabled = "disabled"
+)
+
+type Component struct {
+	Name    string  `json:"name"`
+	Status  string  `json:"status"`
+	Info    string  `json:"info,omitempty"`
+	Latency float64 `json:"latency_ms"`
+}
+
+type Report struct {
+	Status     string       `json:"status"`
+	Ready      bool         `json:"ready"`
+	Components []*Component `json:"components"`
+}
+
+type Checker struct {
+	db    *leveldb.DB
+	fs    fs.FsInterface
+	chain chain.Client
+	cfg   *config.Configuration
+}
+
+func NewChecker(db *leveldb.DB, fs fs.FsInterface, chain chain.Client, cfg *config.Configuration) *Checker {
+	return &Checker{
+		db:    db,
+		fs:    fs,
+		chain: chain,
+		cfg:   cfg,
+	}
+}
+
+// Check runs all dependency checks concurrently, not configured dependencies are disabled and don't affect readiness
+func (checker *Checker) Check() *Report {
+	checks := []struct {
+		name    string
+		enabled bool
+		check   func() error
+	}{
+		{"leveldb", true, checker.checkDb},
+		{"fastdfs", len(checker.cfg.Fastdfs.TrackerAddrs) != 0, checker.fs.Ping},
+		{"tee", checker.cfg.TeeBaseUrl != "", func() error { return tee.Ping(checker.cfg.TeeBaseUrl, checkTimeout) }},
+		{"crust", checker.cfg.Crust.BaseUrl != "" || checker.cfg.Crust.Backend == chain.BackendMock, func() error { return checker.chain.Ping(checkTimeout) }},
+	}
+
+	report := &Report{
+		Status:     StatusOk,
+		Ready:      true,
+		Components: make([]*Component, len(checks)),
+	}
+
+	var wg sync.WaitGroup
+	for index := range checks {
+		component := &Component{
+			Name:   checks[index].name,
+			Status: StatusDisabled,
+		}
+		report.Components[index] = component
+		if !checks[index].enabled {
+			component.Info = "Not configured"
+			continue
+		}
+
+		wg.Add(1)
+		go func(check func() error) {
+			defer wg.Done()
+			timeStart := time.Now()
+			err := runWithTimeout(check)
+			component.Latency = float64(time.Since(timeStart).Microseconds()) / 1000
+			if err != nil {
+				component.Status = StatusError
+				component.Info = err.Error()
+			} else {
+				component.Status = StatusOk
+			}
+		}(checks[index].check)
+	}
+	wg.Wait()
+
+	for _, component := range report.Components {
+		if component.Status == StatusError {
+			report.Status = StatusError
+			report.Ready = false
+		}
+	}
+
+	return report
+}
+
+func (checker *Checker) checkDb() error {
+	_, err := checker.db.GetProperty("leveldb.num-files-at-level0")
+	return err
+}
+
+// runWithTimeout stops waiting for checks which don't support timeout by themselves
+func runWithTimeout(check func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(checkTimeout):
+		return fmt.Errorf("Check timeout after %s", checkTimeout)
+	}
+}
@@ -0,0 +1,457 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"karst/logger"
+	"karst/util"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	dbutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const keyPrefix = "job_"
+
+// Interval of removing finished jobs older than retention
+const pruneInterval = time.Hour
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCanceled  Status = "canceled"
+	// Running job whose context was canceled by daemon shutdown, it is rerun in next start
+	StatusInterrupted Status = "interrupted"
+)
+
+type Job struct {
+	Id         string          `json:"id"`
+	Endpoint   string          `json:"endpoint"`
+	Args       json.RawMessage `json:"args"`
+	Status     Status          `json:"status"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Runner executes a job's arguments and returns its result, the error is recorded as the job failure reason.
+// ctx is canceled when the job is canceled, runner should stop its work then
+type Runner func(ctx context.Context, args json.RawMessage) (interface{}, error)
+
+type Queue struct {
+	db             *leveldb.DB
+	maxConcurrency int
+	// Finished jobs are kept for retention, 0 keeps them forever
+	retention time.Duration
+	runners   map[string]Runner
+	pending   []string
+	// Cancel functions of running jobs
+	running  map[string]context.CancelFunc
+	canceled map[string]bool
+	// Interrupted jobs drop their results, db may be closed when they finish
+	interrupted bool
+	lock        sync.Mutex
+	cond        *sync.Cond
+	wg          sync.WaitGroup
+	workers     int
+	started     bool
+	stopped     bool
+	stop        chan struct{}
+}
+
+var (
+	ErrNotFound = errors.New("Job not found")
+	ErrFinished = errors.New("Job is already finished")
+)
+
+func NewQueue(db *leveldb.DB, maxConcurrency int, retention time.Duration) *Queue {
+	if maxConcurrency <= 0 {
+		maxConcurrency = 1
+	}
+
+	queue := &Queue{
+		db:             db,
+		maxConcurrency: maxConcurrency,
+		retention:      retention,
+		runners:        make(map[string]Runner),
+		pending:        make([]string, 0),
+		running:        make(map[string]context.CancelFunc),
+		canceled:       make(map[string]bool),
+		stop:           make(chan struct{}),
+	}
+	queue.cond = sync.NewCond(&queue.lock)
+
+	return queue
+}
+
+// Register binds a runner to an endpoint, jobs of unknown endpoints fail when they are picked up
+func (queue *Queue) Register(endpoint string, runner Runner) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.runners[endpoint] = runner
+}
+
+// Start recovers unfinished jobs from db and launches workers, finished jobs older than retention are removed
+// now and every pruneInterval
+func (queue *Queue) Start() error {
+	if _, err := queue.Prune(); err != nil {
+		return err
+	}
+	jobs, err := queue.List()
+	if err != nil {
+		return err
+	}
+
+	queue.lock.Lock()
+	for _, job := range jobs {
+		if job.Status == StatusPending || job.Status == StatusRunning || job.Status == StatusInterrupted {
+			if job.Status != StatusPending {
+				logger.Warn("Job '%s' was interrupted by daemon restart, requeue it", job.Id)
+				job.Status = StatusPending
+				job.StartedAt = nil
+				if err := queue.save(job); err != nil {
+					queue.lock.Unlock()
+					return err
+				}
+			}
+			queue.pending = append(queue.pending, job.Id)
+		}
+	}
+	logger.Info("Start job queue with %d workers, %d jobs recovered", queue.maxConcurrency, len(queue.pending))
+	queue.started = true
+	queue.spawn()
+	queue.lock.Unlock()
+
+	queue.wg.Add(1)
+	go queue.prune()
+	return nil
+}
+
+// SetMaxConcurrency changes the number of workers while running, extra workers exit after their current jobs
+func (queue *Queue) SetMaxConcurrency(maxConcurrency int) {
+	if maxConcurrency <= 0 {
+		maxConcurrency = 1
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.maxConcurrency == maxConcurrency {
+		return
+	}
+
+	logger.Info("Change job workers from %d to %d", queue.maxConcurrency, maxConcurrency)
+	queue.maxConcurrency = maxConcurrency
+	if queue.started && !queue.stopped {
+		queue.spawn()
+		queue.cond.Broadcast()
+	}
+}
+
+// spawn launches workers up to max concurrency, it is called with lock held
+func (queue *Queue) spawn() {
+	for queue.workers < queue.maxConcurrency {
+		queue.workers++
+		queue.wg.Add(1)
+		go queue.work()
+	}
+}
+
+// Stop lets workers finish their current jobs and exit until ctx is done, then the contexts of the unfinished
+// running jobs are canceled and they are marked interrupted. Pending and interrupted jobs stay in db for next start
+func (queue *Queue) Stop(ctx context.Context) error {
+	queue.lock.Lock()
+	if !queue.stopped {
+		close(queue.stop)
+	}
+	queue.stopped = true
+	queue.cond.Broadcast()
+	queue.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		queue.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		queue.interrupt()
+		return ctx.Err()
+	}
+}
+
+// interrupt cancels running jobs and marks them interrupted
+func (queue *Queue) interrupt() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.interrupted = true
+	for id, cancel := range queue.running {
+		cancel()
+		if queue.canceled[id] {
+			continue
+		}
+		job, err := queue.Get(id)
+		if err != nil {
+			logger.Error("Get job '%s' failed: %s", id, err)
+			continue
+		}
+		job.Status = StatusInterrupted
+		if err = queue.save(job); err != nil {
+			logger.Error("Save job '%s' failed: %s", id, err)
+			continue
+		}
+		logger.Warn("Job '%s' for '%s' is interrupted by shutdown", job.Id, job.Endpoint)
+	}
+}
+
+func (queue *Queue) Submit(endpoint string, args json.RawMessage) (*Job, error) {
+	job := &Job{
+		Id:        util.NewId(),
+		Endpoint:  endpoint,
+		Args:      args,
+		Status:    StatusPending,
+		CreatedAt: time.Now(),
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if err := queue.save(job); err != nil {
+		return nil, err
+	}
+	queue.pending = append(queue.pending, job.Id)
+	queue.cond.Signal()
+
+	logger.Debug("Submit job '%s' for '%s'", job.Id, endpoint)
+	return job, nil
+}
+
+func (queue *Queue) Get(id string) (*Job, error) {
+	jobBytes, err := queue.db.Get([]byte(keyPrefix+id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	job := &Job{}
+	if err = json.Unmarshal(jobBytes, job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// List returns all jobs ordered by creation time
+func (queue *Queue) List() ([]*Job, error) {
+	jobs := make([]*Job, 0)
+	iter := queue.db.NewIterator(dbutil.BytesPrefix([]byte(keyPrefix)), nil)
+	for iter.Next() {
+		job := &Job{}
+		if err := json.Unmarshal(iter.Value(), job); err != nil {
+			logger.Warn("Bad job record '%s': %s", string(iter.Key()), err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return jobs, nil
+}
+
+// Cancel removes a pending job from the queue, a running job is marked canceled, its context is canceled
+// and its result is dropped
+func (queue *Queue) Cancel(id string) (*Job, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	job, err := queue.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch job.Status {
+	case StatusPending:
+		for i, pendingId := range queue.pending {
+			if pendingId == id {
+				queue.pending = append(queue.pending[:i], queue.pending[i+1:]...)
+				break
+			}
+		}
+	case StatusRunning:
+		queue.canceled[id] = true
+		if cancel, ok := queue.running[id]; ok {
+			cancel()
+		}
+	default:
+		return nil, ErrFinished
+	}
+
+	now := time.Now()
+	job.Status = StatusCanceled
+	job.FinishedAt = &now
+	if err := queue.save(job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func (queue *Queue) work() {
+	defer queue.wg.Done()
+	for {
+		queue.lock.Lock()
+		for len(queue.pending) == 0 && !queue.stopped && queue.workers <= queue.maxConcurrency {
+			queue.cond.Wait()
+		}
+		if queue.stopped || queue.workers > queue.maxConcurrency {
+			queue.workers--
+			queue.lock.Unlock()
+			return
+		}
+
+		id := queue.pending[0]
+		queue.pending = queue.pending[1:]
+		job, err := queue.Get(id)
+		if err != nil {
+			queue.lock.Unlock()
+			logger.Error("Get job '%s' failed: %s", id, err)
+			continue
+		}
+		log := logger.With("job_id", job.Id, "endpoint", job.Endpoint)
+		runner, ok := queue.runners[job.Endpoint]
+		now := time.Now()
+		job.Status = StatusRunning
+		job.StartedAt = &now
+		if err = queue.save(job); err != nil {
+			log.Error("Save job '%s' failed: %s", id, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		queue.running[id] = cancel
+		queue.lock.Unlock()
+
+		var result interface{}
+		if !ok {
+			err = fmt.Errorf("No runner for endpoint '%s'", job.Endpoint)
+		} else {
+			log.Info("Job '%s' for '%s' is running", job.Id, job.Endpoint)
+			result, err = runner(ctx, job.Args)
+		}
+		cancel()
+
+		queue.finish(job, result, err)
+	}
+}
+
+func (queue *Queue) finish(job *Job, result interface{}, err error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	log := logger.With("job_id", job.Id, "endpoint", job.Endpoint)
+	delete(queue.running, job.Id)
+	if queue.canceled[job.Id] {
+		delete(queue.canceled, job.Id)
+		log.Info("Job '%s' was canceled, drop its result", job.Id)
+		return
+	}
+	if queue.interrupted {
+		log.Info("Job '%s' was interrupted, drop its result", job.Id)
+		return
+	}
+
+	now := time.Now()
+	job.FinishedAt = &now
+	if result != nil {
+		if resultBytes, mErr := json.Marshal(result); mErr == nil {
+			job.Result = resultBytes
+		}
+	}
+
+	if err != nil {
+		job.Status = StatusFailed
+		job.Error = err.Error()
+		log.Error("Job '%s' failed: %s", job.Id, err)
+	} else {
+		job.Status = StatusSucceeded
+		log.Info("Job '%s' succeeded in %s", job.Id, job.FinishedAt.Sub(*job.StartedAt))
+	}
+
+	if err = queue.save(job); err != nil {
+		log.Error("Save job '%s' failed: %s", job.Id, err)
+	}
+}
+
+// Prune removes finished jobs older than retention, it returns the number of removed jobs
+func (queue *Queue) Prune() (int, error) {
+	if queue.retention <= 0 {
+		return 0, nil
+	}
+	jobs, err := queue.List()
+	if err != nil {
+		return 0, err
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	pruned := 0
+	for _, job := range jobs {
+		if job.FinishedAt == nil || time.Since(*job.FinishedAt) < queue.retention {
+			continue
+		}
+		// Canceled running jobs have finished time but are still in running
+		if _, ok := queue.running[job.Id]; ok {
+			continue
+		}
+		if err := queue.db.Delete([]byte(keyPrefix+job.Id), nil); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	if pruned != 0 {
+		logger.Info("Removed %d finished jobs older than %s", pruned, queue.retention)
+	}
+	return pruned, nil
+}
+
+// prune runs Prune every pruneInterval until Stop
+func (queue *Queue) prune() {
+	defer queue.wg.Done()
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := queue.Prune(); err != nil {
+				logger.Warn("Remove old jobs failed: %s", err)
+			}
+		case <-queue.stop:
+			return
+		}
+	}
+}
+
+func (queue *Queue) save(job *Job) error {
+	jobBytes, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return queue.db.Put([]byte(keyPrefix+job.Id), jobBytes, nil)
+}
@@ -0,0 +1,178 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func newTestQueue(t *testing.T, maxConcurrency int, retention time.Duration) (*Queue, *leveldb.DB) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Open db: %s", err)
+	}
+	return NewQueue(db, maxConcurrency, retention), db
+}
+
+// blockingRunner runs until ctx is canceled, started gets the job args when it begins
+func blockingRunner(started chan<- string) Runner {
+	return func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		started <- string(args)
+		<-ctx.Done()
+		return "late result", ctx.Err()
+	}
+}
+
+func expectJobStatus(t *testing.T, step string, queue *Queue, id string, status Status) *Job {
+	job, err := queue.Get(id)
+	if err != nil {
+		t.Fatalf("%s: get job: %s", step, err)
+	}
+	if job.Status != status {
+		t.Fatalf("%s: job is %s, want %s", step, job.Status, status)
+	}
+	return job
+}
+
+func TestStopInterruptsRunningJobs(t *testing.T) {
+	queue, db := newTestQueue(t, 1, 0)
+	defer db.Close()
+	started := make(chan string, 1)
+	queue.Register("block", blockingRunner(started))
+	if err := queue.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+
+	running, err := queue.Submit("block", json.RawMessage(`"first"`))
+	if err != nil {
+		t.Fatalf("Submit: %s", err)
+	}
+	pending, err := queue.Submit("block", json.RawMessage(`"second"`))
+	if err != nil {
+		t.Fatalf("Submit: %s", err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Stop: got %v, want deadline exceeded", err)
+	}
+	// Worker exits once its context is canceled, the result is dropped
+	queue.wg.Wait()
+	job := expectJobStatus(t, "Stop", queue, running.Id, StatusInterrupted)
+	if job.Result != nil || job.FinishedAt != nil {
+		t.Errorf("Interrupted job has result %s and finished time %v", job.Result, job.FinishedAt)
+	}
+	expectJobStatus(t, "Stop", queue, pending.Id, StatusPending)
+
+	// Both are rerun in next start
+	restarted := NewQueue(db, 2, 0)
+	restarted.Register("block", blockingRunner(started))
+	if err := restarted.Start(); err != nil {
+		t.Fatalf("Restart: %s", err)
+	}
+	rerun := map[string]bool{<-started: true, <-started: true}
+	if !rerun[`"first"`] || !rerun[`"second"`] {
+		t.Errorf("Rerun jobs are %v", rerun)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	restarted.Stop(ctx)
+	restarted.wg.Wait()
+}
+
+func TestCancel(t *testing.T) {
+	queue, db := newTestQueue(t, 1, 0)
+	defer db.Close()
+	started := make(chan string, 1)
+	finished := make(chan struct{}, 1)
+	queue.Register("block", func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+		defer func() { finished <- struct{}{} }()
+		return blockingRunner(started)(ctx, args)
+	})
+	if err := queue.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	defer queue.Stop(context.Background())
+
+	running, _ := queue.Submit("block", json.RawMessage(`"first"`))
+	pending, _ := queue.Submit("block", json.RawMessage(`"second"`))
+	<-started
+
+	// Pending job never runs
+	if _, err := queue.Cancel(pending.Id); err != nil {
+		t.Fatalf("Cancel pending job: %s", err)
+	}
+	expectJobStatus(t, "Cancel pending job", queue, pending.Id, StatusCanceled)
+
+	// Running job gets its context canceled and its result is dropped
+	job, err := queue.Cancel(running.Id)
+	if err != nil {
+		t.Fatalf("Cancel running job: %s", err)
+	}
+	if job.Status != StatusCanceled || job.FinishedAt == nil {
+		t.Errorf("Canceled job is %s finished at %v", job.Status, job.FinishedAt)
+	}
+	<-finished
+	job = expectJobStatus(t, "Cancel running job", queue, running.Id, StatusCanceled)
+	if job.Result != nil || job.Error != "" {
+		t.Errorf("Canceled job has result %s and error '%s'", job.Result, job.Error)
+	}
+
+	if _, err := queue.Cancel(running.Id); err != ErrFinished {
+		t.Errorf("Cancel canceled job: got %v, want %v", err, ErrFinished)
+	}
+	if _, err := queue.Cancel("unknown"); err != ErrNotFound {
+		t.Errorf("Cancel unknown job: got %v, want %v", err, ErrNotFound)
+	}
+	select {
+	case args := <-started:
+		t.Errorf("Canceled job %s is run", args)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestPrune(t *testing.T) {
+	queue, db := newTestQueue(t, 1, time.Hour)
+	defer db.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	jobs := []*Job{
+		{Id: "old", Status: StatusSucceeded, CreatedAt: old, FinishedAt: &old},
+		{Id: "recent", Status: StatusFailed, CreatedAt: recent, FinishedAt: &recent},
+		{Id: "pending", Status: StatusPending, CreatedAt: old},
+		{Id: "canceled_running", Status: StatusCanceled, CreatedAt: old, FinishedAt: &old},
+	}
+	for _, job := range jobs {
+		if err := queue.save(job); err != nil {
+			t.Fatalf("Save job: %s", err)
+		}
+	}
+	// Canceled job whose runner hasn't returned yet
+	queue.running["canceled_running"] = func() {}
+
+	pruned, err := queue.Prune()
+	if err != nil || pruned != 1 {
+		t.Fatalf("Pruned %d jobs (%v), want 1", pruned, err)
+	}
+	if _, err := queue.Get("old"); err != ErrNotFound {
+		t.Errorf("Old job: got %v, want %v", err, ErrNotFound)
+	}
+	left, _ := queue.List()
+	if len(left) != 3 {
+		t.Errorf("%d jobs are left, want 3", len(left))
+	}
+
+	// 0 retention keeps jobs forever
+	queue.retention = 0
+	delete(queue.running, "canceled_running")
+	if pruned, err := queue.Prune(); err != nil || pruned != 0 {
+		t.Errorf("Pruned %d jobs (%v) without retention", pruned, err)
+	}
+}
@@ -0,0 +1,222 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	version = 1
+	// Scrypt parameters, about 100ms and 32MB memory to derive a key
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+var (
+	ErrNotFound        = errors.New("Keystore not found")
+	ErrWrongPassphrase = errors.New("Wrong keystore passphrase")
+)
+
+// Account is the crust account kept in keystore
+type Account struct {
+	Address  string `json:"address"`
+	Backup   string `json:"backup"`
+	Password string `json:"password"`
+}
+
+type kdfParams struct {
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt string `json:"salt"`
+}
+
+// keystoreFile is the layout on disk, only address is readable without passphrase
+type keystoreFile struct {
+	Version    int       `json:"version"`
+	Address    string    `json:"address"`
+	Kdf        string    `json:"kdf"`
+	KdfParams  kdfParams `json:"kdfparams"`
+	Cipher     string    `json:"cipher"`
+	Nonce      string    `json:"nonce"`
+	Ciphertext string    `json:"ciphertext"`
+}
+
+// NewAccount reads address from crust account backup json
+func NewAccount(backup string, password string) (*Account, error) {
+	backupAddress := struct {
+		Address string `json:"address"`
+	}{}
+	if err := json.Unmarshal([]byte(backup), &backupAddress); err != nil {
+		return nil, fmt.Errorf("Wrong crust account backup: %s", err)
+	}
+	if backupAddress.Address == "" {
+		return nil, errors.New("Wrong crust account backup: address is missing")
+	}
+
+	return &Account{
+		Address:  backupAddress.Address,
+		Backup:   backup,
+		Password: password,
+	}, nil
+}
+
+func Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Create encrypts account with passphrase and writes it to path, existing keystore isn't overwritten
+func Create(path string, account *Account, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("Keystore passphrase is empty")
+	}
+	if Exists(path) {
+		return fmt.Errorf("Keystore '%s' already exists", path)
+	}
+
+	plaintext, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newGcm(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	ks := keystoreFile{
+		Version: version,
+		Address: account.Address,
+		Kdf:     "scrypt",
+		KdfParams: kdfParams{
+			N:    scryptN,
+			R:    scryptR,
+			P:    scryptP,
+			Salt: hex.EncodeToString(salt),
+		},
+		Cipher:     "aes-256-gcm",
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(aead.Seal(nil, nonce, plaintext, []byte(account.Address))),
+	}
+	ksBytes, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to temp file then rename, a half written keystore would lose the account
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, ksBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Unlock decrypts the account in keystore
+func Unlock(path string, passphrase string) (*Account, error) {
+	ks, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if ks.Version != version || ks.Kdf != "scrypt" || ks.Cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("Unsupported keystore: version %d, kdf '%s', cipher '%s'", ks.Version, ks.Kdf, ks.Cipher)
+	}
+
+	salt, err := hex.DecodeString(ks.KdfParams.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong keystore salt: %s", err)
+	}
+	nonce, err := hex.DecodeString(ks.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong keystore nonce: %s", err)
+	}
+	ciphertext, err := hex.DecodeString(ks.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong keystore ciphertext: %s", err)
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, ks.KdfParams.N, ks.KdfParams.R, ks.KdfParams.P, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Wrong keystore nonce size %d", len(nonce))
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(ks.Address))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	account := &Account{}
+	if err := json.Unmarshal(plaintext, account); err != nil {
+		return nil, fmt.Errorf("Wrong keystore content: %s", err)
+	}
+	return account, nil
+}
+
+// Address reads the account address without unlocking
+func Address(path string) (string, error) {
+	ks, err := read(path)
+	if err != nil {
+		return "", err
+	}
+	return ks.Address, nil
+}
+
+func read(path string) (*keystoreFile, error) {
+	ksBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	ks := &keystoreFile{}
+	if err := json.Unmarshal(ksBytes, ks); err != nil {
+		return nil, fmt.Errorf("Wrong keystore file '%s': %s", path, err)
+	}
+	return ks, nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,71 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Passphrase can be given by environment variable, it is used before passphrase file and prompt
+const PassphraseEnv = "KARST_KEYSTORE_PASSPHRASE"
+
+// GetPassphrase looks up passphrase from environment variable, then passphrase file, then asks on terminal
+func GetPassphrase(passphraseFile string, prompt string) (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+
+	if passphraseFile != "" {
+		passphraseBytes, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("Read passphrase file failed: %s", err)
+		}
+		return strings.TrimRight(string(passphraseBytes), "\r\n"), nil
+	}
+
+	return ReadPassphrase(prompt)
+}
+
+// ReadPassphrase asks on terminal without echo
+func ReadPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", fmt.Errorf("Keystore is locked, set %s or 'keystore.passphrase_file' when stdin isn't a terminal", PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(passphrase), nil
+}
+
+// NewPassphrase looks up passphrase like GetPassphrase, but asks twice on terminal to avoid typos
+func NewPassphrase(passphraseFile string) (string, error) {
+	if os.Getenv(PassphraseEnv) != "" || passphraseFile != "" {
+		return GetPassphrase(passphraseFile, "")
+	}
+
+	passphrase, err := ReadPassphrase("New keystore passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("Keystore passphrase is empty")
+	}
+
+	repeat, err := ReadPassphrase("Repeat keystore passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if repeat != passphrase {
+		return "", errors.New("Keystore passphrases don't match")
+	}
+	return passphrase, nil
+}
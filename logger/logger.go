@@ -1,35 +1,299 @@
 package logger
 
-import "log"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
 
-var isDebug bool = false
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "DBUG",
+	InfoLevel:  "INFO",
+	WarnLevel:  "WARN",
+	ErrorLevel: "ERRO",
+}
+
+var jsonLevelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DebugLevel, nil
+	case "", "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("Unknown log level '%s', it should be debug, info, warn or error", name)
+}
+
+type Options struct {
+	// Level is the default level, Levels overrides it by package like 'ws' or 'fs/fastdfs'
+	Level  string
+	Levels map[string]string
+	// Format is 'text' or 'json'
+	Format string
+	// File is written besides console if it isn't empty, it rotates after MaxSize MB with MaxBackups old files kept
+	File       string
+	MaxSize    int
+	MaxBackups int
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger carries fields which are written with every line, it is safe for concurrent use
+type Logger struct {
+	fields []field
+}
+
+type output struct {
+	lock    sync.Mutex
+	level   Level
+	levels  map[string]Level
+	json    bool
+	writers []io.Writer
+	file    *rotateWriter
+}
+
+var out = &output{
+	level:   InfoLevel,
+	levels:  map[string]Level{},
+	writers: []io.Writer{os.Stderr},
+}
+
+var std = &Logger{}
+
+// Configure replaces the outputs, lines written before keep going to stderr
+func Configure(opts Options) error {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+
+	levels := make(map[string]Level)
+	for pkg, name := range opts.Levels {
+		if levels[pkg], err = ParseLevel(name); err != nil {
+			return fmt.Errorf("Level of '%s': %s", pkg, err)
+		}
+	}
+
+	var isJson bool
+	switch opts.Format {
+	case "", "text":
+		isJson = false
+	case "json":
+		isJson = true
+	default:
+		return fmt.Errorf("Unknown log format '%s', it should be text or json", opts.Format)
+	}
+
+	writers := []io.Writer{os.Stderr}
+	var file *rotateWriter
+	if opts.File != "" {
+		if file, err = newRotateWriter(opts.File, int64(opts.MaxSize)<<20, opts.MaxBackups); err != nil {
+			return err
+		}
+		writers = append(writers, file)
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	if out.file != nil {
+		_ = out.file.Close()
+	}
+	out.level = level
+	out.levels = levels
+	out.json = isJson
+	out.writers = writers
+	out.file = file
+
+	return nil
+}
+
+// SetLevel changes the default level only, it can be used while running
+func SetLevel(name string) error {
+	level, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.level = level
+	return nil
+}
+
+// SetLevels changes the default level and package levels together, format and outputs are kept
+func SetLevels(name string, names map[string]string) error {
+	level, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+
+	levels := make(map[string]Level)
+	for pkg, name := range names {
+		if levels[pkg], err = ParseLevel(name); err != nil {
+			return fmt.Errorf("Level of '%s': %s", pkg, err)
+		}
+	}
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	out.level = level
+	out.levels = levels
+	return nil
+}
+
+// With returns a logger which writes key/value pairs with every line
+func With(kv ...interface{}) *Logger {
+	return std.With(kv...)
+}
+
+func (logger *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]field, len(logger.fields), len(logger.fields)+len(kv)/2)
+	copy(fields, logger.fields)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields = append(fields, field{key: fmt.Sprint(kv[i]), value: kv[i+1]})
+	}
+	return &Logger{fields: fields}
+}
+
+func (logger *Logger) Debug(format string, v ...interface{}) {
+	logger.log(DebugLevel, format, v...)
+}
+
+func (logger *Logger) Info(format string, v ...interface{}) {
+	logger.log(InfoLevel, format, v...)
+}
+
+func (logger *Logger) Warn(format string, v ...interface{}) {
+	logger.log(WarnLevel, format, v...)
+}
+
+func (logger *Logger) Error(format string, v ...interface{}) {
+	logger.log(ErrorLevel, format, v...)
+}
 
 func Info(format string, v ...interface{}) {
-	log.SetPrefix("[INFO] ")
-	log.Printf(format, v...)
+	std.log(InfoLevel, format, v...)
 }
 
 func Debug(format string, v ...interface{}) {
-	if isDebug {
-		log.SetPrefix("[DBUG] ")
-		log.Printf(format, v...)
-	}
+	std.log(DebugLevel, format, v...)
 }
 
 func Warn(format string, v ...interface{}) {
-	log.SetPrefix("[WARN] ")
-	log.Printf(format, v...)
+	std.log(WarnLevel, format, v...)
 }
 
 func Error(format string, v ...interface{}) {
-	log.SetPrefix("[ERRO] ")
-	log.Printf(format, v...)
+	std.log(ErrorLevel, format, v...)
 }
 
 func OpenDebug() {
-	isDebug = true
+	_ = SetLevel("debug")
+}
+
+func (logger *Logger) log(level Level, format string, v ...interface{}) {
+	pkg := callerPackage()
+	now := time.Now()
+
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	minLevel, ok := out.levels[pkg]
+	if !ok {
+		minLevel = out.level
+	}
+	if level < minLevel {
+		return
+	}
+
+	var line []byte
+	if out.json {
+		line = formatJson(now, level, pkg, fmt.Sprintf(format, v...), logger.fields)
+	} else {
+		line = formatText(now, level, fmt.Sprintf(format, v...), logger.fields)
+	}
+
+	for _, w := range out.writers {
+		_, _ = w.Write(line)
+	}
+}
+
+func formatText(now time.Time, level Level, msg string, fields []field) []byte {
+	var b strings.Builder
+	b.WriteString("[" + levelNames[level] + "] ")
+	b.WriteString(now.Format("2006/01/02 15:04:05") + " ")
+	b.WriteString(strings.TrimRight(msg, "\n"))
+	for _, f := range fields {
+		value := fmt.Sprint(f.value)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		b.WriteString(" " + f.key + "=" + value)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
 }
 
-func init() {
-	log.SetFlags(log.LstdFlags)
+func formatJson(now time.Time, level Level, pkg string, msg string, fields []field) []byte {
+	entry := map[string]interface{}{
+		"time":  now.Format(time.RFC3339Nano),
+		"level": jsonLevelNames[level],
+		"pkg":   pkg,
+		"msg":   strings.TrimRight(msg, "\n"),
+	}
+	for _, f := range fields {
+		if err, ok := f.value.(error); ok {
+			entry[f.key] = err.Error()
+		} else {
+			entry[f.key] = f.value
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": "error", "msg": "Marshal log failed: " + err.Error()})
+	}
+	return append(line, '\n')
+}
+
+// callerPackage gets the package of the function which calls logger, like 'ws' or 'fs/fastdfs'
+func callerPackage() string {
+	pc, _, _, ok := runtime.Caller(3)
+	if !ok {
+		return ""
+	}
+
+	name := runtime.FuncForPC(pc).Name()
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		name = name[:slash+1+dot]
+	}
+	return strings.TrimPrefix(name, "karst/")
 }
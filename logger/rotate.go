@@ -0,0 +1,101 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const defaultMaxSize = 100 << 20 // 100 MB
+
+// rotateWriter writes to file and moves it to 'file.1' when it reaches max size, 'file.N' older than max backups are removed
+type rotateWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	file       *os.File
+}
+
+func newRotateWriter(path string, maxSize int64, maxBackups int) (*rotateWriter, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	if maxBackups < 0 {
+		maxBackups = 0
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	w := &rotateWriter{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Write is called with output lock held
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	if w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "[ERRO] Rotate log file '%s' failed: %s\n", w.path, err)
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) Close() error {
+	return w.file.Close()
+}
+
+func (w *rotateWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotateWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	var err error
+	if w.maxBackups == 0 {
+		if err = os.Remove(w.path); os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxBackups))
+		for i := w.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		err = os.Rename(w.path, w.path+".1")
+	}
+
+	// Keep writing to the current file even if moving failed
+	if openErr := w.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
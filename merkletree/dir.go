@@ -0,0 +1,55 @@
+package merkletree
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CreateMerkleTreeFromDir builds merkle tree from parts named 'index_hash' in dir, like the ones written by split
+func CreateMerkleTreeFromDir(dir string) (*MerkleTreeNode, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Read parts in '%s' failed: %s", dir, err)
+	}
+
+	type part struct {
+		index uint64
+		hash  []byte
+		size  uint64
+	}
+	parts := make([]part, 0, len(infos))
+	for _, info := range infos {
+		fields := strings.SplitN(info.Name(), "_", 2)
+		if len(fields) != 2 || info.IsDir() {
+			continue
+		}
+		index, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		hash, err := hex.DecodeString(fields[1])
+		if err != nil {
+			continue
+		}
+		parts = append(parts, part{index: index, hash: hash, size: uint64(info.Size())})
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("There is no part in '%s'", dir)
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].index < parts[j].index })
+	partHashs := make([][]byte, 0, len(parts))
+	partSizes := make([]uint64, 0, len(parts))
+	for i, p := range parts {
+		if p.index != uint64(i) {
+			return nil, fmt.Errorf("Part %d is missing in '%s'", i, dir)
+		}
+		partHashs = append(partHashs, p.hash)
+		partSizes = append(partSizes, p.size)
+	}
+	return CreateMerkleTree(partHashs, partSizes), nil
+}
@@ -0,0 +1,61 @@
+package merkletree
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Proof shows a part is the leaf at index of a tree, root is the hash of all leaf hashes in order
+type Proof struct {
+	Index    uint64   `json:"index"`
+	Hash     string   `json:"hash"`
+	Size     uint64   `json:"size"`
+	Siblings []string `json:"siblings"`
+}
+
+// Proof gives the inclusion proof of leaf at index, siblings are the other leaf hashes in order
+func (mt *MerkleTreeNode) Proof(index uint64) (*Proof, error) {
+	if index >= uint64(len(mt.Links)) {
+		return nil, fmt.Errorf("Index %d is out of %d parts", index, len(mt.Links))
+	}
+
+	siblings := make([]string, 0, len(mt.Links)-1)
+	for i := range mt.Links {
+		if uint64(i) != index {
+			siblings = append(siblings, mt.Links[i].Hash)
+		}
+	}
+	return &Proof{
+		Index:    index,
+		Hash:     mt.Links[index].Hash,
+		Size:     mt.Links[index].Size,
+		Siblings: siblings,
+	}, nil
+}
+
+// Root computes root hash from leaf and its siblings
+func (proof *Proof) Root() (string, error) {
+	if proof.Index > uint64(len(proof.Siblings)) {
+		return "", fmt.Errorf("Index %d is out of %d parts", proof.Index, len(proof.Siblings)+1)
+	}
+
+	allHashs := make([]byte, 0, (len(proof.Siblings)+1)*sha256.Size)
+	for i := 0; i <= len(proof.Siblings); i++ {
+		hash := proof.Hash
+		if uint64(i) < proof.Index {
+			hash = proof.Siblings[i]
+		} else if uint64(i) > proof.Index {
+			hash = proof.Siblings[i-1]
+		}
+
+		hashBytes, err := hex.DecodeString(hash)
+		if err != nil {
+			return "", fmt.Errorf("Wrong hash '%s': %s", hash, err)
+		}
+		allHashs = append(allHashs, hashBytes...)
+	}
+
+	rootBytes := sha256.Sum256(allHashs)
+	return hex.EncodeToString(rootBytes[:]), nil
+}
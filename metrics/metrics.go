@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "karst"
+
+var (
+	// Commands
+	CmdRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cmd",
+		Name:      "requests_total",
+		Help:      "Number of command requests by endpoint and return status.",
+	}, []string{"endpoint", "status"})
+	CmdDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "cmd",
+		Name:      "duration_seconds",
+		Help:      "Time of dealing with command requests, asynchronous commands only count the submission.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"endpoint"})
+	Jobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "job",
+		Name:      "finished_total",
+		Help:      "Number of finished background jobs by endpoint and result.",
+	}, []string{"endpoint", "result"})
+
+	// Node data
+	NodeDataParts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "node_data",
+		Name:      "parts_served_total",
+		Help:      "Number of parts sent by node data endpoint.",
+	})
+	NodeDataBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "node_data",
+		Name:      "bytes_sent_total",
+		Help:      "Number of bytes sent by node data endpoint.",
+	})
+	NodeDataErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "node_data",
+		Name:      "errors_total",
+		Help:      "Number of failed node data requests by return status.",
+	}, []string{"status"})
+
+	// Split
+	SplitBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "split",
+		Name:      "bytes_total",
+		Help:      "Number of bytes split into parts.",
+	})
+	SplitParts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "split",
+		Name:      "parts_total",
+		Help:      "Number of parts written by split.",
+	})
+	SplitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "split",
+		Name:      "duration_seconds",
+		Help:      "Time of splitting a file.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	// Fastdfs
+	FastdfsPoolConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "fastdfs",
+		Name:      "pool_conns",
+		Help:      "Number of fastdfs connections in pool by address and state (idle, total).",
+	}, []string{"addr", "state"})
+	FastdfsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "fastdfs",
+		Name:      "operation_duration_seconds",
+		Help:      "Time of fastdfs operations by operation and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"operation", "result"})
+
+	// TEE
+	TeeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "tee",
+		Name:      "duration_seconds",
+		Help:      "Time of TEE operations by operation (seal, unseal, delete).",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"operation"})
+	TeeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "tee",
+		Name:      "errors_total",
+		Help:      "Number of failed TEE operations by operation (seal, unseal, delete).",
+	}, []string{"operation"})
+	TeeInflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "tee",
+		Name:      "in_flight",
+		Help:      "Number of TEE operations waiting for reply by operation (seal, unseal, delete).",
+	}, []string{"operation"})
+
+	// Chain
+	ChainCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "chain",
+		Name:      "calls_total",
+		Help:      "Number of chain api calls by call and result.",
+	}, []string{"call", "result"})
+	ChainRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "chain",
+		Name:      "retries_total",
+		Help:      "Number of chain api calls retried after network errors by call.",
+	}, []string{"call"})
+
+	// Storage proof challenges
+	ChallengesAnswered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "challenge",
+		Name:      "answered_total",
+		Help:      "Number of challenges answered by this provider by result (success, not_found, failed).",
+	}, []string{"result"})
+	ChallengesVerified = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "challenge",
+		Name:      "verified_total",
+		Help:      "Number of challenges sent to providers by result (passed, failed, unverified, error).",
+	}, []string{"result"})
+
+	// Part store
+	StoreDedupParts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "dedup_parts_total",
+		Help:      "Number of parts not written because they are already in part store.",
+	})
+	StoreDedupBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "store",
+		Name:      "dedup_bytes_total",
+		Help:      "Number of bytes not written because they are already in part store.",
+	})
+
+	// Scrub
+	ScrubParts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scrub",
+		Name:      "parts_checked_total",
+		Help:      "Number of stored parts checked by scrubbing.",
+	})
+	ScrubBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scrub",
+		Name:      "bytes_checked_total",
+		Help:      "Number of bytes read by scrubbing.",
+	})
+	ScrubCorruptions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scrub",
+		Name:      "corruptions_total",
+		Help:      "Number of corrupted parts found by scrubbing by kind (mismatch, missing, unreadable).",
+	}, []string{"kind"})
+	ScrubRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scrub",
+		Name:      "repairs_total",
+		Help:      "Number of repairs of corrupted parts by result (replica, fs, failed).",
+	}, []string{"result"})
+	ScrubLastPass = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "scrub",
+		Name:      "last_pass_timestamp_seconds",
+		Help:      "Time of the last finished scrubbing pass.",
+	})
+
+	// Garbage collection
+	GcCollected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "collected_total",
+		Help:      "Number of garbage items removed or fixed by kind.",
+	}, []string{"kind"})
+	GcFreedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "freed_bytes_total",
+		Help:      "Number of bytes of removed garbage.",
+	})
+
+	// Capacity
+	Capacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "capacity",
+		Name:      "bytes",
+		Help:      "Bytes of capacity by state (total, reserved, used, committed).",
+	}, []string{"state"})
+	CapacityRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "capacity",
+		Name:      "rejected_total",
+		Help:      "Number of incoming files and storage orders rejected for exceeding capacity.",
+	})
+
+	// Storage orders
+	Orders = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "order",
+		Name:      "orders",
+		Help:      "Number of storage orders placed to this provider by status.",
+	}, []string{"status"})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func ObserveCmd(endpoint string, status int, timeStart time.Time) {
+	CmdRequests.WithLabelValues(endpoint, strconv.Itoa(status)).Inc()
+	CmdDuration.WithLabelValues(endpoint).Observe(time.Since(timeStart).Seconds())
+}
+
+func ObserveFastdfs(operation string, err error, timeStart time.Time) {
+	FastdfsDuration.WithLabelValues(operation, Result(err)).Observe(time.Since(timeStart).Seconds())
+}
+
+func ObserveTee(operation string, err error, timeStart time.Time) {
+	TeeDuration.WithLabelValues(operation).Observe(time.Since(timeStart).Seconds())
+	if err != nil {
+		TeeErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func ObserveChain(call string, err error) {
+	ChainCalls.WithLabelValues(call, Result(err)).Inc()
+}
+
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -2,7 +2,12 @@ package model
 
 import (
 	"encoding/json"
+	"karst/capacity"
+	"karst/fs"
+	"karst/logger"
 	"karst/merkletree"
+	"karst/store"
+	"karst/tee"
 	"os"
 
 	"github.com/syndtr/goleveldb/leveldb"
@@ -12,6 +17,8 @@ type FileInfo struct {
 	MerkleTree       *merkletree.MerkleTreeNode
 	MerkleTreeSealed *merkletree.MerkleTreeNode
 	StoredPath       string
+	// Keys of sealed parts in fs
+	StoredKeys []string
 }
 
 func (fileInfo *FileInfo) ClearFile() {
@@ -30,6 +37,37 @@ func (fileInfo *FileInfo) ClearDb(db *leveldb.DB) {
 	}
 }
 
+// Remove deletes file everywhere it lives: sealed parts in fs and TEE, parts on disk and in part store, and its
+// records. It stops at the first failure, so it can be run again. Without TEE the sealed file is left in TEE
+func (fileInfo *FileInfo) Remove(db *leveldb.DB, fs fs.FsInterface, tee *tee.Tee, st *store.Store) error {
+	for _, key := range fileInfo.StoredKeys {
+		if err := fs.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	if fileInfo.MerkleTreeSealed != nil {
+		if tee == nil {
+			logger.Warn("TEE isn't configured, sealed file '%s' isn't deleted from TEE", fileInfo.MerkleTreeSealed.Hash)
+		} else if err := tee.Delete(fileInfo.MerkleTreeSealed.Hash); err != nil {
+			return err
+		}
+	}
+
+	// Parts shared with other files stay in store
+	if fileInfo.MerkleTree != nil {
+		if _, err := st.RemoveFile(fileInfo.MerkleTree.Hash); err != nil && err != store.ErrNotFound {
+			return err
+		}
+		if err := capacity.RemoveFile(db, fileInfo.MerkleTree.Hash); err != nil {
+			return err
+		}
+	}
+	fileInfo.ClearFile()
+	fileInfo.ClearDb(db)
+	return nil
+}
+
 func (fileInfo *FileInfo) SaveToDb(db *leveldb.DB) {
 	if fileInfo.MerkleTree != nil || fileInfo.MerkleTreeSealed != nil {
 		fileInfoBytes, _ := json.Marshal(fileInfo)
@@ -0,0 +1,359 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"karst/capacity"
+	"karst/chain"
+	"karst/config"
+	"karst/fs"
+	"karst/logger"
+	"karst/metrics"
+	"karst/model"
+	"karst/store"
+	"karst/tee"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	dbutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const keyPrefix = "order_"
+
+// Chain is polled once a block
+const pollInterval = 6 * time.Second
+
+type Status string
+
+// Orders go pending -> receiving -> sealed -> expired, failed orders are never served
+const (
+	StatusPending   Status = "pending"
+	StatusReceiving Status = "receiving"
+	StatusSealed    Status = "sealed"
+	StatusExpired   Status = "expired"
+	StatusFailed    Status = "failed"
+)
+
+var Statuses = []Status{StatusPending, StatusReceiving, StatusSealed, StatusExpired, StatusFailed}
+
+var ErrNotFound = errors.New("Storage order not found")
+
+// Order is a storage order placed to this provider, chain fields are kept as they were last read
+type Order struct {
+	Id string `json:"id"`
+	chain.FullStorageOrder
+	Status    Status    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (order *Order) finished() bool {
+	return order.Status == StatusExpired || order.Status == StatusFailed
+}
+
+// Watcher polls chain for orders whose provider is this account and moves them through their status,
+// files of expired orders are deleted from fs and TEE
+type Watcher struct {
+	db    *leveldb.DB
+	fs    fs.FsInterface
+	chain chain.Client
+	tee   *tee.Tee
+	store *store.Store
+	// accountant rejects new orders beyond capacity
+	accountant *capacity.Accountant
+	provider   string
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewWatcher creates watcher of storage orders, without TEE sealed files can only be deleted from fs
+func NewWatcher(db *leveldb.DB, fs fs.FsInterface, chain chain.Client, tee *tee.Tee, cfg *config.Configuration) *Watcher {
+	return &Watcher{
+		db:         db,
+		fs:         fs,
+		chain:      chain,
+		tee:        tee,
+		store:      store.New(db, cfg.KarstPaths),
+		accountant: capacity.New(db, cfg, Usage),
+		provider:   cfg.Crust.Address,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start polls chain in background until Stop
+func (watcher *Watcher) Start() {
+	logger.Info("Start watching storage orders to '%s'", watcher.provider)
+	go func() {
+		defer close(watcher.done)
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			if err := watcher.Sync(); chain.KindOf(err) == chain.KindUnsupported {
+				logger.Error("Storage orders aren't watched: %s", err)
+				return
+			} else if err != nil {
+				logger.Warn("Sync storage orders failed: %s", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-watcher.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for the running sync until ctx is done
+func (watcher *Watcher) Stop(ctx context.Context) error {
+	close(watcher.stop)
+	select {
+	case <-watcher.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sync saves new orders from chain and updates status of unfinished ones
+func (watcher *Watcher) Sync() error {
+	block, err := watcher.chain.GetBlockNumber()
+	if err != nil {
+		return err
+	}
+
+	orderIds, err := watcher.chain.GetProviderOrders(watcher.provider)
+	if err != nil {
+		return err
+	}
+
+	for _, orderId := range orderIds {
+		if ok, err := watcher.db.Has([]byte(keyPrefix+orderId), nil); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+
+		sOrder, err := watcher.chain.GetStorageOrder(orderId)
+		if err != nil {
+			logger.Warn("Get storage order '%s' failed: %s", orderId, err)
+			continue
+		}
+
+		now := time.Now()
+		order := &Order{
+			Id:               orderId,
+			FullStorageOrder: sOrder,
+			Status:           StatusPending,
+			CreatedAt:        now,
+			UpdatedAt:        now,
+		}
+		logger.Info("New storage order '%s' from '%s' for file '%s'", orderId, sOrder.Client, sOrder.FileIdentifier)
+
+		// Files beyond capacity aren't served, the order isn't committed
+		if err = watcher.accountant.Accept(usageOf(watcher.db, order)); err != nil {
+			if _, ok := err.(*capacity.QuotaError); !ok {
+				return err
+			}
+			logger.Warn("Storage order '%s' is failed, its file doesn't fit in capacity: %s", orderId, err)
+			order.Status = StatusFailed
+		}
+		if err = Save(watcher.db, order); err != nil {
+			return err
+		}
+	}
+
+	orders, err := List(watcher.db)
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[Status]int)
+	for _, order := range orders {
+		if !order.finished() {
+			watcher.update(order, orders, block)
+		}
+		counts[order.Status]++
+	}
+
+	for _, status := range Statuses {
+		metrics.Orders.WithLabelValues(string(status)).Set(float64(counts[status]))
+	}
+	return nil
+}
+
+// update refreshes order from chain and moves it to its next status, errors are left to next sync
+func (watcher *Watcher) update(order *Order, orders []*Order, block uint64) {
+	// Renew and cancel change expiry on chain
+	sOrder, err := watcher.chain.GetStorageOrder(order.Id)
+	if err != nil {
+		logger.Warn("Get storage order '%s' failed: %s", order.Id, err)
+		return
+	}
+	changed := sOrder != order.FullStorageOrder
+	if changed && sOrder.ExpiredOn != order.ExpiredOn {
+		logger.Info("Storage order '%s' expires on block %d instead of %d", order.Id, sOrder.ExpiredOn, order.ExpiredOn)
+	}
+	order.FullStorageOrder = sOrder
+
+	status := order.Status
+	switch {
+	case block >= order.ExpiredOn:
+		if err := watcher.clean(order, orders, block); err != nil {
+			logger.Warn("Delete file '%s' of expired storage order '%s' failed, retry in next sync: %s", order.FileIdentifier, order.Id, err)
+			break
+		}
+		status = StatusExpired
+	case status == StatusPending:
+		if sOrder.OrderStatus == "Success" {
+			status = StatusReceiving
+		} else if sOrder.OrderStatus == "Failed" {
+			status = StatusFailed
+		}
+	case status == StatusReceiving:
+		fileInfo := model.GetFileInfoFromDb(fileHash(order), watcher.db)
+		if fileInfo != nil && fileInfo.MerkleTreeSealed != nil {
+			status = StatusSealed
+		}
+	}
+
+	if status != order.Status {
+		logger.Info("Storage order '%s' is %s", order.Id, status)
+		order.Status = status
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	order.UpdatedAt = time.Now()
+	if err := Save(watcher.db, order); err != nil {
+		logger.Error("Save storage order '%s' failed: %s", order.Id, err)
+	}
+}
+
+// clean deletes file of expired order from fs, TEE and db, the file is kept if other orders still need it
+func (watcher *Watcher) clean(order *Order, orders []*Order, block uint64) error {
+	for _, other := range orders {
+		if other.Id != order.Id && !other.finished() && other.FileIdentifier == order.FileIdentifier && other.ExpiredOn > block {
+			logger.Info("File '%s' of expired storage order '%s' is kept for order '%s'", order.FileIdentifier, order.Id, other.Id)
+			return nil
+		}
+	}
+
+	fileInfo := model.GetFileInfoFromDb(fileHash(order), watcher.db)
+	if fileInfo == nil {
+		return nil
+	}
+
+	if err := fileInfo.Remove(watcher.db, watcher.fs, watcher.tee, watcher.store); err != nil {
+		return err
+	}
+	logger.Info("File '%s' of expired storage order '%s' is deleted", order.FileIdentifier, order.Id)
+	return nil
+}
+
+// Referencing lists unfinished orders whose file is one of hashes
+func Referencing(db *leveldb.DB, hashes ...string) ([]*Order, error) {
+	orders, err := List(db)
+	if err != nil {
+		return nil, err
+	}
+
+	referencing := make([]*Order, 0)
+	for _, order := range orders {
+		if order.finished() {
+			continue
+		}
+		for _, hash := range hashes {
+			if hash != "" && fileHash(order) == hash {
+				referencing = append(referencing, order)
+				break
+			}
+		}
+	}
+	return referencing, nil
+}
+
+// Usage lists bytes of unfinished orders, their files which aren't split or sealed here yet are committed
+func Usage(db *leveldb.DB) ([]capacity.OrderUsage, error) {
+	orders, err := List(db)
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make([]capacity.OrderUsage, 0)
+	for _, order := range orders {
+		if !order.finished() {
+			usages = append(usages, usageOf(db, order))
+		}
+	}
+	return usages, nil
+}
+
+// usageOf is the bytes order commits, nothing is committed if its file is already split or sealed here
+func usageOf(db *leveldb.DB, order *Order) capacity.OrderUsage {
+	hash := fileHash(order)
+	return capacity.OrderUsage{
+		Id:       order.Id,
+		FileHash: hash,
+		Status:   string(order.Status),
+		Size:     order.FileSize,
+		Stored:   capacity.HasFile(db, hash) || model.GetFileInfoFromDb(hash, db) != nil,
+	}
+}
+
+// fileHash is the key of order's file in db
+func fileHash(order *Order) string {
+	return strings.TrimPrefix(order.FileIdentifier, "0x")
+}
+
+func Save(db *leveldb.DB, order *Order) error {
+	orderBytes, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	return db.Put([]byte(keyPrefix+order.Id), orderBytes, nil)
+}
+
+func Get(db *leveldb.DB, id string) (*Order, error) {
+	orderBytes, err := db.Get([]byte(keyPrefix+id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	order := &Order{}
+	if err = json.Unmarshal(orderBytes, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// List returns all orders ordered by the block they are created on
+func List(db *leveldb.DB) ([]*Order, error) {
+	orders := make([]*Order, 0)
+	iter := db.NewIterator(dbutil.BytesPrefix([]byte(keyPrefix)), nil)
+	for iter.Next() {
+		order := &Order{}
+		if err := json.Unmarshal(iter.Value(), order); err != nil {
+			logger.Warn("Bad storage order record '%s': %s", string(iter.Key()), err)
+			continue
+		}
+		orders = append(orders, order)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].CreatedOn < orders[j].CreatedOn
+	})
+	return orders, nil
+}
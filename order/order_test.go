@@ -0,0 +1,145 @@
+package order
+
+import (
+	"karst/chain"
+	"karst/config"
+	"karst/merkletree"
+	"karst/model"
+	"karst/util"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// newTestWatcher watches orders to chain.MockProviderAccount on mock in a db kept in memory, capacity is total bytes
+func newTestWatcher(t *testing.T, mock *chain.MockChain, total int64) (*Watcher, *leveldb.DB) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Open db: %s", err)
+	}
+	cfg := &config.Configuration{
+		KarstPaths: &util.KarstPaths{},
+		Crust:      config.CrustConfiguration{Address: chain.MockProviderAccount},
+		Capacity:   config.CapacityConfiguration{Total: total},
+	}
+	return NewWatcher(db, nil, mock.Client(chain.MockProviderAccount), nil, cfg), db
+}
+
+// placeOrder places order for file fId which lasts 10 blocks
+func placeOrder(t *testing.T, mock *chain.MockChain, fId string) string {
+	orderId, err := mock.PlaceMockOrder(fId, 10)
+	if err != nil {
+		t.Fatalf("Place order: %s", err)
+	}
+	return orderId
+}
+
+// saveSealedFile records file whose root hash is hash as sealed
+func saveSealedFile(db *leveldb.DB, hash string) {
+	fileInfo := &model.FileInfo{
+		MerkleTree:       &merkletree.MerkleTreeNode{Hash: hash, Size: chain.MockFileSize},
+		MerkleTreeSealed: &merkletree.MerkleTreeNode{Hash: hash + "ff", Size: chain.MockFileSize},
+	}
+	fileInfo.SaveToDb(db)
+}
+
+// syncAndExpect syncs watcher and checks status of orders
+func syncAndExpect(t *testing.T, step string, watcher *Watcher, db *leveldb.DB, statuses map[string]Status) {
+	if err := watcher.Sync(); err != nil {
+		t.Fatalf("%s: sync failed: %s", step, err)
+	}
+	for orderId, status := range statuses {
+		order, err := Get(db, orderId)
+		if err != nil {
+			t.Fatalf("%s: get order '%s': %s", step, orderId, err)
+		}
+		if order.Status != status {
+			t.Errorf("%s: order of file '%s' is %s, want %s", step, order.FileIdentifier, order.Status, status)
+		}
+	}
+}
+
+func TestWatcherStatus(t *testing.T) {
+	mock := chain.NewTestMockChain()
+	watcher, db := newTestWatcher(t, mock, 0)
+	defer db.Close()
+
+	sealedOrder := placeOrder(t, mock, "0xaa01")
+	failedOrder := placeOrder(t, mock, "0xbb02")
+	syncAndExpect(t, "New orders", watcher, db, map[string]Status{sealedOrder: StatusPending, failedOrder: StatusPending})
+
+	mock.Advance(mock.ConfirmBlocks)
+	if err := mock.SetOrderStatus(failedOrder, "Failed"); err != nil {
+		t.Fatalf("Set order status: %s", err)
+	}
+	syncAndExpect(t, "Confirmed orders", watcher, db, map[string]Status{sealedOrder: StatusReceiving, failedOrder: StatusFailed})
+
+	saveSealedFile(db, "aa01")
+	syncAndExpect(t, "Sealed file", watcher, db, map[string]Status{sealedOrder: StatusSealed, failedOrder: StatusFailed})
+
+	mock.Advance(10)
+	syncAndExpect(t, "Expired order", watcher, db, map[string]Status{sealedOrder: StatusExpired, failedOrder: StatusFailed})
+
+	orders, err := List(db)
+	if err != nil || len(orders) != 2 {
+		t.Fatalf("Saved orders are %d (%v), want 2", len(orders), err)
+	}
+	for _, order := range orders {
+		if order.Client != chain.MockClientAccount || order.FileSize != chain.MockFileSize || order.ExpiredOn != 10 {
+			t.Errorf("Order '%s' isn't kept as on chain: %+v", order.Id, order.FullStorageOrder)
+		}
+	}
+}
+
+func TestWatcherCleansExpiredFiles(t *testing.T) {
+	mock := chain.NewTestMockChain()
+	watcher, db := newTestWatcher(t, mock, 0)
+	defer db.Close()
+
+	renewedOrder := placeOrder(t, mock, "0xaa01")
+	sharedOrder := placeOrder(t, mock, "0xbb02")
+	mock.Advance(mock.ConfirmBlocks)
+	syncAndExpect(t, "Confirmed orders", watcher, db, map[string]Status{renewedOrder: StatusReceiving, sharedOrder: StatusReceiving})
+	saveSealedFile(db, "aa01")
+	saveSealedFile(db, "bb02")
+	syncAndExpect(t, "Sealed files", watcher, db, map[string]Status{renewedOrder: StatusSealed, sharedOrder: StatusSealed})
+
+	// Renewal on chain moves expiry of the saved order
+	client := mock.Client(chain.MockClientAccount)
+	if err := client.RenewStorageOrder(renewedOrder, 5, chain.Quote(chain.MockProviderPrice, chain.MockFileSize, 5)); err != nil {
+		t.Fatalf("Renew order: %s", err)
+	}
+	mock.Advance(3)
+	otherOrder := placeOrder(t, mock, "0xbb02")
+	mock.Advance(5)
+	syncAndExpect(t, "Renewed order", watcher, db, map[string]Status{renewedOrder: StatusSealed, sharedOrder: StatusExpired, otherOrder: StatusReceiving})
+	if order, _ := Get(db, renewedOrder); order.ExpiredOn != 15 {
+		t.Errorf("Renewed order expires on %d, want 15", order.ExpiredOn)
+	}
+	if model.GetFileInfoFromDb("bb02", db) == nil {
+		t.Error("File of expired order is deleted while another order needs it")
+	}
+
+	mock.Advance(5)
+	syncAndExpect(t, "Expired order", watcher, db, map[string]Status{renewedOrder: StatusExpired})
+	if model.GetFileInfoFromDb("aa01", db) != nil {
+		t.Error("File of expired order isn't deleted")
+	}
+}
+
+func TestWatcherRejectsOrdersBeyondCapacity(t *testing.T) {
+	mock := chain.NewTestMockChain()
+	watcher, db := newTestWatcher(t, mock, chain.MockFileSize*3/2)
+	defer db.Close()
+
+	committedOrder := placeOrder(t, mock, "0xaa01")
+	syncAndExpect(t, "Order which fits", watcher, db, map[string]Status{committedOrder: StatusPending})
+	rejectedOrder := placeOrder(t, mock, "0xbb02")
+	syncAndExpect(t, "Order beyond committed bytes", watcher, db, map[string]Status{committedOrder: StatusPending, rejectedOrder: StatusFailed})
+
+	// An order for a file which is already here commits nothing
+	saveSealedFile(db, "cc03")
+	storedOrder := placeOrder(t, mock, "0xcc03")
+	syncAndExpect(t, "Order of stored file", watcher, db, map[string]Status{storedOrder: StatusPending})
+}
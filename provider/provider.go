@@ -0,0 +1,168 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"karst/chain"
+	"karst/logger"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policies of choosing providers for storage orders
+const (
+	PolicyCheapest = "cheapest"
+	PolicyFastest  = "fastest"
+	PolicySpread   = "spread"
+)
+
+// InfoPath is where karst advertises its provider information
+const InfoPath = "/api/v0/provider/info"
+
+// Info is advertised by provider, capacity 0 means it isn't advertised, used includes reserved bytes and bytes committed by orders
+type Info struct {
+	Account  string `json:"account"`
+	Capacity uint64 `json:"capacity"`
+	Used     uint64 `json:"used"`
+}
+
+// Candidate is a registered provider with the result of probing its karst address
+type Candidate struct {
+	Account  string  `json:"account"`
+	Address  string  `json:"address"`
+	Price    uint64  `json:"price"`
+	Alive    bool    `json:"alive"`
+	Latency  float64 `json:"latency_ms"`
+	Capacity uint64  `json:"capacity"`
+	Used     uint64  `json:"used"`
+	Info     string  `json:"info,omitempty"`
+}
+
+var ErrNoProvider = errors.New("No available provider")
+
+// Discover lists registered providers from chain and probes them concurrently
+func Discover(client chain.Client, timeout time.Duration) ([]*Candidate, error) {
+	providers, err := client.GetProviders()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]*Candidate, len(providers))
+	var wg sync.WaitGroup
+	for index, p := range providers {
+		candidates[index] = &Candidate{
+			Account: p.Account,
+			Address: p.Address,
+			Price:   p.StoragePrice,
+		}
+		wg.Add(1)
+		go func(candidate *Candidate) {
+			defer wg.Done()
+			probe(candidate, timeout)
+		}(candidates[index])
+	}
+	wg.Wait()
+
+	return candidates, nil
+}
+
+// probe gets provider information from its karst address
+func probe(candidate *Candidate, timeout time.Duration) {
+	infoUrl, err := ApiUrl(candidate.Address, InfoPath)
+	if err != nil {
+		candidate.Info = err.Error()
+		return
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+	timeStart := time.Now()
+	resp, err := httpClient.Get(infoUrl)
+	if err != nil {
+		candidate.Info = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	candidate.Latency = float64(time.Since(timeStart).Microseconds()) / 1000
+
+	if resp.StatusCode != http.StatusOK {
+		candidate.Info = fmt.Sprintf("Provider information returns status %d", resp.StatusCode)
+		return
+	}
+
+	info := Info{}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		candidate.Info = fmt.Sprintf("Wrong provider information: %s", err)
+		return
+	}
+	if info.Account != candidate.Account {
+		candidate.Info = fmt.Sprintf("Karst at '%s' serves account '%s'", candidate.Address, info.Account)
+		return
+	}
+
+	candidate.Alive = true
+	candidate.Capacity = info.Capacity
+	candidate.Used = info.Used
+}
+
+// ApiUrl turns registered karst address like 'ws://127.0.0.1:17000' into the http url of path
+func ApiUrl(address string, path string) (string, error) {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("Wrong karst address '%s'", address)
+	}
+
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "http"
+	case "wss", "https":
+		u.Scheme = "https"
+	default:
+		return "", fmt.Errorf("Unknown scheme of karst address '%s'", address)
+	}
+	u.Path = path
+	return u.String(), nil
+}
+
+// Select picks at most count alive providers which can hold fileSize bytes by policy
+func Select(candidates []*Candidate, policy string, count int, fileSize uint64) ([]*Candidate, error) {
+	available := make([]*Candidate, 0)
+	for _, candidate := range candidates {
+		if candidate.Alive && (candidate.Capacity == 0 || candidate.Capacity >= candidate.Used+fileSize) {
+			available = append(available, candidate)
+		}
+	}
+	if len(available) == 0 {
+		return nil, ErrNoProvider
+	}
+
+	switch policy {
+	case PolicyCheapest:
+		sort.SliceStable(available, func(i, j int) bool {
+			if available[i].Price != available[j].Price {
+				return available[i].Price < available[j].Price
+			}
+			return available[i].Latency < available[j].Latency
+		})
+	case PolicyFastest:
+		sort.SliceStable(available, func(i, j int) bool {
+			return available[i].Latency < available[j].Latency
+		})
+	case PolicySpread:
+		rand.Shuffle(len(available), func(i, j int) {
+			available[i], available[j] = available[j], available[i]
+		})
+	default:
+		return nil, fmt.Errorf("Unknown provider policy '%s'", policy)
+	}
+
+	if count > len(available) {
+		logger.Warn("Only %d providers are available, %d are wanted", len(available), count)
+		count = len(available)
+	}
+	return available[:count], nil
+}
@@ -0,0 +1,481 @@
+package scrub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"karst/config"
+	"karst/fs"
+	"karst/logger"
+	"karst/merkletree"
+	"karst/metrics"
+	"karst/model"
+	"karst/store"
+	"karst/tee"
+	"karst/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const reportKey = "scrub_report"
+
+// A failed pass is retried after this
+const retryInterval = time.Minute
+
+// Kinds of corruption
+const (
+	KindMismatch   = "mismatch"
+	KindMissing    = "missing"
+	KindUnreadable = "unreadable"
+)
+
+// ErrRunning is returned if a pass is already running, in background or by command
+var ErrRunning = errors.New("Scrubbing is already running")
+
+var running int32
+
+// Corruption is a part which isn't what its name or merkle tree says, index is -1 if the part can't be told
+type Corruption struct {
+	Root  string `json:"root"`
+	Index int    `json:"index"`
+	Hash  string `json:"hash"`
+	// Path is where the intact part should be, the corrupted part is found at Found
+	Path         string `json:"path"`
+	Found        string `json:"found,omitempty"`
+	Kind         string `json:"kind"`
+	Reason       string `json:"reason"`
+	Repaired     bool   `json:"repaired"`
+	RepairedFrom string `json:"repaired_from,omitempty"`
+}
+
+// Report is the result of a scrubbing pass
+type Report struct {
+	StartedAt   time.Time    `json:"started_at"`
+	FinishedAt  time.Time    `json:"finished_at"`
+	Interrupted bool         `json:"interrupted"`
+	Files       int          `json:"files"`
+	Parts       int          `json:"parts"`
+	Bytes       uint64       `json:"bytes"`
+	Corruptions []Corruption `json:"corruptions"`
+}
+
+// Repaired counts repaired corruptions
+func (report *Report) Repaired() int {
+	count := 0
+	for _, corruption := range report.Corruptions {
+		if corruption.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// Scrubber re-hashes parts split into files directory against their names and the merkle tree in leveldb.
+// Corrupted parts are repaired from an intact copy of the same part in files directory, or by unsealing
+// the sealed part in fs
+type Scrubber struct {
+	db       *leveldb.DB
+	fs       fs.FsInterface
+	tee      *tee.Tee
+	store    *store.Store
+	paths    *util.KarstPaths
+	interval time.Duration
+	rate     int64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// New creates scrubber, without TEE sealed parts can't be used for repair
+func New(db *leveldb.DB, fs fs.FsInterface, tee *tee.Tee, cfg *config.Configuration) *Scrubber {
+	return &Scrubber{
+		db:       db,
+		fs:       fs,
+		tee:      tee,
+		store:    store.New(db, cfg.KarstPaths),
+		paths:    cfg.KarstPaths,
+		interval: cfg.Scrub.Interval,
+		rate:     int64(cfg.Scrub.Rate) * (1 << 20),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs a pass every interval in background until Stop, passes are timed from the last finished one
+func (scrubber *Scrubber) Start() {
+	if scrubber.interval == 0 {
+		logger.Info("Background scrubbing is disabled")
+		close(scrubber.done)
+		return
+	}
+
+	logger.Info("Start scrubbing parts in '%s' every %s", scrubber.paths.FilesPath, scrubber.interval)
+	go func() {
+		defer close(scrubber.done)
+		next := scrubber.next()
+		for {
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+			case <-scrubber.stop:
+				timer.Stop()
+				return
+			}
+
+			report, err := scrubber.Run(scrubber.stop)
+			if err != nil {
+				if err != ErrRunning {
+					logger.Warn("Scrubbing failed: %s", err)
+				}
+				next = scrubber.next()
+				if retry := time.Now().Add(retryInterval); next.Before(retry) {
+					next = retry
+				}
+				continue
+			}
+			if report.Interrupted {
+				return
+			}
+			next = report.FinishedAt.Add(scrubber.interval)
+		}
+	}()
+}
+
+// Stop waits for the running pass to be interrupted until ctx is done
+func (scrubber *Scrubber) Stop(ctx context.Context) error {
+	close(scrubber.stop)
+	select {
+	case <-scrubber.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// next is the time of next pass, it is now if there is no pass yet
+func (scrubber *Scrubber) next() time.Time {
+	report, err := LastReport(scrubber.db)
+	if err != nil || report == nil {
+		return time.Now()
+	}
+	return report.FinishedAt.Add(scrubber.interval)
+}
+
+// Run scrubs all files in files directory and repairs corrupted parts, the pass is interrupted if stop is closed.
+// Its report is saved as the last report
+func (scrubber *Scrubber) Run(stop <-chan struct{}) (*Report, error) {
+	if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+		return nil, ErrRunning
+	}
+	defer atomic.StoreInt32(&running, 0)
+
+	dirs, err := ioutil.ReadDir(scrubber.paths.FilesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	logger.Info("Scrubbing parts of %d files in '%s'", len(dirs), scrubber.paths.FilesPath)
+	report := &Report{
+		StartedAt:   time.Now(),
+		Corruptions: make([]Corruption, 0),
+	}
+	// Intact parts by hash, they repair corrupted parts of the same hash
+	intact := make(map[string]string)
+	limiter := &throttle{rate: scrubber.rate, start: time.Now()}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if !scrubber.scrubFile(dir.Name(), report, intact, limiter, stop) {
+			report.Interrupted = true
+			break
+		}
+		report.Files++
+	}
+
+	for i := range report.Corruptions {
+		scrubber.repair(&report.Corruptions[i], intact)
+	}
+
+	report.FinishedAt = time.Now()
+	if err = saveReport(scrubber.db, report); err != nil {
+		logger.Error("Save scrubbing report failed: %s", err)
+	}
+	if !report.Interrupted {
+		metrics.ScrubLastPass.Set(float64(report.FinishedAt.Unix()))
+	}
+
+	logger.Info("Scrubbed %d parts of %d files in %s, %d are corrupted and %d are repaired", report.Parts, report.Files,
+		report.FinishedAt.Sub(report.StartedAt), len(report.Corruptions), report.Repaired())
+	return report, nil
+}
+
+// scrubFile checks parts in 'files/root', it returns false if it is stopped
+func (scrubber *Scrubber) scrubFile(root string, report *Report, intact map[string]string, limiter *throttle, stop <-chan struct{}) bool {
+	dir := filepath.Join(scrubber.paths.FilesPath, root)
+	corrupt := func(corruption Corruption) {
+		corruption.Root = root
+		logger.Warn("Part %d of '%s' is corrupted: %s", corruption.Index, root, corruption.Reason)
+		metrics.ScrubCorruptions.WithLabelValues(corruption.Kind).Inc()
+		report.Corruptions = append(report.Corruptions, corruption)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		corrupt(Corruption{Index: -1, Path: dir, Kind: KindUnreadable, Reason: err.Error()})
+		return true
+	}
+	names := make(map[int]string)
+	indices := make([]int, 0, len(infos))
+	for _, info := range infos {
+		if index, _, ok := parsePartName(info.Name()); ok && !info.IsDir() {
+			names[index] = info.Name()
+			indices = append(indices, index)
+		}
+	}
+	sort.Ints(indices)
+
+	// Parts are checked against merkle tree in leveldb, or only their names if the file is unknown
+	var merkleTree *merkletree.MerkleTreeNode
+	if fileInfo := model.GetFileInfoFromDb(root, scrubber.db); fileInfo != nil && fileInfo.MerkleTree != nil && fileInfo.MerkleTree.Hash == root {
+		merkleTree = fileInfo.MerkleTree
+		for index := range merkleTree.Links {
+			if _, ok := names[index]; !ok {
+				hash := merkleTree.Links[index].Hash
+				corrupt(Corruption{Index: index, Hash: hash, Path: partPath(dir, index, hash), Kind: KindMissing, Reason: "Part is missing"})
+			}
+		}
+	} else if nameTree, err := merkletree.CreateMerkleTreeFromDir(dir); err != nil {
+		corrupt(Corruption{Index: -1, Path: dir, Kind: KindMissing, Reason: err.Error()})
+	} else if nameTree.Hash != root {
+		corrupt(Corruption{Index: -1, Path: dir, Kind: KindMismatch, Reason: fmt.Sprintf("Parts are of '%s'", nameTree.Hash)})
+	}
+
+	for _, index := range indices {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+
+		_, hash, _ := parsePartName(names[index])
+		found := filepath.Join(dir, names[index])
+		if merkleTree != nil {
+			if index >= len(merkleTree.Links) {
+				corrupt(Corruption{Index: index, Hash: hash, Path: found, Found: found, Kind: KindMismatch, Reason: fmt.Sprintf("Part is out of %d parts in merkle tree", len(merkleTree.Links))})
+				continue
+			}
+			hash = merkleTree.Links[index].Hash
+		}
+		path := partPath(dir, index, hash)
+
+		data, err := ioutil.ReadFile(found)
+		if err != nil {
+			corrupt(Corruption{Index: index, Hash: hash, Path: path, Found: found, Kind: KindUnreadable, Reason: err.Error()})
+			continue
+		}
+		if !limiter.wait(len(data), stop) {
+			return false
+		}
+		report.Parts++
+		report.Bytes += uint64(len(data))
+		metrics.ScrubParts.Inc()
+		metrics.ScrubBytes.Add(float64(len(data)))
+
+		if dataHash := hashOf(data); dataHash != hash {
+			corrupt(Corruption{Index: index, Hash: hash, Path: path, Found: found, Kind: KindMismatch, Reason: fmt.Sprintf("Part data is of '%s'", dataHash)})
+		} else if found != path {
+			corrupt(Corruption{Index: index, Hash: hash, Path: path, Found: found, Kind: KindMismatch, Reason: fmt.Sprintf("Part is named '%s'", names[index])})
+		} else {
+			intact[hash] = path
+		}
+	}
+	return true
+}
+
+// repair writes the intact part to its path from a replica in files directory or the sealed part in fs
+func (scrubber *Scrubber) repair(corruption *Corruption, intact map[string]string) {
+	if corruption.Index < 0 || corruption.Hash == "" {
+		metrics.ScrubRepairs.WithLabelValues("failed").Inc()
+		return
+	}
+
+	var data []byte
+	source := "replica"
+	if replica, ok := intact[corruption.Hash]; ok {
+		if replicaData, err := ioutil.ReadFile(replica); err == nil && hashOf(replicaData) == corruption.Hash {
+			data = replicaData
+			corruption.RepairedFrom = replica
+		}
+	}
+	if data == nil {
+		source = "fs"
+		sealedData, key, err := scrubber.unsealPart(corruption)
+		if err != nil {
+			logger.Warn("Part %d of '%s' can't be repaired: %s", corruption.Index, corruption.Root, err)
+			metrics.ScrubRepairs.WithLabelValues("failed").Inc()
+			return
+		}
+		data = sealedData
+		corruption.RepairedFrom = key
+	}
+
+	// Parts in store are shared by files, the one in store is replaced and linked again
+	var err error
+	if _, partErr := scrubber.store.GetPart(corruption.Hash); partErr == nil {
+		if err = scrubber.store.Repair(corruption.Hash, data); err == nil {
+			err = scrubber.store.Link(corruption.Hash, corruption.Path)
+		}
+	} else {
+		err = writePart(corruption.Path, data)
+	}
+	if err != nil {
+		logger.Warn("Write repaired part %d of '%s' failed: %s", corruption.Index, corruption.Root, err)
+		corruption.RepairedFrom = ""
+		metrics.ScrubRepairs.WithLabelValues("failed").Inc()
+		return
+	}
+	if corruption.Found != "" && corruption.Found != corruption.Path {
+		if err := os.Remove(corruption.Found); err != nil {
+			logger.Warn("Remove corrupted part '%s' failed: %s", corruption.Found, err)
+		}
+	}
+
+	corruption.Repaired = true
+	metrics.ScrubRepairs.WithLabelValues(source).Inc()
+	logger.Info("Part %d of '%s' is repaired from '%s'", corruption.Index, corruption.Root, corruption.RepairedFrom)
+}
+
+// unsealPart gets sealed part of corruption from fs and unseals it in TEE, it returns the part and its fs key
+func (scrubber *Scrubber) unsealPart(corruption *Corruption) ([]byte, string, error) {
+	fileInfo := model.GetFileInfoFromDb(corruption.Root, scrubber.db)
+	if fileInfo == nil || fileInfo.MerkleTreeSealed == nil {
+		return nil, "", errors.New("There is no replica and the file isn't sealed")
+	}
+	if scrubber.tee == nil {
+		return nil, "", errors.New("There is no replica and TEE isn't configured")
+	}
+	if corruption.Index >= len(fileInfo.StoredKeys) || corruption.Index >= len(fileInfo.MerkleTreeSealed.Links) {
+		return nil, "", fmt.Errorf("Sealed part %d isn't in fs", corruption.Index)
+	}
+
+	key := fileInfo.StoredKeys[corruption.Index]
+	tempPath := filepath.FromSlash(scrubber.paths.TempFilesPath + "/" + corruption.Hash + "_" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer os.Remove(tempPath)
+	if err := scrubber.fs.Get(key, tempPath); err != nil {
+		return nil, "", fmt.Errorf("Get sealed part '%s' from fs failed: %s", key, err)
+	}
+	sealed, err := ioutil.ReadFile(tempPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := scrubber.tee.UnsealPart(fileInfo.MerkleTreeSealed, corruption.Index, sealed)
+	if err != nil {
+		return nil, "", err
+	}
+	if err = tee.CheckPart(corruption.Hash, data); err != nil {
+		return nil, "", fmt.Errorf("Unsealed part %d isn't the one in merkle tree: %s", corruption.Index, err)
+	}
+	return data, key, nil
+}
+
+// LastReport gets the report of the last pass, it is nil if there is no pass yet
+func LastReport(db *leveldb.DB) (*Report, error) {
+	reportBytes, err := db.Get([]byte(reportKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	if err = json.Unmarshal(reportBytes, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func saveReport(db *leveldb.DB, report *Report) error {
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return db.Put([]byte(reportKey), reportBytes, nil)
+}
+
+// throttle keeps reading under rate bytes per second, 0 means unlimited
+type throttle struct {
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+// wait sleeps until n more bytes are allowed, it returns false if it is stopped
+func (limiter *throttle) wait(n int, stop <-chan struct{}) bool {
+	limiter.bytes += int64(n)
+	if limiter.rate <= 0 {
+		return true
+	}
+
+	due := limiter.start.Add(time.Duration(float64(limiter.bytes) / float64(limiter.rate) * float64(time.Second)))
+	if time.Now().After(due) {
+		return true
+	}
+	timer := time.NewTimer(time.Until(due))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// parsePartName parses part name 'index_hash'
+func parsePartName(name string) (int, string, bool) {
+	fields := strings.SplitN(name, "_", 2)
+	if len(fields) != 2 {
+		return 0, "", false
+	}
+	index, err := strconv.Atoi(fields[0])
+	if err != nil || index < 0 {
+		return 0, "", false
+	}
+	if _, err := hex.DecodeString(fields[1]); err != nil || len(fields[1]) != sha256.Size*2 {
+		return 0, "", false
+	}
+	return index, fields[1], true
+}
+
+func partPath(dir string, index int, hash string) string {
+	return filepath.Join(dir, strconv.Itoa(index)+"_"+hash)
+}
+
+// writePart replaces part at path through a temporary file, so a part is never half written
+func writePart(path string, data []byte) error {
+	tempPath := path + ".repair"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func hashOf(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
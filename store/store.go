@@ -0,0 +1,504 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"karst/logger"
+	"karst/merkletree"
+	"karst/metrics"
+	"karst/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	dbutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	partPrefix = "part_"
+	filePrefix = "file_parts_"
+)
+
+var ErrNotFound = errors.New("Part is not found")
+
+// Reference counts and file records are changed together by splits, deletes and repairs
+var lock sync.Mutex
+
+// Part is a part kept in store, it is referenced once by every place of it in recorded files
+type Part struct {
+	Refs int    `json:"refs"`
+	Size uint64 `json:"size"`
+}
+
+// Store keeps every part once in parts directory by its hash, files split into files directory hard link their
+// parts 'index_hash' to it, so TEE and others still read parts from the file directory
+type Store struct {
+	db        *leveldb.DB
+	partsPath string
+	filesPath string
+}
+
+func New(db *leveldb.DB, karstPaths *util.KarstPaths) *Store {
+	return &Store{
+		db:        db,
+		partsPath: karstPaths.PartsPath,
+		filesPath: karstPaths.FilesPath,
+	}
+}
+
+// Path is where part of hash is kept, parts are spread into directories by the first 2 hex of their hash
+func (st *Store) Path(hash string) string {
+	return filepath.Join(st.partsPath, hash[:2], hash)
+}
+
+// Put keeps data of part in store, it returns true without writing if the part is already there and intact.
+// A broken part in store is replaced and linked again into files having it
+func (st *Store) Put(hash string, data []byte) (bool, error) {
+	if err := checkHash(hash); err != nil {
+		return false, err
+	}
+	if hashOf(data) != hash {
+		return false, fmt.Errorf("Hash of part data isn't '%s'", hash)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	info, err := os.Stat(st.Path(hash))
+	if err != nil {
+		return false, writeFile(st.Path(hash), data)
+	}
+	if info.Size() == int64(len(data)) {
+		if existing, err := ioutil.ReadFile(st.Path(hash)); err == nil && hashOf(existing) == hash {
+			metrics.StoreDedupParts.Inc()
+			metrics.StoreDedupBytes.Add(float64(len(data)))
+			return true, nil
+		}
+	}
+	logger.Warn("Part '%s' in store is broken, it is replaced", hash)
+	return false, st.replace(hash, data)
+}
+
+// Link makes path the part of hash in store, the part is copied if hard link isn't supported
+func (st *Store) Link(hash string, path string) error {
+	if err := checkHash(hash); err != nil {
+		return err
+	}
+	return link(st.Path(hash), path)
+}
+
+// AddFile records parts of file split into 'files/root_hash' and references them, a recorded file is skipped.
+// Parts missing in store are taken from the file directory
+func (st *Store) AddFile(merkleTree *merkletree.MerkleTreeNode) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	fileKey := []byte(filePrefix + merkleTree.Hash)
+	if ok, err := st.db.Has(fileKey, nil); err != nil || ok {
+		return err
+	}
+
+	dir := filepath.Join(st.filesPath, merkleTree.Hash)
+	hashs := make([]string, 0, len(merkleTree.Links))
+	parts := make(map[string]*Part)
+	for index, node := range merkleTree.Links {
+		if err := checkHash(node.Hash); err != nil {
+			return err
+		}
+
+		part, ok := parts[node.Hash]
+		if !ok {
+			var err error
+			if part, err = st.getPart(node.Hash); err == ErrNotFound {
+				part = &Part{Size: node.Size}
+			} else if err != nil {
+				return err
+			}
+			if !util.IsDirOrFileExist(st.Path(node.Hash)) {
+				if err = link(filepath.Join(dir, strconv.Itoa(index)+"_"+node.Hash), st.Path(node.Hash)); err != nil {
+					return fmt.Errorf("Keep part %d of '%s' in store failed: %s", index, merkleTree.Hash, err)
+				}
+			}
+			parts[node.Hash] = part
+		}
+
+		part.Refs++
+		hashs = append(hashs, node.Hash)
+	}
+
+	batch := new(leveldb.Batch)
+	for hash, part := range parts {
+		partBytes, _ := json.Marshal(part)
+		batch.Put([]byte(partPrefix+hash), partBytes)
+	}
+	hashsBytes, _ := json.Marshal(hashs)
+	batch.Put(fileKey, hashsBytes)
+	return st.db.Write(batch, nil)
+}
+
+// RemoveFile removes file directory and its record, parts which aren't referenced any more are removed from store.
+// It returns the bytes freed in store
+func (st *Store) RemoveFile(root string) (uint64, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	hashs, err := st.fileParts(root)
+	if err != nil {
+		return 0, err
+	}
+
+	parts := make(map[string]*Part)
+	for _, hash := range hashs {
+		part, ok := parts[hash]
+		if !ok {
+			if part, err = st.getPart(hash); err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			parts[hash] = part
+		}
+		part.Refs--
+	}
+
+	batch := new(leveldb.Batch)
+	unreferenced := make([]string, 0)
+	for hash, part := range parts {
+		if part.Refs <= 0 {
+			batch.Delete([]byte(partPrefix + hash))
+			unreferenced = append(unreferenced, hash)
+			continue
+		}
+		partBytes, _ := json.Marshal(part)
+		batch.Put([]byte(partPrefix+hash), partBytes)
+	}
+	batch.Delete([]byte(filePrefix + root))
+	if err = st.db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+
+	if err = os.RemoveAll(filepath.Join(st.filesPath, root)); err != nil {
+		logger.Warn("Remove parts of '%s' failed: %s", root, err)
+	}
+	var freed uint64
+	for _, hash := range unreferenced {
+		if err = os.Remove(st.Path(hash)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Remove part '%s' from store failed: %s", hash, err)
+			continue
+		}
+		freed += parts[hash].Size
+	}
+	return freed, nil
+}
+
+// HasFile tells whether file of root hash is recorded
+func (st *Store) HasFile(root string) bool {
+	ok, _ := st.db.Has([]byte(filePrefix+root), nil)
+	return ok
+}
+
+// Resolve finds part at index of file in store, ErrNotFound is returned if the file doesn't have it
+func (st *Store) Resolve(root string, index uint64, hash string) (string, error) {
+	hashs, err := st.fileParts(root)
+	if err != nil {
+		return "", err
+	}
+	if index >= uint64(len(hashs)) || hashs[index] != hash {
+		return "", ErrNotFound
+	}
+	return st.Path(hash), nil
+}
+
+// Repair replaces the part in store with intact data, files referencing it are linked to the new one
+func (st *Store) Repair(hash string, data []byte) error {
+	if err := checkHash(hash); err != nil {
+		return err
+	}
+	if hashOf(data) != hash {
+		return fmt.Errorf("Hash of part data isn't '%s'", hash)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	return st.replace(hash, data)
+}
+
+// replace writes part of hash and links it again into every recorded file having it, it is called with lock held
+func (st *Store) replace(hash string, data []byte) error {
+	if err := writeFile(st.Path(hash), data); err != nil {
+		return err
+	}
+
+	iter := st.db.NewIterator(dbutil.BytesPrefix([]byte(filePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		root := string(iter.Key()[len(filePrefix):])
+		hashs := make([]string, 0)
+		if err := json.Unmarshal(iter.Value(), &hashs); err != nil {
+			continue
+		}
+		for index := range hashs {
+			if hashs[index] != hash {
+				continue
+			}
+			if err := link(st.Path(hash), filepath.Join(st.filesPath, root, strconv.Itoa(index)+"_"+hash)); err != nil {
+				return err
+			}
+		}
+	}
+	return iter.Error()
+}
+
+// GetPart gets the reference count and size of part
+func (st *Store) GetPart(hash string) (*Part, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	return st.getPart(hash)
+}
+
+// Size is the bytes of all parts in store, every part is counted once
+func (st *Store) Size() (uint64, error) {
+	var size uint64
+	iter := st.db.NewIterator(dbutil.BytesPrefix([]byte(partPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		part := Part{}
+		if err := json.Unmarshal(iter.Value(), &part); err != nil {
+			continue
+		}
+		size += part.Size
+	}
+	return size, iter.Error()
+}
+
+func (st *Store) getPart(hash string) (*Part, error) {
+	partBytes, err := st.db.Get([]byte(partPrefix+hash), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	part := &Part{}
+	if err = json.Unmarshal(partBytes, part); err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+func (st *Store) fileParts(root string) ([]string, error) {
+	hashsBytes, err := st.db.Get([]byte(filePrefix+root), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	hashs := make([]string, 0)
+	if err = json.Unmarshal(hashsBytes, &hashs); err != nil {
+		return nil, err
+	}
+	return hashs, nil
+}
+
+// link hard links src to dst through a temporary name, so dst is replaced at once
+func link(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+
+	tempPath := dst + ".link"
+	os.Remove(tempPath)
+	if err := os.Link(src, tempPath); err != nil {
+		logger.Debug("Hard link '%s' failed, copy it: %s", src, err)
+		if err = util.CpFile(src, tempPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// writeFile writes data through a temporary file, so a part is never half written
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func checkHash(hash string) error {
+	if hashBytes, err := hex.DecodeString(hash); err != nil || len(hashBytes) != sha256.Size {
+		return fmt.Errorf("Wrong part hash '%s'", hash)
+	}
+	return nil
+}
+
+func hashOf(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Fix is an inconsistency between records and parts directory found by Reconcile
+type Fix struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Size   uint64 `json:"size"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Kinds of fix
+const (
+	FixFileRecord = "file_record"
+	FixPartRecord = "part_record"
+	FixPart       = "store_part"
+	FixTempFile   = "temp_file"
+)
+
+// Reconcile makes part records agree with file records and parts directory: records of files whose directory is gone
+// are dropped, reference counts are recounted, parts missing in store are taken back from file directories, and parts
+// or temporary files older than age which nothing references are removed. Nothing is changed if dryRun is true
+func (st *Store) Reconcile(age time.Duration, dryRun bool) ([]Fix, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	fixes := make([]Fix, 0)
+	apply := func(fix Fix, do func() error) {
+		if !dryRun {
+			if err := do(); err != nil {
+				fix.Error = err.Error()
+			}
+		}
+		fixes = append(fixes, fix)
+	}
+
+	// Files and where their parts are
+	refs := make(map[string]int)
+	places := make(map[string]string)
+	files := make(map[string][]string)
+	iter := st.db.NewIterator(dbutil.BytesPrefix([]byte(filePrefix)), nil)
+	for iter.Next() {
+		hashs := make([]string, 0)
+		if err := json.Unmarshal(iter.Value(), &hashs); err != nil {
+			continue
+		}
+		files[string(iter.Key()[len(filePrefix):])] = hashs
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	for root, hashs := range files {
+		dir := filepath.Join(st.filesPath, root)
+		if !util.IsDirOrFileExist(dir) {
+			apply(Fix{Kind: FixFileRecord, Target: root, Reason: "File directory is missing"}, func() error {
+				return st.db.Delete([]byte(filePrefix+root), nil)
+			})
+			continue
+		}
+		for index, hash := range hashs {
+			refs[hash]++
+			places[hash] = filepath.Join(dir, strconv.Itoa(index)+"_"+hash)
+		}
+	}
+
+	// Reference counts
+	parts := make(map[string]*Part)
+	iter = st.db.NewIterator(dbutil.BytesPrefix([]byte(partPrefix)), nil)
+	for iter.Next() {
+		part := &Part{}
+		if err := json.Unmarshal(iter.Value(), part); err != nil {
+			continue
+		}
+		parts[string(iter.Key()[len(partPrefix):])] = part
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	for hash, part := range parts {
+		hash, part := hash, part
+		if refs[hash] == part.Refs {
+			continue
+		}
+		reason := fmt.Sprintf("Part is referenced %d times but recorded %d", refs[hash], part.Refs)
+		apply(Fix{Kind: FixPartRecord, Target: hash, Reason: reason}, func() error {
+			if refs[hash] == 0 {
+				return st.db.Delete([]byte(partPrefix+hash), nil)
+			}
+			part.Refs = refs[hash]
+			partBytes, _ := json.Marshal(part)
+			return st.db.Put([]byte(partPrefix+hash), partBytes, nil)
+		})
+	}
+	for hash := range refs {
+		hash := hash
+		if _, ok := parts[hash]; ok {
+			continue
+		}
+		apply(Fix{Kind: FixPartRecord, Target: hash, Reason: fmt.Sprintf("Part is referenced %d times but not recorded", refs[hash])}, func() error {
+			info, err := os.Stat(places[hash])
+			if err != nil {
+				return err
+			}
+			partBytes, _ := json.Marshal(&Part{Refs: refs[hash], Size: uint64(info.Size())})
+			return st.db.Put([]byte(partPrefix+hash), partBytes, nil)
+		})
+	}
+
+	// Referenced parts missing in store
+	for hash := range refs {
+		hash := hash
+		if util.IsDirOrFileExist(st.Path(hash)) {
+			continue
+		}
+		apply(Fix{Kind: FixPart, Target: st.Path(hash), Reason: "Referenced part is missing in store, it is taken back from '" + places[hash] + "'"}, func() error {
+			return link(places[hash], st.Path(hash))
+		})
+	}
+
+	// Parts and temporary files nothing references
+	err := filepath.Walk(st.partsPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || time.Since(info.ModTime()) < age {
+			return nil
+		}
+		name := info.Name()
+		if checkHash(name) == nil {
+			if refs[name] != 0 {
+				return nil
+			}
+			apply(Fix{Kind: FixPart, Target: path, Size: uint64(info.Size()), Reason: "Part isn't referenced"}, func() error {
+				return os.Remove(path)
+			})
+		} else if strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, ".link") {
+			apply(Fix{Kind: FixTempFile, Target: path, Size: uint64(info.Size()), Reason: "Temporary file is left"}, func() error {
+				return os.Remove(path)
+			})
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return fixes, err
+	}
+	return fixes, nil
+}
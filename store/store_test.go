@@ -0,0 +1,239 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"karst/merkletree"
+	"karst/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "karst_store_")
+	if err != nil {
+		t.Fatalf("Create temp dir: %s", err)
+	}
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Open db: %s", err)
+	}
+	st := New(db, &util.KarstPaths{
+		FilesPath: filepath.Join(dir, "files"),
+		PartsPath: filepath.Join(dir, "parts"),
+	})
+	return st, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// addFile writes parts into the file directory like split does and records the file
+func addFile(t *testing.T, st *Store, parts ...string) *merkletree.MerkleTreeNode {
+	hashs := make([][]byte, 0, len(parts))
+	sizes := make([]uint64, 0, len(parts))
+	for _, part := range parts {
+		hash := sha256.Sum256([]byte(part))
+		hashs = append(hashs, hash[:])
+		sizes = append(sizes, uint64(len(part)))
+	}
+	merkleTree := merkletree.CreateMerkleTree(hashs, sizes)
+
+	dir := filepath.Join(st.filesPath, merkleTree.Hash)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Create file directory: %s", err)
+	}
+	for index, part := range parts {
+		if err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(index)+"_"+merkleTree.Links[index].Hash), []byte(part), 0644); err != nil {
+			t.Fatalf("Write part: %s", err)
+		}
+	}
+	if err := st.AddFile(merkleTree); err != nil {
+		t.Fatalf("Add file: %s", err)
+	}
+	return merkleTree
+}
+
+func expectRefs(t *testing.T, step string, st *Store, part string, refs int) {
+	got, err := st.GetPart(hashOf([]byte(part)))
+	if refs == 0 {
+		if err != ErrNotFound {
+			t.Errorf("%s: part '%s' is recorded with %+v (%v)", step, part, got, err)
+		}
+		return
+	}
+	if err != nil || got.Refs != refs || got.Size != uint64(len(part)) {
+		t.Errorf("%s: part '%s' is %+v (%v), want %d refs", step, part, got, err, refs)
+	}
+}
+
+func TestPutReplacesBrokenPart(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	data := []byte("part a")
+	hash := hashOf(data)
+	if _, err := st.Put(hash, []byte("part b")); err == nil {
+		t.Error("Part of another hash is put")
+	}
+	if _, err := st.Put("aa", []byte("aa")); err == nil {
+		t.Error("Part of wrong hash is put")
+	}
+	if existed, err := st.Put(hash, data); err != nil || existed {
+		t.Fatalf("Put new part: %t (%v)", existed, err)
+	}
+	if existed, err := st.Put(hash, data); err != nil || !existed {
+		t.Fatalf("Put kept part: %t (%v)", existed, err)
+	}
+
+	// Broken part of the same size is shared by the file linking it
+	merkleTree := addFile(t, st, "part a")
+	filePart := filepath.Join(st.filesPath, merkleTree.Hash, "0_"+hash)
+	if err := ioutil.WriteFile(st.Path(hash), []byte("part x"), 0644); err != nil {
+		t.Fatalf("Break part: %s", err)
+	}
+	if existed, err := st.Put(hash, data); err != nil || existed {
+		t.Fatalf("Put broken part: %t (%v)", existed, err)
+	}
+	for _, path := range []string{st.Path(hash), filePart} {
+		if got, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Part in '%s' is '%s' (%v), want '%s'", path, got, err, data)
+		}
+	}
+	if existed, err := st.Put(hash, data); err != nil || !existed {
+		t.Errorf("Put replaced part: %t (%v)", existed, err)
+	}
+
+	// Missing part is put again
+	os.Remove(st.Path(hash))
+	if existed, err := st.Put(hash, data); err != nil || existed {
+		t.Errorf("Put missing part: %t (%v)", existed, err)
+	}
+	expectRefs(t, "Put", st, "part a", 1)
+}
+
+func TestRefs(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	first := addFile(t, st, "part a", "part b", "part a")
+	second := addFile(t, st, "part a", "part c")
+	// A recorded file isn't counted twice
+	if err := st.AddFile(second); err != nil {
+		t.Fatalf("Add file again: %s", err)
+	}
+	expectRefs(t, "Add files", st, "part a", 3)
+	expectRefs(t, "Add files", st, "part b", 1)
+	expectRefs(t, "Add files", st, "part c", 1)
+	if size, err := st.Size(); err != nil || size != 18 {
+		t.Errorf("Store has %d bytes (%v), want 18", size, err)
+	}
+
+	freed, err := st.RemoveFile(second.Hash)
+	if err != nil || freed != 6 {
+		t.Fatalf("Remove file freed %d bytes (%v), want 6", freed, err)
+	}
+	expectRefs(t, "Remove file", st, "part a", 2)
+	expectRefs(t, "Remove file", st, "part c", 0)
+	if util.IsDirOrFileExist(st.Path(hashOf([]byte("part c")))) || util.IsDirOrFileExist(filepath.Join(st.filesPath, second.Hash)) {
+		t.Error("Parts of removed file are left")
+	}
+	if !util.IsDirOrFileExist(st.Path(hashOf([]byte("part a")))) {
+		t.Error("Part still referenced is removed")
+	}
+	if _, err := st.RemoveFile(second.Hash); err != ErrNotFound {
+		t.Errorf("Remove file again: got %v, want %v", err, ErrNotFound)
+	}
+
+	if path, err := st.Resolve(first.Hash, 2, hashOf([]byte("part a"))); err != nil || path != st.Path(hashOf([]byte("part a"))) {
+		t.Errorf("Resolve part is '%s' (%v)", path, err)
+	}
+	if _, err := st.Resolve(first.Hash, 1, hashOf([]byte("part a"))); err != ErrNotFound {
+		t.Errorf("Resolve part of another index: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	first := addFile(t, st, "part a", "part b", "part a")
+	second := addFile(t, st, "part a", "part c")
+	b := hashOf([]byte("part b"))
+	c := hashOf([]byte("part c"))
+
+	// Wrong count, deleted file directory, part missing in store and a left temporary file
+	if err := st.db.Put([]byte(partPrefix+b), []byte(`{"refs":5,"size":6}`), nil); err != nil {
+		t.Fatalf("Break count: %s", err)
+	}
+	os.RemoveAll(filepath.Join(st.filesPath, second.Hash))
+	os.Remove(st.Path(b))
+	tempPath := st.Path(c) + ".tmp"
+	if err := ioutil.WriteFile(tempPath, []byte("temp"), 0644); err != nil {
+		t.Fatalf("Write temp file: %s", err)
+	}
+
+	// Parts and temporary files newer than age are kept
+	fixes, err := st.Reconcile(time.Hour, true)
+	if err != nil || len(fixes) != 5 {
+		t.Fatalf("Reconcile young parts: %+v (%v)", fixes, err)
+	}
+
+	kinds := map[string]int{FixFileRecord: 1, FixPartRecord: 3, FixPart: 2, FixTempFile: 1}
+	expectFixes := func(step string, fixes []Fix, err error) {
+		if err != nil {
+			t.Fatalf("%s: %s", step, err)
+		}
+		got := make(map[string]int)
+		for _, fix := range fixes {
+			if fix.Error != "" {
+				t.Errorf("%s: %s '%s' failed: %s", step, fix.Kind, fix.Target, fix.Error)
+			}
+			if fix.Kind == FixPart && fix.Target == st.Path(c) && fix.Size != 6 {
+				t.Errorf("%s: unreferenced part is of %d bytes, want 6", step, fix.Size)
+			}
+			got[fix.Kind]++
+		}
+		for kind, n := range kinds {
+			if got[kind] != n {
+				t.Errorf("%s: %d fixes of %s, want %d: %+v", step, got[kind], kind, n, fixes)
+			}
+		}
+	}
+
+	fixes, err = st.Reconcile(0, true)
+	expectFixes("Dry run", fixes, err)
+	expectRefs(t, "Dry run", st, "part a", 3)
+	expectRefs(t, "Dry run", st, "part b", 5)
+	expectRefs(t, "Dry run", st, "part c", 1)
+	if !st.HasFile(second.Hash) || util.IsDirOrFileExist(st.Path(b)) || !util.IsDirOrFileExist(st.Path(c)) || !util.IsDirOrFileExist(tempPath) {
+		t.Fatal("Dry run changes store")
+	}
+
+	fixes, err = st.Reconcile(0, false)
+	expectFixes("Reconcile", fixes, err)
+	expectRefs(t, "Reconcile", st, "part a", 2)
+	expectRefs(t, "Reconcile", st, "part b", 1)
+	expectRefs(t, "Reconcile", st, "part c", 0)
+	if st.HasFile(second.Hash) || !st.HasFile(first.Hash) {
+		t.Error("Records of files aren't reconciled")
+	}
+	if got, err := ioutil.ReadFile(st.Path(b)); err != nil || string(got) != "part b" {
+		t.Errorf("Missing part is taken back as '%s' (%v)", got, err)
+	}
+	if util.IsDirOrFileExist(st.Path(c)) || util.IsDirOrFileExist(tempPath) {
+		t.Error("Unreferenced part or temporary file is left")
+	}
+
+	if fixes, err := st.Reconcile(0, false); err != nil || len(fixes) != 0 {
+		t.Errorf("Reconcile again: %+v (%v)", fixes, err)
+	}
+}
@@ -0,0 +1,333 @@
+package tee
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"karst/logger"
+	"karst/merkletree"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MockServer speaks TEE's websocket protocol for local runs and tests. It "seals" a part by xor with
+// the sha256 of account backup, so sealing is deterministic and only the same backup unseals it
+type MockServer struct {
+	// Sealed and unsealed parts of path mode are kept in dataPath
+	dataPath string
+	upgrader websocket.Upgrader
+	server   *http.Server
+}
+
+// mockRequest is a request of any endpoint, data of stream mode parts comes in binary frame
+type mockRequest struct {
+	Id     string                     `json:"id"`
+	Backup string                     `json:"backup"`
+	Stream bool                       `json:"stream"`
+	Body   *merkletree.MerkleTreeNode `json:"body"`
+	Path   string                     `json:"path"`
+	Root   string                     `json:"root"`
+	Index  int                        `json:"index"`
+	Hash   string                     `json:"hash"`
+}
+
+func NewMockServer(dataPath string) *MockServer {
+	return &MockServer{
+		dataPath: dataPath,
+	}
+}
+
+// Handler serves '/storage/seal', '/storage/unseal' and '/storage/delete' under prefix like '/api/v0'
+func (mock *MockServer) Handler(prefix string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+"/storage/seal", mock.serve(mock.seal))
+	mux.HandleFunc(prefix+"/storage/unseal", mock.serve(mock.unseal))
+	mux.HandleFunc(prefix+"/storage/delete", mock.serve(mock.delete))
+	return mux
+}
+
+// Start serves on address like '127.0.0.1:12222' in background and returns the base url for 'tee_base_url',
+// port 0 picks a free port
+func (mock *MockServer) Start(address string) (string, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", err
+	}
+
+	mock.server = &http.Server{Handler: mock.Handler("/api/v0")}
+	go func() {
+		if err := mock.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Mock TEE stops: %s", err)
+		}
+	}()
+	return listener.Addr().String() + "/api/v0", nil
+}
+
+func (mock *MockServer) Close() error {
+	if mock.server == nil {
+		return nil
+	}
+	return mock.server.Close()
+}
+
+// mockSession keeps parts of stream mode sealed on a connection until their tree is sealed
+type mockSession struct {
+	sealed map[string][]*merkletree.MerkleTreeNode
+}
+
+type mockHandler func(session *mockSession, req *mockRequest, data []byte) (map[string]interface{}, []byte, error)
+
+// serve replies requests of a connection one by one, errors are replied with status 400
+func (mock *MockServer) serve(handle mockHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := mock.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Error("Upgrade: %s", err)
+			return
+		}
+		defer c.Close()
+
+		session := &mockSession{sealed: make(map[string][]*merkletree.MerkleTreeNode)}
+		for {
+			messageType, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var data []byte
+			if messageType == websocket.BinaryMessage {
+				if message, data, err = decodeFrame(message); err != nil {
+					logger.Warn("Mock TEE drops malformed frame: %s", err)
+					continue
+				}
+			}
+
+			req := &mockRequest{}
+			if err = json.Unmarshal(message, req); err != nil {
+				logger.Warn("Mock TEE drops malformed message: %s", err)
+				continue
+			}
+
+			reply, replyData, err := handle(session, req, data)
+			if err != nil {
+				logger.Warn("Mock TEE fails request '%s' of '%s': %s", req.Id, r.URL.Path, err)
+				reply = map[string]interface{}{"status": 400, "body": err.Error()}
+				replyData = nil
+			} else {
+				reply["status"] = 200
+			}
+			reply["id"] = req.Id
+
+			replyBytes, _ := json.Marshal(reply)
+			if replyData != nil {
+				err = c.WriteMessage(websocket.BinaryMessage, encodeFrame(replyBytes, replyData))
+			} else {
+				err = c.WriteMessage(websocket.TextMessage, replyBytes)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (mock *MockServer) seal(session *mockSession, req *mockRequest, data []byte) (map[string]interface{}, []byte, error) {
+	if req.Backup == "" {
+		return nil, nil, errors.New("backup is needed")
+	}
+
+	// Stream mode part
+	if data != nil {
+		if err := CheckPart(req.Hash, data); err != nil {
+			return nil, nil, err
+		}
+		sealed := mockTransform(req.Backup, data)
+		node := mockNode(sealed)
+		parts := session.sealed[req.Root]
+		if req.Index != len(parts) {
+			return nil, nil, fmt.Errorf("part %d is expected, but it is %d", len(parts), req.Index)
+		}
+		session.sealed[req.Root] = append(parts, node)
+		return map[string]interface{}{"hash": node.Hash}, sealed, nil
+	}
+
+	if req.Body == nil || !req.Body.IsLegal() {
+		return nil, nil, errors.New("legal merkle tree is needed")
+	}
+
+	// Stream mode tree, all of its parts are sealed on this connection
+	if req.Stream {
+		parts := session.sealed[req.Body.Hash]
+		delete(session.sealed, req.Body.Hash)
+		if len(parts) != len(req.Body.Links) {
+			return nil, nil, fmt.Errorf("%d parts are sealed, but there are %d", len(parts), len(req.Body.Links))
+		}
+		return mockTreeReply(parts, "")
+	}
+
+	// Path mode, parts are read from path and sealed parts are written into data path
+	read, write, outPath, err := mock.paths(req.Path, "sealed")
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := make([]*merkletree.MerkleTreeNode, 0, len(req.Body.Links))
+	for index := range req.Body.Links {
+		part, err := read(index, &req.Body.Links[index])
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = CheckPart(req.Body.Links[index].Hash, part); err != nil {
+			return nil, nil, err
+		}
+		sealed := mockTransform(req.Backup, part)
+		node := mockNode(sealed)
+		if err = write(index, node, sealed); err != nil {
+			return nil, nil, err
+		}
+		parts = append(parts, node)
+	}
+	return mockTreeReply(parts, outPath)
+}
+
+func (mock *MockServer) unseal(session *mockSession, req *mockRequest, data []byte) (map[string]interface{}, []byte, error) {
+	if req.Backup == "" {
+		return nil, nil, errors.New("backup is needed")
+	}
+
+	// Stream mode part
+	if data != nil {
+		if err := CheckPart(req.Hash, data); err != nil {
+			return nil, nil, err
+		}
+		unsealed := mockTransform(req.Backup, data)
+		return map[string]interface{}{"hash": mockNode(unsealed).Hash}, unsealed, nil
+	}
+
+	// Path mode, sealed parts in path are unsealed into data path
+	merkleTreeSealed, err := merkletree.CreateMerkleTreeFromDir(req.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	read, write, outPath, err := mock.paths(req.Path, "unsealed")
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := make([]*merkletree.MerkleTreeNode, 0, len(merkleTreeSealed.Links))
+	for index := range merkleTreeSealed.Links {
+		sealed, err := read(index, &merkleTreeSealed.Links[index])
+		if err != nil {
+			return nil, nil, err
+		}
+		unsealed := mockTransform(req.Backup, sealed)
+		node := mockNode(unsealed)
+		if err = write(index, node, unsealed); err != nil {
+			return nil, nil, err
+		}
+		parts = append(parts, node)
+	}
+	return mockTreeReply(parts, outPath)
+}
+
+// delete removes sealed parts of path mode, it succeeds if they don't exist
+func (mock *MockServer) delete(session *mockSession, req *mockRequest, data []byte) (map[string]interface{}, []byte, error) {
+	if req.Backup == "" {
+		return nil, nil, errors.New("backup is needed")
+	}
+	if req.Hash == "" {
+		return nil, nil, errors.New("hash is needed")
+	}
+	if err := os.RemoveAll(filepath.FromSlash(mock.dataPath + "/sealed/" + req.Hash)); err != nil {
+		return nil, nil, err
+	}
+	return map[string]interface{}{}, nil, nil
+}
+
+// paths gives reader of parts in path and writer of parts into a new directory under data path
+func (mock *MockServer) paths(path string, kind string) (PartReader, PartWriter, string, error) {
+	if path == "" {
+		return nil, nil, "", errors.New("path is needed")
+	}
+	outPath := filepath.FromSlash(mock.dataPath + "/" + kind + "/" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := os.MkdirAll(outPath, os.ModePerm); err != nil {
+		return nil, nil, "", err
+	}
+
+	read := func(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+		return ioutil.ReadFile(filepath.FromSlash(path + "/" + strconv.Itoa(index) + "_" + node.Hash))
+	}
+	write := func(index int, node *merkletree.MerkleTreeNode, data []byte) error {
+		return ioutil.WriteFile(filepath.FromSlash(outPath+"/"+strconv.Itoa(index)+"_"+node.Hash), data, 0644)
+	}
+	return read, write, outPath, nil
+}
+
+// mockTreeReply replies merkle tree of parts, sealed parts of path mode are moved to 'sealed/root_hash' for delete
+func mockTreeReply(parts []*merkletree.MerkleTreeNode, path string) (map[string]interface{}, []byte, error) {
+	hashs := make([][]byte, 0, len(parts))
+	sizes := make([]uint64, 0, len(parts))
+	for _, part := range parts {
+		hashs = append(hashs, part.HashBytes())
+		sizes = append(sizes, part.Size)
+	}
+	merkleTree := merkletree.CreateMerkleTree(hashs, sizes)
+
+	if path != "" && filepath.Base(filepath.Dir(path)) == "sealed" {
+		rootPath := filepath.Join(filepath.Dir(path), merkleTree.Hash)
+		os.RemoveAll(rootPath)
+		if err := os.Rename(path, rootPath); err != nil {
+			return nil, nil, err
+		}
+		path = rootPath
+	}
+
+	body, _ := json.Marshal(merkleTree)
+	return map[string]interface{}{"body": string(body), "path": path}, nil, nil
+}
+
+// mockTransform xors data with the sha256 of backup, doing it twice gives data back
+func mockTransform(backup string, data []byte) []byte {
+	key := sha256.Sum256([]byte(backup))
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ key[i%len(key)]
+	}
+	return out
+}
+
+func mockNode(data []byte) *merkletree.MerkleTreeNode {
+	hash := sha256.Sum256(data)
+	return merkletree.NewMerkleTreeNode(hash[:], uint64(len(data)))
+}
+
+// StartMockTee starts a mock TEE on a free local port with data in a temporary directory for tests,
+// it returns the base url for 'tee_base_url' and the function to stop it
+func StartMockTee() (string, func(), error) {
+	dataPath, err := ioutil.TempDir("", "karst-mock-tee")
+	if err != nil {
+		return "", nil, err
+	}
+
+	mock := NewMockServer(dataPath)
+	baseUrl, err := mock.Start("127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dataPath)
+		return "", nil, err
+	}
+
+	var once sync.Once
+	return baseUrl, func() {
+		once.Do(func() {
+			mock.Close()
+			os.RemoveAll(dataPath)
+		})
+	}, nil
+}
@@ -0,0 +1,252 @@
+package tee
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"karst/merkletree"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mockBackup = `{"address":"5FqazaU79hjpEMiWTWZx81VjsYFst15eBuSBKdQLgQibD7CX"}`
+
+// mockFile gives parts of different sizes and their merkle tree, seed makes files differ
+func mockFile(seed string, parts int) ([][]byte, *merkletree.MerkleTreeNode) {
+	data := make([][]byte, 0, parts)
+	hashs := make([][]byte, 0, parts)
+	sizes := make([]uint64, 0, parts)
+	for i := 0; i < parts; i++ {
+		part := bytes.Repeat([]byte(seed+strconv.Itoa(i)), 100+i)
+		hash := sha256.Sum256(part)
+		data = append(data, part)
+		hashs = append(hashs, hash[:])
+		sizes = append(sizes, uint64(len(part)))
+	}
+	return data, merkletree.CreateMerkleTree(hashs, sizes)
+}
+
+func newMockTee(t *testing.T, maxSeals int) (*Tee, func()) {
+	baseUrl, stop, err := StartMockTee()
+	if err != nil {
+		t.Fatalf("Start mock TEE: %s", err)
+	}
+	tee, err := NewTee(baseUrl, mockBackup, 5*time.Second, maxSeals)
+	if err != nil {
+		stop()
+		t.Fatalf("Create TEE: %s", err)
+	}
+	return tee, func() {
+		tee.Close()
+		stop()
+	}
+}
+
+// memParts reads and writes parts of stream mode in memory
+type memParts struct {
+	lock  sync.Mutex
+	parts map[int][]byte
+}
+
+func (m *memParts) read(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.parts[index], nil
+}
+
+func (m *memParts) write(index int, node *merkletree.MerkleTreeNode, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.parts[index] = data
+	return nil
+}
+
+func newMemParts(data [][]byte) *memParts {
+	m := &memParts{parts: make(map[int][]byte)}
+	for index, part := range data {
+		m.parts[index] = part
+	}
+	return m
+}
+
+func TestMockSealPathMode(t *testing.T) {
+	tee, stop := newMockTee(t, 1)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "karst_tee_")
+	if err != nil {
+		t.Fatalf("Create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	data, merkleTree := mockFile("path", 3)
+	for index, part := range data {
+		if err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(index)+"_"+merkleTree.Links[index].Hash), part, 0644); err != nil {
+			t.Fatalf("Write part: %s", err)
+		}
+	}
+
+	merkleTreeSealed, sealedPath, err := tee.Seal(dir, merkleTree)
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	if !merkleTreeSealed.IsLegal() || len(merkleTreeSealed.Links) != 3 || merkleTreeSealed.Hash == merkleTree.Hash {
+		t.Fatalf("Sealed merkle tree is %+v", merkleTreeSealed)
+	}
+	if onDisk, err := merkletree.CreateMerkleTreeFromDir(sealedPath); err != nil || onDisk.Hash != merkleTreeSealed.Hash {
+		t.Fatalf("Sealed parts in '%s' are of %v (%v), want '%s'", sealedPath, onDisk, err, merkleTreeSealed.Hash)
+	}
+
+	merkleTreeUnsealed, unsealedPath, err := tee.Unseal(sealedPath)
+	if err != nil {
+		t.Fatalf("Unseal: %s", err)
+	}
+	if merkleTreeUnsealed.Hash != merkleTree.Hash {
+		t.Errorf("Unsealed merkle tree is '%s', want '%s'", merkleTreeUnsealed.Hash, merkleTree.Hash)
+	}
+	for index, part := range data {
+		unsealed, err := ioutil.ReadFile(filepath.Join(unsealedPath, strconv.Itoa(index)+"_"+merkleTree.Links[index].Hash))
+		if err != nil || !bytes.Equal(unsealed, part) {
+			t.Errorf("Unsealed part %d differs (%v)", index, err)
+		}
+	}
+
+	if err := tee.Delete(merkleTreeSealed.Hash); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := os.Stat(sealedPath); !os.IsNotExist(err) {
+		t.Errorf("Sealed parts are left after delete (%v)", err)
+	}
+
+	// Another account can't unseal
+	other, err := NewTee(tee.BaseUrl, "other", time.Second, 1)
+	if err != nil {
+		t.Fatalf("Create TEE: %s", err)
+	}
+	defer other.Close()
+	if _, path, err := other.Seal(dir, merkleTree); err != nil {
+		t.Fatalf("Seal with other account: %s", err)
+	} else if merkleTreeOther, _, err := tee.Unseal(path); err != nil || merkleTreeOther.Hash == merkleTree.Hash {
+		t.Errorf("Parts sealed by other account are unsealed (%v)", err)
+	}
+}
+
+func TestMockSealStreamMode(t *testing.T) {
+	tee, stop := newMockTee(t, 1)
+	defer stop()
+
+	data, merkleTree := mockFile("stream", 3)
+	sealed := newMemParts(nil)
+	merkleTreeSealed, err := tee.SealStream(merkleTree, newMemParts(data).read, sealed.write)
+	if err != nil {
+		t.Fatalf("Seal stream: %s", err)
+	}
+	if len(sealed.parts) != 3 || merkleTreeSealed.Hash == merkleTree.Hash {
+		t.Fatalf("Sealed %d parts of '%s'", len(sealed.parts), merkleTreeSealed.Hash)
+	}
+	for index, part := range sealed.parts {
+		if err := CheckPart(merkleTreeSealed.Links[index].Hash, part); err != nil {
+			t.Errorf("Sealed part %d: %s", index, err)
+		}
+	}
+
+	unsealed := newMemParts(nil)
+	merkleTreeUnsealed, err := tee.UnsealStream(merkleTreeSealed, sealed.read, unsealed.write)
+	if err != nil {
+		t.Fatalf("Unseal stream: %s", err)
+	}
+	if merkleTreeUnsealed.Hash != merkleTree.Hash {
+		t.Errorf("Unsealed merkle tree is '%s', want '%s'", merkleTreeUnsealed.Hash, merkleTree.Hash)
+	}
+	for index, part := range data {
+		if !bytes.Equal(unsealed.parts[index], part) {
+			t.Errorf("Unsealed part %d differs", index)
+		}
+	}
+
+	part, err := tee.UnsealPart(merkleTreeSealed, 1, sealed.parts[1])
+	if err != nil || !bytes.Equal(part, data[1]) {
+		t.Errorf("Unsealed part 1 differs (%v)", err)
+	}
+	// Part which isn't of the sealed tree is refused before it is sent
+	if _, err := tee.UnsealPart(merkleTreeSealed, 1, sealed.parts[0]); err == nil {
+		t.Error("Wrong part is unsealed")
+	}
+}
+
+func TestFrame(t *testing.T) {
+	message := []byte(`{"id":"1","hash":"aa"}`)
+	data := []byte{0, 1, 2, 3}
+	frame := encodeFrame(message, data)
+	if binary.BigEndian.Uint32(frame) != uint32(len(message)) || !bytes.Equal(frame[4:4+len(message)], message) ||
+		!bytes.Equal(frame[4+len(message):], data) {
+		t.Fatalf("Frame is %x", frame)
+	}
+
+	decodedMessage, decodedData, err := decodeFrame(frame)
+	if err != nil || !bytes.Equal(decodedMessage, message) || !bytes.Equal(decodedData, data) {
+		t.Errorf("Frame is decoded as '%s' with %x (%v)", decodedMessage, decodedData, err)
+	}
+	if decodedMessage, decodedData, err := decodeFrame(encodeFrame(message, nil)); err != nil || !bytes.Equal(decodedMessage, message) || len(decodedData) != 0 {
+		t.Errorf("Frame without data is decoded as '%s' with %x (%v)", decodedMessage, decodedData, err)
+	}
+
+	if _, _, err := decodeFrame([]byte{0, 0, 1}); err == nil {
+		t.Error("Frame shorter than header is decoded")
+	}
+	if _, _, err := decodeFrame(append([]byte{0, 0, 1, 0}, message...)); err == nil {
+		t.Error("Frame whose message length is out of it is decoded")
+	}
+}
+
+func TestMockConcurrentRequests(t *testing.T) {
+	tee, stop := newMockTee(t, 4)
+	defer stop()
+
+	// Files are sealed and unsealed at the same time on the shared sessions
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, merkleTree := mockFile(fmt.Sprintf("file%d", i), 2+i%3)
+			sealed := newMemParts(nil)
+			merkleTreeSealed, err := tee.SealStream(merkleTree, newMemParts(data).read, sealed.write)
+			if err != nil {
+				errs <- err
+				return
+			}
+			unsealed := newMemParts(nil)
+			merkleTreeUnsealed, err := tee.UnsealStream(merkleTreeSealed, sealed.read, unsealed.write)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if merkleTreeUnsealed.Hash != merkleTree.Hash {
+				errs <- fmt.Errorf("File %d is unsealed as '%s', want '%s'", i, merkleTreeUnsealed.Hash, merkleTree.Hash)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(tee.sessions) != 2 {
+		t.Errorf("Requests are on %d sessions, want 2", len(tee.sessions))
+	}
+	for endpoint, s := range tee.sessions {
+		s.lock.Lock()
+		if s.conn == nil || len(s.pending) != 0 {
+			t.Errorf("Session of '%s' is dropped or has %d pending requests", endpoint, len(s.pending))
+		}
+		s.lock.Unlock()
+	}
+}
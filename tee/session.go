@@ -0,0 +1,272 @@
+package tee
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"karst/logger"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Interval of pinging TEE on session, a connection without pong or message in interval and timeout is dropped
+// and redialed by next request
+const sessionPingInterval = 30 * time.Second
+
+// Time to dial TEE and finish websocket handshake, it is short so an unreachable TEE fails requests quickly
+const sessionConnectTimeout = 10 * time.Second
+
+var errSessionClosed = errors.New("TEE session is closed")
+
+// reply is the message of TEE for a request with its binary data, or the error of its connection
+type reply struct {
+	message []byte
+	data    []byte
+	err     error
+}
+
+// session keeps a websocket to a TEE endpoint and multiplexes requests on it. Every request carries
+// an 'id' which TEE sends back in its reply, replies can come in any order.
+// Requests and replies with data are binary frames: 4 bytes big endian length of json message, json message, data
+type session struct {
+	url          string
+	timeout      time.Duration
+	pingInterval time.Duration
+	nextId       uint64
+
+	lock    sync.Mutex
+	conn    *websocket.Conn
+	pending map[string]chan reply
+	closed  bool
+
+	// Gorilla websocket supports one concurrent writer
+	writeLock sync.Mutex
+}
+
+func newSession(url string, timeout time.Duration) *session {
+	return &session{
+		url:          url,
+		timeout:      timeout,
+		pingInterval: sessionPingInterval,
+		pending:      make(map[string]chan reply),
+	}
+}
+
+// request sends body and data with a new id and waits for its reply until timeout, data can be nil
+func (s *session) request(body map[string]interface{}, data []byte) (*reply, error) {
+	id := strconv.FormatUint(atomic.AddUint64(&s.nextId, 1), 10)
+	body["id"] = id
+	message, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	messageType := websocket.TextMessage
+	if data != nil {
+		message = encodeFrame(message, data)
+		messageType = websocket.BinaryMessage
+	}
+
+	replyChan := make(chan reply, 1)
+	conn, err := s.connect(id, replyChan)
+	if err != nil {
+		return nil, err
+	}
+
+	s.writeLock.Lock()
+	conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	err = conn.WriteMessage(messageType, message)
+	s.writeLock.Unlock()
+	if err != nil {
+		s.drop(conn, err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-replyChan:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &r, nil
+	case <-timer.C:
+		s.forget(id)
+		return nil, fmt.Errorf("TEE doesn't reply request %s in %s", id, s.timeout)
+	}
+}
+
+// connect dials TEE if there is no connection and adds request to pending ones. Dialing is done without lock,
+// so requests on a working connection aren't blocked by it
+func (s *session) connect(id string, replyChan chan reply) (*websocket.Conn, error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, errSessionClosed
+	}
+	if conn := s.conn; conn != nil {
+		s.pending[id] = replyChan
+		s.lock.Unlock()
+		return conn, nil
+	}
+	s.lock.Unlock()
+
+	logger.Info("Connecting to TEE '%s'", s.url)
+	dialer := &websocket.Dialer{HandshakeTimeout: sessionConnectTimeout}
+	conn, _, err := dialer.Dial(s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		conn.Close()
+		return nil, errSessionClosed
+	}
+	// Another request has connected meanwhile
+	if s.conn != nil {
+		conn.Close()
+	} else {
+		s.conn = conn
+		// Half-open connection gets neither pongs nor messages, its read fails after deadline
+		conn.SetReadDeadline(time.Now().Add(s.pingInterval + s.timeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(s.pingInterval + s.timeout))
+		})
+		done := make(chan struct{})
+		go s.read(conn, done)
+		go s.ping(conn, done)
+	}
+
+	s.pending[id] = replyChan
+	return s.conn, nil
+}
+
+// read dispatches replies of conn to pending requests until conn fails
+func (s *session) read(conn *websocket.Conn, done chan struct{}) {
+	defer close(done)
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			s.drop(conn, err)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(s.pingInterval + s.timeout))
+
+		var data []byte
+		if messageType == websocket.BinaryMessage {
+			if message, data, err = decodeFrame(message); err != nil {
+				logger.Warn("Drop malformed frame from TEE '%s': %s", s.url, err)
+				continue
+			}
+		}
+		logger.Debug("Recv: %s with %d bytes data", message, len(data))
+
+		var header struct {
+			Id string `json:"id"`
+		}
+		if err := json.Unmarshal(message, &header); err != nil {
+			logger.Warn("Drop malformed message from TEE '%s': %s", s.url, err)
+			continue
+		}
+
+		s.lock.Lock()
+		replyChan, ok := s.pending[header.Id]
+		// TEE without request id replies the only request in flight
+		if !ok && header.Id == "" && len(s.pending) == 1 {
+			for id, c := range s.pending {
+				header.Id, replyChan, ok = id, c, true
+			}
+		}
+		if ok {
+			delete(s.pending, header.Id)
+		}
+		s.lock.Unlock()
+
+		if !ok {
+			logger.Warn("Drop reply of unknown request '%s' from TEE '%s'", header.Id, s.url)
+			continue
+		}
+		replyChan <- reply{message: message, data: data}
+	}
+}
+
+// ping keeps idle conn alive, pongs extend read deadline of conn
+func (s *session) ping(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.writeLock.Lock()
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.timeout))
+			s.writeLock.Unlock()
+			if err != nil {
+				s.drop(conn, err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// drop closes conn and fails its pending requests, next request redials
+func (s *session) drop(conn *websocket.Conn, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != conn {
+		return
+	}
+
+	if !s.closed {
+		logger.Warn("Connection to TEE '%s' is dropped: %s", s.url, err)
+	}
+	conn.Close()
+	s.conn = nil
+	for id, replyChan := range s.pending {
+		replyChan <- reply{err: fmt.Errorf("Connection to TEE is dropped: %s", err)}
+		delete(s.pending, id)
+	}
+}
+
+func (s *session) forget(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.pending, id)
+}
+
+// close fails pending requests and refuses new ones
+func (s *session) close() {
+	s.lock.Lock()
+	s.closed = true
+	conn := s.conn
+	s.lock.Unlock()
+
+	if conn != nil {
+		s.drop(conn, errSessionClosed)
+	}
+}
+
+func encodeFrame(message []byte, data []byte) []byte {
+	frame := make([]byte, 4, 4+len(message)+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	frame = append(frame, message...)
+	return append(frame, data...)
+}
+
+func decodeFrame(frame []byte) ([]byte, []byte, error) {
+	if len(frame) < 4 {
+		return nil, nil, errors.New("frame is shorter than its header")
+	}
+	length := binary.BigEndian.Uint32(frame)
+	if uint64(length) > uint64(len(frame)-4) {
+		return nil, nil, fmt.Errorf("message length %d is out of frame", length)
+	}
+	return frame[4 : 4+length], frame[4+length:], nil
+}
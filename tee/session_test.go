@@ -0,0 +1,106 @@
+package tee
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newEchoTee replies every request with its id, it doesn't answer pings unless pong is true.
+// The number of connections is counted in conns
+func newEchoTee(t *testing.T, pong bool, conns *int32) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %s", err)
+			return
+		}
+		defer c.Close()
+		atomic.AddInt32(conns, 1)
+		if !pong {
+			c.SetPingHandler(func(string) error { return nil })
+		}
+		for {
+			_, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			var body map[string]interface{}
+			json.Unmarshal(message, &body)
+			reply, _ := json.Marshal(map[string]interface{}{"id": body["id"], "status": 200})
+			if err := c.WriteMessage(websocket.TextMessage, reply); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func newTestSession(server *httptest.Server) *session {
+	s := newSession("ws"+strings.TrimPrefix(server.URL, "http"), 100*time.Millisecond)
+	s.pingInterval = 50 * time.Millisecond
+	return s
+}
+
+func connected(s *session) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn != nil
+}
+
+func TestSessionDropsHalfOpenConnection(t *testing.T) {
+	var conns int32
+	server := newEchoTee(t, false, &conns)
+	defer server.Close()
+	s := newTestSession(server)
+	defer s.close()
+
+	if _, err := s.request(map[string]interface{}{}, nil); err != nil {
+		t.Fatalf("Request: %s", err)
+	}
+
+	// Pings get no pong, read fails after ping interval and timeout
+	deadline := time.Now().Add(2 * time.Second)
+	for connected(s) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if connected(s) {
+		t.Fatal("Connection without pongs isn't dropped")
+	}
+
+	if _, err := s.request(map[string]interface{}{}, nil); err != nil {
+		t.Fatalf("Request after drop: %s", err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("Session dialed %d times, want 2", n)
+	}
+}
+
+func TestSessionKeepsIdleConnection(t *testing.T) {
+	var conns int32
+	server := newEchoTee(t, true, &conns)
+	defer server.Close()
+	s := newTestSession(server)
+	defer s.close()
+
+	if _, err := s.request(map[string]interface{}{}, nil); err != nil {
+		t.Fatalf("Request: %s", err)
+	}
+	// Pongs extend read deadline beyond several intervals
+	time.Sleep(500 * time.Millisecond)
+	if !connected(s) {
+		t.Fatal("Idle connection with pongs is dropped")
+	}
+	if _, err := s.request(map[string]interface{}{}, nil); err != nil {
+		t.Fatalf("Request on idle connection: %s", err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Session dialed %d times, want 1", n)
+	}
+}
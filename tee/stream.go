@@ -0,0 +1,188 @@
+package tee
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"karst/logger"
+	"karst/merkletree"
+	"karst/metrics"
+	"time"
+)
+
+// Modes of passing file data to TEE
+const (
+	// ModePath sends the path of parts, TEE shares filesystem with karst and reads parts by itself
+	ModePath = "path"
+	// ModeStream sends parts on the session and gets sealed parts back, TEE can live on another host
+	ModeStream = "stream"
+)
+
+// PartReader reads the data of part at index, node is the part in merkle tree
+type PartReader func(index int, node *merkletree.MerkleTreeNode) ([]byte, error)
+
+// PartWriter keeps the data of part at index returned by TEE, node is the part in the resulting merkle tree
+type PartWriter func(index int, node *merkletree.MerkleTreeNode, data []byte) error
+
+type partBackMessage struct {
+	Status int
+	Hash   string
+	Body   string
+}
+
+// SealStream sends parts of merkle tree to TEE one by one and passes sealed parts to write, it returns the sealed tree
+func (tee *Tee) SealStream(merkleTree *merkletree.MerkleTreeNode, read PartReader, write PartWriter) (*merkletree.MerkleTreeNode, error) {
+	timeStart := time.Now()
+	merkleTreeSealed, err := tee.sealStream(merkleTree, read, write)
+	metrics.ObserveTee("seal", err, timeStart)
+	return merkleTreeSealed, err
+}
+
+// UnsealStream sends sealed parts to TEE one by one and passes unsealed parts to write, it returns the unsealed tree
+func (tee *Tee) UnsealStream(merkleTreeSealed *merkletree.MerkleTreeNode, read PartReader, write PartWriter) (*merkletree.MerkleTreeNode, error) {
+	timeStart := time.Now()
+	merkleTree, err := tee.unsealStream(merkleTreeSealed, read, write)
+	metrics.ObserveTee("unseal", err, timeStart)
+	return merkleTree, err
+}
+
+// UnsealPart sends one sealed part at index of sealed merkle tree to TEE and returns the unsealed part
+func (tee *Tee) UnsealPart(merkleTreeSealed *merkletree.MerkleTreeNode, index int, data []byte) ([]byte, error) {
+	timeStart := time.Now()
+	metrics.TeeInflight.WithLabelValues("unseal").Inc()
+	defer metrics.TeeInflight.WithLabelValues("unseal").Dec()
+
+	var unsealed []byte
+	_, err := tee.streamPart("/storage/unseal", merkleTreeSealed.Hash, index, &merkleTreeSealed.Links[index],
+		func(index int, node *merkletree.MerkleTreeNode) ([]byte, error) {
+			return data, nil
+		},
+		func(index int, node *merkletree.MerkleTreeNode, data []byte) error {
+			unsealed = data
+			return nil
+		})
+	metrics.ObserveTee("unseal", err, timeStart)
+	if err != nil {
+		return nil, fmt.Errorf("Unseal part %d of '%s' failed: %s", index, merkleTreeSealed.Hash, err)
+	}
+	return unsealed, nil
+}
+
+func (tee *Tee) sealStream(merkleTree *merkletree.MerkleTreeNode, read PartReader, write PartWriter) (*merkletree.MerkleTreeNode, error) {
+	// Wait for a free slot, sealing is heavy for TEE
+	tee.seals <- struct{}{}
+	defer func() { <-tee.seals }()
+	metrics.TeeInflight.WithLabelValues("seal").Inc()
+	defer metrics.TeeInflight.WithLabelValues("seal").Dec()
+
+	logger.Info("Streaming %d parts of '%s' to TEE to seal", len(merkleTree.Links), merkleTree.Hash)
+	sealedHashs := make([]string, 0, len(merkleTree.Links))
+	for index := range merkleTree.Links {
+		sealedHash, err := tee.streamPart("/storage/seal", merkleTree.Hash, index, &merkleTree.Links[index], read, write)
+		if err != nil {
+			return nil, fmt.Errorf("Seal part %d of '%s' failed: %s", index, merkleTree.Hash, err)
+		}
+		sealedHashs = append(sealedHashs, sealedHash)
+	}
+
+	// TEE has all parts, it seals the tree
+	var sealedMes sealedMessage
+	_, err := tee.request("/storage/seal", map[string]interface{}{
+		"backup": tee.Backup,
+		"stream": true,
+		"body":   merkleTree,
+	}, nil, &sealedMes)
+	if err != nil {
+		return nil, fmt.Errorf("Seal failed: %s", err)
+	}
+	if sealedMes.Status != 200 {
+		return nil, fmt.Errorf("Seal failed, error code is %d", sealedMes.Status)
+	}
+
+	var merkleTreeSealed merkletree.MerkleTreeNode
+	if err = json.Unmarshal([]byte(sealedMes.Body), &merkleTreeSealed); err != nil {
+		return nil, fmt.Errorf("Unmarshal sealed merkle tree failed: %s", err)
+	}
+	if !merkleTreeSealed.IsLegal() || len(merkleTreeSealed.Links) != len(sealedHashs) {
+		return nil, fmt.Errorf("Sealed merkle tree '%s' is illegal", merkleTreeSealed.Hash)
+	}
+	for index, sealedHash := range sealedHashs {
+		if merkleTreeSealed.Links[index].Hash != sealedHash {
+			return nil, fmt.Errorf("Sealed part %d is '%s' but it is '%s' in sealed merkle tree", index, sealedHash, merkleTreeSealed.Links[index].Hash)
+		}
+	}
+
+	return &merkleTreeSealed, nil
+}
+
+func (tee *Tee) unsealStream(merkleTreeSealed *merkletree.MerkleTreeNode, read PartReader, write PartWriter) (*merkletree.MerkleTreeNode, error) {
+	metrics.TeeInflight.WithLabelValues("unseal").Inc()
+	defer metrics.TeeInflight.WithLabelValues("unseal").Dec()
+
+	logger.Info("Streaming %d sealed parts of '%s' to TEE to unseal", len(merkleTreeSealed.Links), merkleTreeSealed.Hash)
+	partHashs := make([][]byte, 0, len(merkleTreeSealed.Links))
+	partSizes := make([]uint64, 0, len(merkleTreeSealed.Links))
+	for index := range merkleTreeSealed.Links {
+		var size uint64
+		partHash, err := tee.streamPart("/storage/unseal", merkleTreeSealed.Hash, index, &merkleTreeSealed.Links[index], read,
+			func(index int, node *merkletree.MerkleTreeNode, data []byte) error {
+				size = node.Size
+				return write(index, node, data)
+			})
+		if err != nil {
+			return nil, fmt.Errorf("Unseal part %d of '%s' failed: %s", index, merkleTreeSealed.Hash, err)
+		}
+
+		hashBytes, _ := hex.DecodeString(partHash)
+		partHashs = append(partHashs, hashBytes)
+		partSizes = append(partSizes, size)
+	}
+
+	return merkletree.CreateMerkleTree(partHashs, partSizes), nil
+}
+
+// streamPart sends a part to TEE endpoint and writes the part sent back, it returns the hash of the part sent back
+func (tee *Tee) streamPart(endpoint string, root string, index int, node *merkletree.MerkleTreeNode, read PartReader, write PartWriter) (string, error) {
+	data, err := read(index, node)
+	if err != nil {
+		return "", err
+	}
+	if err = CheckPart(node.Hash, data); err != nil {
+		return "", err
+	}
+
+	var partBackMes partBackMessage
+	backData, err := tee.request(endpoint, map[string]interface{}{
+		"backup": tee.Backup,
+		"stream": true,
+		"root":   root,
+		"index":  index,
+		"hash":   node.Hash,
+	}, data, &partBackMes)
+	if err != nil {
+		return "", err
+	}
+	if partBackMes.Status != 200 {
+		return "", fmt.Errorf("TEE returns %d: %s", partBackMes.Status, partBackMes.Body)
+	}
+	if err = CheckPart(partBackMes.Hash, backData); err != nil {
+		return "", err
+	}
+
+	backNode := merkletree.NewMerkleTreeNode(nil, uint64(len(backData)))
+	backNode.Hash = partBackMes.Hash
+	if err = write(index, backNode, backData); err != nil {
+		return "", err
+	}
+	return partBackMes.Hash, nil
+}
+
+// CheckPart checks data against its hex sha256 hash
+func CheckPart(hash string, data []byte) error {
+	partHash := sha256.Sum256(data)
+	if hex.EncodeToString(partHash[:]) != hash {
+		return fmt.Errorf("Hash of part data isn't '%s'", hash)
+	}
+	return nil
+}
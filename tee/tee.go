@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"karst/logger"
 	"karst/merkletree"
-
-	"github.com/gorilla/websocket"
+	"karst/metrics"
+	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
 type sealedMessage struct {
@@ -22,63 +25,118 @@ type unsealBackMessage struct {
 	Path   string
 }
 
+type deleteBackMessage struct {
+	Status int
+	Body   string
+}
+
+// Tee talks to TEE on a session per endpoint, seals are limited to a bounded number in flight
 type Tee struct {
 	BaseUrl string
 	Backup  string
+
+	timeout  time.Duration
+	seals    chan struct{}
+	lock     sync.Mutex
+	sessions map[string]*session
+	closed   bool
 }
 
-func NewTee(baseUrl string, backup string) (*Tee, error) {
+// NewTee creates TEE client whose requests fail after timeout, at most maxSeals seals are sent at the same time
+func NewTee(baseUrl string, backup string, timeout time.Duration, maxSeals int) (*Tee, error) {
 	if backup == "" || baseUrl == "" {
 		return nil, errors.New("Fatal error in getting backup and tee base url")
 	}
 
 	return &Tee{
-		BaseUrl: baseUrl,
-		Backup:  backup,
+		BaseUrl:  baseUrl,
+		Backup:   backup,
+		timeout:  timeout,
+		seals:    make(chan struct{}, maxSeals),
+		sessions: make(map[string]*session),
 	}, nil
 }
 
-// TODO: change to wss
-func (tee *Tee) Seal(path string, merkleTree *merkletree.MerkleTreeNode) (*merkletree.MerkleTreeNode, string, error) {
-	// Connect to tee
-	url := "ws://" + tee.BaseUrl + "/storage/seal"
-	logger.Info("Connecting to TEE '%s' to seal file", url)
-	c, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		return nil, "", err
-	}
-	defer c.Close()
-
-	// Send file to seal
-	reqBody := map[string]interface{}{
-		"backup": tee.Backup,
-		"body":   merkleTree,
-		"path":   path,
+// Close closes sessions, requests in flight fail
+func (tee *Tee) Close() {
+	tee.lock.Lock()
+	defer tee.lock.Unlock()
+	tee.closed = true
+	for _, s := range tee.sessions {
+		s.close()
 	}
+}
 
-	reqBodyBytes, err := json.Marshal(reqBody)
+// Ping checks whether TEE's address is reachable
+func Ping(baseUrl string, timeout time.Duration) error {
+	host := strings.SplitN(baseUrl, "/", 2)[0]
+	conn, err := net.DialTimeout("tcp", host, timeout)
 	if err != nil {
-		return nil, "", err
-	} else {
-		logger.Debug("Request body for sealing: %s", string(reqBodyBytes))
+		return err
 	}
+	return conn.Close()
+}
 
-	err = c.WriteMessage(websocket.TextMessage, reqBodyBytes)
-	if err != nil {
-		return nil, "", err
+func (tee *Tee) Seal(path string, merkleTree *merkletree.MerkleTreeNode) (*merkletree.MerkleTreeNode, string, error) {
+	timeStart := time.Now()
+	merkleTreeSealed, sealedPath, err := tee.seal(path, merkleTree)
+	metrics.ObserveTee("seal", err, timeStart)
+	return merkleTreeSealed, sealedPath, err
+}
+
+func (tee *Tee) Unseal(path string) (*merkletree.MerkleTreeNode, string, error) {
+	timeStart := time.Now()
+	merkleTree, unsealedPath, err := tee.unseal(path)
+	metrics.ObserveTee("unseal", err, timeStart)
+	return merkleTree, unsealedPath, err
+}
+
+// Delete removes the sealed file of merkle root hash from TEE
+func (tee *Tee) Delete(hash string) error {
+	timeStart := time.Now()
+	err := tee.delete(hash)
+	metrics.ObserveTee("delete", err, timeStart)
+	return err
+}
+
+// request sends body and data to TEE endpoint like '/storage/seal', unmarshals the reply into result and returns its data
+func (tee *Tee) request(endpoint string, body map[string]interface{}, data []byte, result interface{}) ([]byte, error) {
+	// TODO: change to wss
+	tee.lock.Lock()
+	if tee.closed {
+		tee.lock.Unlock()
+		return nil, errSessionClosed
 	}
+	s, ok := tee.sessions[endpoint]
+	if !ok {
+		s = newSession("ws://"+tee.BaseUrl+endpoint, tee.timeout)
+		tee.sessions[endpoint] = s
+	}
+	tee.lock.Unlock()
 
-	// Deal result
-	_, message, err := c.ReadMessage()
+	r, err := s.request(body, data)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	logger.Debug("Recv: %s", message)
+	return r.data, json.Unmarshal(r.message, result)
+}
+
+func (tee *Tee) seal(path string, merkleTree *merkletree.MerkleTreeNode) (*merkletree.MerkleTreeNode, string, error) {
+	// Wait for a free slot, sealing is heavy for TEE
+	tee.seals <- struct{}{}
+	defer func() { <-tee.seals }()
+	metrics.TeeInflight.WithLabelValues("seal").Inc()
+	defer metrics.TeeInflight.WithLabelValues("seal").Dec()
 
+	logger.Info("Sealing file '%s' in TEE", path)
 	var sealedMes sealedMessage
-	err = json.Unmarshal([]byte(message), &sealedMes)
+	_, err := tee.request("/storage/seal", map[string]interface{}{
+		"backup": tee.Backup,
+		"body":   merkleTree,
+		"path":   path,
+	}, nil, &sealedMes)
 	if err != nil {
-		return nil, "", fmt.Errorf("Unmarshal seal result failed: %s", err)
+		return nil, "", fmt.Errorf("Seal failed: %s", err)
 	}
 
 	if sealedMes.Status != 200 {
@@ -93,49 +151,48 @@ func (tee *Tee) Seal(path string, merkleTree *merkletree.MerkleTreeNode) (*merkl
 	return &merkleTreeSealed, sealedMes.Path, nil
 }
 
-func (tee *Tee) Unseal(path string) (*merkletree.MerkleTreeNode, string, error) {
-	// Connect to tee
-	url := "ws://" + tee.BaseUrl + "/storage/unseal"
-	logger.Info("Connecting to TEE '%s' to unseal file", url)
-	c, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		return nil, "", err
-	}
-	defer c.Close()
+func (tee *Tee) unseal(path string) (*merkletree.MerkleTreeNode, string, error) {
+	metrics.TeeInflight.WithLabelValues("unseal").Inc()
+	defer metrics.TeeInflight.WithLabelValues("unseal").Dec()
 
-	// Send file to seal
-	reqBody := map[string]interface{}{
+	logger.Info("Unsealing file '%s' in TEE", path)
+	var unsealBackMes unsealBackMessage
+	_, err := tee.request("/storage/unseal", map[string]interface{}{
 		"backup": tee.Backup,
 		"path":   path,
-	}
-
-	reqBodyBytes, err := json.Marshal(reqBody)
+	}, nil, &unsealBackMes)
 	if err != nil {
-		return nil, "", err
-	} else {
-		logger.Debug("Request body for unsealing: %s", string(reqBodyBytes))
+		return nil, "", fmt.Errorf("Unseal failed: %s", err)
 	}
-
-	err = c.WriteMessage(websocket.TextMessage, reqBodyBytes)
-	if err != nil {
-		return nil, "", err
+	if unsealBackMes.Status != 200 {
+		return nil, "", fmt.Errorf("Unseal failed: %s", unsealBackMes.Body)
 	}
 
-	// Deal result
-	_, message, err := c.ReadMessage()
-	if err != nil {
-		return nil, "", err
+	// Body is the merkle tree of unsealed parts in path
+	var merkleTree merkletree.MerkleTreeNode
+	if err = json.Unmarshal([]byte(unsealBackMes.Body), &merkleTree); err != nil {
+		return nil, "", fmt.Errorf("Unmarshal unsealed merkle tree failed: %s", err)
 	}
-	logger.Debug("Recv: %s", message)
 
-	var unsealBackMes unsealBackMessage
-	err = json.Unmarshal([]byte(message), &unsealBackMes)
+	return &merkleTree, unsealBackMes.Path, nil
+}
+
+func (tee *Tee) delete(hash string) error {
+	metrics.TeeInflight.WithLabelValues("delete").Inc()
+	defer metrics.TeeInflight.WithLabelValues("delete").Dec()
+
+	logger.Info("Deleting file '%s' in TEE", hash)
+	var deleteBackMes deleteBackMessage
+	_, err := tee.request("/storage/delete", map[string]interface{}{
+		"backup": tee.Backup,
+		"hash":   hash,
+	}, nil, &deleteBackMes)
 	if err != nil {
-		return nil, "", fmt.Errorf("Unmarshal unseal back message failed: %s", err)
+		return fmt.Errorf("Delete failed: %s", err)
 	}
-	if unsealBackMes.Status != 200 {
-		return nil, "", fmt.Errorf("Unseal failed: %s", unsealBackMes.Body)
+	if deleteBackMes.Status != 200 {
+		return fmt.Errorf("Delete failed: %s", deleteBackMes.Body)
 	}
 
-	return nil, unsealBackMes.Path, nil
+	return nil
 }
@@ -1,6 +1,9 @@
 package util
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,8 +20,11 @@ type KarstPaths struct {
 	KarstPath      string
 	ConfigFilePath string
 	FilesPath      string
+	PartsPath      string
 	TempFilesPath  string
 	DbPath         string
+	KeystorePath   string
+	ApiTokenPath   string
 }
 
 func GetKarstPaths() *KarstPaths {
@@ -30,8 +36,11 @@ func GetKarstPaths() *KarstPaths {
 
 	karstPaths.ConfigFilePath = filepath.FromSlash(karstPaths.KarstPath + "/config.json")
 	karstPaths.FilesPath = filepath.FromSlash(karstPaths.KarstPath + "/files")
+	karstPaths.PartsPath = filepath.FromSlash(karstPaths.KarstPath + "/parts")
 	karstPaths.TempFilesPath = filepath.FromSlash(karstPaths.KarstPath + "/temp_files")
 	karstPaths.DbPath = filepath.FromSlash(karstPaths.KarstPath + "/db")
+	karstPaths.KeystorePath = filepath.FromSlash(karstPaths.KarstPath + "/keystore.json")
+	karstPaths.ApiTokenPath = filepath.FromSlash(karstPaths.KarstPath + "/api_token")
 
 	return karstPaths
 }
@@ -53,6 +62,32 @@ func RandString(n int) string {
 	return string(b)
 }
 
+// NewId returns a random 16 hex characters id for jobs, requests and connections
+func NewId() string {
+	idBytes := make([]byte, 8)
+	if _, err := crand.Read(idBytes); err != nil {
+		return RandString(16)
+	}
+	return hex.EncodeToString(idBytes)
+}
+
+// Redact replaces values of the given keys in a json message for logging, message which isn't a json object is hidden
+func Redact(message []byte, keys ...string) string {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return fmt.Sprintf("<%d bytes>", len(message))
+	}
+
+	for _, key := range keys {
+		if _, ok := fields[key]; ok {
+			fields[key] = "******"
+		}
+	}
+
+	redacted, _ := json.Marshal(fields)
+	return string(redacted)
+}
+
 // File copies a single file from src to dst
 func CpFile(src, dst string) error {
 	var err error
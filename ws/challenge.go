@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"encoding/json"
+	"karst/challenge"
+	"karst/logger"
+	"karst/metrics"
+	"karst/util"
+	"net/http"
+)
+
+// answerChallenge proves this provider holds the challenged parts, verifiers are chain or clients without authority
+func answerChallenge(w http.ResponseWriter, r *http.Request) {
+	log := logger.With("conn_id", util.NewId(), "remote", r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := challenge.Challenge{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&c); err != nil {
+		writeChallengeError(w, http.StatusBadRequest, "Wrong challenge: "+err.Error())
+		return
+	}
+	if err := c.Check(); err != nil {
+		writeChallengeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tree, read, err := challenge.LocalParts(c.Root, db, fsClient, cfg.KarstPaths)
+	if err == challenge.ErrNotFound {
+		metrics.ChallengesAnswered.WithLabelValues("not_found").Inc()
+		writeChallengeError(w, http.StatusNotFound, "File '"+c.Root+"' is not found")
+		return
+	}
+	if err == nil {
+		var response *challenge.Response
+		if response, err = challenge.Respond(&c, tree, read); err == nil {
+			log.Info("Answer challenge of %d parts of '%s'", len(c.Indices), c.Root)
+			metrics.ChallengesAnswered.WithLabelValues("success").Inc()
+			w.Header().Set("Content-Type", "application/json")
+			if err = json.NewEncoder(w).Encode(response); err != nil {
+				log.Error("Write err: %s", err)
+			}
+			return
+		}
+	}
+
+	log.Error("Answer challenge of '%s' failed: %s", c.Root, err)
+	metrics.ChallengesAnswered.WithLabelValues("failed").Inc()
+	writeChallengeError(w, http.StatusInternalServerError, err.Error())
+}
+
+func writeChallengeError(w http.ResponseWriter, status int, info string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"info":   info,
+	})
+}
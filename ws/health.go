@@ -0,0 +1,35 @@
+package ws
+
+import (
+	"encoding/json"
+	"karst/logger"
+	"net/http"
+)
+
+// healthCheck always returns 200 while daemon is serving, the report shows status of every dependency
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, false)
+}
+
+// readyCheck returns 503 if any configured dependency is unusable
+func readyCheck(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, true)
+}
+
+func writeReport(w http.ResponseWriter, checkReady bool) {
+	report := checker.Check()
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		logger.Error("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if checkReady && !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err = w.Write(reportBytes); err != nil {
+		logger.Error("Write err: %s", err)
+	}
+}
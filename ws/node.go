@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"karst/logger"
+	"karst/metrics"
+	"karst/util"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -22,48 +24,53 @@ type NodeDataMessage struct {
 }
 
 func nodeData(w http.ResponseWriter, r *http.Request) {
+	log := logger.With("conn_id", util.NewId(), "remote", r.RemoteAddr)
+
 	// Upgrade http to ws
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		logger.Error("Upgrade: %s", err)
+		log.Error("Upgrade: %s", err)
 		return
 	}
 	defer c.Close()
+	defer setIdle(c, false)
 
 	// Check backup
+	setIdle(c, true)
 	mt, message, err := c.ReadMessage()
+	setIdle(c, false)
 	if err != nil {
-		logger.Error("Read err: %s", err)
+		log.Error("Read err: %s", err)
 		return
 	}
 
 	if mt != websocket.TextMessage {
-		logger.Error("Wrong message type is %d", mt)
+		log.Error("Wrong message type is %d", mt)
 		err = c.WriteMessage(websocket.TextMessage, []byte("{ \"status\": 400 }"))
 		if err != nil {
-			logger.Error("Write err: %s", err)
+			log.Error("Write err: %s", err)
 		}
 		return
 	}
 
-	logger.Debug("Recv backup message: %s, message type is %d", message, mt)
+	log.Debug("Recv backup message: %s, message type is %d", util.Redact(message, "backup"), mt)
 
 	var backupMes BackupMessage
 	err = json.Unmarshal([]byte(message), &backupMes)
 	if err != nil {
-		logger.Error("Unmarshal failed: %s", err)
+		log.Error("Unmarshal failed: %s", err)
 		err = c.WriteMessage(websocket.TextMessage, []byte("{ \"status\": 400 }"))
 		if err != nil {
-			logger.Error("Write err: %s", err)
+			log.Error("Write err: %s", err)
 		}
 		return
 	}
 
 	if backupMes.Backup != cfg.Crust.Backup {
-		logger.Error("Need right backup")
+		log.Error("Need right backup")
 		err = c.WriteMessage(websocket.TextMessage, []byte("{ \"status\": 400 }"))
 		if err != nil {
-			logger.Error("Write err: %s", err)
+			log.Error("Write err: %s", err)
 		}
 		return
 	}
@@ -71,16 +78,22 @@ func nodeData(w http.ResponseWriter, r *http.Request) {
 	// Send right backup message
 	err = c.WriteMessage(websocket.TextMessage, []byte("{ \"status\": 200 }"))
 	if err != nil {
-		logger.Error("Write err: %s", err)
+		log.Error("Write err: %s", err)
 	}
 
-	logger.Debug("Right backup, waiting for node data request...")
+	log.Debug("Right backup, waiting for node data request...")
 
 	// Get and send node data
 	for {
+		setIdle(c, true)
 		mt, message, err := c.ReadMessage()
+		setIdle(c, false)
 		if err != nil {
-			logger.Error("Read err: %s", err)
+			if goAway(c) {
+				log.Debug("Node data connection is closed for shutting down")
+			} else {
+				log.Error("Read err: %s", err)
+			}
 			return
 		}
 
@@ -88,36 +101,43 @@ func nodeData(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		logger.Debug("Recv node data get message: %s, message type is %d", message, mt)
+		log.Debug("Recv node data get message: %s, message type is %d", message, mt)
 
 		var nodeDataMsg NodeDataMessage
 		err = json.Unmarshal([]byte(message), &nodeDataMsg)
 		if err != nil {
-			logger.Error("Unmarshal failed: %s", err)
+			log.Error("Unmarshal failed: %s", err)
 			err = c.WriteMessage(websocket.TextMessage, []byte("{ \"status\": 400 }"))
 			if err != nil {
-				logger.Error("Write err: %s", err)
+				log.Error("Write err: %s", err)
 			}
 			return
 		}
 
-		nodeFilePath := filepath.FromSlash(cfg.KarstPaths.FilesPath + "/" + nodeDataMsg.FileHash + "/" + strconv.FormatUint(nodeDataMsg.NodeIndex, 10) + "_" + nodeDataMsg.NodeHash)
-		logger.Debug("Try to get '%s' file", nodeFilePath)
+		// Parts of recorded files are read from part store, the others from their file directory
+		nodeFilePath, err := parts.Resolve(nodeDataMsg.FileHash, nodeDataMsg.NodeIndex, nodeDataMsg.NodeHash)
+		if err != nil {
+			nodeFilePath = filepath.FromSlash(cfg.KarstPaths.FilesPath + "/" + nodeDataMsg.FileHash + "/" + strconv.FormatUint(nodeDataMsg.NodeIndex, 10) + "_" + nodeDataMsg.NodeHash)
+		}
+		log.Debug("Try to get '%s' file", nodeFilePath)
 
 		fileBytes, err := ioutil.ReadFile(nodeFilePath)
 		if err != nil {
-			logger.Error("Read file '%s' filed: %s", nodeFilePath, err)
+			log.Error("Read file '%s' filed: %s", nodeFilePath, err)
+			metrics.NodeDataErrors.WithLabelValues("404").Inc()
 			err = c.WriteMessage(websocket.TextMessage, []byte("{ \"status\": 404 }"))
 			if err != nil {
-				logger.Error("Write err: %s", err)
+				log.Error("Write err: %s", err)
 			}
 			return
 		}
 
 		err = c.WriteMessage(websocket.BinaryMessage, fileBytes)
 		if err != nil {
-			logger.Error("Write err: %s", err)
+			log.Error("Write err: %s", err)
 			return
 		}
+		metrics.NodeDataParts.Inc()
+		metrics.NodeDataBytes.Add(float64(len(fileBytes)))
 	}
 }
@@ -0,0 +1,43 @@
+package ws
+
+import (
+	"encoding/json"
+	"karst/capacity"
+	"karst/logger"
+	"karst/order"
+	"karst/provider"
+	"net/http"
+)
+
+// providerInfo advertises crust account and capacity of this provider to clients choosing providers
+func providerInfo(w http.ResponseWriter, r *http.Request) {
+	info := provider.Info{
+		Account: cfg.Crust.Address,
+	}
+
+	// Reserved bytes and bytes committed by storage orders are advertised as used, so clients don't place orders
+	// beyond what is offered
+	accountant := capacity.New(db, cfg, order.Usage)
+	if accountant.Limited() {
+		report, err := accountant.Report()
+		if err != nil {
+			logger.Error("Get capacity failed: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info.Capacity = report.Total
+		info.Used = report.Reserved + report.Used + report.Committed
+	}
+
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		logger.Error("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(infoBytes); err != nil {
+		logger.Error("Write err: %s", err)
+	}
+}
@@ -1,17 +1,40 @@
 package ws
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	"karst/chain"
+	"karst/challenge"
 	"karst/config"
+	"karst/fs"
+	"karst/health"
 	"karst/logger"
+	"karst/metrics"
+	"karst/provider"
+	"karst/store"
 
 	"github.com/gorilla/websocket"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
 var db *leveldb.DB = nil
+var fsClient fs.FsInterface = nil
+var parts *store.Store = nil
 var cfg *config.Configuration = nil
+var checker *health.Checker = nil
+var server *http.Server = nil
+
+// Requests being handled, websocket handlers only return after their connections are done
+var inFlight sync.WaitGroup
+
+// Node data connections waiting for next request, they are interrupted when shutting down
+var idleConns = make(map[*websocket.Conn]bool)
+var idleConnsLock sync.Mutex
+var shuttingDown = false
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
@@ -20,15 +43,105 @@ var upgrader = websocket.Upgrader{
 }
 
 // TODO: wss is needed
-func StartServer(inDb *leveldb.DB, inConfig *config.Configuration) error {
+// StartServer listens on base url and serves in background, serving errors are sent to the returned channel
+func StartServer(inDb *leveldb.DB, inFs fs.FsInterface, inChain chain.Client, inConfig *config.Configuration) (<-chan error, error) {
 	db = inDb
+	fsClient = inFs
 	cfg = inConfig
+	parts = store.New(inDb, inConfig.KarstPaths)
+	checker = health.NewChecker(inDb, inFs, inChain, inConfig)
 	http.HandleFunc("/api/v0/node/data", nodeData)
+	http.HandleFunc("/health", healthCheck)
+	http.HandleFunc("/ready", readyCheck)
+	http.HandleFunc(provider.InfoPath, providerInfo)
+	http.HandleFunc(challenge.Path, answerChallenge)
+	http.Handle("/metrics", metrics.Handler())
+
+	listener, err := net.Listen("tcp", cfg.BaseUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	server = &http.Server{
+		Handler: trackInFlight(http.DefaultServeMux),
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+		}
+		close(serveErr)
+	}()
 
 	logger.Info("Start ws at '%s'", cfg.BaseUrl)
-	if err := http.ListenAndServe(cfg.BaseUrl, nil); err != nil {
+	return serveErr, nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until ctx is done
+func Shutdown(ctx context.Context) error {
+	if server == nil {
+		return nil
+	}
+
+	// Hijacked websocket connections aren't tracked by http server, stop the idle ones and wait for the others
+	idleConnsLock.Lock()
+	shuttingDown = true
+	for c := range idleConns {
+		_ = c.SetReadDeadline(time.Now())
+	}
+	idleConnsLock.Unlock()
+
+	server.SetKeepAlivesEnabled(false)
+	err := server.Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func trackInFlight(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// goAway sends close message to peer if server is shutting down
+func goAway(c *websocket.Conn) bool {
+	idleConnsLock.Lock()
+	defer idleConnsLock.Unlock()
+	if !shuttingDown {
+		return false
+	}
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "karst is shutting down")
+	_ = c.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	return true
+}
+
+// setIdle marks whether the connection is waiting for next request
+func setIdle(c *websocket.Conn, idle bool) {
+	idleConnsLock.Lock()
+	defer idleConnsLock.Unlock()
+	if !idle {
+		delete(idleConns, c)
+		return
 	}
 
-	return nil
+	idleConns[c] = true
+	// Shutdown has begun, don't wait for requests any more
+	if shuttingDown {
+		_ = c.SetReadDeadline(time.Now())
+	}
 }
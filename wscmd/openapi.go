@@ -0,0 +1,148 @@
+package wscmd
+
+import (
+	"encoding/json"
+	"karst/logger"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const OpenApiPath = "/api/v0/openapi.json"
+
+type openApiDoc struct {
+	OpenApi    string                            `json:"openapi"`
+	Info       map[string]string                 `json:"info"`
+	Paths      map[string]map[string]openApiOp   `json:"paths"`
+	Components map[string]map[string]interface{} `json:"components"`
+	Security   []map[string][]string             `json:"security"`
+}
+
+type openApiOp struct {
+	OperationId string                     `json:"operationId"`
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description"`
+	RequestBody openApiBody                `json:"requestBody"`
+	Responses   map[string]openApiResponse `json:"responses"`
+}
+
+type openApiBody struct {
+	Required bool                          `json:"required"`
+	Content  map[string]map[string]*Schema `json:"content"`
+}
+
+type openApiResponse struct {
+	Description string                        `json:"description"`
+	Content     map[string]map[string]*Schema `json:"content"`
+}
+
+// HandleOpenApi serves the OpenAPI document of all registered commands, it should be called after commands registered
+func HandleOpenApi(version string) {
+	docBytes, err := json.Marshal(openApi(version))
+	if err != nil {
+		logger.Error("Generate OpenAPI document failed: %s", err)
+		return
+	}
+
+	http.HandleFunc(OpenApiPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(docBytes); err != nil {
+			logger.Error("Write err: %s", err)
+		}
+	})
+}
+
+func openApi(version string) *openApiDoc {
+	doc := &openApiDoc{
+		OpenApi: "3.0.0",
+		Info: map[string]string{
+			"title":       "Karst",
+			"description": "Commands of karst daemon, every command is served as both websocket and 'POST' request on the same path",
+			"version":     version,
+		},
+		Paths: make(map[string]map[string]openApiOp),
+		Components: map[string]map[string]interface{}{
+			"schemas": {
+				"Error": responseSchema(nil),
+			},
+			"securitySchemes": {
+				"apiToken": map[string]string{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Api token in 'api_token' of karst path, it is renewed every daemon start",
+				},
+			},
+		},
+		Security: []map[string][]string{{"apiToken": {}}},
+	}
+
+	for _, wsc := range registeredCmds {
+		reqSchema := SchemaOf(wsc.Request)
+		if reqSchema.Properties == nil {
+			reqSchema.Properties = make(map[string]*Schema)
+		}
+
+		var dataSchema *Schema
+		description := "Command result"
+		if wsc.Async {
+			dataSchema = SchemaOf(JobData{})
+			description = "Job is submitted, command result can be got by 'job/status'"
+		} else if wsc.Data != nil {
+			dataSchema = SchemaOf(wsc.Data)
+		}
+
+		errRef := map[string]map[string]*Schema{
+			"application/json": {"schema": {Ref: "#/components/schemas/Error"}},
+		}
+		doc.Paths["/api/v0/cmd/"+wsc.WsEndpoint] = map[string]openApiOp{
+			"post": {
+				OperationId: strings.Replace(wsc.WsEndpoint, "/", "_", -1),
+				Summary:     wsc.Cmd.Short,
+				Description: wsc.Cmd.Long,
+				RequestBody: openApiBody{
+					Required: true,
+					Content: map[string]map[string]*Schema{
+						"application/json": {"schema": reqSchema},
+					},
+				},
+				Responses: map[string]openApiResponse{
+					"200": {
+						Description: description,
+						Content: map[string]map[string]*Schema{
+							"application/json": {"schema": responseSchema(dataSchema)},
+						},
+					},
+					"default": {
+						Description: "Error with machine-readable code",
+						Content:     errRef,
+					},
+				},
+			},
+		}
+	}
+
+	return doc
+}
+
+func responseSchema(data *Schema) *Schema {
+	codes := make([]string, 0)
+	for code := range codeStatus {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+
+	schema := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"status": {Type: "integer"},
+			"code":   {Type: "string", Description: "One of: " + strings.Join(codes, ", ")},
+			"info":   {Type: "string"},
+		},
+		Required: []string{"status", "info"},
+	}
+	if data != nil {
+		schema.Properties["data"] = data
+	}
+
+	return schema
+}
@@ -0,0 +1,87 @@
+package wscmd
+
+import "fmt"
+
+type ErrorCode string
+
+const (
+	CodeBadRequest      ErrorCode = "bad_request"
+	CodeInvalidArgument ErrorCode = "invalid_argument"
+	CodeUnauthorized    ErrorCode = "unauthorized"
+	CodeNotFound        ErrorCode = "not_found"
+	CodeNotAllowed      ErrorCode = "method_not_allowed"
+	CodeConflict        ErrorCode = "conflict"
+	CodeInternal        ErrorCode = "internal_error"
+	CodeNotImplemented  ErrorCode = "not_implemented"
+	CodeUnavailable     ErrorCode = "unavailable"
+	CodeInsufficient    ErrorCode = "insufficient_storage"
+	CodeOutcomeUnknown  ErrorCode = "outcome_unknown"
+)
+
+var codeStatus = map[ErrorCode]int{
+	CodeBadRequest:      400,
+	CodeInvalidArgument: 400,
+	CodeUnauthorized:    401,
+	CodeNotFound:        404,
+	CodeNotAllowed:      405,
+	CodeConflict:        409,
+	CodeInternal:        500,
+	CodeNotImplemented:  501,
+	CodeUnavailable:     503,
+	CodeInsufficient:    507,
+	CodeOutcomeUnknown:  504,
+}
+
+// Error is returned by command runners, its code is sent back to caller
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func NewError(code ErrorCode, format string, v ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, v...),
+	}
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+func (err *Error) Status() int {
+	if status, ok := codeStatus[err.Code]; ok {
+		return status
+	}
+	return 500
+}
+
+// Response is the common return message of all commands, 'data' holds the command's result
+type Response struct {
+	Status int         `json:"status"`
+	Code   ErrorCode   `json:"code,omitempty"`
+	Info   string      `json:"info"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+func Success(info string, data interface{}) *Response {
+	return &Response{
+		Status: 200,
+		Info:   info,
+		Data:   data,
+	}
+}
+
+// Failure wraps error as response, errors which are not *Error are treated as internal errors
+func Failure(err error) *Response {
+	wsErr, ok := err.(*Error)
+	if !ok {
+		wsErr = NewError(CodeInternal, "%s", err)
+	}
+
+	return &Response{
+		Status: wsErr.Status(),
+		Code:   wsErr.Code,
+		Info:   wsErr.Message,
+	}
+}
@@ -0,0 +1,47 @@
+package wscmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"karst/logger"
+	"karst/util"
+	"net/http"
+)
+
+// Max size of rest request body
+const maxRestBodySize = 1 << 20
+
+// handleRest serves the command as 'POST /api/v0/cmd/<endpoint>', the body is the same json as websocket message
+func (wsc *WsCmd) handleRest(w http.ResponseWriter, r *http.Request, log *logger.Logger) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJson(w, Failure(NewError(CodeNotAllowed, "Method '%s' is not allowed, use POST or websocket", r.Method)), log)
+		return
+	}
+
+	message, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRestBodySize))
+	if err != nil {
+		log.Error("Read: %s", err)
+		writeJson(w, Failure(NewError(CodeBadRequest, "Read body failed: %s", err)), log)
+		return
+	}
+	log.Debug("Recv: %s", util.Redact(message, "backup", "password"))
+
+	writeJson(w, wsc.handleMessage(r.Context(), message, log), log)
+}
+
+func writeJson(w http.ResponseWriter, resp *Response, log *logger.Logger) {
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		log.Error("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Debug("Return: %s", string(respBytes))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.Status)
+	if _, err = w.Write(respBytes); err != nil {
+		log.Error("Write err: %s", err)
+	}
+}
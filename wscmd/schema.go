@@ -0,0 +1,191 @@
+package wscmd
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Schema is a subset of JSON schema generated from request structs by 'json', 'validate' (required, min=N) and 'desc' tags
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+}
+
+func SchemaOf(v interface{}) *Schema {
+	if v == nil {
+		return &Schema{Type: "object"}
+	}
+	return schemaOfType(reflect.TypeOf(v), map[reflect.Type]bool{})
+}
+
+func schemaOfType(t reflect.Type, visiting map[reflect.Type]bool) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema := &Schema{Type: "integer"}
+		if t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64 {
+			zero := float64(0)
+			schema.Minimum = &zero
+		}
+		return schema
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOfType(t.Elem(), visiting)}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		// Recursive types (like merkle tree) are only described on the first level
+		if visiting[t] {
+			return &Schema{Type: "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		noAdditional := false
+		schema := &Schema{
+			Type:                 "object",
+			Properties:           make(map[string]*Schema),
+			AdditionalProperties: &noAdditional,
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			name := field.Name
+			if jsonTag := field.Tag.Get("json"); jsonTag != "" {
+				name = strings.Split(jsonTag, ",")[0]
+				if name == "-" {
+					continue
+				}
+			}
+
+			fieldSchema := schemaOfType(field.Type, visiting)
+			fieldSchema.Description = field.Tag.Get("desc")
+			for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+				switch {
+				case rule == "required":
+					schema.Required = append(schema.Required, name)
+				case strings.HasPrefix(rule, "min="):
+					min, err := strconv.ParseFloat(strings.TrimPrefix(rule, "min="), 64)
+					if err != nil {
+						continue
+					}
+					if fieldSchema.Type == "string" {
+						minLength := int(min)
+						fieldSchema.MinLength = &minLength
+					} else {
+						fieldSchema.Minimum = &min
+					}
+				}
+			}
+			schema.Properties[name] = fieldSchema
+		}
+		return schema
+	default:
+		return &Schema{}
+	}
+}
+
+// Validate checks a value decoded by encoding/json against the schema
+func (schema *Schema) Validate(value interface{}) error {
+	return schema.validate(value, "")
+}
+
+func (schema *Schema) validate(value interface{}, path string) error {
+	name := path
+	if name == "" {
+		name = "request"
+	}
+
+	switch schema.Type {
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("'%s' should be a boolean", name)
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("'%s' should be a number", name)
+		}
+		if schema.Type == "integer" && number != float64(int64(number)) {
+			return fmt.Errorf("'%s' should be an integer", name)
+		}
+		if schema.Minimum != nil && number < *schema.Minimum {
+			return fmt.Errorf("'%s' should be at least %v", name, *schema.Minimum)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("'%s' should be a string", name)
+		}
+		if schema.MinLength != nil && len(str) < *schema.MinLength {
+			return fmt.Errorf("'%s' should have at least %d characters", name, *schema.MinLength)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("'%s' should be an array", name)
+		}
+		if schema.Items != nil {
+			for index, item := range items {
+				if err := schema.Items.validate(item, fmt.Sprintf("%s[%d]", path, index)); err != nil {
+					return err
+				}
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("'%s' should be an object", name)
+		}
+		for _, required := range schema.Required {
+			if v, ok := object[required]; !ok || v == nil || v == "" {
+				return fmt.Errorf("'%s' is needed", joinPath(path, required))
+			}
+		}
+		for key, v := range object {
+			propSchema, ok := schema.Properties[key]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("'%s' is unknown", joinPath(path, key))
+				}
+				continue
+			}
+			if v == nil {
+				continue
+			}
+			if err := propSchema.validate(v, joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,125 @@
+package wscmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"karst/logger"
+	"strings"
+	"testing"
+)
+
+type testPart struct {
+	Hash string `json:"hash" validate:"required"`
+	Size uint64 `json:"size"`
+}
+
+type testRequest struct {
+	FilePath string     `json:"file_path" validate:"required,min=2" desc:"Path of file"`
+	Count    int        `json:"count" validate:"min=1"`
+	Force    bool       `json:"force"`
+	Parts    []testPart `json:"parts"`
+	internal string
+}
+
+// Validate rejects what schema can't express, conflicts keep their own code
+func (req *testRequest) Validate() error {
+	if req.Count > 10 {
+		return errors.New("'count' should be at most 10")
+	}
+	if req.FilePath == "busy" {
+		return NewError(CodeConflict, "File is busy")
+	}
+	return nil
+}
+
+func TestSchemaOf(t *testing.T) {
+	schema := SchemaOf(testRequest{})
+	if schema.Type != "object" || len(schema.Properties) != 4 || schema.AdditionalProperties == nil || *schema.AdditionalProperties {
+		t.Fatalf("Schema is %+v", schema)
+	}
+	if strings.Join(schema.Required, ",") != "file_path" {
+		t.Errorf("Required are %v", schema.Required)
+	}
+	filePath := schema.Properties["file_path"]
+	if filePath.Type != "string" || filePath.Description != "Path of file" || filePath.MinLength == nil || *filePath.MinLength != 2 {
+		t.Errorf("Schema of file_path is %+v", filePath)
+	}
+	if count := schema.Properties["count"]; count.Type != "integer" || count.Minimum == nil || *count.Minimum != 1 {
+		t.Errorf("Schema of count is %+v", count)
+	}
+	parts := schema.Properties["parts"]
+	if parts.Type != "array" || parts.Items.Properties["size"].Minimum == nil || strings.Join(parts.Items.Required, ",") != "hash" {
+		t.Errorf("Schema of parts is %+v", parts)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema := SchemaOf(testRequest{})
+	cases := map[string]string{
+		`{"file_path":"/a","count":1,"force":true,"parts":[{"hash":"aa","size":1}]}`: "",
+		`{"file_path":"/a","count":null}`:                                            "",
+		`{"count":1}`:                                                                "'file_path' is needed",
+		`{"file_path":""}`:                                                           "'file_path' is needed",
+		`{"file_path":"/"}`:                                                          "'file_path' should have at least 2 characters",
+		`{"file_path":1}`:                                                            "'file_path' should be a string",
+		`{"file_path":"/a","count":1.5}`:                                             "'count' should be an integer",
+		`{"file_path":"/a","count":0}`:                                               "'count' should be at least 1",
+		`{"file_path":"/a","force":"yes"}`:                                           "'force' should be a boolean",
+		`{"file_path":"/a","parts":{}}`:                                              "'parts' should be an array",
+		`{"file_path":"/a","parts":[{"size":1}]}`:                                    "'parts[0].hash' is needed",
+		`{"file_path":"/a","parts":[{"hash":"aa","size":-1}]}`:                       "'parts[0].size' should be at least 0",
+		`{"file_path":"/a","internal":"x"}`:                                          "'internal' is unknown",
+		`[]`:                                                                         "'request' should be an object",
+	}
+	for message, want := range cases {
+		var value interface{}
+		if err := json.Unmarshal([]byte(message), &value); err != nil {
+			t.Fatalf("Unmarshal '%s': %s", message, err)
+		}
+		err := schema.Validate(value)
+		if (want == "" && err != nil) || (want != "" && (err == nil || err.Error() != want)) {
+			t.Errorf("Validate '%s': got %v, want '%s'", message, err, want)
+		}
+	}
+}
+
+func TestDealMessage(t *testing.T) {
+	var got *testRequest
+	wsc := &WsCmd{
+		WsEndpoint: "test",
+		Request:    testRequest{},
+		WsRunner: func(ctx context.Context, req interface{}, wsc *WsCmd) *Response {
+			got = req.(*testRequest)
+			return Success("ok", nil)
+		},
+	}
+	log := logger.With("endpoint", "test")
+
+	resp := wsc.dealMessage(context.Background(), []byte(`{"file_path":"/a","count":2,"parts":[{"hash":"aa","size":3}]}`), log)
+	if resp.Status != 200 || got == nil || got.FilePath != "/a" || got.Count != 2 || len(got.Parts) != 1 || got.Parts[0].Size != 3 {
+		t.Fatalf("Runner got %+v with response %+v", got, resp)
+	}
+
+	cases := map[string]ErrorCode{
+		`not json`:                       CodeBadRequest,
+		`{"count":2}`:                    CodeInvalidArgument,
+		`{"file_path":"/a","count":11}`:  CodeInvalidArgument,
+		`{"file_path":"busy","count":1}`: CodeConflict,
+	}
+	for message, code := range cases {
+		got = nil
+		if resp := wsc.dealMessage(context.Background(), []byte(message), log); resp.Code != code || got != nil {
+			t.Errorf("Message '%s': got %+v, want %s without running", message, resp, code)
+		}
+	}
+
+	// Arguments of queued jobs are decoded the same way
+	req, err := wsc.decodeRequest([]byte(`{"file_path":"/b","count":1}`))
+	if err != nil || req.(*testRequest).FilePath != "/b" {
+		t.Errorf("Decode job arguments: %+v (%v)", req, err)
+	}
+	if _, err := wsc.decodeRequest([]byte(`{"file_path":1}`)); err == nil || err.(*Error).Code != CodeInvalidArgument {
+		t.Errorf("Decode wrong job arguments: got %v, want invalid argument", err)
+	}
+}
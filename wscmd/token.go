@@ -0,0 +1,67 @@
+package wscmd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const tokenPrefix = "Bearer "
+
+// Token of local api, commands are rejected until it is set
+var apiToken string
+
+// NewApiToken generates the token of local api and writes it into path which only the owner can read,
+// cli reads it from there. Every daemon start gets a new token
+func NewApiToken(path string) error {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	// Old file may be readable by others
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(token), 0600); err != nil {
+		return err
+	}
+
+	apiToken = token
+	return nil
+}
+
+// ReadApiToken reads the token of local api written by daemon
+func ReadApiToken(path string) (string, error) {
+	tokenBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", errors.New("Api token isn't found, karst daemon isn't started")
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(tokenBytes)), nil
+}
+
+// TokenHeader is the header which authenticates a request with token
+func TokenHeader(token string) http.Header {
+	return http.Header{"Authorization": {tokenPrefix + token}}
+}
+
+// authorize checks the token in 'Authorization' header of the request
+func authorize(r *http.Request) error {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, tokenPrefix) {
+		return NewError(CodeUnauthorized, "Api token is required in 'Authorization' header")
+	}
+	token := strings.TrimPrefix(header, tokenPrefix)
+	if apiToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+		return NewError(CodeUnauthorized, "Wrong api token")
+	}
+	return nil
+}
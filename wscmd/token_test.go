@@ -0,0 +1,103 @@
+package wscmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type echoRequest struct {
+	Text string `json:"text"`
+}
+
+var echoWsCmd = &WsCmd{
+	WsEndpoint: "echo",
+	Request:    echoRequest{},
+	WsRunner: func(ctx context.Context, req interface{}, wsc *WsCmd) *Response {
+		return Success(req.(*echoRequest).Text, nil)
+	},
+}
+
+func TestApiToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "karst_token_")
+	if err != nil {
+		t.Fatalf("Create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api_token")
+
+	// Token file of the last start may be readable by others
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatalf("Write old token: %s", err)
+	}
+	if err := NewApiToken(path); err != nil {
+		t.Fatalf("New api token: %s", err)
+	}
+	defer func() { apiToken = "" }()
+	token, err := ReadApiToken(path)
+	if err != nil || token != apiToken || len(token) != 64 {
+		t.Fatalf("Read api token '%s' (%v), want '%s'", token, err, apiToken)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Api token file mode is %s, want 0600", info.Mode())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(echoWsCmd.handleFunc))
+	defer server.Close()
+	post := func(header http.Header, body string) *Response {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		httpResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Post: %s", err)
+		}
+		defer httpResp.Body.Close()
+		resp := &Response{}
+		if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil || resp.Status != httpResp.StatusCode {
+			t.Fatalf("Response %+v (%v) of http status %d", resp, err, httpResp.StatusCode)
+		}
+		return resp
+	}
+
+	if resp := post(nil, `{"text":"hi"}`); resp.Code != CodeUnauthorized {
+		t.Errorf("Request without token: got %+v, want unauthorized", resp)
+	}
+	if resp := post(TokenHeader("wrong"), `{"text":"hi"}`); resp.Code != CodeUnauthorized {
+		t.Errorf("Request with wrong token: got %+v, want unauthorized", resp)
+	}
+	if resp := post(TokenHeader(token), `{"text":"hi"}`); resp.Status != 200 || resp.Info != "hi" {
+		t.Errorf("Request with token: got %+v", resp)
+	}
+	// Crust account isn't part of requests
+	if resp := post(TokenHeader(token), `{"text":"hi","backup":"{}","password":"123456"}`); resp.Code != CodeInvalidArgument {
+		t.Errorf("Request with backup: got %+v, want invalid argument", resp)
+	}
+
+	// Websocket handshake is rejected without token
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	if _, httpResp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || httpResp == nil || httpResp.StatusCode != 401 {
+		t.Errorf("Websocket without token is connected (%v)", err)
+	}
+	c, _, err := websocket.DefaultDialer.Dial(url, TokenHeader(token))
+	if err != nil {
+		t.Fatalf("Dial with token: %s", err)
+	}
+	defer c.Close()
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"text":"hello"}`)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	resp := &Response{}
+	if err := c.ReadJSON(resp); err != nil || resp.Info != "hello" {
+		t.Errorf("Websocket response %+v (%v)", resp, err)
+	}
+}
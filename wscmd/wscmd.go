@@ -1,11 +1,22 @@
 package wscmd
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"karst/chain"
 	"karst/config"
 	"karst/fs"
+	"karst/job"
 	"karst/logger"
+	"karst/metrics"
+	"karst/tee"
+	"karst/util"
 	"net/http"
+	"os"
+	"reflect"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/spf13/cobra"
@@ -13,34 +24,84 @@ import (
 )
 
 type WsCmd struct {
-	Db         *leveldb.DB
-	Cfg        *config.Configuration
-	Fs         fs.FsInterface
+	Db    *leveldb.DB
+	Cfg   *config.Configuration
+	Fs    fs.FsInterface
+	Chain chain.Client
+	// Tee is nil if TEE isn't configured
+	Tee        *tee.Tee
+	Jobs       *job.Queue
 	Cmd        *cobra.Command
 	WsEndpoint string
-	Connecter  func(cmd *cobra.Command, args []string) (map[string]string, error)
-	WsRunner   func(args map[string]string, wsc *WsCmd) interface{}
+	// Async commands are put into job queue and return job id immediately
+	Async bool
+	// Request is the zero value of command's request struct, WsRunner gets a pointer to a filled copy
+	Request interface{}
+	// Data is the zero value of command's result data, it is only used to describe the api
+	Data      interface{}
+	Connecter func(cmd *cobra.Command, args []string) (interface{}, error)
+	// WsRunner gets ctx of the request, or of the job for async commands which is canceled by job cancel
+	WsRunner func(ctx context.Context, req interface{}, wsc *WsCmd) *Response
+}
+
+// Validator can be implemented by request structs to check what schema can't express
+type Validator interface {
+	Validate() error
+}
+
+// Commands registered in daemon, in registration order
+var registeredCmds = make([]*WsCmd, 0)
+
+type JobData struct {
+	JobId string `json:"job_id"`
 }
 
 func (wsc *WsCmd) connectCmdAndWsFunc(cmd *cobra.Command, args []string) {
-	wsc.Cfg = config.GetInstance()
+	cfg, err := config.GetInstance()
+	if err != nil {
+		logger.Error("%s", err)
+		os.Exit(-1)
+	}
+	token, err := ReadApiToken(cfg.KarstPaths.ApiTokenPath)
+	if err != nil {
+		logger.Error("%s", err)
+		os.Exit(-1)
+	}
+	wsc.Cfg = cfg
 	// Connect to ws
 	url := "ws://" + wsc.Cfg.BaseUrl + "/api/v0/cmd/" + wsc.WsEndpoint
-	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	c, resp, err := websocket.DefaultDialer.Dial(url, TokenHeader(token))
 	if err != nil {
+		if resp != nil {
+			if body, rErr := ioutil.ReadAll(resp.Body); rErr == nil && len(body) != 0 {
+				logger.Error("%s", body)
+				return
+			}
+		}
 		logger.Error("%s", err)
 		return
 	}
 	defer c.Close()
 
 	// Get request
-	reqBody, err := wsc.Connecter(cmd, args)
+	req, err := wsc.Connecter(cmd, args)
 	if err != nil {
 		logger.Error("%s", err)
 		return
 	}
-	reqBody["backup"] = wsc.Cfg.Crust.Backup
-	reqBody["password"] = wsc.Cfg.Crust.Password
+
+	reqBody := make(map[string]interface{})
+	if req != nil {
+		reqBytes, err := json.Marshal(req)
+		if err != nil {
+			logger.Error("%s", err)
+			return
+		}
+		if err = json.Unmarshal(reqBytes, &reqBody); err != nil {
+			logger.Error("%s", err)
+			return
+		}
+	}
 
 	// Send message to ws
 	reqBodyBytes, err := json.Marshal(reqBody)
@@ -61,6 +122,12 @@ func (wsc *WsCmd) connectCmdAndWsFunc(cmd *cobra.Command, args []string) {
 		logger.Error("%s", err)
 		return
 	}
+
+	var result Response
+	if err = json.Unmarshal(message, &result); err == nil && result.Status != 200 {
+		logger.Error("%s", message)
+		return
+	}
 	logger.Info("%s", message)
 }
 
@@ -69,6 +136,22 @@ func (wsc *WsCmd) ConnectCmdAndWs() {
 }
 
 func (wsc *WsCmd) handleFunc(w http.ResponseWriter, r *http.Request) {
+	reqId := util.NewId()
+	log := logger.With("req_id", reqId, "endpoint", wsc.WsEndpoint)
+	if err := authorize(r); err != nil {
+		log.Error("%s", err)
+		w.Header().Set("X-Request-Id", reqId)
+		resp := Failure(err)
+		metrics.ObserveCmd(wsc.WsEndpoint, resp.Status, time.Now())
+		writeJson(w, resp, log)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("X-Request-Id", reqId)
+		wsc.handleRest(w, r, log)
+		return
+	}
+
 	// Get ws upgrader
 	var upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -77,10 +160,9 @@ func (wsc *WsCmd) handleFunc(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Upgrade http to ws
-	c, err := upgrader.Upgrade(w, r, nil)
+	c, err := upgrader.Upgrade(w, r, http.Header{"X-Request-Id": {reqId}})
 	if err != nil {
-		logger.Error("Upgrade: %s", err)
-		wsc.sendBack(c, 500)
+		log.Error("Upgrade: %s", err)
 		return
 	}
 	defer c.Close()
@@ -88,57 +170,137 @@ func (wsc *WsCmd) handleFunc(w http.ResponseWriter, r *http.Request) {
 	// Deal result
 	mt, message, err := c.ReadMessage()
 	if err != nil {
-		logger.Error("Read: %s", err)
-		wsc.sendBack(c, 400)
+		log.Error("Read: %s", err)
+		wsc.sendBack(c, Failure(NewError(CodeBadRequest, "Read message failed: %s", err)), log)
 		return
 	}
 	if mt != websocket.TextMessage {
-		logger.Error("Wrong message type: %s", err)
-		wsc.sendBack(c, 400)
+		log.Error("Wrong message type: %d", mt)
+		wsc.sendBack(c, Failure(NewError(CodeBadRequest, "Message should be text")), log)
 		return
 	}
-	logger.Debug("Recv: %s", message)
+	log.Debug("Recv: %s", util.Redact(message, "backup", "password"))
 
-	// Check backup
-	args := make(map[string]string)
-	err = json.Unmarshal(message, &args)
-	if err != nil {
-		logger.Error("Wrong message: %s", err)
-		wsc.sendBack(c, 400)
-		return
+	wsc.sendBack(c, wsc.handleMessage(r.Context(), message, log), log)
+}
+
+func (wsc *WsCmd) handleMessage(ctx context.Context, message []byte, log *logger.Logger) *Response {
+	timeStart := time.Now()
+	resp := wsc.dealMessage(ctx, message, log)
+	metrics.ObserveCmd(wsc.WsEndpoint, resp.Status, timeStart)
+	return resp
+}
+
+// dealMessage checks request, then runs or queues the command. The request is authorized by handleFunc
+func (wsc *WsCmd) dealMessage(ctx context.Context, message []byte, log *logger.Logger) *Response {
+	// Check request
+	reqBody := make(map[string]interface{})
+	if err := json.Unmarshal(message, &reqBody); err != nil {
+		log.Error("Wrong message: %s", err)
+		return Failure(NewError(CodeBadRequest, "Wrong message: %s", err))
 	}
-	if args["backup"] != wsc.Cfg.Crust.Backup {
-		logger.Error("Wrong backup: %s", err)
-		wsc.sendBack(c, 400)
-		return
+
+	if err := SchemaOf(wsc.Request).Validate(reqBody); err != nil {
+		log.Error("Invalid request: %s", err)
+		return Failure(NewError(CodeInvalidArgument, "%s", err))
 	}
-	if args["password"] != wsc.Cfg.Crust.Password {
-		logger.Error("Wrong password: %s", err)
-		wsc.sendBack(c, 400)
-		return
+
+	reqBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return Failure(err)
+	}
+
+	// Put into job queue
+	if wsc.Async && wsc.Jobs != nil {
+		if _, err := wsc.decodeRequest(reqBytes); err != nil {
+			log.Error("Invalid request: %s", err)
+			return Failure(err)
+		}
+
+		job, err := wsc.Jobs.Submit(wsc.WsEndpoint, reqBytes)
+		if err != nil {
+			log.Error("Submit job failed: %s", err)
+			return Failure(err)
+		}
+
+		return Success(fmt.Sprintf("Job '%s' is submitted, run 'karst job status %s' to check it.", job.Id, job.Id), JobData{
+			JobId: job.Id,
+		})
 	}
 
 	// Run deal function
-	wsc.sendBack(c, wsc.WsRunner(args, wsc))
+	req, err := wsc.decodeRequest(reqBytes)
+	if err != nil {
+		log.Error("Invalid request: %s", err)
+		return Failure(err)
+	}
+	return wsc.WsRunner(ctx, req, wsc)
+}
+
+// decodeRequest fills a new request struct, the result is a pointer to the struct
+func (wsc *WsCmd) decodeRequest(reqBytes []byte) (interface{}, error) {
+	if wsc.Request == nil {
+		return nil, nil
+	}
+
+	req := reflect.New(reflect.TypeOf(wsc.Request)).Interface()
+	if err := json.Unmarshal(reqBytes, req); err != nil {
+		return nil, NewError(CodeInvalidArgument, "%s", err)
+	}
+
+	if validator, ok := req.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			if _, ok := err.(*Error); ok {
+				return nil, err
+			}
+			return nil, NewError(CodeInvalidArgument, "%s", err)
+		}
+	}
+
+	return req, nil
+}
+
+// runJob adapts WsRunner to job runner, a response whose status isn't 200 fails the job
+func (wsc *WsCmd) runJob(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	req, err := wsc.decodeRequest(args)
+	if err != nil {
+		metrics.Jobs.WithLabelValues(wsc.WsEndpoint, metrics.Result(err)).Inc()
+		return Failure(err), err
+	}
+
+	resp := wsc.WsRunner(ctx, req, wsc)
+	if resp.Status != 200 {
+		err = fmt.Errorf("%s (%s)", resp.Info, resp.Code)
+	}
+
+	metrics.Jobs.WithLabelValues(wsc.WsEndpoint, metrics.Result(err)).Inc()
+	return resp, err
 }
 
-func (wsc *WsCmd) sendBack(c *websocket.Conn, back interface{}) {
+func (wsc *WsCmd) sendBack(c *websocket.Conn, back interface{}, log *logger.Logger) {
 	backBytes, err := json.Marshal(back)
 	if err != nil {
-		logger.Error("%s", err)
+		log.Error("%s", err)
 	} else {
-		logger.Debug("Return: %s", string(backBytes))
+		log.Debug("Return: %s", string(backBytes))
 	}
 
 	err = c.WriteMessage(websocket.TextMessage, backBytes)
 	if err != nil {
-		logger.Error("Write err: %s", err)
+		log.Error("Write err: %s", err)
 	}
 }
 
-func (wsc *WsCmd) Register(db *leveldb.DB, fs fs.FsInterface, cfg *config.Configuration) {
+func (wsc *WsCmd) Register(db *leveldb.DB, fs fs.FsInterface, chain chain.Client, tee *tee.Tee, cfg *config.Configuration, jobs *job.Queue) {
 	wsc.Db = db
 	wsc.Cfg = cfg
 	wsc.Fs = fs
+	wsc.Chain = chain
+	wsc.Tee = tee
+	wsc.Jobs = jobs
+	if wsc.Async {
+		jobs.Register(wsc.WsEndpoint, wsc.runJob)
+	}
+	registeredCmds = append(registeredCmds, wsc)
 	http.HandleFunc("/api/v0/cmd/"+wsc.WsEndpoint, wsc.handleFunc)
 }